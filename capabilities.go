@@ -0,0 +1,72 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The Linux capabilities, named as in the lxc configuration
+var allCapabilities = []string{
+	"audit_control", "audit_read", "audit_write", "block_suspend", "chown", "dac_override",
+	"dac_read_search", "fowner", "fsetid", "ipc_lock", "ipc_owner", "kill", "lease",
+	"linux_immutable", "mac_admin", "mac_override", "mknod", "net_admin", "net_bind_service",
+	"net_broadcast", "net_raw", "setfcap", "setgid", "setpcap", "setuid", "sys_admin",
+	"sys_boot", "sys_chroot", "sys_module", "sys_nice", "sys_pacct", "sys_ptrace",
+	"sys_rawio", "sys_resource", "sys_time", "sys_tty_config", "syslog", "wake_alarm",
+}
+
+// The capabilities dropped from containers which aren't privileged
+var defaultDroppedCapabilities = []string{
+	"audit_control", "audit_write", "mac_admin", "mac_override", "mknod", "net_raw", "setfcap",
+	"setpcap", "sys_admin", "sys_boot", "sys_module", "sys_nice", "sys_pacct", "sys_rawio",
+	"sys_resource", "sys_time", "sys_tty_config",
+}
+
+// NormalizeCapability returns the lxc name of capability `name`, given as
+// NET_ADMIN, CAP_NET_ADMIN or net_admin, or ALL for all of them.
+func NormalizeCapability(name string) (string, error) {
+	capability := strings.TrimPrefix(strings.ToLower(name), "cap_")
+	if capability == "all" {
+		return "ALL", nil
+	}
+	for _, c := range allCapabilities {
+		if c == capability {
+			return capability, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown capability: %s", name)
+}
+
+// DroppedCapabilities returns the capabilities dropped from the container:
+// the default ones unless it is privileged, plus CapDrop, minus CapAdd.
+func (config *Config) DroppedCapabilities() []string {
+	dropped := make(map[string]bool)
+	if !config.Privileged {
+		for _, c := range defaultDroppedCapabilities {
+			dropped[c] = true
+		}
+	}
+	for _, c := range config.CapDrop {
+		if c == "ALL" {
+			for _, c := range allCapabilities {
+				dropped[c] = true
+			}
+		}
+		dropped[c] = true
+	}
+	for _, c := range config.CapAdd {
+		if c == "ALL" {
+			dropped = make(map[string]bool)
+		}
+		delete(dropped, c)
+	}
+	var capabilities []string
+	for c := range dropped {
+		if c != "ALL" {
+			capabilities = append(capabilities, c)
+		}
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
@@ -0,0 +1,36 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeCapability(t *testing.T) {
+	for name, expected := range map[string]string{"NET_ADMIN": "net_admin", "CAP_SYS_TIME": "sys_time", "mknod": "mknod", "all": "ALL"} {
+		if capability, err := NormalizeCapability(name); err != nil || capability != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", name, expected, capability, err)
+		}
+	}
+	if _, err := NormalizeCapability("FLY"); err == nil {
+		t.Errorf("Unknown capabilities should be rejected")
+	}
+}
+
+func TestDroppedCapabilities(t *testing.T) {
+	for _, test := range []struct {
+		config   Config
+		expected string
+	}{
+		{Config{}, strings.Join(defaultDroppedCapabilities, " ")},
+		{Config{Privileged: true}, ""},
+		{Config{Privileged: true, CapDrop: []string{"mknod"}}, "mknod"},
+		{Config{CapAdd: []string{"ALL"}, CapDrop: []string{"chown"}}, ""},
+		{Config{CapDrop: []string{"ALL"}, CapAdd: []string{"chown"}}, strings.Join(allCapabilities[:4], " ") + " " + strings.Join(allCapabilities[5:], " ")},
+		{Config{CapAdd: []string{"net_raw", "sys_time", "mknod"}, CapDrop: []string{"chown"}},
+			"audit_control audit_write chown mac_admin mac_override setfcap setpcap sys_admin sys_boot sys_module sys_nice sys_pacct sys_rawio sys_resource sys_tty_config"},
+	} {
+		if dropped := strings.Join(test.config.DroppedCapabilities(), " "); dropped != test.expected {
+			t.Errorf("%+v: expected '%s', got '%s'", test.config, test.expected, dropped)
+		}
+	}
+}
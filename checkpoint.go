@@ -0,0 +1,163 @@
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/image"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// A checkpoint directory holds:
+//
+//	DIR/criu/		the process state dumped by CRIU
+//	DIR/rw.tar		the changes to the filesystem of the container
+//	DIR/config.json		the container, to create it on another host
+
+// Checkpoint dumps the processes of the running container to the directory
+// `dir` with CRIU, along with the changes to its filesystem, so that Restore
+// resumes them later, possibly on another host. The container stops unless
+// `leaveRunning` is true.
+func (container *Container) Checkpoint(dir string, leaveRunning bool) error {
+	if !container.State.Running {
+		return fmt.Errorf("Container %v is not running", container.Id)
+	}
+	if container.Config.Tty || container.Config.OpenStdin {
+		return fmt.Errorf("Container %v has a tty or an open stdin, which can't be restored", container.Id)
+	}
+	if err := os.MkdirAll(path.Join(dir, "criu"), 0700); err != nil {
+		return err
+	}
+	args := []string{"-n", container.Id, "-D", path.Join(dir, "criu")}
+	if !leaveRunning {
+		// Don't let the restart policy start it again
+		container.requestStop()
+		args = append(args, "-s")
+	}
+	if output, err := exec.Command("/usr/bin/lxc-checkpoint", args...).CombinedOutput(); err != nil {
+		container.setStopping(false)
+		return fmt.Errorf("Checkpoint failed: %s", strings.TrimSpace(string(output)))
+	}
+	if !leaveRunning {
+		container.Wait()
+	}
+	rw, err := image.Tar(container.Filesystem.RWPath, image.Uncompressed)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path.Join(dir, "rw.tar"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.ReadFrom(rw); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path.Join(container.Root, "config.json"))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "config.json"), data, 0600); err != nil {
+		return err
+	}
+	container.events.Publish(container.Id, "checkpoint")
+	return nil
+}
+
+// Restore resumes the processes of the stopped container from the checkpoint
+// in the directory `dir`, with the filesystem they had then. The container
+// gets a new IP address and new ports.
+func (container *Container) Restore(dir string) error {
+	container.launchLock.Lock()
+	defer container.launchLock.Unlock()
+	if container.State.Running {
+		return fmt.Errorf("Container %v is running", container.Id)
+	}
+	if _, err := os.Stat(path.Join(dir, "criu")); err != nil {
+		return errors.New("No checkpoint in " + dir)
+	}
+	// Bring the filesystem back to its state at the checkpoint
+	if container.Filesystem.IsMounted() {
+		if err := container.Filesystem.Umount(); err != nil {
+			return err
+		}
+	}
+	rw, err := os.Open(path.Join(dir, "rw.tar"))
+	if err != nil {
+		return err
+	}
+	defer rw.Close()
+	if err := os.RemoveAll(container.Filesystem.RWPath); err != nil {
+		return err
+	}
+	if err := os.Mkdir(container.Filesystem.RWPath, 0700); err != nil {
+		return err
+	}
+	if err := image.Untar(rw, container.Filesystem.RWPath); err != nil {
+		return err
+	}
+	if err := container.Filesystem.EnsureMounted(); err != nil {
+		return err
+	}
+	if err := container.createMountPoints(); err != nil {
+		return err
+	}
+	if err := container.allocateNetwork(); err != nil {
+		return err
+	}
+	if err := container.generateLXCConfig(); err != nil {
+		container.releaseNetwork()
+		return err
+	}
+	// lxc-checkpoint reads the configuration of the container from
+	// LXCPATH/NAME/config
+	config := path.Join(container.Root, "config")
+	os.Remove(config)
+	if err := os.Symlink(path.Base(container.lxcConfigPath), config); err != nil {
+		container.releaseNetwork()
+		return err
+	}
+	// In the foreground, lxc-checkpoint is the parent of the restored
+	// processes, as lxc-start is for started ones.
+	container.cmd = monitorCommand(container.exitStatusPath(), "/usr/bin/lxc-checkpoint", "-r", "-F",
+		"-n", container.Id, "-P", path.Dir(container.Root), "-D", path.Join(dir, "criu"))
+	container.cmd.Stdout = container.stdout
+	container.cmd.Stderr = container.stderr
+	if err := container.cmd.Start(); err != nil {
+		container.releaseNetwork()
+		return err
+	}
+	container.setStopping(false)
+	container.running("restore")
+	return nil
+}
+
+// LoadCheckpoint creates the container of the checkpoint in the directory
+// `dir`, taken on another host, so that Restore resumes it. The container is
+// created from the image `resolve` finds for the image of the checkpoint, a
+// copy of it on this host: the layers recorded in the checkpoint, paths on
+// the other host, aren't trusted.
+func (docker *Docker) LoadCheckpoint(dir string, resolve func(name string) *image.Image) (*Container, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	source := &Container{}
+	if err := json.Unmarshal(data, source); err != nil {
+		return nil, err
+	}
+	if source.Filesystem == nil || source.Config == nil {
+		return nil, errors.New("Invalid checkpoint: " + dir)
+	}
+	img := resolve(source.Config.Image)
+	if img == nil {
+		return nil, fmt.Errorf("Image %v of container %v is missing: pull it first", source.Config.Image, source.Id)
+	}
+	source.Config.Image = img.Id
+	source.Filesystem.Layers = img.Layers
+	return docker.Create(source.Id, source.Path, source.Args, source.Filesystem.Layers, source.Config)
+}
@@ -0,0 +1,34 @@
+package docker
+
+import (
+	"github.com/dotcloud/docker/image"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// The layers of a checkpoint taken on another host are those of the local
+// copy of its image, never the paths recorded in the checkpoint
+func TestLoadCheckpointLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := `{"Id": "evil", "Path": "sh", "Config": {"Image": "base"}, "Filesystem": {"Layers": ["/etc"]}}`
+	if err := ioutil.WriteFile(path.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var resolved []string
+	_, err = (&Docker{}).LoadCheckpoint(dir, func(name string) *image.Image {
+		resolved = append(resolved, name)
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("Expected a checkpoint without a local image to be refused")
+	}
+	if len(resolved) != 1 || resolved[0] != "base" {
+		t.Fatalf("Expected the image of the checkpoint to be resolved, got %v", resolved)
+	}
+}
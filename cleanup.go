@@ -0,0 +1,204 @@
+package docker
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A daemon which crashes leaves its containers behind: their monitors,
+// lxc-start and processes may go on running, their filesystems stay mounted,
+// and their persisted state says that they run. On start, before any
+// container starts, the daemon kills those processes, unmounts those
+// filesystems and records the containers as stopped, and logs what it cleaned
+// up.
+
+// How long the processes left behind get to die once killed
+const strayTimeout = 5 * time.Second
+
+// A hostProcess is a process running on the host, as read from /proc.
+type hostProcess struct {
+	pid    int
+	args   []string
+	cgroup string
+}
+
+// hostProcesses returns the processes running on the host, except the daemon.
+func hostProcesses() []*hostProcess {
+	dir, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var processes []*hostProcess
+	for _, entry := range dir {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(path.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		cgroup, _ := ioutil.ReadFile(path.Join("/proc", entry.Name(), "cgroup"))
+		processes = append(processes, &hostProcess{
+			pid:    pid,
+			args:   strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"),
+			cgroup: string(cgroup),
+		})
+	}
+	return processes
+}
+
+// belongsTo returns whether the process runs `container`: its monitor, its
+// lxc-start, or a process in its cgroup.
+func (p *hostProcess) belongsTo(container *Container) bool {
+	if len(p.args) > 2 && p.args[1] == MonitorArg && p.args[2] == container.exitStatusPath() {
+		return true
+	}
+	if len(p.args) > 0 && path.Base(p.args[0]) == "lxc-start" {
+		for i := 1; i+1 < len(p.args); i++ {
+			if p.args[i] == "-n" && p.args[i+1] == container.Id {
+				return true
+			}
+		}
+	}
+	// HIERARCHY:SUBSYSTEMS:PATH, where lxc names the cgroups after the
+	// containers
+	for _, line := range strings.Split(p.cgroup, "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) == 3 && (fields[2] == "/"+container.Id || strings.HasSuffix(fields[2], "/lxc/"+container.Id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitGone waits for the processes of `pids` to be gone, for up to
+// strayTimeout.
+func waitGone(pids []int) {
+	deadline := time.Now().Add(strayTimeout)
+	for _, pid := range pids {
+		for syscall.Kill(pid, 0) == nil && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// reconcile checks the state which the container loaded from disk persisted
+// against `processes`, the processes running on the host. The processes left
+// behind by the container are killed, and the container is recorded as
+// stopped, with the exit status which its monitor recorded if any. It
+// returns the number of processes killed, and whether the container was
+// still running.
+func (container *Container) reconcile(processes []*hostProcess) (int, bool) {
+	persisted := container.State
+	container.State = newState()
+	if persisted == nil {
+		return 0, false
+	}
+	container.State.restore(persisted)
+
+	var killed []int
+	for _, p := range processes {
+		if !p.belongsTo(container) {
+			continue
+		}
+		if err := syscall.Kill(p.pid, syscall.SIGKILL); err != nil {
+			log.Printf("%v: Failed to kill process %d left behind: %v", container.Id, p.pid, err)
+			continue
+		}
+		log.Printf("%v: Killed process %d left behind: %s", container.Id, p.pid, strings.Join(p.args, " "))
+		killed = append(killed, p.pid)
+	}
+	waitGone(killed)
+	if !persisted.Running && len(killed) == 0 {
+		return 0, false
+	}
+
+	// The exit status is unknown, unless the monitor recorded it before
+	// dying
+	exitCode, finishedAt := -1, time.Now()
+	if status, ok := container.readExitStatus(); ok {
+		exitCode = status
+		if info, err := os.Stat(container.exitStatusPath()); err == nil {
+			finishedAt = info.ModTime()
+		}
+	} else if len(killed) > 0 {
+		exitCode = 128 + int(syscall.SIGKILL)
+	}
+	container.State.setFinished(exitCode, finishedAt)
+	log.Printf("%v: Was left running by the previous daemon: recorded as stopped with exit status %d", container.Id, exitCode)
+	if err := container.save(); err != nil {
+		log.Printf("%v: Failed to save the reconciled state: %v", container.Id, err)
+	}
+	return len(killed), true
+}
+
+// unescapeMountPoint decodes the octal escapes of the mount points of
+// /proc/mounts, eg. \040 for spaces.
+func unescapeMountPoint(s string) string {
+	var unescaped []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				unescaped = append(unescaped, byte(c))
+				i += 3
+				continue
+			}
+		}
+		unescaped = append(unescaped, s[i])
+	}
+	return string(unescaped)
+}
+
+// mountPointsUnder returns the mount points of `mounts`, in the format of
+// /proc/mounts, which are under directory `root`. The deepest come first, so
+// that they can be unmounted in order.
+func mountPointsUnder(mounts []byte, root string) []string {
+	var mountPoints []string
+	for _, line := range strings.Split(string(mounts), "\n") {
+		// DEVICE MOUNTPOINT TYPE OPTIONS DUMP PASS
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if mountPoint := unescapeMountPoint(fields[1]); strings.HasPrefix(mountPoint, root+"/") {
+			mountPoints = append(mountPoints, mountPoint)
+		}
+	}
+	sort.SliceStable(mountPoints, func(i, j int) bool {
+		return strings.Count(mountPoints[i], "/") > strings.Count(mountPoints[j], "/")
+	})
+	return mountPoints
+}
+
+// cleanupMounts unmounts the filesystems of the containers left mounted by
+// the previous daemon. It returns how many were unmounted.
+func (docker *Docker) cleanupMounts() int {
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return 0
+	}
+	// /proc/mounts has the real paths
+	root := docker.repository
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		root = real
+	}
+	unmounted := 0
+	for _, mountPoint := range mountPointsUnder(mounts, root) {
+		if err := unmount(mountPoint); err != nil {
+			log.Printf("Failed to unmount %v left behind: %v", mountPoint, err)
+			continue
+		}
+		log.Printf("Unmounted %v left behind", mountPoint)
+		unmounted++
+	}
+	return unmounted
+}
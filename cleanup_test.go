@@ -0,0 +1,95 @@
+package docker
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestMountPointsUnder(t *testing.T) {
+	mounts := `rootfs / rootfs rw 0 0
+/dev/sda1 /var/lib/docker ext4 rw,relatime 0 0
+none /var/lib/docker/containers/abc/rootfs aufs rw,relatime 0 0
+tmpfs /var/lib/docker/containers/abc/rootfs/tmp tmpfs rw 0 0
+none /var/lib/docker/containers/my\040box/rootfs aufs rw,relatime 0 0
+none /var/lib/docker/containers-old/abc/rootfs aufs rw,relatime 0 0
+`
+	expected := []string{
+		"/var/lib/docker/containers/abc/rootfs/tmp",
+		"/var/lib/docker/containers/abc/rootfs",
+		"/var/lib/docker/containers/my box/rootfs",
+	}
+	if mountPoints := mountPointsUnder([]byte(mounts), "/var/lib/docker/containers"); !reflect.DeepEqual(mountPoints, expected) {
+		t.Fatalf("Expected %v, got %v", expected, mountPoints)
+	}
+}
+
+func TestBelongsTo(t *testing.T) {
+	container := &Container{Id: "abc", Root: "/var/lib/docker/containers/abc"}
+	for _, p := range []*hostProcess{
+		{args: []string{"/usr/bin/docker", MonitorArg, "/var/lib/docker/containers/abc/exit-status", "/usr/bin/lxc-start", "-n", "abc"}},
+		{args: []string{"/usr/bin/lxc-start", "-n", "abc", "-f", "config.lxc"}},
+		{args: []string{"/bin/sh"}, cgroup: "4:memory:/lxc/abc\n3:cpu:/lxc/abc\n"},
+	} {
+		if !p.belongsTo(container) {
+			t.Errorf("%v should belong to the container", p.args)
+		}
+	}
+	for _, p := range []*hostProcess{
+		{args: []string{"/usr/bin/docker", MonitorArg, "/var/lib/docker/containers/abcd/exit-status", "/usr/bin/lxc-start", "-n", "abcd"}},
+		{args: []string{"/usr/bin/lxc-start", "-n", "abcd"}},
+		{args: []string{"/bin/sh", "-n", "abc"}},
+		{args: []string{"/bin/sh"}, cgroup: "4:memory:/lxc/abcd\n3:cpu:/user/abc/x\n"},
+	} {
+		if p.belongsTo(container) {
+			t.Errorf("%v shouldn't belong to the container", p.args)
+		}
+	}
+}
+
+func TestRestoreCrashed(t *testing.T) {
+	docker, err := newTestDocker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := docker.Create(
+		"test_crashed",
+		"ls",
+		[]string{"-al"},
+		[]string{testLayerPath},
+		&Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Destroy(container)
+	// Simulate a daemon which crashed while the container ran, and a
+	// monitor which recorded its exit status
+	container.State.Running = true
+	container.State.Pid = 1 << 30
+	if err := container.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(container.exitStatusPath(), []byte("3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewFromDirectory(docker.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := other.Get("test_crashed")
+	if restored == nil {
+		t.Fatalf("The container wasn't restored")
+	}
+	if restored.State.Running || restored.State.ExitCode != 3 || restored.State.FinishedAt.IsZero() {
+		t.Fatalf("Expected the container to be stopped with exit status 3, got %+v", restored.State)
+	}
+	// The reconciled state is persisted
+	again, err := NewFromDirectory(docker.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := again.Get("test_crashed").State; state.Running || state.ExitCode != 3 {
+		t.Fatalf("The reconciled state wasn't saved: %+v", state)
+	}
+}
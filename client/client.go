@@ -1,6 +1,9 @@
 package client
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker"
 	"github.com/dotcloud/docker/future"
 	"github.com/dotcloud/docker/rcli"
 	"io"
@@ -10,10 +13,16 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strings"
 )
 
-// Run docker in "simple mode": run a single command and return.
+// Run docker in "simple mode": run a single command and return. A failed
+// command returns an rcli.ExitStatus.
 func SimpleMode(args []string) error {
+	if len(args) == 1 && args[0] == "version" {
+		return Version(os.Stdout, os.Stderr)
+	}
 	var oldState *State
 	var err error
 	if IsTerminal(0) && os.Getenv("NORAW") == "" {
@@ -27,31 +36,73 @@ func SimpleMode(args []string) error {
 	// CloseWrite(), which we need to cleanly signal that stdin is closed without
 	// closing the connection.
 	// See http://code.google.com/p/go/issues/detail?id=3345
-	conn, err := rcli.Call("tcp", "127.0.0.1:4242", args...)
+	session, err := rcli.Dial("tcp", "127.0.0.1:4242", args...)
 	if err != nil {
 		return err
 	}
+	var status int
 	receive_stdout := future.Go(func() error {
-		_, err := io.Copy(os.Stdout, conn)
+		var err error
+		status, err = session.Receive(os.Stdout, os.Stderr)
 		return err
 	})
-	send_stdin := future.Go(func() error {
-		_, err := io.Copy(conn, os.Stdin)
-		if err := conn.CloseWrite(); err != nil {
+	// The end of stdin is sent as a half-close, so that the command sees EOF
+	// while its output keeps coming. Once the call is over, the rest of
+	// stdin is left unread: commands which don't read it don't wait for it.
+	go func() {
+		if _, err := io.Copy(session, os.Stdin); err != nil {
+			return
+		}
+		if err := session.CloseWrite(); err != nil {
 			log.Printf("Couldn't send EOF: " + err.Error())
 		}
-		return err
-	})
+	}()
 	if err := <-receive_stdout; err != nil {
 		return err
 	}
 	if oldState != nil {
 		Restore(0, oldState)
 	}
-	if !IsTerminal(0) {
-		if err := <-send_stdin; err != nil {
-			return err
-		}
+	if status != 0 {
+		return rcli.ExitStatus(status)
+	}
+	return nil
+}
+
+// Version prints the version of the client, then the version of the daemon,
+// and warns if they differ.
+func Version(stdout, stderr io.Writer) error {
+	gitCommit := docker.GITCOMMIT
+	if gitCommit == "" {
+		gitCommit = "N/A"
+	}
+	fmt.Fprintf(stdout, "Client version: %s\nClient API version: %d\nGo version (client): %s\nGit commit (client): %s\n",
+		docker.VERSION, rcli.APIVERSION, runtime.Version(), gitCommit)
+	conn, err := rcli.Call("tcp", "127.0.0.1:4242", "version", "-json")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.CloseWrite()
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	var server struct {
+		Version    string
+		ApiVersion int
+		GoVersion  string
+		GitCommit  string
+	}
+	if err := json.Unmarshal(data, &server); err != nil {
+		// Daemons older than 'docker version' only return an error
+		return fmt.Errorf("Unable to get the server version: %s", strings.TrimSpace(string(data)))
+	}
+	fmt.Fprintf(stdout, "Server version: %s\nServer API version: %d\nGo version (server): %s\nGit commit (server): %s\n",
+		server.Version, server.ApiVersion, server.GoVersion, server.GitCommit)
+	if server.Version != docker.VERSION || server.ApiVersion != rcli.APIVERSION {
+		fmt.Fprintf(stderr, "WARNING: the client (%s, API %d) and the server (%s, API %d) don't match\n",
+			docker.VERSION, rcli.APIVERSION, server.Version, server.ApiVersion)
 	}
 	return nil
 }
@@ -82,23 +133,48 @@ func InteractiveMode(scripts ...string) error {
 	for _, cmd := range []string{
 		"help",
 		"run",
+		"create",
+		"scale",
+		"up",
+		"down",
+		"update",
+		"events",
+		"checkpoint",
+		"restore",
+		"migrate",
+		"cluster",
+		"network",
+		"backup",
 		"ps",
 		"pull",
+		"push",
+		"search",
 		"put",
+		"import",
+		"save",
+		"load",
 		"rm",
 		"kill",
 		"wait",
+		"stats",
 		"stop",
 		"start",
 		"restart",
 		"logs",
 		"diff",
 		"commit",
+		"build",
+		"clone",
+		"rename",
+		"label",
 		"attach",
 		"info",
+		"version",
+		"completion",
 		"tar",
 		"web",
 		"images",
+		"fsck",
 		"docker",
 	} {
 		if err := os.Symlink(dockerPath, path.Join(tmp, cmd)); err != nil {
@@ -3,14 +3,20 @@ package docker
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/future"
+	"github.com/dotcloud/docker/image"
 	"github.com/kr/pty"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -45,25 +51,96 @@ type Container struct {
 	stderr        *writeBroadcaster
 	stdin         io.ReadCloser
 	stdinPipe     io.WriteCloser
+	// The master side of the tty of the container, which resizes it
+	ptyMaster *os.File
 
 	stdoutLog *os.File
 	stderrLog *os.File
+
+	// Number of times the restart policy restarted the container since it
+	// was last started by hand
+	RestartCount int
+	// Set when the container is stopped on purpose, so that its restart
+	// policy doesn't start it again. Guarded by the lock of State, like oom.
+	stopping bool
+	// Serializes the starts of the container with the requests to stop it,
+	// so that its restart policy can't start it once it is stopped
+	launchLock sync.Mutex
+	// Serializes the writes of config.json
+	saveLock sync.Mutex
+	// Set when the container ran out of memory since it started
+	oom    bool
+	events *Events
+	// Finds the other containers, such as the dependencies of the container
+	lookup func(id string) *Container
+	// Lists the running containers, such as those in its /etc/hosts
+	listRunning func() []*Container
+	// Generates its /etc/resolv.conf
+	resolvConf func() ([]byte, error)
+	// Updates what depends on the running containers, such as the ICC
+	// rules, as the container starts and stops
+	changed func(container *Container, running bool)
+	// Called once the container exited, unless its restart policy restarts it
+	exited func(container *Container)
+	// How many callers of Freeze are reading the frozen container
+	freezes    int
+	freezeLock sync.Mutex
 }
 
 type Config struct {
-	Hostname  string
-	User      string
-	Ram       int64
-	Ports     []int
-	Tty       bool // Attach standard streams to a tty, including stdin if it is not closed.
-	OpenStdin bool // Open stdin
+	Image      string   // The ID of the image the container was created from
+	Hostname   string   // The ID of the container by default
+	Domainname string   // Qualifies the hostname, eg. example.com
+	User       string   // USER[:GROUP], names or numeric IDs
+	GroupAdd   []string // Supplementary groups, names or numeric IDs
+	Ram        int64
+	CpuShares  int64 // Relative CPU weight (1024 by default)
+	PidsLimit  int64 // Maximum number of processes, if not 0
+	// Relative block IO weight, from 10 to 1000 (500 by default)
+	BlkioWeight    int64
+	BlkioThrottles []*BlkioThrottle
+	OomKillDisable bool  // Pause the processes instead of killing them when out of memory
+	OomScoreAdj    int64 // Adjust the likelihood of the processes to be killed when the host runs out of memory, from -1000 to 1000
+	Ports          []int // Ports published on random ports of the host
+	PortBindings   []*PortBinding
+	ExposedPorts   []int // Ports the container listens on, published or not
+	Tty            bool  // Attach standard streams to a tty, including stdin if it is not closed.
+	OpenStdin      bool  // Open stdin
+	Labels         map[string]string
+	// Restart the container when it exits: "no" (or empty), "always", or
+	// "on-failure[:MAX]" for non-zero exit codes, at most MAX times.
+	RestartPolicy string
+	AutoRemove    bool     // Remove the container once it exits
+	Privileged    bool     // Give all capabilities and access to all devices
+	CapAdd        []string // Capabilities kept, or ALL
+	CapDrop       []string // Capabilities dropped, or ALL
+	Devices       []*Device
+	ReadOnly      bool // Mount the root filesystem read-only, with a tmpfs on /tmp and /run
+	Tmpfs         []*TmpfsMount
+	ShmSize       int64 // Size of /dev/shm in bytes (64MB by default)
+	Ulimits       []*Ulimit
+	Env           []string // Variables of the environment, as KEY=VALUE
+	MacAddress    string   // MAC address of eth0, random if empty
+	NetRateIn     int64    // Bandwidth of the traffic sent to the container, in bytes per second, if limited
+	NetRateOut    int64    // Bandwidth of the traffic sent by the container, in bytes per second, if limited
+	Network       string   // The network the container attaches to, the default one if empty
+	// Other names of the container in the /etc/hosts of the containers
+	NetworkAliases []string
+	Volumes        []*Volume
+	DependsOn      []string // IDs of the containers which must be running before it starts
+	// The AppArmor profile and SELinux label of the container, if any
+	AppArmorProfile string
+	SELinuxLabel    string
 }
 
 type NetworkSettings struct {
-	IpAddress   string
-	IpPrefixLen int
-	Gateway     string
-	PortMapping map[string]string
+	IpAddress     string
+	IpPrefixLen   int
+	Gateway       string
+	PortMapping   map[string]string
+	PortAddresses map[string]string `json:",omitempty"` // The address of the host the ports are published on, if not all of them
+	HostInterface string            // The host end of the veth pair of the container
+	Bridge        string            // The bridge of the network of the container
 }
 
 func createContainer(id string, root string, command string, args []string, layers []string, config *Config, netManager *NetworkManager) (*Container, error) {
@@ -87,12 +164,12 @@ func createContainer(id string, root string, command string, args []string, laye
 		return nil, err
 	}
 	// Setup logging of stdout and stderr to disk
-	if stdoutLog, err := os.OpenFile(path.Join(container.Root, id+"-stdout.log"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+	if stdoutLog, err := os.OpenFile(container.logPath("stdout"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
 		return nil, err
 	} else {
 		container.stdoutLog = stdoutLog
 	}
-	if stderrLog, err := os.OpenFile(path.Join(container.Root, id+"-stderr.log"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+	if stderrLog, err := os.OpenFile(container.logPath("stderr"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
 		return nil, err
 	} else {
 		container.stderrLog = stderrLog
@@ -131,12 +208,12 @@ func loadContainer(containerPath string, netManager *NetworkManager) (*Container
 		return nil, err
 	}
 	// Setup logging of stdout and stderr to disk
-	if stdoutLog, err := os.OpenFile(path.Join(container.Root, container.Id+"-stdout.log"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+	if stdoutLog, err := os.OpenFile(container.logPath("stdout"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
 		return nil, err
 	} else {
 		container.stdoutLog = stdoutLog
 	}
-	if stderrLog, err := os.OpenFile(path.Join(container.Root, container.Id+"-stderr.log"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+	if stderrLog, err := os.OpenFile(container.logPath("stderr"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
 		return nil, err
 	} else {
 		container.stderrLog = stderrLog
@@ -153,7 +230,18 @@ func loadContainer(containerPath string, netManager *NetworkManager) (*Container
 	} else {
 		container.stdinPipe = NopWriteCloser(ioutil.Discard) // Silently drop stdin
 	}
-	container.State = newState()
+	// The container isn't running anymore, even if the daemon which ran it
+	// crashed before releasing its network. Its state is the one persisted,
+	// until docker.reconcile checks it against what is left on the host.
+	reserved := container.State.StartedAt.IsZero() && container.NetworkSettings != nil && container.NetworkSettings.IpAddress != ""
+	container.NetworkSettings = &NetworkSettings{}
+	// The containers created with a reserved network, which never started,
+	// get one again
+	if reserved {
+		if err := container.Reserve(); err != nil {
+			log.Printf("%v: Failed to reserve the network: %v", container.Id, err)
+		}
+	}
 	return container, nil
 }
 
@@ -165,55 +253,240 @@ func (container *Container) When() time.Time {
 	return container.Created
 }
 
-func (container *Container) loadUserData() (map[string]string, error) {
-	jsonData, err := ioutil.ReadFile(path.Join(container.Root, "userdata.json"))
+// copyChanges copies the content of the RW layer of `source`.
+func (container *Container) copyChanges(source *Container) error {
+	// FIXME: freeze the source container while copying it
+	rw, err := image.Tar(source.Filesystem.RWPath, image.Uncompressed)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return make(map[string]string), nil
+		return err
+	}
+	return image.Untar(rw, container.Filesystem.RWPath)
+}
+
+// rename moves the container to ID `id` and directory `root`. The config of
+// the new ID is written first, then the directory and the logs are moved;
+// if anything fails, the container is left as it was. The container must not
+// be running.
+func (container *Container) rename(id, root string) error {
+	if container.Filesystem.IsMounted() {
+		if err := container.Filesystem.Umount(); err != nil {
+			return err
 		}
-		return nil, err
 	}
-	data := make(map[string]string)
-	if err := json.Unmarshal(jsonData, &data); err != nil {
-		return nil, err
+	oldId, oldRoot, oldHostname := container.Id, container.Root, container.Config.Hostname
+	oldLogs := []string{container.logPath("stdout"), container.logPath("stderr")}
+	move := func(id, root, hostname string) {
+		container.Id = id
+		container.Root = root
+		container.Filesystem.RootFS = path.Join(root, "rootfs")
+		container.Filesystem.RWPath = path.Join(root, "rw")
+		container.lxcConfigPath = path.Join(root, "config.lxc")
+		container.Config.Hostname = hostname
+	}
+	hostname := oldHostname
+	if hostname == oldId || hostname == TruncateId(oldId) {
+		hostname = id
 	}
-	return data, nil
+	move(id, root, hostname)
+	if err := container.saveTo(oldRoot); err != nil {
+		move(oldId, oldRoot, oldHostname)
+		return err
+	}
+	rollback := func(err error) error {
+		move(oldId, oldRoot, oldHostname)
+		if e := container.save(); e != nil {
+			log.Printf("%v: Failed to restore the config: %v", oldId, e)
+		}
+		return err
+	}
+	if err := os.Rename(oldRoot, root); err != nil {
+		return rollback(err)
+	}
+	// The log files stay open: renaming them doesn't interrupt logging
+	for i, name := range []string{"stdout", "stderr"} {
+		if err := os.Rename(path.Join(root, path.Base(oldLogs[i])), container.logPath(name)); err != nil {
+			for j, name := range []string{"stdout", "stderr"}[:i] {
+				os.Rename(container.logPath(name), path.Join(root, path.Base(oldLogs[j])))
+			}
+			if e := os.Rename(root, oldRoot); e != nil {
+				log.Printf("%v: Failed to move %s back: %v", oldId, root, e)
+			}
+			return rollback(err)
+		}
+	}
+	return nil
 }
 
-func (container *Container) saveUserData(data map[string]string) error {
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return err
+// SetLabel sets the label `key` of the container to `value`, or removes it
+// if `value` is empty.
+func (container *Container) SetLabel(key, value string) error {
+	if container.Config.Labels == nil {
+		container.Config.Labels = make(map[string]string)
 	}
-	return ioutil.WriteFile(path.Join(container.Root, "userdata.json"), jsonData, 0700)
+	if value == "" {
+		delete(container.Config.Labels, key)
+	} else {
+		container.Config.Labels[key] = value
+	}
+	return container.save()
 }
 
-func (container *Container) SetUserData(key, value string) error {
-	data, err := container.loadUserData()
-	if err != nil {
+// Status returns a human-readable description of the state of the container,
+// eg. 'Up 5 minutes', 'Exited (0) 2 hours ago' or 'Created 3 days ago'.
+func (container *Container) Status() string {
+	if !container.State.Running && container.State.StartedAt.IsZero() && !container.Created.IsZero() {
+		return fmt.Sprintf("Created %s ago", future.HumanDuration(time.Now().Sub(container.Created)))
+	}
+	return container.State.String()
+}
+
+// Label returns the value of the label `key` of the container.
+func (container *Container) Label(key string) string {
+	return container.Config.Labels[key]
+}
+
+// The label of a container listing the paths left out of the images committed
+// from it, separated by commas, eg. '/tmp,/root/.cache,*.pyc'
+const CommitExcludeLabel = "commit.exclude"
+
+// CommitExcludes returns the patterns of the paths which the container leaves
+// out of the images committed from it, from its label commit.exclude.
+func (container *Container) CommitExcludes() []string {
+	var excludes []string
+	for _, pattern := range strings.Split(container.Label(CommitExcludeLabel), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			excludes = append(excludes, pattern)
+		}
+	}
+	return excludes
+}
+
+// SetResources changes the memory limit (in bytes) and the CPU shares of the
+// container; zero means no limit. The limits of a running container are
+// changed in place.
+func (container *Container) SetResources(ram, cpuShares int64) error {
+	if container.State.Running {
+		memory, shares := ram, cpuShares
+		if memory == 0 {
+			memory = -1
+		}
+		if shares == 0 {
+			shares = 1024
+		}
+		for key, value := range map[string]int64{"memory.limit_in_bytes": memory, "cpu.shares": shares} {
+			if output, err := exec.Command("/usr/bin/lxc-cgroup", "-n", container.Id, key, strconv.FormatInt(value, 10)).CombinedOutput(); err != nil {
+				return fmt.Errorf("Failed to set %s: %s", key, strings.TrimSpace(string(output)))
+			}
+		}
+	}
+	container.Config.Ram = ram
+	container.Config.CpuShares = cpuShares
+	return container.save()
+}
+
+// SetRestartPolicy changes the restart policy of the container.
+func (container *Container) SetRestartPolicy(policy string) error {
+	if _, _, err := ParseRestartPolicy(policy); err != nil {
 		return err
 	}
-	data[key] = value
-	return container.saveUserData(data)
+	container.Config.RestartPolicy = policy
+	return container.save()
 }
 
-func (container *Container) GetUserData(key string) string {
-	data, err := container.loadUserData()
+// ParseRestartPolicy splits a restart policy into its name and its maximum
+// number of restarts (zero for no maximum).
+func ParseRestartPolicy(policy string) (name string, max int, err error) {
+	parts := strings.SplitN(policy, ":", 2)
+	name = parts[0]
+	switch name {
+	case "", "no", "always":
+		if len(parts) == 2 {
+			return "", 0, fmt.Errorf("Invalid restart policy: %s (only on-failure takes a maximum)", policy)
+		}
+	case "on-failure":
+		if len(parts) == 2 {
+			if max, err = strconv.Atoi(parts[1]); err != nil || max < 0 {
+				return "", 0, fmt.Errorf("Invalid restart policy: %s (invalid maximum)", policy)
+			}
+		}
+	default:
+		return "", 0, fmt.Errorf("Invalid restart policy: %s (expected no, always or on-failure[:MAX])", policy)
+	}
+	return name, max, nil
+}
+
+// shouldRestart returns true if the restart policy of the container restarts
+// it after it exited with `exitCode`.
+func (container *Container) shouldRestart(exitCode int) bool {
+	// Containers removed on exit are removed instead
+	if container.isStopping() || container.Config.AutoRemove {
+		return false
+	}
+	name, max, err := ParseRestartPolicy(container.Config.RestartPolicy)
 	if err != nil {
-		return ""
+		return false
 	}
-	if value, exists := data[key]; exists {
-		return value
+	switch name {
+	case "always":
+		return true
+	case "on-failure":
+		return exitCode != 0 && (max == 0 || container.RestartCount < max)
 	}
-	return ""
+	return false
 }
 
 func (container *Container) save() (err error) {
+	return container.saveTo(container.Root)
+}
+
+// saveTo writes the config of the container to directory `root`, atomically:
+// to a temporary file of its own, synced, then renamed over config.json.
+func (container *Container) saveTo(root string) error {
+	container.saveLock.Lock()
+	defer container.saveLock.Unlock()
 	data, err := json.Marshal(container)
 	if err != nil {
-		return
+		return err
+	}
+	return image.WriteFileAtomic(path.Join(root, "config.json"), data, 0600)
+}
+
+// createMountPoints creates the mount points of the devices, volumes and
+// scratch filesystems of the container, which lxc can't create in a read-only root
+// filesystem.
+func (container *Container) createMountPoints() error {
+	dirs := []string{"/dev/shm"}
+	files := []string{"/etc/hosts", "/etc/hostname", "/etc/resolv.conf"}
+	for _, mount := range container.Config.TmpfsMounts() {
+		dirs = append(dirs, mount.Path)
+	}
+	for _, device := range container.Config.Devices {
+		files = append(files, device.PathInContainer)
+	}
+	for _, volume := range container.Config.Volumes {
+		if volume.isDir() {
+			dirs = append(dirs, volume.PathInContainer)
+		} else {
+			files = append(files, volume.PathInContainer)
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(path.Join(container.Filesystem.RootFS, dir), 0755); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		target := path.Join(container.Filesystem.RootFS, file)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
 	}
-	return ioutil.WriteFile(path.Join(container.Root, "config.json"), data, 0666)
+	return nil
 }
 
 func (container *Container) generateLXCConfig() error {
@@ -235,6 +508,7 @@ func (container *Container) startPty() error {
 		return err
 	}
 	container.cmd.Stdout = stdout_slave
+	container.ptyMaster = stdout_master
 
 	stderr_master, stderr_slave, err := pty.Open()
 	if err != nil {
@@ -256,17 +530,23 @@ func (container *Container) startPty() error {
 	// stdin
 	var stdin_slave io.ReadCloser
 	if container.Config.OpenStdin {
-		stdin_master, stdin_slave, err := pty.Open()
+		stdin_master, slave, err := pty.Open()
 		if err != nil {
 			return err
 		}
+		stdin_slave = slave
 		container.cmd.Stdin = stdin_slave
 		// FIXME: The following appears to be broken.
 		// "cannot set terminal process group (-1): Inappropriate ioctl for device"
 		// container.cmd.SysProcAttr = &syscall.SysProcAttr{Setctty: true, Setsid: true}
 		go func() {
 			defer container.stdin.Close()
-			io.Copy(stdin_master, container.stdin)
+			if _, err := io.Copy(stdin_master, container.stdin); err == nil {
+				// A tty can't be half-closed: pass the end of the input on
+				// as ^D, which the program reads as EOF. The first one
+				// flushes the last line if it isn't terminated.
+				stdin_master.Write([]byte{4, 4})
+			}
 		}()
 	}
 	if err := container.cmd.Start(); err != nil {
@@ -280,6 +560,18 @@ func (container *Container) startPty() error {
 	return nil
 }
 
+// Resize sets the size of the tty of the container, eg. as the terminal of a
+// client attached to it is resized.
+func (container *Container) Resize(height, width int) error {
+	if !container.Config.Tty || container.ptyMaster == nil || !container.State.Running {
+		return fmt.Errorf("Container %v has no tty to resize", container.Id)
+	}
+	if height <= 0 || width <= 0 || height > 0xffff || width > 0xffff {
+		return fmt.Errorf("Invalid tty size: %dx%d", width, height)
+	}
+	return pty.Setsize(container.ptyMaster, &pty.Winsize{Rows: uint16(height), Cols: uint16(width)})
+}
+
 func (container *Container) start() error {
 	container.cmd.Stdout = container.stdout
 	container.cmd.Stderr = container.stderr
@@ -297,10 +589,64 @@ func (container *Container) start() error {
 }
 
 func (container *Container) Start() error {
+	container.launchLock.Lock()
+	defer container.launchLock.Unlock()
+	container.setStopping(false)
+	container.RestartCount = 0
+	return container.launch()
+}
+
+func (container *Container) launch() error {
+	if err := container.dependenciesRunning(); err != nil {
+		return err
+	}
 	if err := container.Filesystem.EnsureMounted(); err != nil {
 		return err
 	}
-	if err := container.allocateNetwork(); err != nil {
+	if err := container.createMountPoints(); err != nil {
+		return err
+	}
+	running := container.listRunning()
+	if err := container.checkMacAddress(running); err != nil {
+		return err
+	}
+	// The network reserved by 'docker create' is used by the first start
+	reserved := container.network != nil
+	if !reserved {
+		if err := container.allocateNetwork(); err != nil {
+			return err
+		}
+	}
+	// Don't leave the address and the port mappings behind if lxc fails,
+	// unless they were reserved
+	if err := container.startLXC(running); err != nil {
+		if !reserved {
+			container.releaseNetwork()
+		}
+		return err
+	}
+	container.running("start")
+	if err := container.limitBandwidth(); err != nil {
+		// Better not run at all than exceed the limits
+		container.setStopping(true)
+		container.kill()
+		return err
+	}
+	return nil
+}
+
+// startLXC starts the process of the container with lxc-start, once its
+// network is allocated.
+func (container *Container) startLXC(running []*Container) error {
+	if err := container.writeHosts(append(running, container)); err != nil {
+		return err
+	}
+	if err := container.writeHostname(); err != nil {
+		return err
+	}
+	if resolvConf, err := container.resolvConf(); err != nil {
+		return err
+	} else if err := container.writeResolvConf(resolvConf); err != nil {
 		return err
 	}
 	if err := container.generateLXCConfig(); err != nil {
@@ -315,31 +661,54 @@ func (container *Container) Start() error {
 
 	// Networking
 	params = append(params, "-g", container.network.Gateway.String())
+	if container.Config.Domainname != "" {
+		params = append(params, "-domainname", container.Config.Domainname)
+	}
 
 	// User
 	if container.Config.User != "" {
 		params = append(params, "-u", container.Config.User)
 	}
+	if len(container.Config.GroupAdd) > 0 {
+		params = append(params, "-G", strings.Join(container.Config.GroupAdd, ","))
+	}
+
+	// Environment
+	for _, env := range container.Config.Env {
+		params = append(params, "-e", env)
+	}
 
 	// Program
 	params = append(params, "--", container.Path)
 	params = append(params, container.Args...)
 
-	container.cmd = exec.Command("/usr/bin/lxc-start", params...)
+	container.cmd = monitorCommand(container.exitStatusPath(), "/usr/bin/lxc-start", params...)
 
-	var err error
 	if container.Config.Tty {
-		err = container.startPty()
-	} else {
-		err = container.start()
-	}
-	if err != nil {
-		return err
+		return container.startPty()
 	}
+	return container.start()
+}
+
+// running records that the process of the container started, after `action`
+// (start or restore), and monitors it.
+func (container *Container) running(action string) {
 	container.State.setRunning(container.cmd.Process.Pid)
 	container.save()
+	if container.changed != nil {
+		container.changed(container, true)
+	}
+	container.events.Publish(container.Id, action)
+	container.setOOM(false)
+	go func() {
+		if err := watchOOM(container.Id, func() {
+			container.setOOM(true)
+			container.events.Publish(container.Id, "oom")
+		}); err != nil {
+			log.Printf("%v: Failed to watch for OOM events: %v", container.Id, err)
+		}
+	}()
 	go container.monitor()
-	return nil
 }
 
 func (container *Container) Run() error {
@@ -377,8 +746,15 @@ func (container *Container) StdoutPipe() (io.ReadCloser, error) {
 	return newBufReader(reader), nil
 }
 
-func (container *Container) StdoutLog() io.Reader {
-	r, err := os.Open(container.stdoutLog.Name())
+// logPath returns the path of the log of the output stream `name`
+func (container *Container) logPath(name string) string {
+	return path.Join(container.Root, container.Id+"-"+name+".log")
+}
+
+// StdoutLog returns the log of the stdout of the container, which lasts until
+// the container is destroyed, or nil if it can't be opened.
+func (container *Container) StdoutLog() io.ReadCloser {
+	r, err := os.Open(container.logPath("stdout"))
 	if err != nil {
 		return nil
 	}
@@ -391,35 +767,120 @@ func (container *Container) StderrPipe() (io.ReadCloser, error) {
 	return newBufReader(reader), nil
 }
 
-func (container *Container) StderrLog() io.Reader {
-	r, err := os.Open(container.stderrLog.Name())
+// StderrLog is StdoutLog for stderr.
+func (container *Container) StderrLog() io.ReadCloser {
+	r, err := os.Open(container.logPath("stderr"))
 	if err != nil {
 		return nil
 	}
 	return r
 }
 
+// ArchiveLogs copies the logs of the container to directory `dir`/ID, as
+// stdout.log and stderr.log, with its configuration and state as
+// config.json, so that they outlive the container.
+func (container *Container) ArchiveLogs(dir string) error {
+	archive := path.Join(dir, container.Id)
+	if err := os.MkdirAll(archive, 0700); err != nil {
+		return err
+	}
+	for src, dst := range map[string]string{
+		container.logPath("stdout"):              "stdout.log",
+		container.logPath("stderr"):              "stderr.log",
+		path.Join(container.Root, "config.json"): "config.json",
+	} {
+		if err := copyFile(src, path.Join(archive, dst)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// closeLogs closes the log files of the container, once it is destroyed.
+func (container *Container) closeLogs() {
+	for _, f := range []*os.File{container.stdoutLog, container.stderrLog} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
 func (container *Container) allocateNetwork() error {
-	iface, err := container.networkManager.Allocate()
+	iface, err := container.networkManager.Allocate(container.Config.Network)
 	if err != nil {
 		return err
 	}
 	container.NetworkSettings.PortMapping = make(map[string]string)
+	container.NetworkSettings.PortAddresses = make(map[string]string)
+	bindings := append([]*PortBinding{}, container.Config.PortBindings...)
 	for _, port := range container.Config.Ports {
-		if extPort, err := iface.AllocatePort(port); err != nil {
+		bindings = append(bindings, &PortBinding{ContainerPort: port})
+	}
+	for _, binding := range bindings {
+		if extPort, err := iface.AllocatePort(net.ParseIP(binding.HostIp), binding.HostPort, binding.ContainerPort); err != nil {
 			iface.Release()
 			return err
 		} else {
-			container.NetworkSettings.PortMapping[strconv.Itoa(port)] = strconv.Itoa(extPort)
+			port := strconv.Itoa(binding.ContainerPort)
+			container.NetworkSettings.PortMapping[port] = strconv.Itoa(extPort)
+			if binding.HostIp != "" {
+				container.NetworkSettings.PortAddresses[port] = binding.HostIp
+			}
 		}
 	}
 	container.network = iface
 	container.NetworkSettings.IpAddress = iface.IPNet.IP.String()
 	container.NetworkSettings.IpPrefixLen, _ = iface.IPNet.Mask.Size()
 	container.NetworkSettings.Gateway = iface.Gateway.String()
+	container.NetworkSettings.HostInterface = container.vethName()
+	container.NetworkSettings.Bridge = iface.network.Bridge
 	return nil
 }
 
+// Reserve allocates the address and the ports of the container before it
+// first starts, so that they are known, and taken by no other container, as
+// soon as it is created. The first start uses them; they are released when
+// the container stops, or when it is destroyed without starting.
+func (container *Container) Reserve() error {
+	container.launchLock.Lock()
+	defer container.launchLock.Unlock()
+	if container.State.Running || container.network != nil {
+		return nil
+	}
+	if err := container.allocateNetwork(); err != nil {
+		return err
+	}
+	return container.save()
+}
+
+// releaseReservation releases the network reserved by Reserve, if the
+// container didn't start since.
+func (container *Container) releaseReservation() error {
+	container.launchLock.Lock()
+	defer container.launchLock.Unlock()
+	if container.State.Running || container.network == nil {
+		return nil
+	}
+	return container.releaseNetwork()
+}
+
 func (container *Container) releaseNetwork() error {
 	err := container.network.Release()
 	container.network = nil
@@ -431,8 +892,17 @@ func (container *Container) monitor() {
 	// Wait for the program to exit
 	container.cmd.Wait()
 	exitCode := container.cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+	// The status recorded by the monitor survives it being killed while it
+	// kills the processes left behind
+	if status, ok := container.readExitStatus(); ok {
+		exitCode = status
+	}
 
-	// Cleanup
+	// Cleanup. Nothing may let the other containers reach the address of
+	// the container once it is released.
+	if container.changed != nil {
+		container.changed(container, false)
+	}
 	if err := container.releaseNetwork(); err != nil {
 		log.Printf("%v: Failed to release network: %v", container.Id, err)
 	}
@@ -442,17 +912,50 @@ func (container *Container) monitor() {
 		log.Printf("%v: Failed to umount filesystem: %v", container.Id, err)
 	}
 
-	// Re-create a brand new stdin pipe once the container exited
+	// Re-create a brand new stdin pipe once the container exited. Clients
+	// still attached to the old one get an error instead of blocking.
 	if container.Config.OpenStdin {
+		container.stdin.Close()
 		container.stdin, container.stdinPipe = io.Pipe()
 	}
 
 	// Report status back
-	container.State.setStopped(exitCode)
+	container.State.setStopped(exitCode, container.isOOM() && !container.Config.OomKillDisable)
 	container.save()
+	container.events.Publish(container.Id, "die")
+
+	if !container.shouldRestart(exitCode) {
+		if container.exited != nil {
+			container.exited(container)
+		}
+		return
+	}
+	// Don't spin on containers which exit right away
+	time.Sleep(restartDelay)
+	if container.State.Running || container.isStopping() {
+		return
+	}
+	// Wait for the dependencies which are restarting as well
+	container.waitForDependencies()
+	// It may have been started or stopped by hand meanwhile
+	container.launchLock.Lock()
+	defer container.launchLock.Unlock()
+	if container.State.Running || container.isStopping() {
+		return
+	}
+	container.RestartCount++
+	if err := container.launch(); err != nil {
+		log.Printf("%v: Failed to restart: %v", container.Id, err)
+		container.save()
+	}
 }
 
+// restartDelay is how long the restart policy waits before restarting a
+// container.
+const restartDelay = time.Second
+
 func (container *Container) kill() error {
+	// Killing the monitor kills lxc-start, and the container with it
 	if err := container.cmd.Process.Kill(); err != nil {
 		return err
 	}
@@ -461,7 +964,40 @@ func (container *Container) kill() error {
 	return nil
 }
 
+// requestStop keeps the restart policy from starting the container again,
+// once it is stopped.
+func (container *Container) requestStop() {
+	container.launchLock.Lock()
+	defer container.launchLock.Unlock()
+	container.setStopping(true)
+}
+
+func (container *Container) setStopping(stopping bool) {
+	container.State.stateChangeLock.Lock()
+	defer container.State.stateChangeLock.Unlock()
+	container.stopping = stopping
+}
+
+func (container *Container) isStopping() bool {
+	container.State.stateChangeLock.Lock()
+	defer container.State.stateChangeLock.Unlock()
+	return container.stopping
+}
+
+func (container *Container) setOOM(oom bool) {
+	container.State.stateChangeLock.Lock()
+	defer container.State.stateChangeLock.Unlock()
+	container.oom = oom
+}
+
+func (container *Container) isOOM() bool {
+	container.State.stateChangeLock.Lock()
+	defer container.State.stateChangeLock.Unlock()
+	return container.oom
+}
+
 func (container *Container) Kill() error {
+	container.requestStop()
 	if !container.State.Running {
 		return nil
 	}
@@ -469,6 +1005,7 @@ func (container *Container) Kill() error {
 }
 
 func (container *Container) Stop() error {
+	container.requestStop()
 	if !container.State.Running {
 		return nil
 	}
@@ -504,25 +1041,15 @@ func (container *Container) Restart() error {
 
 // Wait blocks until the container stops running, then returns its exit code.
 func (container *Container) Wait() int {
-
-	for container.State.Running {
-		container.State.wait()
-	}
+	<-container.State.Stopped()
 	return container.State.ExitCode
 }
 
 func (container *Container) WaitTimeout(timeout time.Duration) error {
-	done := make(chan bool)
-	go func() {
-		container.Wait()
-		done <- true
-	}()
-
 	select {
 	case <-time.After(timeout):
 		return errors.New("Timed Out")
-	case <-done:
+	case <-container.State.Stopped():
 		return nil
 	}
-	return nil
 }
@@ -1,9 +1,13 @@
 package docker
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -512,6 +516,57 @@ func TestTty(t *testing.T) {
 	}
 }
 
+// The container sees the end of its input, and its output isn't cut off
+// by it: 'echo hi | docker run -i -a base sh -c "cat; echo done"'
+func TestStdinEOF(t *testing.T) {
+	docker, err := newTestDocker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(tty bool) {
+		container, err := docker.Create(
+			"stdin_eof_test",
+			"/bin/sh",
+			[]string{"-c", "cat; echo done"},
+			[]string{testLayerPath},
+			&Config{
+				OpenStdin: true,
+				Tty:       tty,
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer docker.Destroy(container)
+
+		stdin, err := container.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := container.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stdout.Close()
+		if err := container.Start(); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(stdin, "hi\n")
+		stdin.Close()
+		output, err := ioutil.ReadAll(stdout)
+		container.Wait()
+		// Ttys end lines with \r\n
+		if lines := strings.Fields(string(output)); len(lines) != 2 || lines[0] != "hi" || lines[1] != "done" {
+			t.Fatalf("Unexpected output with tty=%v: %q", tty, output)
+		}
+		if container.State.ExitCode != 0 {
+			t.Fatalf("Unexpected exit code with tty=%v: %d", tty, container.State.ExitCode)
+		}
+	}
+	run(false)
+	run(true)
+}
+
 func TestEnv(t *testing.T) {
 	docker, err := newTestDocker()
 	if err != nil {
@@ -644,3 +699,162 @@ func BenchmarkRunParallel(b *testing.B) {
 		b.Fatal(errors)
 	}
 }
+
+func TestParseRestartPolicy(t *testing.T) {
+	for _, policy := range []string{"", "no", "always", "on-failure", "on-failure:3"} {
+		if _, _, err := ParseRestartPolicy(policy); err != nil {
+			t.Errorf("%s: %s", policy, err)
+		}
+	}
+	for _, policy := range []string{"sometimes", "always:3", "on-failure:", "on-failure:-1"} {
+		if _, _, err := ParseRestartPolicy(policy); err == nil {
+			t.Errorf("%s: expected an error", policy)
+		}
+	}
+	if name, max, _ := ParseRestartPolicy("on-failure:3"); name != "on-failure" || max != 3 {
+		t.Errorf("Expected on-failure with a maximum of 3, got %s with %d", name, max)
+	}
+}
+
+func TestCommitExcludes(t *testing.T) {
+	container := &Container{Config: &Config{Labels: map[string]string{CommitExcludeLabel: " /tmp, *.pyc,,/root/.cache "}}}
+	expected := []string{"/tmp", "*.pyc", "/root/.cache"}
+	if excludes := container.CommitExcludes(); !reflect.DeepEqual(excludes, expected) {
+		t.Fatalf("Expected %v, got %v", expected, excludes)
+	}
+	container.Config.Labels = nil
+	if excludes := container.CommitExcludes(); len(excludes) != 0 {
+		t.Fatalf("Expected no exclusions, got %v", excludes)
+	}
+}
+
+func TestArchiveLogs(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	container := &Container{Id: "abc", Root: path.Join(root, "abc")}
+	if err := os.Mkdir(container.Root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(container.logPath("stdout"), []byte("out\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(container.logPath("stderr"), []byte("crashed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	spool := path.Join(root, "spool")
+	if err := container.ArchiveLogs(spool); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"stdout.log": "out\n", "stderr.log": "crashed\n"} {
+		data, err := ioutil.ReadFile(path.Join(spool, "abc", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("Expected %v to be %q, got %q", name, expected, data)
+		}
+	}
+	// The logs outlive the container
+	if err := os.RemoveAll(container.Root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(spool, "abc", "stderr.log")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveConcurrently(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	container := &Container{Id: "abc", Root: root, Config: &Config{}, State: newState()}
+	errors := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func() {
+			errors <- container.save()
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-errors; err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded := &Container{}
+	if data, err := ioutil.ReadFile(path.Join(root, "config.json")); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(data, loaded); err != nil || loaded.Id != "abc" {
+		t.Fatalf("Unexpected config %s (%v)", data, err)
+	}
+	if info, err := os.Stat(path.Join(root, "config.json")); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the config to be private, got %v (%v)", info.Mode(), err)
+	}
+	// No temporary file is left behind
+	if files, err := ioutil.ReadDir(root); err != nil || len(files) != 1 {
+		t.Fatalf("Expected only config.json, got %d files (%v)", len(files), err)
+	}
+}
+
+func TestShouldRestartAutoRemove(t *testing.T) {
+	container := &Container{Config: &Config{RestartPolicy: "always", AutoRemove: true}, State: newState()}
+	if container.shouldRestart(1) {
+		t.Fatalf("Containers removed on exit shouldn't restart")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	docker, err := newTestDocker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := docker.Create(
+		"reserve_test",
+		"true",
+		[]string{},
+		[]string{testLayerPath},
+		&Config{Ports: []int{80}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := container.Reserve(); err != nil {
+		t.Fatal(err)
+	}
+	ip := container.NetworkSettings.IpAddress
+	port := container.NetworkSettings.PortMapping["80"]
+	if ip == "" || port == "" {
+		t.Fatalf("Expected an address and a port to be reserved, got %#v", container.NetworkSettings)
+	}
+	// The first start uses the reservation
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if container.NetworkSettings.IpAddress != ip || container.NetworkSettings.PortMapping["80"] != port {
+		t.Fatalf("Expected the container to start with %s:%s, got %#v", ip, port, container.NetworkSettings)
+	}
+	container.Wait()
+
+	// Destroying a container which never started releases its reservation
+	other, err := docker.Create("reserve_test2", "true", []string{}, []string{testLayerPath}, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Reserve(); err != nil {
+		t.Fatal(err)
+	}
+	iface := other.network
+	if err := docker.Destroy(other); err != nil {
+		t.Fatal(err)
+	}
+	if other.network != nil {
+		t.Fatal("Expected the reservation to be released")
+	}
+	if err := iface.network.ipAllocator.Release(iface.IPNet.IP); err == nil {
+		t.Fatal("Expected the reserved address to be released already")
+	}
+	docker.Destroy(container)
+}
@@ -0,0 +1,97 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// checkDependencies returns the IDs of the containers which `id` depends on,
+// `dependsOn` being their IDs or unique prefixes of them. It returns an error
+// unless they exist, and don't depend on `id` themselves, directly or not.
+func (docker *Docker) checkDependencies(id string, dependsOn []string) ([]string, error) {
+	var ids []string
+	for _, dependency := range dependsOn {
+		container := docker.Get(dependency)
+		if container == nil {
+			return nil, fmt.Errorf("Container %v depends on %v, which doesn't exist", id, dependency)
+		}
+		ids = append(ids, container.Id)
+	}
+	dependsOn = ids
+	visited := make(map[string]bool)
+	var visit func(path []string) error
+	visit = func(path []string) error {
+		current := path[len(path)-1]
+		if current == id && len(path) > 1 {
+			return fmt.Errorf("Dependency cycle: %s", strings.Join(path, " -> "))
+		}
+		if visited[current] {
+			return nil
+		}
+		visited[current] = true
+		var next []string
+		if current == id {
+			next = dependsOn
+		} else if container := docker.Get(current); container != nil {
+			next = container.Config.DependsOn
+		}
+		for _, dependency := range next {
+			if err := visit(append(path, dependency)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit([]string{id}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// dependenciesRunning returns an error unless the containers which the
+// container depends on are running.
+func (container *Container) dependenciesRunning() error {
+	for _, id := range container.Config.DependsOn {
+		dependency := container.lookup(id)
+		if dependency == nil {
+			return fmt.Errorf("Container %v depends on %v, which doesn't exist", container.Id, id)
+		}
+		if !dependency.State.Running {
+			return fmt.Errorf("Container %v depends on %v, which is not running", container.Id, id)
+		}
+	}
+	return nil
+}
+
+// waitingForDependencies returns true if some containers which the container
+// depends on exist, but are not running.
+func (container *Container) waitingForDependencies() bool {
+	for _, id := range container.Config.DependsOn {
+		if dependency := container.lookup(id); dependency != nil && !dependency.State.Running {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForDependencies blocks until the containers which the container depends
+// on run again, or until the container is stopped by hand. Their starts are
+// events, but stopping the container isn't: that is checked every
+// restartDelay.
+func (container *Container) waitForDependencies() {
+	if !container.waitingForDependencies() {
+		return
+	}
+	var events chan *Event
+	if container.events != nil {
+		events = container.events.Subscribe()
+		defer container.events.Unsubscribe(events)
+	}
+	for container.waitingForDependencies() && !container.isStopping() {
+		select {
+		case <-events:
+		case <-time.After(restartDelay):
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDependencies(t *testing.T) {
+	docker, err := newTestDocker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(id string, dependsOn ...string) (*Container, error) {
+		return docker.Create(id, "ls", []string{"-al"}, []string{testLayerPath}, &Config{DependsOn: dependsOn})
+	}
+	if _, err := create("web", "db"); err == nil {
+		t.Fatal("A container shouldn't depend on a container which doesn't exist")
+	}
+	db, err := create("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err := create("web", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Destroy(web)
+	if err := web.Start(); err == nil || !strings.Contains(err.Error(), "not running") {
+		t.Fatalf("A container shouldn't start before its dependencies, got %v", err)
+	}
+	if !web.waitingForDependencies() {
+		t.Fatal("The container should be waiting for db")
+	}
+	// Re-creating db on top of web would close a cycle
+	if err := docker.Destroy(db); err != nil {
+		t.Fatal(err)
+	}
+	if web.waitingForDependencies() {
+		t.Fatal("The container can't wait for a container which doesn't exist")
+	}
+	if _, err := create("db", "web"); err == nil || !strings.Contains(err.Error(), "db -> web -> db") {
+		t.Fatalf("Expected a dependency cycle, got %v", err)
+	}
+	other, err := create("other", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Destroy(other)
+	if err := docker.Rename(other, "db"); err == nil {
+		t.Fatal("Renaming a container shouldn't close a dependency cycle")
+	}
+	// Dependencies named by short ID are stored by ID
+	cache, err := create(docker.NewId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Destroy(cache)
+	worker, err := create("worker", TruncateId(cache.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Destroy(worker)
+	if len(worker.Config.DependsOn) != 1 || worker.Config.DependsOn[0] != cache.Id {
+		t.Fatalf("Expected worker to depend on %v, got %v", cache.Id, worker.Config.DependsOn)
+	}
+	// ...and follow it when it is renamed
+	if err := docker.Rename(cache, "cache"); err != nil {
+		t.Fatal(err)
+	}
+	if len(worker.Config.DependsOn) != 1 || worker.Config.DependsOn[0] != "cache" {
+		t.Fatalf("Expected worker to depend on cache, got %v", worker.Config.DependsOn)
+	}
+}
@@ -0,0 +1,67 @@
+package docker
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A Device is a host device exposed in a container.
+type Device struct {
+	PathOnHost      string
+	PathInContainer string
+	Permissions     string // Any of r (read), w (write) and m (mknod)
+}
+
+// ParseDevice parses a device given as HOST[:CONTAINER[:PERMISSIONS]]. The
+// device has the same path in the container by default, and all permissions.
+func ParseDevice(spec string) (*Device, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("Invalid device: %s (expected HOST[:CONTAINER[:PERMISSIONS]])", spec)
+	}
+	device := &Device{PathOnHost: parts[0], PathInContainer: parts[0], Permissions: "rwm"}
+	if len(parts) > 1 && parts[1] != "" {
+		device.PathInContainer = parts[1]
+	}
+	if len(parts) > 2 {
+		device.Permissions = parts[2]
+	}
+	if !path.IsAbs(device.PathOnHost) || !path.IsAbs(device.PathInContainer) {
+		return nil, fmt.Errorf("Invalid device: %s (the paths must be absolute)", spec)
+	}
+	if device.Permissions == "" || strings.Trim(device.Permissions, "rwm") != "" {
+		return nil, fmt.Errorf("Invalid device: %s (the permissions are any of r, w and m)", spec)
+	}
+	return device, nil
+}
+
+// CgroupRule returns the rule of the devices cgroup giving access to the
+// device, such as "c 10:229 rwm".
+func (device *Device) CgroupRule() (string, error) {
+	kind, major, minor, err := deviceNumbers(device.PathOnHost)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %d:%d %s", kind, major, minor, device.Permissions), nil
+}
+
+// A BlkioThrottle limits the rate of the IO of a container on a block device.
+type BlkioThrottle struct {
+	Kind string // read_bps, write_bps, read_iops or write_iops
+	Path string
+	Rate int64 // Bytes or operations per second
+}
+
+// CgroupRule returns the rule of the blkio cgroup throttling the device, such
+// as "8:0 1048576".
+func (throttle *BlkioThrottle) CgroupRule() (string, error) {
+	kind, major, minor, err := deviceNumbers(throttle.Path)
+	if err != nil {
+		return "", err
+	}
+	if kind != "b" {
+		return "", fmt.Errorf("%s is not a block device", throttle.Path)
+	}
+	return fmt.Sprintf("%d:%d %d", major, minor, throttle.Rate), nil
+}
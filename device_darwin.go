@@ -0,0 +1,7 @@
+package docker
+
+import "errors"
+
+func deviceNumbers(path string) (kind string, major, minor int64, err error) {
+	return "", 0, 0, errors.New("devices are not implemented on darwin")
+}
@@ -0,0 +1,27 @@
+package docker
+
+import (
+	"errors"
+	"syscall"
+)
+
+// deviceNumbers returns the type ("c" or "b"), major and minor numbers of the
+// device file `path`.
+func deviceNumbers(path string) (kind string, major, minor int64, err error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return "", 0, 0, err
+	}
+	switch stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		kind = "c"
+	case syscall.S_IFBLK:
+		kind = "b"
+	default:
+		return "", 0, 0, errors.New(path + " is not a device")
+	}
+	rdev := uint64(stat.Rdev)
+	major = int64((rdev>>8)&0xfff | (rdev>>32)&^0xfff)
+	minor = int64(rdev&0xff | (rdev>>12)&0xfff00)
+	return kind, major, minor, nil
+}
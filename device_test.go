@@ -0,0 +1,39 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestParseDevice(t *testing.T) {
+	for spec, expected := range map[string]Device{
+		"/dev/fuse":               {"/dev/fuse", "/dev/fuse", "rwm"},
+		"/dev/dri/card0:/dev/gpu": {"/dev/dri/card0", "/dev/gpu", "rwm"},
+		"/dev/sda:/dev/xvda:r":    {"/dev/sda", "/dev/xvda", "r"},
+		"/dev/null::rw":           {"/dev/null", "/dev/null", "rw"},
+	} {
+		device, err := ParseDevice(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+		} else if *device != expected {
+			t.Errorf("%s: expected %+v, got %+v", spec, expected, *device)
+		}
+	}
+	for _, spec := range []string{"dev/fuse", "/dev/fuse:fuse", "/dev/fuse:/dev/fuse:x", "/dev/fuse:/dev/fuse:", "/a:/b:r:w"} {
+		if _, err := ParseDevice(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestCgroupRule(t *testing.T) {
+	device, err := ParseDevice("/dev/null:/dev/null:rw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule, err := device.CgroupRule(); err != nil || rule != "c 1:3 rw" {
+		t.Fatalf("Expected 'c 1:3 rw', got '%s' (%v)", rule, err)
+	}
+	if _, err := (&Device{PathOnHost: "/etc/passwd", Permissions: "r"}).CgroupRule(); err == nil {
+		t.Fatalf("Regular files aren't devices")
+	}
+}
@@ -3,21 +3,35 @@ package docker
 import (
 	"container/list"
 	"fmt"
-	"io/ioutil"
+	"github.com/dotcloud/docker/future"
+	"github.com/dotcloud/docker/image"
 	"log"
 	"os"
 	"path"
 	"sort"
+	"strings"
+	"sync"
 )
 
 type Docker struct {
 	root           string
 	repository     string
 	containers     *list.List
+	lock           sync.RWMutex    // Protects the list of containers, which commands change concurrently
+	creating       map[string]bool // The IDs of the containers being created, see reserveId
 	networkManager *NetworkManager
+	options        NetworkOptions
+	Events         *Events    // The events of the containers
+	changeLock     sync.Mutex // Serializes the updates as containers start and stop
+	changeHooks    []func(container *Container, running bool)
+	exitHooks      []func(container *Container)
+	mcsLock        sync.Mutex
+	mcsLevels      map[string]bool // The SELinux levels of the containers, see allocateMCSLevel
 }
 
 func (docker *Docker) List() []*Container {
+	docker.lock.RLock()
+	defer docker.lock.RUnlock()
 	containers := new(History)
 	for e := docker.containers.Front(); e != nil; e = e.Next() {
 		containers.Add(e.Value.(*Container))
@@ -35,74 +49,286 @@ func (docker *Docker) getContainerElement(id string) *list.Element {
 	return nil
 }
 
+// Get returns the container whose ID is `id`, or else the only one whose
+// generated ID starts with `id`. Names chosen by hand or by rename only
+// match exactly. It returns nil if there is none, or several.
 func (docker *Docker) Get(id string) *Container {
-	e := docker.getContainerElement(id)
-	if e == nil {
+	docker.lock.RLock()
+	defer docker.lock.RUnlock()
+	if e := docker.getContainerElement(id); e != nil {
+		return e.Value.(*Container)
+	}
+	if id == "" || !isHex(id) {
 		return nil
 	}
-	return e.Value.(*Container)
+	var found *Container
+	for e := docker.containers.Front(); e != nil; e = e.Next() {
+		if container := e.Value.(*Container); isGeneratedId(container.Id) && strings.HasPrefix(container.Id, id) {
+			if found != nil {
+				return nil
+			}
+			found = container
+		}
+	}
+	return found
 }
 
+// isGeneratedId returns whether `id` is a container ID generated by NewId,
+// rather than a name.
+func isGeneratedId(id string) bool {
+	return len(id) == 64 && isHex(id)
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Exists returns whether a container has ID `id`, unlike Get which accepts
+// prefixes.
 func (docker *Docker) Exists(id string) bool {
-	return docker.Get(id) != nil
+	docker.lock.RLock()
+	defer docker.lock.RUnlock()
+	return docker.getContainerElement(id) != nil
+}
+
+// NewId returns a new random container ID: 64 hex digits. It is retried on
+// the unlikely collision of its short form with the ID of another container,
+// so that short IDs stay unambiguous.
+func (docker *Docker) NewId() string {
+	for {
+		id := future.RandomId()
+		collides := false
+		for _, container := range docker.List() {
+			collides = collides || strings.HasPrefix(container.Id, TruncateId(id))
+		}
+		if !collides {
+			return id
+		}
+	}
+}
+
+// ImageUsers returns the IDs of the containers created from image `id`.
+func (docker *Docker) ImageUsers(id string) []string {
+	var users []string
+	for _, container := range docker.List() {
+		if container.Config.Image == id {
+			users = append(users, container.Id)
+		}
+	}
+	return users
 }
 
 func (docker *Docker) Create(id string, command string, args []string, layers []string, config *Config) (*Container, error) {
-	if docker.Exists(id) {
-		return nil, fmt.Errorf("Container %v already exists", id)
+	// The ID is taken until the container is listed, or fails to be created
+	if err := docker.reserveId(id); err != nil {
+		return nil, err
+	}
+	defer docker.releaseId(id)
+	dependsOn, err := docker.checkDependencies(id, config.DependsOn)
+	if err != nil {
+		return nil, err
+	}
+	config.DependsOn = dependsOn
+	if docker.networkManager.Get(config.Network) == nil {
+		return nil, fmt.Errorf("No such network: %s", config.Network)
+	}
+	if err := docker.allocateMCSLevel(config); err != nil {
+		return nil, err
 	}
 	root := path.Join(docker.repository, id)
 	container, err := createContainer(id, root, command, args, layers, config, docker.networkManager)
 	if err != nil {
+		docker.releaseMCSLevel(&Container{Config: config})
 		return nil, err
 	}
+	container.events = docker.Events
+	container.lookup = docker.Get
+	container.listRunning = docker.running
+	container.resolvConf = docker.resolvConf
+	container.changed = docker.containerChanged
+	container.exited = docker.containerExited
+	docker.lock.Lock()
 	docker.containers.PushBack(container)
+	docker.lock.Unlock()
+	docker.Events.Publish(container.Id, "create")
+	return container, nil
+}
+
+// reserveId keeps the other creations and renames from taking the ID `id`
+// while a container is created with it, until releaseId.
+func (docker *Docker) reserveId(id string) error {
+	docker.lock.Lock()
+	defer docker.lock.Unlock()
+	if docker.getContainerElement(id) != nil || docker.creating[id] {
+		return fmt.Errorf("Container %v already exists", id)
+	}
+	if docker.creating == nil {
+		docker.creating = make(map[string]bool)
+	}
+	docker.creating[id] = true
+	return nil
+}
+
+func (docker *Docker) releaseId(id string) {
+	docker.lock.Lock()
+	defer docker.lock.Unlock()
+	delete(docker.creating, id)
+}
+
+// Clone creates a new container `id` with the same command, image and
+// configuration as `source`. If `withChanges` is true, the changes made to the
+// filesystem of `source` are copied as well.
+func (docker *Docker) Clone(source *Container, id string, withChanges bool) (*Container, error) {
+	config := *source.Config
+	if config.Hostname == source.Id || config.Hostname == TruncateId(source.Id) {
+		config.Hostname = TruncateId(id)
+	}
+	// The clone gets categories of its own, rather than those of the source
+	if isMCSLevel(selinuxLevel(config.SELinuxLabel)) {
+		config.SELinuxLabel = strings.TrimSuffix(config.SELinuxLabel, selinuxLevel(config.SELinuxLabel)) + defaultSELinuxLabel["level"]
+	}
+	config.Labels = make(map[string]string)
+	for key, value := range source.Config.Labels {
+		config.Labels[key] = value
+	}
+	container, err := docker.Create(id, source.Path, source.Args, source.Filesystem.Layers, &config)
+	if err != nil {
+		return nil, err
+	}
+	if withChanges {
+		if err := container.copyChanges(source); err != nil {
+			docker.Destroy(container)
+			return nil, err
+		}
+	}
 	return container, nil
 }
 
+// Rename changes the ID of `container` to `id`. The container must be stopped.
+func (docker *Docker) Rename(container *Container, id string) error {
+	if container.State.Running {
+		return fmt.Errorf("Container %v is running: stop it before renaming it", container.Id)
+	}
+	if id == "" || path.Base(id) != id || strings.HasPrefix(id, ".") {
+		return fmt.Errorf("Invalid container ID: %v", id)
+	}
+	if docker.Exists(id) {
+		return fmt.Errorf("Container %v already exists", id)
+	}
+	if _, err := docker.checkDependencies(id, container.Config.DependsOn); err != nil {
+		return err
+	}
+	oldId := container.Id
+	// The container is found by its new ID once it is renamed on disk, and
+	// not before
+	docker.lock.Lock()
+	if docker.getContainerElement(id) != nil || docker.creating[id] {
+		docker.lock.Unlock()
+		return fmt.Errorf("Container %v already exists", id)
+	}
+	err := container.rename(id, path.Join(docker.repository, id))
+	docker.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	// The containers which depend on it follow it
+	for _, c := range docker.List() {
+		dependsOn, changed := make([]string, len(c.Config.DependsOn)), false
+		for i, dependency := range c.Config.DependsOn {
+			if dependsOn[i] = dependency; dependency == oldId {
+				dependsOn[i], changed = id, true
+			}
+		}
+		if changed {
+			c.Config.DependsOn = dependsOn
+			if err := c.save(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (docker *Docker) Destroy(container *Container) error {
-	element := docker.getContainerElement(container.Id)
-	if element == nil {
+	if !docker.Exists(container.Id) {
 		return fmt.Errorf("Container %v not found - maybe it was already destroyed?", container.Id)
 	}
 
 	if err := container.Stop(); err != nil {
 		return err
 	}
+	if err := container.releaseReservation(); err != nil {
+		log.Printf("%v: Failed to release network: %v", container.Id, err)
+	}
 	if container.Filesystem.IsMounted() {
 		if err := container.Filesystem.Umount(); err != nil {
 			log.Printf("Unable to umount container %v: %v", container.Id, err)
 		}
 	}
+	container.closeLogs()
 	if err := os.RemoveAll(container.Root); err != nil {
 		log.Printf("Unable to remove filesystem for %v: %v", container.Id, err)
 	}
-	docker.containers.Remove(element)
+	docker.lock.Lock()
+	if element := docker.getContainerElement(container.Id); element != nil {
+		docker.containers.Remove(element)
+	}
+	docker.lock.Unlock()
+	docker.releaseMCSLevel(container)
+	docker.Events.Publish(container.Id, "destroy")
 	return nil
 }
 
 func (docker *Docker) restore() error {
-	dir, err := ioutil.ReadDir(docker.repository)
+	ids, err := containerIds(docker.repository)
 	if err != nil {
 		return err
 	}
-	for _, v := range dir {
-		container, err := loadContainer(path.Join(docker.repository, v.Name()), docker.networkManager)
+	processes := hostProcesses()
+	killed, reconciled := 0, 0
+	for _, id := range ids {
+		container, err := loadContainer(path.Join(docker.repository, id), docker.networkManager)
 		if err != nil {
-			log.Printf("Failed to load container %v: %v", v.Name(), err)
+			log.Printf("Failed to load container %v: %v", id, err)
 			continue
 		}
+		if n, ok := container.reconcile(processes); ok {
+			killed += n
+			reconciled++
+		}
+		container.events = docker.Events
+		container.lookup = docker.Get
+		container.listRunning = docker.running
+		container.resolvConf = docker.resolvConf
+		container.changed = docker.containerChanged
+		container.exited = docker.containerExited
+		docker.reserveMCSLevel(container)
 		docker.containers.PushBack(container)
 	}
+	unmounted := docker.cleanupMounts()
+	if reconciled > 0 || unmounted > 0 {
+		log.Printf("Cleaned up after the previous daemon: %d containers stopped, %d processes killed, %d filesystems unmounted", reconciled, killed, unmounted)
+	}
 	return nil
 }
 
-func New() (*Docker, error) {
-	return NewFromDirectory("/var/lib/docker")
+// New returns the docker of /var/lib/docker, which configures the networking
+// of the containers with `options`.
+func New(options NetworkOptions) (*Docker, error) {
+	return newDocker("/var/lib/docker", options)
 }
 
 func NewFromDirectory(root string) (*Docker, error) {
-	netManager, err := newNetworkManager(networkBridgeIface)
+	return newDocker(root, NetworkOptions{})
+}
+
+func newDocker(root string, options NetworkOptions) (*Docker, error) {
+	netManager, err := newNetworkManager(networkBridgeIface, path.Join(root, "networks"), options)
 	if err != nil {
 		return nil, err
 	}
@@ -111,18 +337,115 @@ func NewFromDirectory(root string) (*Docker, error) {
 		repository:     path.Join(root, "containers"),
 		containers:     list.New(),
 		networkManager: netManager,
+		options:        options,
+		Events:         newEvents(),
+		mcsLevels:      make(map[string]bool),
 	}
 
 	if err := os.MkdirAll(docker.repository, 0700); err != nil && !os.IsExist(err) {
 		return nil, err
 	}
+	if _, err := MigrateContainers(docker.repository, image.MigrateOptions{Backup: true, Log: image.LogWriter{}}); err != nil {
+		return nil, err
+	}
 
 	if err := docker.restore(); err != nil {
 		return nil, err
 	}
+	// No container runs yet: the port mappings left by the previous daemon
+	// are stale
+	if err := netManager.reconcile(); err != nil {
+		return nil, err
+	}
+	if err := netManager.applyIcc(nil); err != nil {
+		return nil, err
+	}
+	go docker.watchResolvConf()
 	return docker, nil
 }
 
+// containerChanged updates the /etc/hosts of the running containers and
+// the rules of the networks where ICC is disabled as `container` starts or
+// stops (`running`). It is called before the container is reported to run,
+// and before its address is released once it stopped, so that no change is
+// missed and no stale rule or host name points at a reused address.
+func (docker *Docker) containerChanged(container *Container, running bool) {
+	docker.changeLock.Lock()
+	defer docker.changeLock.Unlock()
+	var containers []*Container
+	for _, c := range docker.running() {
+		if c != container || running {
+			containers = append(containers, c)
+		}
+	}
+	updateHosts(containers)
+	if err := docker.networkManager.applyIcc(containers); err != nil {
+		log.Printf("Failed to update the ICC rules: %v", err)
+	}
+	for _, hook := range docker.changeHooks {
+		hook(container, running)
+	}
+}
+
+// OnChange registers `hook`, called in order as containers start and stop
+// (`running`): before they are reported to run, and before their address
+// is released once they stopped. Hooks are registered before any container
+// starts, and must not block.
+func (docker *Docker) OnChange(hook func(container *Container, running bool)) {
+	docker.changeHooks = append(docker.changeHooks, hook)
+}
+
+// OnExit registers `hook`, called by the monitor of the containers once they
+// exited, unless their restart policy restarts them. Hooks are registered
+// before any container starts.
+func (docker *Docker) OnExit(hook func(container *Container)) {
+	docker.exitHooks = append(docker.exitHooks, hook)
+}
+
+func (docker *Docker) containerExited(container *Container) {
+	for _, hook := range docker.exitHooks {
+		hook(container)
+	}
+}
+
+// Networks returns the networks the containers can attach to, sorted by name.
+func (docker *Docker) Networks() []*Network {
+	return docker.networkManager.List()
+}
+
+// Network returns network `name`, or nil if it doesn't exist.
+func (docker *Docker) Network(name string) *Network {
+	return docker.networkManager.Get(name)
+}
+
+// CreateNetwork creates network `name` on subnet `subnet` with gateway
+// `gateway`, which are chosen if empty. Its containers can talk to each
+// other if `icc` is true.
+func (docker *Docker) CreateNetwork(name, subnet, gateway string, icc bool) (*Network, error) {
+	network, err := docker.networkManager.Create(name, subnet, gateway, icc)
+	if err != nil {
+		return nil, err
+	}
+	if err := docker.networkManager.applyIcc(docker.running()); err != nil {
+		docker.networkManager.Remove(name)
+		return nil, err
+	}
+	return network, nil
+}
+
+// RemoveNetwork removes network `name`, unless a container uses it.
+func (docker *Docker) RemoveNetwork(name string) error {
+	for _, container := range docker.List() {
+		if container.NetworkName() == name {
+			return fmt.Errorf("Network %s is used by container %s", name, container.Id)
+		}
+	}
+	if err := docker.networkManager.Remove(name); err != nil {
+		return err
+	}
+	return docker.networkManager.applyIcc(docker.running())
+}
+
 type History []*Container
 
 func (history *History) Len() int {
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"github.com/dotcloud/docker/client"
+	"github.com/dotcloud/docker/rcli"
 	"log"
 	"os"
 	"path"
@@ -18,12 +19,23 @@ func main() {
 			}
 		} else {
 			if err := client.SimpleMode(os.Args[1:]); err != nil {
-				log.Fatal(err)
+				exit(err)
 			}
 		}
 	} else {
 		if err := client.SimpleMode(append([]string{cmd}, os.Args[1:]...)); err != nil {
-			log.Fatal(err)
+			exit(err)
 		}
 	}
 }
+
+// exit exits with the status of a failed command. Errors of the command
+// itself were already printed by the client. Errors of the client, eg. to
+// reach the daemon, exit with rcli.StatusError like errors of the daemon.
+func exit(err error) {
+	if status, ok := err.(rcli.ExitStatus); ok {
+		os.Exit(int(status))
+	}
+	log.Print(err)
+	os.Exit(rcli.StatusError)
+}
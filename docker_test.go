@@ -1,9 +1,13 @@
 package docker
 
 import (
+	"container/list"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -14,6 +18,9 @@ func init() {
 	if SelfPath() == "/sbin/init" {
 		SysInit()
 	}
+	if IsMonitor() {
+		Monitor()
+	}
 
 	// Make sure the unit test image is there
 	if _, err := os.Stat(testLayerPath); err != nil {
@@ -238,3 +245,216 @@ func TestRestore(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestClone(t *testing.T) {
+	docker, err := newTestDocker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := docker.Create(
+		"test_clone_source",
+		"ls",
+		[]string{"-al"},
+		[]string{testLayerPath},
+		&Config{Hostname: "test_clone_source", Ram: 42},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Destroy(source)
+	if err := source.SetLabel("comment", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(source.Filesystem.RWPath, "changed"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, withChanges := range []bool{false, true} {
+		id := fmt.Sprintf("test_clone_%v", withChanges)
+		clone, err := docker.Clone(source, id, withChanges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer docker.Destroy(clone)
+		if clone.Path != source.Path || len(clone.Args) != 1 || clone.Config.Ram != 42 {
+			t.Errorf("The command and configuration of the container weren't cloned")
+		}
+		if clone.Config.Hostname != id {
+			t.Errorf("Expected hostname %s, got %s", id, clone.Config.Hostname)
+		}
+		if clone.Label("comment") != "hello" {
+			t.Errorf("Labels weren't cloned")
+		}
+		_, err = os.Stat(path.Join(clone.Filesystem.RWPath, "changed"))
+		if withChanges && err != nil {
+			t.Errorf("Changes weren't cloned: %s", err)
+		} else if !withChanges && err == nil {
+			t.Errorf("Changes were cloned without being asked to")
+		}
+	}
+	if _, err := docker.Clone(source, "test_clone_source", false); err == nil {
+		t.Errorf("Cloning to an existing ID should fail")
+	}
+}
+
+func TestRename(t *testing.T) {
+	docker, err := newTestDocker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := docker.Create(
+		"test_rename",
+		"ls",
+		[]string{"-al"},
+		[]string{testLayerPath},
+		&Config{Hostname: "test_rename"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Destroy(container)
+	if _, err := container.stdoutLog.Write([]byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := docker.Rename(container, "test_renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if docker.Get("test_rename") != nil || docker.Get("test_renamed") != container {
+		t.Fatalf("The container can't be found under its new ID")
+	}
+	if container.Config.Hostname != "test_renamed" {
+		t.Errorf("Expected the hostname to follow the ID, got %s", container.Config.Hostname)
+	}
+	// Logging goes on in the renamed log file
+	if _, err := container.stdoutLog.Write([]byte("after\n")); err != nil {
+		t.Fatal(err)
+	}
+	output, err := ioutil.ReadAll(container.StdoutLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "before\nafter\n" {
+		t.Errorf("Unexpected log content: %q", output)
+	}
+	// The new ID must survive a restart of docker
+	other, err := NewFromDirectory(docker.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored := other.Get("test_renamed"); restored == nil || restored.Root != container.Root {
+		t.Fatalf("The renamed container wasn't restored")
+	}
+	for _, id := range []string{"", "../evil", "test_renamed"} {
+		if err := docker.Rename(container, id); err == nil {
+			t.Errorf("Renaming to '%s' should fail", id)
+		}
+	}
+	// A rename which fails half-way leaves the container as it was
+	root := container.Root
+	if err := container.rename("test_nowhere", path.Join(root, "missing", "test_nowhere")); err == nil {
+		t.Fatalf("Renaming to a missing directory should fail")
+	}
+	if container.Id != "test_renamed" || container.Root != root || container.Config.Hostname != "test_renamed" {
+		t.Fatalf("The container wasn't restored: %s in %s", container.Id, container.Root)
+	}
+	if restored, err := loadContainer(root, docker.networkManager); err != nil || restored.Id != "test_renamed" {
+		t.Fatalf("The config of the container wasn't restored (%v)", err)
+	}
+}
+
+func TestLabelsFromUserData(t *testing.T) {
+	docker, err := newTestDocker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := docker.Create(
+		"test_labels",
+		"ls",
+		[]string{"-al"},
+		[]string{testLayerPath},
+		&Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Destroy(container)
+	// Simulate a container created by an older version
+	if err := ioutil.WriteFile(path.Join(container.Root, "userdata.json"), []byte(`{"comment": "hello", "image": "base:1234"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	container.Config.Labels = nil
+	if err := container.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(docker.repository, ".VERSION")); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewFromDirectory(docker.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := other.Get("test_labels")
+	if restored == nil {
+		t.Fatalf("The container wasn't restored")
+	}
+	if restored.Label("comment") != "hello" || restored.Config.Image != "base:1234" {
+		t.Fatalf("Userdata wasn't migrated: labels %v, image %s", restored.Config.Labels, restored.Config.Image)
+	}
+	if err := restored.SetLabel("comment", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := restored.Config.Labels["comment"]; exists {
+		t.Fatalf("Setting an empty label should remove it")
+	}
+}
+
+func TestGetPrefix(t *testing.T) {
+	docker := &Docker{containers: list.New()}
+	first, second := "0123456789abcdef"+strings.Repeat("0", 48), "0123ffff"+strings.Repeat("0", 56)
+	for _, id := range []string{first, second, "web", "web-old", "cafe", "cafe00"} {
+		docker.containers.PushBack(&Container{Id: id})
+	}
+	for id, expected := range map[string]string{
+		first:   first,
+		"01234": first,
+		"0123f": second,
+		"web":   "web",
+		"web-":  "", // Names only match exactly
+		"caf":   "",
+		"cafe":  "cafe",
+		"0123":  "", // Ambiguous
+		"1":     "",
+		"":      "",
+	} {
+		container := docker.Get(id)
+		if (container == nil && expected != "") || (container != nil && container.Id != expected) {
+			t.Errorf("Get(%q): expected %q, got %v", id, expected, container)
+		}
+	}
+	if docker.Exists("01234") || !docker.Exists("web") {
+		t.Errorf("Exists should only accept full IDs")
+	}
+	id := docker.NewId()
+	if len(id) != 64 || docker.Get(TruncateId(id)) != nil {
+		t.Fatalf("Unexpected new ID %s", id)
+	}
+}
+
+func TestReserveId(t *testing.T) {
+	docker := &Docker{containers: list.New()}
+	if err := docker.reserveId("web"); err != nil {
+		t.Fatal(err)
+	}
+	// A concurrent creation of the same ID fails
+	if err := docker.reserveId("web"); err == nil {
+		t.Fatalf("An ID being created shouldn't be reserved twice")
+	}
+	docker.releaseId("web")
+	if err := docker.reserveId("web"); err != nil {
+		t.Fatal(err)
+	}
+	docker.releaseId("web")
+	docker.containers.PushBack(&Container{Id: "web"})
+	if err := docker.reserveId("web"); err == nil {
+		t.Fatalf("The ID of an existing container shouldn't be reserved")
+	}
+}
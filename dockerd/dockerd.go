@@ -3,18 +3,121 @@ package main
 import (
 	"flag"
 	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/registry"
 	"github.com/dotcloud/docker/server"
 	"log"
+	"os"
 )
 
 func main() {
+	if docker.IsMonitor() {
+		// Running as the monitor of a container
+		docker.Monitor()
+		return
+	}
 	if docker.SelfPath() == "/sbin/init" {
 		// Running in init mode
 		docker.SysInit()
 		return
 	}
+	fl_migrate_dry := flag.Bool("migrate-dry-run", false, "Show the pending migrations of the image store and the containers, then exit")
+	fl_migrate_nobackup := flag.Bool("migrate-nobackup", false, "Don't back up the image store and the containers before migrating them")
+	fl_signatures := flag.Bool("require-signatures", false, "Refuse to pull images without a valid signature")
+	fl_registry := flag.String("registry", "", "URL of the default registry or S3 bucket (s3://BUCKET[/PREFIX]) for push and pull")
+	fl_http_proxy := flag.String("http-proxy", "", "Proxy for HTTP downloads (default: $HTTP_PROXY)")
+	fl_https_proxy := flag.String("https-proxy", "", "Proxy for HTTPS downloads (default: $HTTPS_PROXY)")
+	fl_no_proxy := flag.String("no-proxy", "", "Comma-separated hosts to reach without a proxy (default: $NO_PROXY)")
+	fl_restore_backup := flag.String("restore-backup", "", "Rebuild /var/lib/docker from a backup made by 'docker backup' (- for stdin), then exit")
+	fl_restore_volumes := flag.Bool("restore-volumes", false, "With -restore-backup, also restore the volumes of the containers, to their paths on the host recorded by the backup")
+	fl_debug := flag.Bool("D", false, "Debug mode: log the source location of messages")
+	fl_timeouts := server.Timeouts{}
+	flag.Var(fl_timeouts, "timeout", "Cancel COMMAND after DURATION, as COMMAND=DURATION, eg. pull=10m (can be repeated)")
+	fl_max_heavy := flag.Int("max-heavy", 0, "How many heavy commands (pull, push, commit, tar...) may run at once (0: no limit)")
+	fl_queue_heavy := flag.Bool("queue-heavy", false, "Queue the heavy commands beyond -max-heavy instead of rejecting them")
+	fl_ulimits := server.Ulimits{}
+	flag.Var(fl_ulimits, "default-ulimit", "Default resource limit NAME=SOFT[:HARD] of the containers, such as nofile=4096 (can be repeated)")
+	var fl_port_hooks server.PortHooks
+	flag.Var(&fl_port_hooks, "port-hook", "Register the ports of the containers as they start and stop with a script, http://HOST/PATH or etcd://HOST:PORT/PREFIX (can be repeated)")
+	fl_plugins := flag.String("plugins", "/var/lib/docker/plugins", "Run the commands which aren't built in with the executables docker-COMMAND of this directory")
+	var fl_authz_plugins server.AuthzPlugins
+	flag.Var(&fl_authz_plugins, "authz-plugin", "Allow, deny or rewrite the commands before they run with a script, http://HOST/PATH or unix:///PATH/TO/SOCKET (can be repeated)")
+	fl_log_commands := flag.Bool("log-commands", false, "Log the commands as they run")
+	var fl_dns server.Nameservers
+	flag.Var(&fl_dns, "dns", "Nameserver of the containers, instead of those of the host (can be repeated)")
+	var fl_dns_search server.SearchDomains
+	flag.Var(&fl_dns_search, "dns-search", "Search domain of the containers, instead of those of the host (can be repeated)")
+	var fl_dns_opt server.ResolverOptions
+	flag.Var(&fl_dns_opt, "dns-opt", "Resolver option of the containers, such as ndots:2, instead of those of the host (can be repeated)")
+	fl_icc := flag.Bool("icc", true, "Let the containers of the default network talk to each other, and by default those of new networks")
+	fl_userland_proxy := flag.Bool("userland-proxy", false, "Publish the ports of the containers with proxies, for hosts where iptables NAT isn't available")
+	fl_cache_size := flag.Int64("cache-size", 10<<30, "Prune the cache of the downloaded archives down to this many bytes, least recently used first (0: no limit)")
+	fl_log_spool := flag.String("log-spool", "", "Archive the logs of the containers removed on exit (run -rm) to this directory, where 'docker logs' still finds them")
+	fl_listen := flag.String("H", "", "Also listen on tcp://HOST[:PORT] (port 4243 by default) for the other daemons and remote clients, which must present a certificate signed by -tlscacert")
+	fl_tls_ca := flag.String("tlscacert", "", "CA which signs the certificates of the daemons and of their remote clients")
+	fl_tls_cert := flag.String("tlscert", "", "Certificate of the daemon, valid for server and client authentication, for -H and the calls to other daemons")
+	fl_tls_key := flag.String("tlskey", "", "Private key of -tlscert")
 	flag.Parse()
-	d, err := server.New()
+	if *fl_debug {
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
+	}
+	if *fl_restore_backup != "" {
+		archive := os.Stdin
+		if *fl_restore_backup != "-" {
+			f, err := os.Open(*fl_restore_backup)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			archive = f
+		}
+		if err := server.RestoreBackup(archive, *fl_restore_volumes, os.Stderr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Upgrade the stores before anything else touches them
+	if err := server.MigrateStores(image.MigrateOptions{
+		DryRun: *fl_migrate_dry,
+		Backup: !*fl_migrate_nobackup,
+		Log:    os.Stderr,
+	}); err != nil {
+		log.Fatal(err)
+	}
+	if *fl_migrate_dry {
+		return
+	}
+	var tls *server.TLSOptions
+	if *fl_tls_ca != "" || *fl_tls_cert != "" || *fl_tls_key != "" {
+		tls = &server.TLSOptions{CACert: *fl_tls_ca, Cert: *fl_tls_cert, Key: *fl_tls_key}
+	}
+	d, err := server.New(&server.Options{
+		RequireSignatures: *fl_signatures,
+		Debug:             *fl_debug,
+		Timeouts:          fl_timeouts,
+		MaxHeavy:          *fl_max_heavy,
+		QueueHeavy:        *fl_queue_heavy,
+		DefaultUlimits:    fl_ulimits,
+		PortHooks:         fl_port_hooks,
+		PluginsDir:        *fl_plugins,
+		AuthzPlugins:      fl_authz_plugins,
+		LogCommands:       *fl_log_commands,
+		UserlandProxy:     *fl_userland_proxy,
+		DisableIcc:        !*fl_icc,
+		DNS:               fl_dns,
+		DNSSearch:         fl_dns_search,
+		DNSOptions:        fl_dns_opt,
+		LogSpool:          *fl_log_spool,
+		CacheSize:         *fl_cache_size,
+		Listen:            *fl_listen,
+		TLS:               tls,
+		Registry:          *fl_registry,
+		Proxy: &registry.ProxyConfig{
+			HTTPProxy:  *fl_http_proxy,
+			HTTPSProxy: *fl_https_proxy,
+			NoProxy:    *fl_no_proxy,
+		},
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,7 @@
+package docker
+
+import "errors"
+
+func setDomainname(name string) error {
+	return errors.New("setdomainname is not implemented on darwin")
+}
@@ -0,0 +1,7 @@
+package docker
+
+import "syscall"
+
+func setDomainname(name string) error {
+	return syscall.Setdomainname([]byte(name))
+}
@@ -0,0 +1,60 @@
+package docker
+
+import (
+	"sync"
+	"time"
+)
+
+// An Event is a change in the life of a container.
+type Event struct {
+	Time      time.Time
+	Container string
+	Action    string // create, start, die, oom, destroy...
+}
+
+// Events broadcasts the events of the containers to their subscribers.
+// Subscribers which don't keep up miss events rather than block the
+// containers.
+type Events struct {
+	lock        sync.Mutex
+	subscribers map[chan *Event]bool
+}
+
+func newEvents() *Events {
+	return &Events{subscribers: make(map[chan *Event]bool)}
+}
+
+// Subscribe returns a channel receiving the events published from now on.
+func (events *Events) Subscribe() chan *Event {
+	events.lock.Lock()
+	defer events.lock.Unlock()
+	ch := make(chan *Event, 128)
+	events.subscribers[ch] = true
+	return ch
+}
+
+// Unsubscribe stops sending events to `ch`, and closes it.
+func (events *Events) Unsubscribe(ch chan *Event) {
+	events.lock.Lock()
+	defer events.lock.Unlock()
+	if events.subscribers[ch] {
+		delete(events.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish sends the event `action` of container `id` to the subscribers.
+func (events *Events) Publish(id, action string) {
+	if events == nil {
+		return
+	}
+	event := &Event{Time: time.Now(), Container: id, Action: action}
+	events.lock.Lock()
+	defer events.lock.Unlock()
+	for ch := range events.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
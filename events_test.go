@@ -0,0 +1,29 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	events := newEvents()
+	ch := events.Subscribe()
+	events.Publish("test", "start")
+	if event := <-ch; event.Container != "test" || event.Action != "start" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	// Slow subscribers miss events instead of blocking
+	for i := 0; i < 1000; i++ {
+		events.Publish("test", "oom")
+	}
+	events.Unsubscribe(ch)
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != cap(ch) {
+		t.Fatalf("Expected %d buffered events, got %d", cap(ch), n)
+	}
+	// Containers which aren't managed by a Docker don't publish events
+	var none *Events
+	none.Publish("test", "start")
+}
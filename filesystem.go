@@ -215,6 +215,12 @@ func (fs *Filesystem) Changes() ([]Change, error) {
 	return changes, nil
 }
 
+// Size returns the size of the changes to the filesystem, in bytes: the size
+// of the files of its read-write layer.
+func (fs *Filesystem) Size() (int64, error) {
+	return image.LayerSize(fs.RWPath)
+}
+
 // Reset removes all changes to the filesystem, reverting it to its initial state.
 func (fs *Filesystem) Reset() error {
 	if err := os.RemoveAll(fs.RWPath); err != nil {
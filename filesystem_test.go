@@ -206,3 +206,21 @@ func TestChanges(t *testing.T) {
 		t.Errorf("Unexpected changes: %v", changes)
 	}
 }
+
+func TestFilesystemSize(t *testing.T) {
+	_, filesystem := newTestFilesystem(t, []string{testLayerPath})
+	if size, err := filesystem.Size(); err != nil || size != 0 {
+		t.Fatalf("Expected an empty filesystem, got %d bytes (%v)", size, err)
+	}
+	if err := os.MkdirAll(path.Join(filesystem.RWPath, "etc", ".wh..wh.plnk"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"etc/motd": 100, "a": 20, "etc/.wh..wh.plnk/42": 1000} {
+		if err := ioutil.WriteFile(path.Join(filesystem.RWPath, name), bytes.Repeat([]byte{'x'}, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size, err := filesystem.Size(); err != nil || size != 120 {
+		t.Fatalf("Expected 120 bytes, got %d (%v)", size, err)
+	}
+}
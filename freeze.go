@@ -0,0 +1,42 @@
+package docker
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Freeze suspends the processes of the running container with the freezer
+// cgroup until Unfreeze, so that its filesystem can be read consistently.
+// Freezes nest: the processes resume after as many calls to Unfreeze.
+func (container *Container) Freeze() error {
+	container.freezeLock.Lock()
+	defer container.freezeLock.Unlock()
+	if container.freezes == 0 {
+		if !container.State.Running {
+			return fmt.Errorf("Container %v is not running", container.Id)
+		}
+		if output, err := exec.Command("/usr/bin/lxc-freeze", "-n", container.Id).CombinedOutput(); err != nil {
+			return fmt.Errorf("Unable to freeze %v: %s", container.Id, strings.TrimSpace(string(output)))
+		}
+	}
+	container.freezes++
+	return nil
+}
+
+// Unfreeze resumes the processes of the container suspended by Freeze.
+func (container *Container) Unfreeze() error {
+	container.freezeLock.Lock()
+	defer container.freezeLock.Unlock()
+	if container.freezes == 0 {
+		return fmt.Errorf("Container %v is not frozen", container.Id)
+	}
+	container.freezes--
+	if container.freezes > 0 || !container.State.Running {
+		return nil
+	}
+	if output, err := exec.Command("/usr/bin/lxc-unfreeze", "-n", container.Id).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to unfreeze %v: %s", container.Id, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -1,12 +1,18 @@
 package future
 
 import (
-	"bytes"
+	cryptorand "crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -45,13 +51,114 @@ func HumanDuration(d time.Duration) string {
 	return fmt.Sprintf("%d years", d.Hours()/24/365)
 }
 
-func randomBytes() io.Reader {
-	return bytes.NewBuffer([]byte(fmt.Sprintf("%x", rand.Int())))
+// HumanSize returns a human-readable approximation of `size` bytes, eg. "42.1 MB".
+func HumanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value, i := float64(size), 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
 }
 
+// DiskUsage returns the total size of the regular files under `root`. Files
+// with several hard links are only counted once, and like with du -x, the
+// filesystems mounted under `root` aren't counted, eg. the root filesystems
+// of the running containers, made of layers counted already.
+func DiskUsage(root string) (int64, error) {
+	var size int64
+	seen := make(map[uint64]bool)
+	st, err := os.Stat(root)
+	if err != nil {
+		return 0, err
+	}
+	dev := st.Sys().(*syscall.Stat_t).Dev
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may disappear while we walk, eg. temporary files
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.IsDir() && stat.Dev != dev {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			if seen[stat.Ino] {
+				return nil
+			}
+			seen[stat.Ino] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// KernelVersion returns the release of the running kernel, eg. "3.8.0-19-generic".
+func KernelVersion() (string, error) {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(release)), nil
+}
+
+// MemInfo returns the total memory of the host, and the memory available to
+// new processes without swapping, in bytes.
+func MemInfo() (total int64, available int64, err error) {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		var name string
+		var kb int64
+		if _, err := fmt.Sscanf(line, "%s %d kB", &name, &kb); err != nil {
+			continue
+		}
+		switch name {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	if total == 0 {
+		return 0, 0, fmt.Errorf("Unexpected /proc/meminfo")
+	}
+	return total, available, nil
+}
+
+// RandomId returns 32 random bytes as 64 hex digits.
 func RandomId() string {
-	id, _ := ComputeId(randomBytes()) // can't fail
-	return id
+	id := make([]byte, 32)
+	if _, err := cryptorand.Read(id); err != nil {
+		panic(err) // The kernel ran out of randomness
+	}
+	return hex.EncodeToString(id)
+}
+
+// CloseOnCancel closes `c` if `cancel` is closed before `stop` is called, to
+// interrupt the reads and writes blocked on it.
+func CloseOnCancel(c io.Closer, cancel <-chan struct{}) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-cancel:
+			c.Close()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
 }
 
 func Go(f func() error) chan error {
@@ -85,11 +192,13 @@ func Pv(src io.Reader, info io.Writer) io.Reader {
 	return r
 }
 
-// Curl makes an http request by executing the unix command 'curl', and returns
-// the body of the response. If `stderr` is not nil, a progress bar will be
-// written to it.
-func Curl(url string, stderr io.Writer) (io.Reader, error) {
+// Curl makes an http request to `url` by executing the unix command 'curl',
+// in the environment `env` (the environment of the current process if nil),
+// and returns the body of the response. If `stderr` is not nil, a progress
+// bar will be written to it.
+func Curl(url string, env []string, stderr io.Writer) (io.Reader, error) {
 	curl := exec.Command("curl", "-#", "-L", url)
+	curl.Env = env
 	output, err := curl.StdoutPipe()
 	if err != nil {
 		return nil, err
@@ -100,3 +209,81 @@ func Curl(url string, stderr io.Writer) (io.Reader, error) {
 	}
 	return output, nil
 }
+
+// The schemes of the repositories which GitClone clones. Others, such as
+// file:// or ext::, would let clients read the host or run commands on it.
+var gitSchemes = []string{"https://", "git://", "ssh://"}
+
+// GitClone clones the git repository at `url` into `dir` and checks out
+// `ref` (a branch, tag or commit), if not empty. Progress is displayed on `stderr`.
+func GitClone(url, ref, dir string, stderr io.Writer) error {
+	// Neither may pass as an option of git, eg. --upload-pack=COMMAND
+	if strings.HasPrefix(url, "-") {
+		return fmt.Errorf("Invalid git repository: %s", url)
+	}
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("Invalid git reference: %s", ref)
+	}
+	supported := false
+	for _, scheme := range gitSchemes {
+		if strings.HasPrefix(url, scheme) {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("Unsupported git repository: %s (expected %s)", url, strings.Join(gitSchemes, ", "))
+	}
+	clone := exec.Command("git", "clone", "--quiet", "--", url, dir)
+	clone.Stdout = stderr
+	clone.Stderr = stderr
+	if err := clone.Run(); err != nil {
+		return fmt.Errorf("git clone %s: %s", url, err)
+	}
+	if ref == "" {
+		return nil
+	}
+	checkout := exec.Command("git", "checkout", "--quiet", ref, "--")
+	checkout.Dir = dir
+	checkout.Stdout = stderr
+	checkout.Stderr = stderr
+	if err := checkout.Run(); err != nil {
+		return fmt.Errorf("git checkout %s: %s", ref, err)
+	}
+	return nil
+}
+
+// Flock opens the file at `path`, creating it if necessary, and acquires an
+// advisory lock on it: exclusive if `exclusive` is true, shared otherwise.
+// It blocks until the lock is available. The lock is released by closing
+// the returned file.
+func Flock(path string, exclusive bool) (*os.File, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	return flock(path, how)
+}
+
+// TryFlock is like Flock with an exclusive lock, but returns immediately
+// with an error if the lock is held by somebody else.
+func TryFlock(path string) (*os.File, error) {
+	return flock(path, syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func flock(path string, how int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,131 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// The /etc/hosts of the containers resolves the running containers of their
+// network by ID, hostname and network alias, so that they can reach each
+// other by name.
+
+var validHostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// ValidateHostname returns an error if `name` isn't a valid host name.
+func ValidateHostname(name string) error {
+	if len(name) > 253 || !validHostname.MatchString(name) {
+		return fmt.Errorf("Invalid host name: %s", name)
+	}
+	return nil
+}
+
+// ParseMacAddress returns the MAC address `addr` in the canonical form, if
+// it can be given to a container: 6 bytes, unicast.
+func ParseMacAddress(addr string) (string, error) {
+	mac, err := net.ParseMAC(addr)
+	if err != nil || len(mac) != 6 {
+		return "", fmt.Errorf("Invalid MAC address: %s", addr)
+	}
+	if mac[0]&1 != 0 {
+		return "", fmt.Errorf("Invalid MAC address: %s is a multicast address", addr)
+	}
+	return mac.String(), nil
+}
+
+// HostsPath returns the path of the /etc/hosts of the container on the host.
+func (container *Container) HostsPath() string {
+	return path.Join(container.Root, "hosts")
+}
+
+// HostnamePath returns the path of the /etc/hostname of the container on
+// the host.
+func (container *Container) HostnamePath() string {
+	return path.Join(container.Root, "hostname")
+}
+
+// hostnames returns the names of the container in the /etc/hosts of the
+// containers, its fully qualified hostname first.
+func (container *Container) hostnames() []string {
+	var names []string
+	if hostname := container.Config.Hostname; hostname != "" {
+		if container.Config.Domainname != "" {
+			names = append(names, hostname+"."+container.Config.Domainname)
+		}
+		names = append(names, hostname)
+	}
+	if container.Config.Hostname != container.Id {
+		names = append(names, container.Id)
+	}
+	return append(names, container.Config.NetworkAliases...)
+}
+
+// writeHostname writes the /etc/hostname of the container.
+func (container *Container) writeHostname() error {
+	hostname := container.Config.Hostname
+	if hostname == "" {
+		hostname = container.Id
+	}
+	return ioutil.WriteFile(container.HostnamePath(), []byte(hostname+"\n"), 0644)
+}
+
+// NetworkName returns the name of the network of the container.
+func (container *Container) NetworkName() string {
+	if container.Config.Network == "" {
+		return DefaultNetwork
+	}
+	return container.Config.Network
+}
+
+// writeHosts writes the /etc/hosts of the container, resolving the
+// containers of `running` on its network. It is rewritten in place, since
+// it is bind-mounted in the container.
+func (container *Container) writeHosts(running []*Container) error {
+	var hosts bytes.Buffer
+	fmt.Fprintf(&hosts, "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n")
+	for _, c := range running {
+		if c.NetworkSettings.IpAddress != "" && c.NetworkName() == container.NetworkName() {
+			fmt.Fprintf(&hosts, "%s\t%s\n", c.NetworkSettings.IpAddress, strings.Join(c.hostnames(), " "))
+		}
+	}
+	return ioutil.WriteFile(container.HostsPath(), hosts.Bytes(), 0644)
+}
+
+// checkMacAddress returns an error if another container of `running` uses
+// the MAC address of the container.
+func (container *Container) checkMacAddress(running []*Container) error {
+	if container.Config.MacAddress == "" {
+		return nil
+	}
+	for _, c := range running {
+		if c != container && c.Config.MacAddress == container.Config.MacAddress {
+			return fmt.Errorf("The MAC address %s is already used by container %s", container.Config.MacAddress, c.Id)
+		}
+	}
+	return nil
+}
+
+// running returns the containers which are running.
+func (docker *Docker) running() []*Container {
+	var running []*Container
+	for _, container := range docker.List() {
+		if container.State.Running {
+			running = append(running, container)
+		}
+	}
+	return running
+}
+
+// updateHosts rewrites the /etc/hosts of the containers of `running`.
+func updateHosts(running []*Container) {
+	for _, container := range running {
+		if err := container.writeHosts(running); err != nil {
+			log.Printf("%v: Failed to update /etc/hosts: %v", container.Id, err)
+		}
+	}
+}
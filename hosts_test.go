@@ -0,0 +1,42 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateHostname(t *testing.T) {
+	for _, name := range []string{"db", "db-1", "db.example.com", "a1"} {
+		if err := ValidateHostname(name); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	for _, name := range []string{"", "-db", "db-", "db..example", "db_1", "db/1"} {
+		if err := ValidateHostname(name); err == nil {
+			t.Errorf("%s should be invalid", name)
+		}
+	}
+}
+
+func TestParseMacAddress(t *testing.T) {
+	if mac, err := ParseMacAddress("02:42:AC:11:00:02"); err != nil || mac != "02:42:ac:11:00:02" {
+		t.Errorf("Unexpected result: %s, %v", mac, err)
+	}
+	for _, addr := range []string{"", "02:42:ac:11:00", "01:00:5e:00:00:01", "00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"} {
+		if _, err := ParseMacAddress(addr); err == nil {
+			t.Errorf("%s should be invalid", addr)
+		}
+	}
+}
+
+func TestHostnames(t *testing.T) {
+	container := &Container{Id: "4f2c1a9b", Config: &Config{Hostname: "4f2c1a9b", NetworkAliases: []string{"db"}}}
+	if names := strings.Join(container.hostnames(), " "); names != "4f2c1a9b db" {
+		t.Errorf("Unexpected names: %s", names)
+	}
+	container.Config.Hostname = "web"
+	container.Config.Domainname = "example.com"
+	if names := strings.Join(container.hostnames(), " "); names != "web.example.com web 4f2c1a9b db" {
+		t.Errorf("Unexpected names: %s", names)
+	}
+}
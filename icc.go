@@ -0,0 +1,142 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The containers of a network can talk to each other, unless inter-container
+// communication (ICC) is disabled on the network: by dockerd -icc=false for
+// the default network, or by 'docker network create -icc=false'. The
+// containers of such a network only accept the connections of the
+// containers they allow: those which depend on them, and those listed in
+// their label icc.allow.
+
+const (
+	iccChain = "DOCKER-ICC"
+	// The label of a container listing the IDs of the containers allowed to
+	// connect to it, or unique prefixes of them, separated by commas, where
+	// ICC is disabled
+	IccAllowLabel = "icc.allow"
+)
+
+// allowedPeers returns the containers of `containers` allowed to connect to
+// the container.
+func (container *Container) allowedPeers(containers []*Container) []*Container {
+	allowed := make(map[string]bool)
+	for _, id := range strings.Split(container.Config.Labels[IccAllowLabel], ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		// The label may name them by short ID
+		if container.lookup != nil {
+			if c := container.lookup(id); c != nil {
+				id = c.Id
+			}
+		}
+		allowed[id] = true
+	}
+	var peers []*Container
+	for _, c := range containers {
+		if c == container {
+			continue
+		}
+		dependsOn := false
+		for _, id := range c.Config.DependsOn {
+			dependsOn = dependsOn || id == container.Id
+		}
+		if dependsOn || allowed[c.Id] {
+			peers = append(peers, c)
+		}
+	}
+	return peers
+}
+
+// iccRules returns the rules of the DOCKER-ICC chain keeping the containers
+// of `running` on network `network`, where ICC is disabled, from talking to
+// each other, except on the exposed ports of the containers which allow it.
+func iccRules(network *Network, running []*Container) [][]string {
+	var containers []*Container
+	for _, c := range running {
+		if c.NetworkName() == network.Name && c.NetworkSettings.IpAddress != "" {
+			containers = append(containers, c)
+		}
+	}
+	bridge := []string{"-i", network.Bridge, "-o", network.Bridge}
+	rules := [][]string{append(append([]string{}, bridge...), "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")}
+	for _, container := range containers {
+		ports := MergePorts(container.Config.ExposedPorts, container.Config.PublishedPorts())
+		for _, peer := range container.allowedPeers(containers) {
+			allow := append(append([]string{}, bridge...), "-s", peer.NetworkSettings.IpAddress+"/32", "-d", container.NetworkSettings.IpAddress+"/32")
+			// Without exposed ports, all of them are allowed
+			if len(ports) == 0 {
+				rules = append(rules, append(allow, "-j", "ACCEPT"))
+			}
+			for _, port := range ports {
+				rules = append(rules, append(append([]string{}, allow...), "-p", "tcp", "-m", "tcp", "--dport", strconv.Itoa(port), "-j", "ACCEPT"))
+			}
+		}
+	}
+	return append(rules, append(append([]string{}, bridge...), "-j", "DROP"))
+}
+
+// applyIcc replaces the rules of the DOCKER-ICC chain with those of the
+// networks where ICC is disabled, for the containers of `running`. The chain
+// is replaced at once, so that no connection slips through in between.
+func (manager *NetworkManager) applyIcc(running []*Container) error {
+	manager.iccLock.Lock()
+	defer manager.iccLock.Unlock()
+	var rules [][]string
+	for _, network := range manager.List() {
+		if network.DisableIcc {
+			rules = append(rules, iccRules(network, running)...)
+		}
+	}
+	// Hosts without iptables are fine, as long as ICC isn't disabled and no
+	// previous daemon left rules
+	if len(rules) == 0 && !manager.iccSetup && iptables("-L", iccChain, "-n") != nil {
+		return nil
+	}
+	if !manager.iccSetup {
+		if err := setupIccChain(); err != nil {
+			return err
+		}
+		manager.iccSetup = true
+	}
+	var restore bytes.Buffer
+	fmt.Fprintf(&restore, "*filter\n:%s - [0:0]\n", iccChain)
+	for _, rule := range rules {
+		fmt.Fprintf(&restore, "-A %s %s\n", iccChain, strings.Join(rule, " "))
+	}
+	fmt.Fprintf(&restore, "COMMIT\n")
+	cmd := exec.Command("/sbin/iptables-restore", "--noflush")
+	cmd.Stdin = &restore
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables-restore failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// setupIccChain creates the DOCKER-ICC chain and jumps to it from FORWARD.
+// The traffic between the containers of a bridge only goes through iptables
+// with bridge-nf-call-iptables.
+func setupIccChain() error {
+	if iptables("-L", iccChain, "-n") != nil {
+		if err := iptables("-N", iccChain); err != nil {
+			return fmt.Errorf("Unable to setup ICC: Failed to create %s chain", iccChain)
+		}
+	}
+	deleteRules("-D", "FORWARD", "-j", iccChain)
+	if err := iptables("-I", "FORWARD", "-j", iccChain); err != nil {
+		return fmt.Errorf("Unable to setup ICC: Failed to inject docker in FORWARD chain")
+	}
+	exec.Command("/sbin/modprobe", "br_netfilter").Run()
+	if err := ioutil.WriteFile("/proc/sys/net/bridge/bridge-nf-call-iptables", []byte("1"), 0644); err != nil {
+		return fmt.Errorf("Unable to setup ICC: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package docker
+
+import (
+	"container/list"
+	"strings"
+	"testing"
+)
+
+func TestIccRules(t *testing.T) {
+	network := &Network{Name: "tenant", Bridge: "docker-1234abcd"}
+	web := &Container{
+		Id:              strings.Repeat("ab", 32),
+		Config:          &Config{Network: "tenant", DependsOn: []string{"db"}},
+		NetworkSettings: &NetworkSettings{IpAddress: "172.18.0.2"},
+	}
+	db := &Container{
+		Id:              "db",
+		Config:          &Config{Network: "tenant", ExposedPorts: []int{5432}},
+		NetworkSettings: &NetworkSettings{IpAddress: "172.18.0.3"},
+	}
+	cache := &Container{
+		Id:              "cache",
+		Config:          &Config{Network: "tenant", Labels: map[string]string{IccAllowLabel: TruncateId(web.Id) + ", other"}},
+		NetworkSettings: &NetworkSettings{IpAddress: "172.18.0.4"},
+	}
+	other := &Container{
+		Id:              "other",
+		Config:          &Config{},
+		NetworkSettings: &NetworkSettings{IpAddress: "10.0.3.2"},
+	}
+	docker := &Docker{containers: list.New()}
+	for _, container := range []*Container{web, db, cache, other} {
+		container.lookup = docker.Get
+		docker.containers.PushBack(container)
+	}
+	var rules []string
+	for _, rule := range iccRules(network, []*Container{web, db, cache, other}) {
+		rules = append(rules, strings.Join(rule, " "))
+	}
+	expected := []string{
+		"-i docker-1234abcd -o docker-1234abcd -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		// web depends on db, which only exposes 5432
+		"-i docker-1234abcd -o docker-1234abcd -s 172.18.0.2/32 -d 172.18.0.3/32 -p tcp -m tcp --dport 5432 -j ACCEPT",
+		// cache allows web, and other isn't on the network
+		"-i docker-1234abcd -o docker-1234abcd -s 172.18.0.2/32 -d 172.18.0.4/32 -j ACCEPT",
+		"-i docker-1234abcd -o docker-1234abcd -j DROP",
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected rules:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(rules, "\n"))
+	}
+}
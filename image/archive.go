@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os/exec"
+	"strings"
 )
 
 type Compression uint32
@@ -26,7 +27,26 @@ func (compression *Compression) Flag() string {
 }
 
 func Tar(path string, compression Compression) (io.Reader, error) {
-	cmd := exec.Command("bsdtar", "-f", "-", "-C", path, "-c"+compression.Flag(), ".")
+	return TarFilter(path, compression, nil)
+}
+
+// TarFilter is like Tar, without the files and directories matching the
+// patterns of `excludes`, and their contents. Patterns starting with / match
+// from the root of `path`, eg. '/tmp', and the others at any depth, eg.
+// '*.pyc' or '.cache'.
+func TarFilter(path string, compression Compression, excludes []string) (io.Reader, error) {
+	args := []string{"-f", "-", "-C", path, "-c" + compression.Flag()}
+	for _, pattern := range excludes {
+		if strings.Trim(pattern, "/") == "" {
+			continue
+		}
+		// bsdtar anchors the patterns starting with ^ at the root
+		if strings.HasPrefix(pattern, "/") {
+			pattern = "^" + strings.TrimLeft(pattern, "/")
+		}
+		args = append(args, "--exclude", pattern)
+	}
+	cmd := exec.Command("bsdtar", append(args, ".")...)
 	return CmdStream(cmd)
 }
 
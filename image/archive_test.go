@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"testing"
 )
 
@@ -52,3 +53,44 @@ func TestTarUntar(t *testing.T) {
 		t.Fatalf("Error stating %s: %s", tmp, err.Error())
 	}
 }
+
+func TestTarFilter(t *testing.T) {
+	src, err := ioutil.TempDir("", "docker-test-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	for _, dir := range []string{"tmp/cache", "var/tmp", "app"} {
+		if err := os.MkdirAll(path.Join(src, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"tmp/cache/a", "tmpfile", "var/tmp/b", "app/main.py", "app/main.pyc"} {
+		if err := ioutil.WriteFile(path.Join(src, file), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive, err := TarFilter(src, Uncompressed, []string{"/tmp", "*.pyc", "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := ioutil.TempDir("", "docker-test-untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	if err := Untar(archive, dst); err != nil {
+		t.Fatal(err)
+	}
+	for file, kept := range map[string]bool{
+		"tmp":          false,
+		"tmpfile":      true,
+		"var/tmp/b":    true,
+		"app/main.py":  true,
+		"app/main.pyc": false,
+	} {
+		if _, err := os.Stat(path.Join(dst, file)); (err == nil) != kept {
+			t.Errorf("Expected %s to be kept: %v, got %v", file, kept, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package image
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// The build cache remembers the image produced by running a build
+// instruction on top of a parent image, so that rebuilding an unchanged
+// recipe can reuse it instead of running the instruction again:
+//
+//	ROOT/buildcache/HASH	the ID of the image built by an instruction on a parent
+//
+// where HASH is derived from the parent ID and the instruction.
+
+func (store *Store) buildCachePath(parentId, instruction string) string {
+	key := sha256.Sum256([]byte(parentId + "\n" + strings.TrimSpace(instruction)))
+	return path.Join(store.Root, "buildcache", fmt.Sprintf("%x", key))
+}
+
+// CachedBuild returns the image previously built by running `instruction` on
+// top of image `parentId`, or nil if there is none. Entries whose image was
+// deleted since are discarded.
+func (store *Store) CachedBuild(parentId, instruction string) *Image {
+	p := store.buildCachePath(parentId, instruction)
+	id, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	image := store.Find(string(id))
+	if image == nil || image.Id != string(id) || image.Parent != parentId {
+		os.Remove(p)
+		return nil
+	}
+	return image
+}
+
+// CacheBuild records that running `instruction` on top of the parent of
+// `image` produced `image`.
+func (store *Store) CacheBuild(instruction string, image *Image) error {
+	if image.Parent == "" {
+		return fmt.Errorf("Can't cache %s: it has no parent", image.Id)
+	}
+	p := store.buildCachePath(image.Parent, instruction)
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		return err
+	}
+	return WriteFileAtomic(p, []byte(image.Id), 0600)
+}
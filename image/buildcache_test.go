@@ -0,0 +1,35 @@
+package image
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBuildCache(t *testing.T) {
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	base := importFake(t, store, "base", nil)
+	built := createFake(t, store, "app", base)
+	if img := store.CachedBuild(base.Id, "run apt-get install curl"); img != nil {
+		t.Fatalf("Empty cache returned %s", img.Id)
+	}
+	if err := store.CacheBuild("run apt-get install curl", built); err != nil {
+		t.Fatal(err)
+	}
+	if img := store.CachedBuild(base.Id, "  run apt-get install curl\n"); img == nil || img.Id != built.Id {
+		t.Fatalf("Expected %s from the cache, got %v", built.Id, img)
+	}
+	if img := store.CachedBuild(base.Id, "run apt-get install wget"); img != nil {
+		t.Fatalf("A different instruction shouldn't hit the cache")
+	}
+	if err := store.CacheBuild("copy .", base); err == nil {
+		t.Fatalf("Caching an image without a parent should fail")
+	}
+	// Deleting the image invalidates the entry
+	if err := store.DeleteId(built.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	if img := store.CachedBuild(base.Id, "run apt-get install curl"); img != nil {
+		t.Fatalf("Cache returned the deleted image %s", img.Id)
+	}
+}
@@ -0,0 +1,133 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A Problem is an inconsistency between the index and the layers of a store,
+// as reported by Fsck.
+type Problem struct {
+	Kind  ProblemKind
+	Image string // The ID of the affected image, if any
+	Layer string // The path of the affected layer, if any
+}
+
+type ProblemKind int
+
+const (
+	DanglingImage ProblemKind = iota // An image references a layer which doesn't exist
+	OrphanLayer                      // A layer isn't referenced by any image
+	BrokenParent                     // An image's parent isn't in the index
+)
+
+func (problem *Problem) String() string {
+	switch problem.Kind {
+	case DanglingImage:
+		return fmt.Sprintf("dangling image %s: missing layer %s", problem.Image, problem.Layer)
+	case OrphanLayer:
+		return fmt.Sprintf("orphaned layer %s", problem.Layer)
+	case BrokenParent:
+		return fmt.Sprintf("broken parent for image %s: no such image %s", problem.Image, problem.Layer)
+	}
+	return fmt.Sprintf("unknown problem %d", problem.Kind)
+}
+
+// Fsck cross-checks the index against the contents of the layers directory,
+// and returns the list of inconsistencies it found.
+func (store *Store) Fsck() ([]*Problem, error) {
+	if err := store.Index.rload(); err != nil {
+		return nil, err
+	}
+	store.Index.mutex.RLock()
+	defer store.Index.mutex.RUnlock()
+	var problems []*Problem
+	referenced := make(map[string]bool)
+	for _, id := range store.Index.ids() {
+		img := store.Index.ById[id]
+		for _, layer := range img.Layers {
+			referenced[layer] = true
+			if st, err := os.Stat(layer); err != nil || !st.IsDir() {
+				problems = append(problems, &Problem{Kind: DanglingImage, Image: img.Id, Layer: layer})
+			}
+		}
+		if img.Parent != "" && store.Index.ById[img.Parent] == nil {
+			problems = append(problems, &Problem{Kind: BrokenParent, Image: img.Id, Layer: img.Parent})
+		}
+	}
+	for _, layer := range store.Layers.List() {
+		// Layers being added aren't referenced yet
+		if !referenced[layer] && !strings.HasPrefix(path.Base(layer), "tmp-") {
+			problems = append(problems, &Problem{Kind: OrphanLayer, Layer: layer})
+		}
+	}
+	return problems, nil
+}
+
+// Repair fixes the problems reported by Fsck: dangling images are removed
+// from the index, orphaned layers are moved out of the way to the quarantine
+// directory of the store, and broken parent references are cleared.
+func (store *Store) Repair(problems []*Problem) error {
+	var orphans []string
+	err := store.Index.transaction(func() error {
+		for _, problem := range problems {
+			switch problem.Kind {
+			case DanglingImage:
+				store.Index.remove(problem.Image)
+			case BrokenParent:
+				if img, exists := store.Index.ById[problem.Image]; exists {
+					img.Parent = ""
+				}
+			case OrphanLayer:
+				orphans = append(orphans, problem.Layer)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	quarantine := store.QuarantinePath()
+	if err := os.MkdirAll(quarantine, 0700); err != nil {
+		return err
+	}
+	for _, layer := range orphans {
+		if err := os.Rename(layer, path.Join(quarantine, path.Base(layer))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QuarantinePath returns the directory where Repair moves orphaned layers.
+func (store *Store) QuarantinePath() string {
+	return path.Join(store.Root, "quarantine")
+}
+
+// ids returns the IDs of all images in the index, sorted.
+func (index *Index) ids() []string {
+	var ids []string
+	for id := range index.ById {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// remove deletes the image with the given ID from the index, as well as
+// its name if it was the only version left.
+func (index *Index) remove(id string) {
+	for name, history := range index.ByName {
+		history.Del(id)
+		if history.Len() == 0 {
+			delete(index.ByName, name)
+		}
+	}
+	delete(index.ById, id)
+}
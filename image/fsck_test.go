@@ -0,0 +1,72 @@
+package image
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	foo := createFake(t, store, "foo", nil)
+	bar := createFake(t, store, "bar", foo)
+	baz := createFake(t, store, "baz", nil)
+	// A layer being added isn't orphaned
+	if err := os.Mkdir(path.Join(store.Layers.Root, "tmp-123"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := store.Fsck(); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("Expected a clean store, got %v", problems)
+	}
+	// Break things
+	if err := os.RemoveAll(baz.Layers[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("foo", false); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := store.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[ProblemKind]*Problem)
+	for _, problem := range problems {
+		kinds[problem.Kind] = problem
+	}
+	if p := kinds[DanglingImage]; p == nil || p.Image != baz.Id {
+		t.Errorf("Expected %s to be reported as dangling, got %v", baz.Id, p)
+	}
+	if p := kinds[BrokenParent]; p == nil || p.Image != bar.Id {
+		t.Errorf("Expected %s to be reported with a broken parent, got %v", bar.Id, p)
+	}
+	if p := kinds[OrphanLayer]; p != nil {
+		t.Errorf("foo's layer is still used by bar, it shouldn't be orphaned: %v", p)
+	}
+	// Remove bar, orphaning the layers
+	if err := store.Delete("bar", false); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err = store.Fsck(); err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 3 {
+		t.Fatalf("Expected 3 problems (1 dangling image, 2 orphaned layers), got %v", problems)
+	}
+	if err := store.Repair(problems); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := store.Fsck(); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("Expected a clean store after repair, got %v", problems)
+	}
+	if store.Find(baz.Id) != nil {
+		t.Errorf("Dangling image %s should have been removed", baz.Id)
+	}
+	if _, err := os.Stat(path.Join(store.QuarantinePath(), path.Base(foo.Layers[0]))); err != nil {
+		t.Errorf("Orphaned layer should have been quarantined: %s", err)
+	}
+}
@@ -3,6 +3,7 @@ package image
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/dotcloud/docker/future"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,6 +31,9 @@ func New(root string) (*Store, error) {
 	if err := os.MkdirAll(abspath, 0700); err != nil && !os.IsExist(err) {
 		return nil, err
 	}
+	if _, err := Migrate(abspath, MigrateOptions{Backup: true, Log: LogWriter{}}); err != nil {
+		return nil, err
+	}
 	layers, err := NewLayerStore(path.Join(root, "layers"))
 	if err != nil {
 		return nil, err
@@ -36,16 +41,26 @@ func New(root string) (*Store, error) {
 	if err := layers.Init(); err != nil {
 		return nil, err
 	}
-	return &Store{
+	store := &Store{
 		Root:   abspath,
 		Index:  NewIndex(path.Join(root, "index.json")),
 		Layers: layers,
-	}, nil
+	}
+	if err := store.recover(); err != nil {
+		return nil, err
+	}
+	return store, nil
 }
 
 // Import creates a new image from the contents of `archive` and registers it in the store as `name`.
 // If `parent` is not nil, it will registered as the parent of the new image.
 func (store *Store) Import(name string, archive io.Reader, parent *Image) (*Image, error) {
+	return store.ImportTag(name, "", archive, parent)
+}
+
+// ImportTag is like Import, but also tags the new image with `tag`. The tag
+// is removed from any other version of `name`.
+func (store *Store) ImportTag(name, tag string, archive io.Reader, parent *Image) (*Image, error) {
 	layer, err := store.Layers.AddLayer(archive)
 	if err != nil {
 		return nil, err
@@ -58,7 +73,15 @@ func (store *Store) Import(name string, archive io.Reader, parent *Image) (*Imag
 	if parent != nil {
 		parentId = parent.Id
 	}
-	return store.Create(name, parentId, layers...)
+	image, err := NewImage(name, layers, parentId)
+	if err != nil {
+		return nil, err
+	}
+	image.Tag = tag
+	if err := store.Index.Add(name, image); err != nil {
+		return nil, err
+	}
+	return image, nil
 }
 
 func (store *Store) Create(name string, source string, layers ...string) (*Image, error) {
@@ -78,6 +101,17 @@ type Index struct {
 	Path   string
 	ByName map[string]*History
 	ById   map[string]*Image
+
+	// If set, InUse returns the IDs of the containers using image `id`.
+	// Images in use can't be deleted unless forced.
+	InUse func(id string) []string `json:"-"`
+
+	// The state of the file when it was last loaded or saved. As long as it
+	// doesn't change, the in-memory maps are up-to-date and load() is a no-op.
+	loaded os.FileInfo
+	// Protects the maps above against concurrent access from the goroutines
+	// of the same process. Other processes are kept out by flock().
+	mutex sync.RWMutex
 }
 
 func NewIndex(path string) *Index {
@@ -89,15 +123,23 @@ func NewIndex(path string) *Index {
 }
 
 func (index *Index) Exists(id string) bool {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
 	_, exists := index.ById[id]
 	return exists
 }
 
 func (index *Index) Find(idOrName string) *Image {
 	// Load
-	if err := index.load(); err != nil {
+	if err := index.rload(); err != nil {
 		return nil
 	}
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	return index.find(idOrName)
+}
+
+func (index *Index) find(idOrName string) *Image {
 	// Lookup by ID
 	if image, exists := index.ById[idOrName]; exists {
 		return image
@@ -106,148 +148,420 @@ func (index *Index) Find(idOrName string) *Image {
 	if history, exists := index.ByName[idOrName]; exists && history.Len() > 0 {
 		return (*history)[0]
 	}
+	// Lookup by name:tag
+	if idx := strings.LastIndex(idOrName, ":"); idx >= 0 {
+		if history, exists := index.ByName[idOrName[:idx]]; exists {
+			for _, image := range *history {
+				if image.Tag != "" && image.Tag == idOrName[idx+1:] {
+					return image
+				}
+			}
+		}
+	}
 	return nil
 }
 
 func (index *Index) Add(name string, image *Image) error {
-	// Load
-	if err := index.load(); err != nil {
+	if err := ValidateName(name); err != nil {
 		return err
 	}
+	return index.transaction(func() error {
+		index.add(name, image)
+		return nil
+	})
+}
+
+func (index *Index) add(name string, image *Image) {
 	if _, exists := index.ByName[name]; !exists {
 		index.ByName[name] = new(History)
 	} else {
 		// If this image is already the latest version, don't add it.
 		if (*index.ByName[name])[0].Id == image.Id {
-			return nil
+			return
+		}
+	}
+	// A tag designates a single version
+	if image.Tag != "" {
+		for _, other := range *index.ByName[name] {
+			if other.Tag == image.Tag {
+				other.Tag = ""
+			}
 		}
 	}
 	index.ByName[name].Add(image)
 	index.ById[image.Id] = image
-	// Save
-	if err := index.save(); err != nil {
-		return err
-	}
-	return nil
 }
 
+// Copy registers image `srcNameOrId` under `dstName` as well. The copy shares
+// the layers of the source: see Store.Clone for an independent copy.
 func (index *Index) Copy(srcNameOrId, dstName string) (*Image, error) {
 	if srcNameOrId == "" || dstName == "" {
 		return nil, errors.New("Illegal image name")
 	}
-	// Load
-	if err := index.load(); err != nil {
+	if err := ValidateName(dstName); err != nil {
+		return nil, err
+	}
+	var dst *Image
+	err := index.transaction(func() error {
+		src := index.find(srcNameOrId)
+		if src == nil {
+			return errors.New("No such image: " + srcNameOrId)
+		}
+		img, err := NewImage(dstName, src.Layers, src.Id)
+		if err != nil {
+			return err
+		}
+		img.ExposedPorts = src.ExposedPorts
+		img.CreatedBy, img.Comment = src.CreatedBy, src.Comment
+		index.add(dstName, img)
+		dst = img
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// Clone is like Copy, but the new image gets copies of the layers of the
+// source image rather than sharing them, so that neither can affect the
+// other.
+func (store *Store) Clone(srcNameOrId, dstName string) (*Image, error) {
+	if err := ValidateName(dstName); err != nil {
 		return nil, err
 	}
-	src := index.Find(srcNameOrId)
+	src := store.Index.Find(srcNameOrId)
 	if src == nil {
 		return nil, errors.New("No such image: " + srcNameOrId)
 	}
-	dst, err := NewImage(dstName, src.Layers, src.Id)
-	if err != nil {
-		return nil, err
+	var layers []string
+	for _, layer := range src.Layers {
+		clone, err := store.Layers.CloneLayer(layer)
+		if err != nil {
+			for _, clone := range layers {
+				os.RemoveAll(clone)
+			}
+			return nil, err
+		}
+		layers = append(layers, clone)
 	}
-	if err := index.Add(dstName, dst); err != nil {
+	img, err := NewImage(dstName, layers, src.Id)
+	if err != nil {
 		return nil, err
 	}
-	// Save
-	if err := index.save(); err != nil {
+	img.ExposedPorts = src.ExposedPorts
+	img.CreatedBy, img.Comment = src.CreatedBy, src.Comment
+	if err := store.Index.Add(dstName, img); err != nil {
 		return nil, err
 	}
-	return dst, nil
+	return img, nil
+}
+
+// SetLabels merges `labels` into the labels of image `id`. Labels with an
+// empty value are removed.
+func (index *Index) SetLabels(id string, labels map[string]string) error {
+	return index.transaction(func() error {
+		image, exists := index.ById[id]
+		if !exists {
+			return errors.New("No such image: " + id)
+		}
+		if image.Labels == nil {
+			image.Labels = make(map[string]string)
+		}
+		for key, value := range labels {
+			if value == "" {
+				delete(image.Labels, key)
+			} else {
+				image.Labels[key] = value
+			}
+		}
+		return nil
+	})
+}
+
+// SetExposedPorts sets the ports exposed by the containers of image `id`.
+func (index *Index) SetExposedPorts(id string, ports []int) error {
+	return index.transaction(func() error {
+		image, exists := index.ById[id]
+		if !exists {
+			return errors.New("No such image: " + id)
+		}
+		image.ExposedPorts = ports
+		return nil
+	})
+}
+
+// SetCreatedBy records the command of the container which image `id` was
+// committed from, and the comment of the commit.
+func (index *Index) SetCreatedBy(id, createdBy, comment string) error {
+	return index.transaction(func() error {
+		image, exists := index.ById[id]
+		if !exists {
+			return errors.New("No such image: " + id)
+		}
+		image.CreatedBy = createdBy
+		image.Comment = comment
+		return nil
+	})
 }
 
 func (index *Index) Rename(oldName, newName string) error {
-	// Load
-	if err := index.load(); err != nil {
+	if err := ValidateName(newName); err != nil {
 		return err
 	}
-	if _, exists := index.ByName[oldName]; !exists {
-		return errors.New("Can't rename " + oldName + ": no such image.")
+	return index.transaction(func() error {
+		if _, exists := index.ByName[oldName]; !exists {
+			return errors.New("Can't rename " + oldName + ": no such image.")
+		}
+		if _, exists := index.ByName[newName]; exists {
+			return errors.New("Can't rename to " + newName + ": name is already in use.")
+		}
+		index.ByName[newName] = index.ByName[oldName]
+		delete(index.ByName, oldName)
+		// Change the ID of all images, since they include the name
+		for _, image := range *index.ByName[newName] {
+			if id, err := generateImageId(newName, image.Layers); err != nil {
+				return err
+			} else {
+				oldId := image.Id
+				image.Id = id
+				index.ById[id] = image
+				delete(index.ById, oldId)
+			}
+		}
+		return nil
+	})
+}
+
+// Delete deletes all images with the name `name`.
+// Unless `force` is true, it fails if any of them is in use.
+func (index *Index) Delete(name string, force bool) error {
+	return index.transaction(func() error {
+		if _, exists := index.ByName[name]; !exists {
+			return errors.New("No such image: " + name)
+		}
+		if !force {
+			if err := index.checkInUse(*index.ByName[name]...); err != nil {
+				return err
+			}
+		}
+		// Remove from index lookup
+		for _, image := range *index.ByName[name] {
+			delete(index.ById, image.Id)
+		}
+		// Remove from name lookup
+		delete(index.ByName, name)
+		return nil
+	})
+}
+
+// DeleteId deletes the single image with ID `id`, leaving the other versions
+// of the same name alone. Unless `force` is true, it fails if the image is
+// in use.
+func (index *Index) DeleteId(id string, force bool) error {
+	return index.transaction(func() error {
+		image, exists := index.ById[id]
+		if !exists {
+			return errors.New("No such image: " + id)
+		}
+		if !force {
+			if err := index.checkInUse(image); err != nil {
+				return err
+			}
+		}
+		index.remove(id)
+		return nil
+	})
+}
+
+// Aliases returns the images, other than `image` itself, which share its
+// layers, for example because they were created with Copy.
+func (index *Index) Aliases(image *Image) []*Image {
+	if err := index.rload(); err != nil {
+		return nil
+	}
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	var aliases []*Image
+	for _, id := range index.ids() {
+		other := index.ById[id]
+		if other.Id != image.Id && len(other.Layers) > 0 && len(image.Layers) > 0 && other.Layers[0] == image.Layers[0] {
+			aliases = append(aliases, other)
+		}
 	}
-	if _, exists := index.ByName[newName]; exists {
-		return errors.New("Can't rename to " + newName + ": name is already in use.")
+	return aliases
+}
+
+// DeleteMatch deletes all images whose name matches `pattern`.
+// Unless `force` is true, it fails without deleting anything if any of them
+// is in use.
+func (index *Index) DeleteMatch(pattern string, force bool) error {
+	return index.transaction(func() error {
+		for name, history := range index.ByName {
+			if match, err := regexp.MatchString(pattern, name); err != nil {
+				return err
+			} else if match {
+				if !force {
+					if err := index.checkInUse(*history...); err != nil {
+						return err
+					}
+				}
+				// Remove from index lookup
+				for _, image := range *history {
+					delete(index.ById, image.Id)
+				}
+				// Remove from name lookup
+				delete(index.ByName, name)
+			}
+		}
+		return nil
+	})
+}
+
+// An ImageInUseError is returned when trying to delete images which are
+// used by containers.
+type ImageInUseError struct {
+	Images     []string
+	Containers []string
+}
+
+func (err *ImageInUseError) Error() string {
+	return fmt.Sprintf("Image(s) %s in use by container(s) %s", strings.Join(err.Images, ", "), strings.Join(err.Containers, ", "))
+}
+
+func (index *Index) checkInUse(images ...*Image) error {
+	if index.InUse == nil {
+		return nil
 	}
-	index.ByName[newName] = index.ByName[oldName]
-	delete(index.ByName, oldName)
-	// Change the ID of all images, since they include the name
-	for _, image := range *index.ByName[newName] {
-		if id, err := generateImageId(newName, image.Layers); err != nil {
-			return err
-		} else {
-			oldId := image.Id
-			image.Id = id
-			index.ById[id] = image
-			delete(index.ById, oldId)
+	inUse := &ImageInUseError{}
+	for _, image := range images {
+		if users := index.InUse(image.Id); len(users) > 0 {
+			inUse.Images = append(inUse.Images, image.Id)
+			inUse.Containers = append(inUse.Containers, users...)
 		}
 	}
-	// Save
-	if err := index.save(); err != nil {
-		return err
+	if len(inUse.Images) > 0 {
+		return inUse
 	}
 	return nil
 }
 
-// Delete deletes all images with the name `name`
-func (index *Index) Delete(name string) error {
-	// Load
-	if err := index.load(); err != nil {
-		return err
+func (index *Index) Names() []string {
+	if err := index.rload(); err != nil {
+		return []string{}
 	}
-	if _, exists := index.ByName[name]; !exists {
-		return errors.New("No such image: " + name)
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	var names []string
+	for name := range index.ByName {
+		names = append(names, name)
 	}
-	// Remove from index lookup
-	for _, image := range *index.ByName[name] {
-		delete(index.ById, image.Id)
+	sort.Strings(names)
+	return names
+}
+
+// History returns a copy of the versions of image `name`, most recent first.
+func (index *Index) History(name string) History {
+	if err := index.rload(); err != nil {
+		return nil
 	}
-	// Remove from name lookup
-	delete(index.ByName, name)
-	// Save
-	if err := index.save(); err != nil {
-		return err
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	history, exists := index.ByName[name]
+	if !exists {
+		return nil
 	}
-	return nil
+	return append(History{}, *history...)
 }
 
-// DeleteMatch deletes all images whose name matches `pattern`
-func (index *Index) DeleteMatch(pattern string) error {
-	// Load
+// Count returns the total number of images in the index.
+func (index *Index) Count() int {
+	if err := index.rload(); err != nil {
+		return 0
+	}
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	return len(index.ById)
+}
+
+// transaction loads the latest version of the index, applies `fn` to it and
+// commits the result to disk in a single atomic step.
+// If `fn` returns an error, its changes are discarded and the index on disk
+// is left untouched.
+func (index *Index) transaction(fn func() error) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	// Hold an exclusive lock for the whole read-modify-write cycle, so that
+	// concurrent writers (eg. another daemon or a standalone client sharing
+	// the same store) can't clobber each other's changes.
+	lock, err := future.Flock(index.lockPath(), true)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
 	if err := index.load(); err != nil {
 		return err
 	}
-	for name, history := range index.ByName {
-		if match, err := regexp.MatchString(pattern, name); err != nil {
-			return err
-		} else if match {
-			// Remove from index lookup
-			for _, image := range *history {
-				delete(index.ById, image.Id)
-			}
-			// Remove from name lookup
-			delete(index.ByName, name)
+	if err := fn(); err != nil {
+		// Roll back the in-memory changes
+		index.invalidate()
+		if e := index.load(); e != nil {
+			return errors.New(err.Error() + " (rollback failed: " + e.Error() + ")")
 		}
-	}
-	// Save
-	if err := index.save(); err != nil {
 		return err
 	}
-	return nil
+	return index.save()
 }
 
-func (index *Index) Names() []string {
+// Snapshot returns the content of the index file, read under a shared lock
+// so that it never observes a write in progress.
+func (index *Index) Snapshot() ([]byte, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	lock, err := future.Flock(index.lockPath(), false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
 	if err := index.load(); err != nil {
-		return []string{}
+		return nil, err
 	}
-	var names []string
-	for name := range index.ByName {
-		names = append(names, name)
+	return json.Marshal(index)
+}
+
+// rload loads the index under a shared lock, so that it never observes
+// a write in progress.
+func (index *Index) rload() error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	lock, err := future.Flock(index.lockPath(), false)
+	if err != nil {
+		return err
 	}
-	sort.Strings(names)
-	return names
+	defer lock.Close()
+	return index.load()
+}
+
+func (index *Index) lockPath() string {
+	return index.Path + ".lock"
 }
 
 func (index *Index) load() error {
+	st, err := os.Stat(index.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if index.isCached(st) {
+		return nil
+	}
+	// Always start from empty maps: unmarshaling into existing maps would
+	// merge stale entries with the contents of the file.
+	index.ByName = make(map[string]*History)
+	index.ById = make(map[string]*Image)
+	index.loaded = nil
+	if st == nil {
+		return nil
+	}
 	jsonData, err := ioutil.ReadFile(index.Path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -260,17 +574,96 @@ func (index *Index) load() error {
 		return err
 	}
 	index.Path = path
+	// ByName and ById are decoded as distinct copies of each image: share
+	// them again so that changes to an image are seen through both.
+	for _, history := range index.ByName {
+		for _, image := range *history {
+			index.ById[image.Id] = image
+		}
+	}
+	index.loaded = st
 	return nil
 }
 
+// isCached returns true if the file described by `st` is the one the index
+// was last loaded from or saved to, ie. the in-memory copy is still valid.
+// Saves always replace the file, so a different inode means another process
+// wrote to the index; in-place edits are caught by the size and mtime.
+func (index *Index) isCached(st os.FileInfo) bool {
+	if index.loaded == nil || st == nil {
+		return false
+	}
+	return os.SameFile(index.loaded, st) &&
+		index.loaded.Size() == st.Size() &&
+		index.loaded.ModTime().Equal(st.ModTime())
+}
+
+// invalidate discards the in-memory copy of the index, forcing the next
+// load() to read it from disk.
+func (index *Index) invalidate() {
+	index.loaded = nil
+}
+
+// save writes the index to a temporary file in the same directory, syncs it
+// and renames it over the previous version. A crash at any point leaves
+// either the old or the new index on disk, never a partial one.
+// The previous version is kept as a backup.
 func (index *Index) save() error {
 	jsonData, err := json.Marshal(index)
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(index.Path, jsonData, 0600); err != nil {
+	if err := index.backup(); err != nil {
+		return err
+	}
+	index.invalidate()
+	if err := WriteFileAtomic(index.Path, jsonData, 0600); err != nil {
+		return err
+	}
+	// What we just wrote is what we have in memory
+	if st, err := os.Stat(index.Path); err == nil {
+		index.loaded = st
+	}
+	return nil
+}
+
+// WriteFileAtomic writes `data` to `filename` through a temporary file,
+// synced then renamed over it, so that a crash leaves either the previous
+// content or the new one.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(path.Dir(filename), "."+path.Base(filename)+"-")
+	if err != nil {
 		return err
 	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Make sure the rename itself is durable
+	if dir, err := os.Open(path.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
 	return nil
 }
 
@@ -312,6 +705,14 @@ type Image struct {
 	Layers  []string // Absolute paths
 	Created time.Time
 	Parent  string
+	Tag     string            // Optional. Designates this version of the image as NAME:TAG
+	Labels  map[string]string `json:",omitempty"`
+	// Ports the containers of the image listen on, published by 'run -P'
+	ExposedPorts []int `json:",omitempty"`
+	// The command of the container the image was committed from, and the
+	// comment of the commit
+	CreatedBy string `json:",omitempty"`
+	Comment   string `json:",omitempty"`
 }
 
 func (image *Image) IdParts() (string, string) {
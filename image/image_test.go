@@ -0,0 +1,436 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/future"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestIndex(t *testing.T) (*Index, string) {
+	tmp, err := ioutil.TempDir("", "docker-test-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewIndex(path.Join(tmp, "index.json")), tmp
+}
+
+func TestIndexAddFind(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	img, err := NewImage("foo", []string{"/layers/aaaa"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add("foo", img); err != nil {
+		t.Fatal(err)
+	}
+	// A fresh index on the same file must see the image
+	other := NewIndex(index.Path)
+	if found := other.Find("foo"); found == nil || found.Id != img.Id {
+		t.Fatalf("Expected to find %s, got %v", img.Id, found)
+	}
+	if found := other.Find(img.Id); found == nil {
+		t.Fatalf("Expected to find %s by id", img.Id)
+	}
+}
+
+func TestIndexSnapshot(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	img, err := NewImage("foo", []string{"/layers/aaaa"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add("foo", img); err != nil {
+		t.Fatal(err)
+	}
+	data, err := NewIndex(index.Path).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The snapshot is a valid index file
+	restored := NewIndex(path.Join(tmp, "restored.json"))
+	if err := ioutil.WriteFile(restored.Path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if found := restored.Find("foo"); found == nil || found.Id != img.Id {
+		t.Fatalf("Expected to find %s in the snapshot, got %v", img.Id, found)
+	}
+}
+
+func TestIndexTransactionRollback(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	img, err := NewImage("foo", []string{"/layers/aaaa"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add("foo", img); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(index.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("failure")
+	if err := index.transaction(func() error {
+		delete(index.ByName, "foo")
+		delete(index.ById, img.Id)
+		return failure
+	}); err != failure {
+		t.Fatalf("Expected the transaction error, got %v", err)
+	}
+	// The in-memory index must have been rolled back...
+	if !index.Exists(img.Id) {
+		t.Fatalf("Rolled back transaction left %s deleted in memory", img.Id)
+	}
+	// ...and the file left untouched
+	after, err := ioutil.ReadFile(index.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Fatalf("Rolled back transaction modified the index on disk")
+	}
+}
+
+func TestIndexDeleteDoesNotResurrect(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	for _, name := range []string{"foo", "bar"} {
+		img, err := NewImage(name, []string{"/layers/" + name}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := index.Add(name, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Delete("foo", false); err != nil {
+		t.Fatal(err)
+	}
+	if names := index.Names(); len(names) != 1 || names[0] != "bar" {
+		t.Fatalf("Expected [bar], got %v", names)
+	}
+	// No temporary files should be left behind
+	files, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".index.json-") {
+			t.Fatalf("Temporary file %s left behind", f.Name())
+		}
+	}
+}
+
+func TestIndexConcurrentWriters(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	// Two independent Index objects on the same file simulate two processes
+	// sharing a store. Without locking, one side's additions get lost.
+	other := NewIndex(index.Path)
+	done := make(chan error)
+	for i, idx := range []*Index{index, other} {
+		go func(i int, idx *Index) {
+			for j := 0; j < 20; j++ {
+				name := fmt.Sprintf("img%d-%d", i, j)
+				img, err := NewImage(name, []string{"/layers/" + name}, "")
+				if err != nil {
+					done <- err
+					return
+				}
+				if err := idx.Add(name, img); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}(i, idx)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := NewIndex(index.Path).Names(); len(names) != 40 {
+		t.Fatalf("Expected 40 images, found %d", len(names))
+	}
+}
+
+func TestIndexCacheInvalidation(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	other := NewIndex(index.Path)
+	foo, err := NewImage("foo", []string{"/layers/foo"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add("foo", foo); err != nil {
+		t.Fatal(err)
+	}
+	if other.Find("foo") == nil {
+		t.Fatalf("Expected to find foo")
+	}
+	// A cached lookup must return the very same object
+	if other.Find("foo") != other.Find("foo") {
+		t.Fatalf("Index was reloaded although it didn't change")
+	}
+	bar, err := NewImage("bar", []string{"/layers/bar"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add("bar", bar); err != nil {
+		t.Fatal(err)
+	}
+	// The change made through another Index must invalidate the cache
+	if other.Find("bar") == nil {
+		t.Fatalf("Cached index didn't pick up changes made by another writer")
+	}
+}
+
+func TestIndexConcurrentAccess(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				name := fmt.Sprintf("img%d-%d", i, j)
+				img, err := NewImage(name, []string{"/layers/" + name}, "")
+				if err != nil {
+					errs <- err
+					return
+				}
+				if err := index.Add(name, img); err != nil {
+					errs <- err
+					return
+				}
+				if found := index.Find(name); found == nil || found.Id != img.Id {
+					errs <- fmt.Errorf("Couldn't find %s right after adding it", name)
+					return
+				}
+				index.Names()
+				if j%2 == 0 {
+					if err := index.Delete(name, false); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if count := index.Count(); count != 50 {
+		t.Fatalf("Expected 50 images, found %d", count)
+	}
+}
+
+func TestIndexDeleteId(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	v1, err := NewImage("foo", []string{"/layers/v1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := NewImage("foo", []string{"/layers/v2"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range []*Image{v1, v2} {
+		if err := index.Add("foo", img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.DeleteId(v2.Id, false); err != nil {
+		t.Fatal(err)
+	}
+	// The other version must still be reachable by name
+	if img := index.Find("foo"); img == nil || img.Id != v1.Id {
+		t.Fatalf("Expected foo to resolve to %s, got %v", v1.Id, img)
+	}
+	if err := index.DeleteId(v1.Id, false); err != nil {
+		t.Fatal(err)
+	}
+	// Removing the last version removes the name
+	if names := index.Names(); len(names) != 0 {
+		t.Fatalf("Expected no names left, got %v", names)
+	}
+	if err := index.DeleteId(v1.Id, false); err == nil {
+		t.Fatalf("Deleting a missing image should fail")
+	}
+}
+
+func TestIndexDeleteInUse(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	foo, err := NewImage("foo", []string{"/layers/foo"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add("foo", foo); err != nil {
+		t.Fatal(err)
+	}
+	index.InUse = func(id string) []string {
+		if id == foo.Id {
+			return []string{"c1", "c2"}
+		}
+		return nil
+	}
+	for _, del := range []func() error{
+		func() error { return index.Delete("foo", false) },
+		func() error { return index.DeleteId(foo.Id, false) },
+		func() error { return index.DeleteMatch("f.*", false) },
+	} {
+		err := del()
+		if inUse, ok := err.(*ImageInUseError); !ok {
+			t.Fatalf("Expected an ImageInUseError, got %v", err)
+		} else if len(inUse.Containers) != 2 {
+			t.Fatalf("Expected the 2 dependent containers to be listed, got %v", inUse.Containers)
+		}
+		if index.Find("foo") == nil {
+			t.Fatalf("Image in use was deleted")
+		}
+	}
+	if err := index.DeleteMatch("f.*", true); err != nil {
+		t.Fatal(err)
+	}
+	if index.Find("foo") != nil {
+		t.Fatalf("Forced delete didn't delete the image")
+	}
+}
+
+func TestIndexTags(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	var versions []*Image
+	for _, tag := range []string{"1.0", "1.1", "1.0"} {
+		img, err := NewImage("foo", []string{"/layers/" + future.RandomId()}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		img.Tag = tag
+		if err := index.Add("foo", img); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, img)
+	}
+	if img := index.Find("foo:1.1"); img == nil || img.Id != versions[1].Id {
+		t.Fatalf("Expected foo:1.1 to resolve to %s, got %v", versions[1].Id, img)
+	}
+	// The tag was moved to the latest version tagged 1.0
+	if img := index.Find("foo:1.0"); img == nil || img.Id != versions[2].Id {
+		t.Fatalf("Expected foo:1.0 to resolve to %s, got %v", versions[2].Id, img)
+	}
+	if img := index.Find("foo:2.0"); img != nil {
+		t.Fatalf("foo:2.0 shouldn't exist")
+	}
+}
+
+func TestIndexLabels(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	img, err := NewImage("foo", []string{"/layers/foo"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add("foo", img); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.SetLabels(img.Id, map[string]string{"team": "infra", "env": "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.SetLabels(img.Id, map[string]string{"env": ""}); err != nil {
+		t.Fatal(err)
+	}
+	// Labels must be visible by ID and by name, from another Index too
+	other := NewIndex(index.Path)
+	for _, name := range []string{img.Id, "foo"} {
+		found := other.Find(name)
+		if found == nil || found.Labels["team"] != "infra" || len(found.Labels) != 1 {
+			t.Fatalf("Unexpected labels for %s: %v", name, found)
+		}
+	}
+	if err := index.SetLabels("missing", map[string]string{"a": "b"}); err == nil {
+		t.Fatalf("Labeling a missing image should fail")
+	}
+}
+
+func TestIndexCreatedBy(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	img, err := NewImage("foo", []string{"/layers/foo"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add("foo", img); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.SetCreatedBy(img.Id, "apt-get install -y nginx", "Install nginx"); err != nil {
+		t.Fatal(err)
+	}
+	// Visible from another Index, and kept by copies
+	other := NewIndex(index.Path)
+	if found := other.Find("foo"); found == nil || found.CreatedBy != "apt-get install -y nginx" || found.Comment != "Install nginx" {
+		t.Fatalf("Unexpected image %v", found)
+	}
+	cp, err := index.Copy("foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.CreatedBy != "apt-get install -y nginx" || cp.Comment != "Install nginx" {
+		t.Fatalf("The copy lost the command and comment: %v", cp)
+	}
+	if err := index.SetCreatedBy("missing", "true", ""); err == nil {
+		t.Fatalf("Setting the command of a missing image should fail")
+	}
+}
+
+func TestStoreClone(t *testing.T) {
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	base := importFake(t, store, "base", nil)
+	src := importFake(t, store, "foo", base)
+	clone, err := store.Clone("foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.Parent != src.Id || len(clone.Layers) != len(src.Layers) {
+		t.Fatalf("Unexpected clone %v of %v", clone, src)
+	}
+	for i, layer := range clone.Layers {
+		if layer == src.Layers[i] {
+			t.Fatalf("The clone shares layer %s", layer)
+		}
+		data, err := ioutil.ReadFile(path.Join(layer, "etc/passwd"))
+		if err != nil || string(data) != "Hello world!\n" {
+			t.Fatalf("Unexpected content of the cloned layer: %q (%v)", data, err)
+		}
+	}
+	if aliases := store.Aliases(clone); len(aliases) != 0 {
+		t.Fatalf("The clone shouldn't have aliases, got %v", aliases)
+	}
+	// Changing the clone leaves the source alone
+	if err := ioutil.WriteFile(path.Join(clone.Layers[0], "etc/passwd"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path.Join(src.Layers[0], "etc/passwd")); err != nil || string(data) != "Hello world!\n" {
+		t.Fatalf("The source changed with its clone: %q (%v)", data, err)
+	}
+	if _, err := store.Clone("missing", "baz"); err == nil {
+		t.Fatalf("Cloning a missing image should fail")
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 )
 
 type LayerStore struct {
@@ -45,6 +47,28 @@ func (store *LayerStore) Get(id string) string {
 	return store.layerPath(id)
 }
 
+// LayerSize returns the size of the files of layer `layer`, in bytes,
+// without the AUFS metadata.
+func LayerSize(layer string) (int64, error) {
+	var size int64
+	err := filepath.Walk(layer, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(filepath.Base(path), ".wh..wh.") {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if f.Mode().IsRegular() {
+			size += f.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
 func (store *LayerStore) rootExists() (bool, error) {
 	if stat, err := os.Stat(store.Root); err != nil {
 		if os.IsNotExist(err) {
@@ -79,53 +103,68 @@ func (store *LayerStore) layerPath(id string) string {
 	return path.Join(store.Root, id)
 }
 
+// AddLayer unpacks `archive` as a new layer and returns its path. The ID of a
+// layer is the digest of its archive: if a layer with the same ID is already
+// in the store, it is returned without unpacking the archive again.
 func (store *LayerStore) AddLayer(archive io.Reader) (string, error) {
-	errors := make(chan error)
+	// Spool the archive while computing its ID
+	spool, err := ioutil.TempFile(store.Root, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	id, err := future.ComputeId(io.TeeReader(archive, spool))
+	if err != nil {
+		return "", err
+	}
+	layer := store.layerPath(id)
+	if store.Exists(id) {
+		return layer, nil
+	}
+	if _, err := spool.Seek(0, 0); err != nil {
+		return "", err
+	}
 	// Untar
 	tmp, err := store.Mktemp()
 	defer os.RemoveAll(tmp)
 	if err != nil {
 		return "", err
 	}
-	untarR, untarW := io.Pipe()
-	go func() {
-		errors <- Untar(untarR, tmp)
-	}()
-	// Compute ID
-	var id string
-	hashR, hashW := io.Pipe()
-	go func() {
-		_id, err := future.ComputeId(hashR)
-		id = _id
-		errors <- err
-	}()
-	// Duplicate archive to each stream
-	_, err = io.Copy(io.MultiWriter(hashW, untarW), archive)
-	hashW.Close()
-	untarW.Close()
-	if err != nil {
+	if err := Untar(spool, tmp); err != nil {
 		return "", err
 	}
-	// Wait for goroutines
-	for i := 0; i < 2; i += 1 {
-		select {
-		case err := <-errors:
-			{
-				if err != nil {
-					return "", err
-				}
-			}
-		}
-	}
-	layer := store.layerPath(id)
-	if !store.Exists(id) {
-		if err := os.Rename(tmp, layer); err != nil {
-			return "", err
+	if err := os.Rename(tmp, layer); err != nil {
+		// Another import of the same archive may have won the race
+		if store.Exists(id) {
+			return layer, nil
 		}
+		return "", err
 	}
 	return layer, nil
 }
 
+// CloneLayer copies `layer` to a new layer of the store, and returns its path.
+// The files are reflinked on the filesystems which support it, and copied
+// otherwise: unlike hard links, the copy never shares their content. The ID
+// of the copy is random, since the digest of its archive is the one of
+// `layer`.
+func (store *LayerStore) CloneLayer(layer string) (string, error) {
+	tmp, err := store.Mktemp()
+	defer os.RemoveAll(tmp)
+	if err != nil {
+		return "", err
+	}
+	if output, err := exec.Command("cp", "-a", "--reflink=auto", layer+"/.", tmp).CombinedOutput(); err != nil {
+		return "", errors.New(err.Error() + ": " + string(output))
+	}
+	clone := store.layerPath(future.RandomId())
+	if err := os.Rename(tmp, clone); err != nil {
+		return "", err
+	}
+	return clone, nil
+}
+
 func (store *LayerStore) Exists(id string) bool {
 	st, err := os.Stat(store.layerPath(id))
 	if err != nil {
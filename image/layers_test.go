@@ -32,6 +32,43 @@ func TestAddLayer(t *testing.T) {
 	}
 }
 
+func TestAddLayerDedup(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	store, err := NewLayerStore(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := fake.FakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := store.AddLayer(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without bsdtar in the PATH, unpacking the archive would fail
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+	archive, err = fake.FakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := store.AddLayer(archive)
+	if err != nil {
+		t.Fatalf("Identical layer was unpacked again: %s", err)
+	}
+	if again != layer {
+		t.Fatalf("Expected %s, got %s", layer, again)
+	}
+	if files, _ := ioutil.ReadDir(tmp); len(files) != 1 {
+		t.Fatalf("Expected a single layer in the store, found %d files", len(files))
+	}
+}
+
 func TestComputeId(t *testing.T) {
 	id1, err := future.ComputeId(bytes.NewBufferString("hello world\n"))
 	if err != nil {
@@ -45,3 +82,31 @@ func TestComputeId(t *testing.T) {
 		t.Fatalf("Identical checksums for difference content (%s == %s)", id1, id2)
 	}
 }
+
+func TestLayerSize(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	store, err := NewLayerStore(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := fake.FakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := store.AddLayer(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := LayerSize(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 files of 13 bytes
+	if size != 52 {
+		t.Fatalf("Expected a layer of 52 bytes, got %d", size)
+	}
+}
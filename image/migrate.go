@@ -0,0 +1,244 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/future"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StoreVersion is the version of the on-disk layout of a store written by
+// this code. Stores without a version marker are at version 0.
+const StoreVersion = 1
+
+// A Migration upgrades a store from version `Version - 1` to `Version`.
+type Migration struct {
+	Version     int
+	Description string
+	Run         func(root string) error
+}
+
+// Migrations, in order. Each one must be idempotent: a crash after Run but
+// before the version marker is updated will cause it to run again.
+var migrations = []*Migration{
+	{1, "Add a format version marker to the store", migrateIndexV1},
+}
+
+type MigrateOptions struct {
+	DryRun bool      // Only report which migrations would be applied
+	Backup bool      // Back up the metadata of the store before migrating it
+	Log    io.Writer // Progress messages are written here, if not nil
+}
+
+// A Layout describes the versions of the on-disk layout of a store, so that
+// stores other than the image store are migrated the same way.
+type Layout struct {
+	Current    int          // The version written by this code
+	Migrations []*Migration // In order, up to Current
+	Marker     string       // The name of the version marker, at the top of the store
+	Lock       string       // The name of the file locked while migrating, if not ""
+	Backups    string       // The prefix of the names of the backups, at the top of the store
+	// IsNew returns whether the unversioned store at `root` is brand new,
+	// with nothing to migrate.
+	IsNew func(root string) bool
+	// Metadata returns the files backed up before migrating the store at
+	// `root`, relative to it.
+	Metadata func(root string) ([]string, error)
+}
+
+// The layout of the image store. Layers are never modified in place, so
+// only the regular files at the top of the store are backed up.
+var imageLayout = &Layout{
+	Current:    StoreVersion,
+	Migrations: migrations,
+	Marker:     "VERSION",
+	Lock:       "index.json.lock",
+	Backups:    "backup-",
+	IsNew: func(root string) bool {
+		_, err := os.Stat(path.Join(root, "index.json"))
+		return os.IsNotExist(err)
+	},
+	Metadata: topFiles,
+}
+
+// Version returns the version of the on-disk layout of the image store at
+// `root`.
+func Version(root string) (int, error) {
+	return imageLayout.StoredVersion(root)
+}
+
+func setVersion(root string, version int) error {
+	return imageLayout.setVersion(root, version)
+}
+
+// StoredVersion returns the version of the on-disk layout of the store at
+// `root`. Stores without a version marker are at version 0.
+func (layout *Layout) StoredVersion(root string) (int, error) {
+	marker := path.Join(root, layout.Marker)
+	data, err := ioutil.ReadFile(marker)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return -1, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1, fmt.Errorf("Invalid store version in %s: %s", marker, err)
+	}
+	return version, nil
+}
+
+func (layout *Layout) setVersion(root string, version int) error {
+	return WriteFileAtomic(path.Join(root, layout.Marker), []byte(strconv.Itoa(version)+"\n"), 0600)
+}
+
+// Migrate upgrades the image store at `root` to StoreVersion, and returns
+// the migrations which were applied (or would be, in dry-run mode).
+func Migrate(root string, options MigrateOptions) ([]*Migration, error) {
+	return imageLayout.Migrate(root, options)
+}
+
+// Migrate upgrades the store at `root` to the current version of the
+// layout, and returns the migrations which were applied (or would be, in
+// dry-run mode).
+func (layout *Layout) Migrate(root string, options MigrateOptions) ([]*Migration, error) {
+	logf := func(format string, args ...interface{}) {
+		if options.Log != nil {
+			fmt.Fprintf(options.Log, format+"\n", args...)
+		}
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	// Keep other processes away from the store while we change its layout
+	if layout.Lock != "" {
+		lock, err := future.Flock(path.Join(root, layout.Lock), true)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Close()
+	}
+	version, err := layout.StoredVersion(root)
+	if err != nil {
+		return nil, err
+	}
+	if version > layout.Current {
+		return nil, fmt.Errorf("The store at %s has version %d, but only versions up to %d are supported. Please upgrade docker.", root, version, layout.Current)
+	}
+	var pending []*Migration
+	for _, migration := range layout.Migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	if version == 0 && layout.IsNew(root) {
+		// A brand new store: there is nothing to migrate
+		if options.DryRun {
+			return nil, nil
+		}
+		return nil, layout.setVersion(root, layout.Current)
+	}
+	if options.DryRun {
+		for _, migration := range pending {
+			logf("Would migrate %s to version %d: %s", root, migration.Version, migration.Description)
+		}
+		return pending, nil
+	}
+	if options.Backup {
+		backup, err := layout.backupMetadata(root, version)
+		if err != nil {
+			return nil, errors.New("Unable to back up the store before migrating it: " + err.Error())
+		}
+		logf("Backed up %s to %s", root, backup)
+	}
+	for _, migration := range pending {
+		logf("Migrating %s to version %d: %s", root, migration.Version, migration.Description)
+		if err := migration.Run(root); err != nil {
+			return nil, fmt.Errorf("Migration to version %d failed: %s", migration.Version, err)
+		}
+		if err := layout.setVersion(root, migration.Version); err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// backupMetadata copies the metadata of the store to a new directory, and
+// returns its path.
+func (layout *Layout) backupMetadata(root string, version int) (string, error) {
+	files, err := layout.Metadata(root)
+	if err != nil {
+		return "", err
+	}
+	backup := path.Join(root, fmt.Sprintf("%sv%d-%d", layout.Backups, version, time.Now().Unix()))
+	if err := os.Mkdir(backup, 0700); err != nil {
+		return "", err
+	}
+	for _, name := range files {
+		info, err := os.Stat(path.Join(root, name))
+		if err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadFile(path.Join(root, name))
+		if err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(path.Dir(path.Join(backup, name)), 0700); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(path.Join(backup, name), data, info.Mode()); err != nil {
+			return "", err
+		}
+	}
+	return backup, nil
+}
+
+// topFiles returns the regular files at the top of the store (the index,
+// its backup, the version marker...), except its locks.
+func topFiles(root string) ([]string, error) {
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if f.Mode().IsRegular() && !strings.HasSuffix(f.Name(), ".lock") {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+// Version 0 -> 1: the layout of version 0 is unchanged, but its index may
+// have been written in place by older versions of docker. Make sure it is
+// readable, and rewrite it atomically.
+func migrateIndexV1(root string) error {
+	index := NewIndex(path.Join(root, "index.json"))
+	if err := index.load(); err != nil {
+		return err
+	}
+	if index.loaded == nil {
+		// No index yet: nothing to do
+		return nil
+	}
+	return index.save()
+}
+
+// LogWriter sends migration messages to the standard logger
+type LogWriter struct{}
+
+func (LogWriter) Write(p []byte) (int, error) {
+	log.Print(string(p))
+	return len(p), nil
+}
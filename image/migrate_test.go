@@ -0,0 +1,67 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// A version 0 store, as written by older versions of docker
+	v0 := `{"Path":"/var/lib/docker/images/index.json","ByName":{},"ById":{}}`
+	if err := ioutil.WriteFile(path.Join(root, "index.json"), []byte(v0), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := Version(root); err != nil || version != 0 {
+		t.Fatalf("Expected version 0, got %d (%v)", version, err)
+	}
+	// Dry run: nothing should change
+	if pending, err := Migrate(root, MigrateOptions{DryRun: true}); err != nil {
+		t.Fatal(err)
+	} else if len(pending) != StoreVersion {
+		t.Fatalf("Expected %d pending migrations, got %d", StoreVersion, len(pending))
+	}
+	if version, _ := Version(root); version != 0 {
+		t.Fatalf("Dry run changed the store version to %d", version)
+	}
+	// For real
+	if _, err := Migrate(root, MigrateOptions{Backup: true}); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := Version(root); version != StoreVersion {
+		t.Fatalf("Expected version %d after migration, got %d", StoreVersion, version)
+	}
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backup string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "backup-v0-") {
+			backup = path.Join(root, f.Name())
+		}
+	}
+	if data, err := ioutil.ReadFile(path.Join(backup, "index.json")); err != nil {
+		t.Fatalf("No backup of the index: %s", err)
+	} else if string(data) != v0 {
+		t.Fatalf("Backup doesn't match the original index")
+	}
+	// Up-to-date stores are left alone
+	if applied, err := Migrate(root, MigrateOptions{Backup: true}); err != nil || len(applied) != 0 {
+		t.Fatalf("Expected no migration, got %v (%v)", applied, err)
+	}
+	// Stores from the future are refused
+	if err := setVersion(root, StoreVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(root); err == nil {
+		t.Fatalf("Opening a store with an unsupported version should fail")
+	}
+}
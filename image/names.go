@@ -0,0 +1,59 @@
+package image
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Image names are either a plain repository name ("base"), or a repository
+// within a namespace ("sendhub/base").
+var validNameComponent = regexp.MustCompile(`^[a-zA-Z0-9_.+-]+$`)
+
+// ValidateName returns an error if `name` is not a valid image name.
+func ValidateName(name string) error {
+	parts := strings.Split(name, "/")
+	if len(parts) > 2 {
+		return errors.New("Invalid image name " + name + ": only one level of namespace is allowed")
+	}
+	for _, part := range parts {
+		if !validNameComponent.MatchString(part) {
+			return errors.New("Invalid image name " + name + ": names may only contain letters, digits, '_', '.', '+' and '-', with an optional namespace prefix ('namespace/name')")
+		}
+	}
+	return nil
+}
+
+// SplitName splits an image name into its namespace (empty for top-level
+// names) and repository name.
+func SplitName(name string) (namespace, repository string) {
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		return name[:idx], name[idx+1:]
+	}
+	return "", name
+}
+
+// Namespaces returns the namespaces of all images in the index, sorted.
+// Top-level images belong to the empty namespace.
+func (index *Index) Namespaces() []string {
+	var namespaces []string
+	seen := make(map[string]bool)
+	for _, name := range index.Names() {
+		if namespace, _ := SplitName(name); !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// NamesIn returns the names of all images in `namespace`, sorted.
+func (index *Index) NamesIn(namespace string) []string {
+	var names []string
+	for _, name := range index.Names() {
+		if ns, _ := SplitName(name); ns == namespace {
+			names = append(names, name)
+		}
+	}
+	return names
+}
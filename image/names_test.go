@@ -0,0 +1,44 @@
+package image
+
+import (
+	"os"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"base", "docker-ut", "sendhub/base", "lost+found", "a_b.c"} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("%s should be valid: %s", name, err)
+		}
+	}
+	for _, name := range []string{"", "a/b/c", "/base", "sendhub/", "foo:bar", "with space", "http://example.com/foo.tar"} {
+		if err := ValidateName(name); err == nil {
+			t.Errorf("%s should be invalid", name)
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	index, tmp := newTestIndex(t)
+	defer os.RemoveAll(tmp)
+	for _, name := range []string{"base", "sendhub/base", "sendhub/app", "other/app"} {
+		img, err := NewImage(name, []string{"/layers/" + name}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := index.Add(name, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ns := index.Namespaces(); len(ns) != 3 || ns[0] != "" || ns[1] != "other" || ns[2] != "sendhub" {
+		t.Fatalf("Unexpected namespaces %v", ns)
+	}
+	if names := index.NamesIn("sendhub"); len(names) != 2 || names[0] != "sendhub/app" || names[1] != "sendhub/base" {
+		t.Fatalf("Unexpected names in sendhub: %v", names)
+	}
+	if img := index.Find("sendhub/base"); img == nil {
+		t.Fatalf("Unable to find sendhub/base")
+	} else if namespace, repo := SplitName("sendhub/base"); namespace != "sendhub" || repo != "base" {
+		t.Fatalf("Unexpected split: %s, %s", namespace, repo)
+	}
+}
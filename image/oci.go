@@ -0,0 +1,415 @@
+package image
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Import and export of images in the OCI image layout
+// (https://github.com/opencontainers/image-spec/blob/main/image-layout.md),
+// so that they can be exchanged with other container tools.
+
+const (
+	ociLayoutVersion     = "1.0.0"
+	OCIMediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	OCIMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	OCIMediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	OCIMediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+	OCIAnnotationRef     = "org.opencontainers.image.ref.name"
+	// The ID of a layer in the store which exported it
+	OCIAnnotationLayerId = "com.docker.layer.id"
+)
+
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+type OCIIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []OCIDescriptor `json:"manifests"`
+}
+
+type OCIManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        OCIDescriptor   `json:"config"`
+	Layers        []OCIDescriptor `json:"layers"`
+}
+
+type ociConfig struct {
+	Created      time.Time `json:"created"`
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Config       struct {
+		ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"` // As PORT/tcp
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIds []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// ExportOCI writes `image` to the directory `dir` in the OCI image layout.
+func (store *Store) ExportOCI(image *Image, dir string) error {
+	if err := os.MkdirAll(path.Join(dir, "blobs", "sha256"), 0700); err != nil {
+		return err
+	}
+	config := &ociConfig{
+		Created:      image.Created,
+		Architecture: "amd64",
+		OS:           "linux",
+	}
+	config.RootFS.Type = "layers"
+	if len(image.ExposedPorts) > 0 {
+		config.Config.ExposedPorts = make(map[string]struct{})
+		for _, port := range image.ExposedPorts {
+			config.Config.ExposedPorts[fmt.Sprintf("%d/tcp", port)] = struct{}{}
+		}
+	}
+	manifest := &OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     OCIMediaTypeManifest,
+	}
+	// OCI lists layers from the bottom up
+	for i := len(image.Layers) - 1; i >= 0; i-- {
+		archive, err := Tar(image.Layers[i], Uncompressed)
+		if err != nil {
+			return err
+		}
+		layer, err := writeBlob(dir, OCIMediaTypeLayer, archive)
+		if err != nil {
+			return err
+		}
+		layer.Annotations = map[string]string{OCIAnnotationLayerId: path.Base(image.Layers[i])}
+		manifest.Layers = append(manifest.Layers, *layer)
+		// Layers are not compressed: their diff ID is their digest
+		config.RootFS.DiffIds = append(config.RootFS.DiffIds, layer.Digest)
+	}
+	configDesc, err := writeJSONBlob(dir, OCIMediaTypeConfig, config)
+	if err != nil {
+		return err
+	}
+	manifest.Config = *configDesc
+	manifestDesc, err := writeJSONBlob(dir, OCIMediaTypeManifest, manifest)
+	if err != nil {
+		return err
+	}
+	name, _ := image.IdParts()
+	ref := name
+	if image.Tag != "" {
+		ref += ":" + image.Tag
+	}
+	manifestDesc.Annotations = map[string]string{OCIAnnotationRef: ref}
+	return WriteOCIIndex(dir, *manifestDesc)
+}
+
+// WriteOCIIndex marks `dir` as an OCI image layout containing `manifests`.
+func WriteOCIIndex(dir string, manifests ...OCIDescriptor) error {
+	if err := writeJSON(path.Join(dir, "index.json"), &OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     OCIMediaTypeIndex,
+		Manifests:     manifests,
+	}); err != nil {
+		return err
+	}
+	return writeJSON(path.Join(dir, "oci-layout"), &ociLayout{ociLayoutVersion})
+}
+
+// ReadOCIIndex returns the index of the OCI image layout in `dir`.
+func ReadOCIIndex(dir string) (*OCIIndex, error) {
+	layout := &ociLayout{}
+	if err := readJSON(path.Join(dir, "oci-layout"), layout); err != nil {
+		return nil, errors.New("Not an OCI image layout: " + err.Error())
+	}
+	if !strings.HasPrefix(layout.ImageLayoutVersion, "1.") {
+		return nil, errors.New("Unsupported OCI image layout version " + layout.ImageLayoutVersion)
+	}
+	index := &OCIIndex{}
+	if err := readJSON(path.Join(dir, "index.json"), index); err != nil {
+		return nil, err
+	}
+	if len(index.Manifests) == 0 {
+		return nil, errors.New("No image found in OCI image layout")
+	}
+	return index, nil
+}
+
+// ImportOCI creates a new image named `name` from the first manifest of the
+// OCI image layout in `dir`. The digest of every blob is verified. The blobs
+// of uncompressed layers which the store already has may be missing.
+func (store *Store) ImportOCI(name string, dir string) (*Image, error) {
+	index, err := ReadOCIIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	manifestDesc := index.Manifests[0]
+	manifest := &OCIManifest{}
+	if err := readJSONBlob(dir, manifestDesc, manifest); err != nil {
+		return nil, err
+	}
+	var layers []string
+	for _, desc := range manifest.Layers {
+		layer, err := store.importBlob(dir, desc)
+		if err != nil {
+			return nil, err
+		}
+		// Our layers are listed from the top down
+		layers = append([]string{layer}, layers...)
+	}
+	if len(layers) == 0 {
+		return nil, errors.New("The image has no layers")
+	}
+	image, err := NewImage(name, layers, "")
+	if err != nil {
+		return nil, err
+	}
+	if ref := manifestDesc.Annotations[OCIAnnotationRef]; ref != "" {
+		if idx := strings.LastIndex(ref, ":"); idx >= 0 && !strings.Contains(ref[idx:], "/") {
+			image.Tag = ref[idx+1:]
+		}
+	}
+	config := &ociConfig{}
+	if err := readJSONBlob(dir, manifest.Config, config); err == nil {
+		if !config.Created.IsZero() {
+			image.Created = config.Created
+		}
+		image.ExposedPorts = ociExposedPorts(config)
+	}
+	if err := store.Index.Add(name, image); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+func (store *Store) importBlob(dir string, desc OCIDescriptor) (string, error) {
+	// The blobs of the layers which the store already has may be left out
+	if p, err := OCIBlobPath(dir, desc.Digest); err == nil && desc.MediaType == OCIMediaTypeLayer {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			for _, id := range OCILayerIds(desc) {
+				if layer := store.Layers.Get(id); layer != "" {
+					return layer, nil
+				}
+			}
+		}
+	}
+	// Check the digest before extracting anything, so that a corrupt blob
+	// leaves no layer behind
+	if err := verifyBlob(dir, desc); err != nil {
+		return "", err
+	}
+	blob, _, err := openBlob(dir, desc)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+	var archive io.Reader = blob
+	if strings.HasSuffix(desc.MediaType, "+gzip") || strings.HasSuffix(desc.MediaType, ".gzip") {
+		gz, err := gzip.NewReader(blob)
+		if err != nil {
+			return "", err
+		}
+		archive = gz
+	}
+	return store.Layers.AddLayer(archive)
+}
+
+// verifyBlob reads the blob described by `desc` through, to check its
+// digest.
+func verifyBlob(dir string, desc OCIDescriptor) error {
+	blob, verifier, err := openBlob(dir, desc)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	if _, err := io.Copy(ioutil.Discard, blob); err != nil {
+		return err
+	}
+	return verifier()
+}
+
+// ReadOCILayers returns the layers of the first manifest of the OCI image
+// layout in `dir`, from the bottom up.
+func ReadOCILayers(dir string) ([]OCIDescriptor, error) {
+	index, err := ReadOCIIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &OCIManifest{}
+	if err := readJSONBlob(dir, index.Manifests[0], manifest); err != nil {
+		return nil, err
+	}
+	return manifest.Layers, nil
+}
+
+// OCILayerId returns the ID of the layer imported from the uncompressed
+// layer blob `desc`. Like the ID of any layer, it is derived from the digest
+// of its archive, so a store which has it doesn't need the blob.
+func OCILayerId(desc OCIDescriptor) string {
+	digest := strings.TrimPrefix(desc.Digest, "sha256:")
+	if len(digest) < 16 {
+		return ""
+	}
+	return digest[:16]
+}
+
+// OCILayerIds returns the IDs which the layer of blob `desc` may have in a
+// store: the ID it had in the store which exported it, eg. the digest of the
+// archive it was pulled or committed from, then OCILayerId.
+func OCILayerIds(desc OCIDescriptor) []string {
+	var ids []string
+	if id := desc.Annotations[OCIAnnotationLayerId]; id != "" && path.Base(id) == id && !strings.HasPrefix(id, ".") {
+		ids = append(ids, id)
+	}
+	if id := OCILayerId(desc); id != "" {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// OCIBlobPath returns the location of the blob with digest `digest` in the
+// OCI image layout in `dir`.
+func OCIBlobPath(dir string, digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || strings.ContainsAny(parts[1], "/.") {
+		return "", errors.New("Unsupported digest " + digest)
+	}
+	return path.Join(dir, "blobs", parts[0], parts[1]), nil
+}
+
+type digestReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *digestReader) Close() error {
+	return r.file.Close()
+}
+
+// openBlob opens the blob described by `desc`. The returned function must be
+// called once the blob has been read entirely, to check its digest.
+func openBlob(dir string, desc OCIDescriptor) (io.ReadCloser, func() error, error) {
+	p, err := OCIBlobPath(dir, desc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := sha256.New()
+	verifier := func() error {
+		if digest := digestOf(h); digest != desc.Digest {
+			return fmt.Errorf("Digest mismatch for blob %s: got %s", desc.Digest, digest)
+		}
+		return nil
+	}
+	return &digestReader{io.TeeReader(f, h), f}, verifier, nil
+}
+
+func digestOf(h hash.Hash) string {
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
+
+func writeBlob(dir, mediaType string, content io.Reader) (*OCIDescriptor, error) {
+	tmp, err := ioutil.TempFile(path.Join(dir, "blobs"), "tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), content)
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+	desc := &OCIDescriptor{
+		MediaType: mediaType,
+		Digest:    digestOf(h),
+		Size:      size,
+	}
+	p, err := OCIBlobPath(dir, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+func writeJSONBlob(dir, mediaType string, obj interface{}) (*OCIDescriptor, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return writeBlob(dir, mediaType, strings.NewReader(string(data)))
+}
+
+func readJSONBlob(dir string, desc OCIDescriptor, obj interface{}) error {
+	blob, verifier, err := openBlob(dir, desc)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return err
+	}
+	if err := verifier(); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, obj)
+}
+
+func writeJSON(filename string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+func readJSON(filename string, obj interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, obj)
+}
+
+// ociExposedPorts returns the TCP ports exposed by an OCI image
+// configuration, sorted. Other protocols aren't supported.
+func ociExposedPorts(config *ociConfig) []int {
+	var ports []int
+	for spec := range config.Config.ExposedPorts {
+		parts := strings.SplitN(spec, "/", 2)
+		if len(parts) == 2 && parts[1] != "tcp" {
+			continue
+		}
+		if port, err := strconv.Atoi(parts[0]); err == nil && port > 0 && port < 65536 {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
@@ -0,0 +1,200 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestOCIRoundTrip(t *testing.T) {
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	base := importFake(t, store, "base", nil)
+	app := createFake(t, store, "sendhub/app", base)
+	app.ExposedPorts = []int{443, 80}
+	layout, err := ioutil.TempDir("", "docker-test-oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(layout)
+	if err := store.ExportOCI(app, layout); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"oci-layout", "index.json", "blobs/sha256"} {
+		if _, err := os.Stat(path.Join(layout, name)); err != nil {
+			t.Fatalf("Missing %s in layout: %s", name, err)
+		}
+	}
+	other, otherTmp := newTestStore(t)
+	defer os.RemoveAll(otherTmp)
+	img, err := other.ImportOCI("imported", layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Layers) != 2 {
+		t.Fatalf("Expected 2 layers, got %d", len(img.Layers))
+	}
+	if !img.Created.Equal(app.Created) {
+		t.Errorf("Creation date wasn't preserved: %v != %v", img.Created, app.Created)
+	}
+	if len(img.ExposedPorts) != 2 || img.ExposedPorts[0] != 80 || img.ExposedPorts[1] != 443 {
+		t.Errorf("Exposed ports weren't preserved: %v", img.ExposedPorts)
+	}
+	// The base layer must have kept its content
+	if _, err := os.Stat(path.Join(img.Layers[1], "etc/passwd")); err != nil {
+		t.Errorf("Base layer content is missing: %s", err)
+	}
+	if other.Find("imported") == nil {
+		t.Fatalf("Imported image is not in the index")
+	}
+}
+
+func TestOCIDigestMismatch(t *testing.T) {
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	base := importFake(t, store, "base", nil)
+	layout, err := ioutil.TempDir("", "docker-test-oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(layout)
+	if err := store.ExportOCI(base, layout); err != nil {
+		t.Fatal(err)
+	}
+	// Tamper with the layer
+	index := &OCIIndex{}
+	if err := readJSON(path.Join(layout, "index.json"), index); err != nil {
+		t.Fatal(err)
+	}
+	manifest := &OCIManifest{}
+	if err := readJSONBlob(layout, index.Manifests[0], manifest); err != nil {
+		t.Fatal(err)
+	}
+	p, err := OCIBlobPath(layout, manifest.Layers[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 1024))
+	f.Close()
+	other, otherTmp := newTestStore(t)
+	defer os.RemoveAll(otherTmp)
+	if _, err := other.ImportOCI("tampered", layout); err == nil {
+		t.Fatalf("Importing a tampered layer should fail")
+	}
+	if layers := other.Layers.List(); len(layers) != 0 {
+		t.Fatalf("A tampered layer was extracted: %v", layers)
+	}
+}
+
+func TestOCIMissingLayers(t *testing.T) {
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	base := importFake(t, store, "base", nil)
+	app := createFake(t, store, "sendhub/app", base)
+	other, otherTmp := newTestStore(t)
+	defer os.RemoveAll(otherTmp)
+	export := func() string {
+		layout, err := ioutil.TempDir("", "docker-test-oci")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.ExportOCI(app, layout); err != nil {
+			os.RemoveAll(layout)
+			t.Fatal(err)
+		}
+		return layout
+	}
+	layout := export()
+	defer os.RemoveAll(layout)
+	if _, err := other.ImportOCI("imported", layout); err != nil {
+		t.Fatal(err)
+	}
+	// Send the image again, without the layers the other store has
+	layout = export()
+	defer os.RemoveAll(layout)
+	layers, err := ReadOCILayers(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 {
+		t.Fatalf("Expected 2 layers, got %d", len(layers))
+	}
+	for _, layer := range layers {
+		if !other.Layers.Exists(OCILayerId(layer)) {
+			t.Fatalf("Layer %s should be in the other store", OCILayerId(layer))
+		}
+		p, err := OCIBlobPath(layout, layer.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	img, err := other.ImportOCI("imported", layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(img.Layers[1], "etc/passwd")); err != nil {
+		t.Errorf("Base layer content is missing: %s", err)
+	}
+	// A store without the layers still needs the blobs
+	third, thirdTmp := newTestStore(t)
+	defer os.RemoveAll(thirdTmp)
+	if _, err := third.ImportOCI("imported", layout); err == nil {
+		t.Fatal("Importing a layout with missing blobs should fail")
+	}
+}
+
+func TestOCILayerIds(t *testing.T) {
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	base := importFake(t, store, "base", nil)
+	app := createFake(t, store, "sendhub/app", base)
+	layout, err := ioutil.TempDir("", "docker-test-oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(layout)
+	if err := store.ExportOCI(app, layout); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := ReadOCILayers(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// From the bottom up, the stored ID first
+	for i, layer := range layers {
+		ids := OCILayerIds(layer)
+		if expected := path.Base(app.Layers[len(app.Layers)-1-i]); len(ids) != 2 || ids[0] != expected || ids[1] != OCILayerId(layer) {
+			t.Fatalf("Expected the IDs of layer %d to be [%s %s], got %v", i, expected, OCILayerId(layer), ids)
+		}
+	}
+	// A store which imported the same archive has the base layer under its
+	// stored ID, but not under the ID of its export: it doesn't need its blob
+	other, otherTmp := newTestStore(t)
+	defer os.RemoveAll(otherTmp)
+	importFake(t, other, "base", nil)
+	if other.Layers.Exists(OCILayerId(layers[0])) {
+		t.Fatalf("The export of the base layer should have another ID")
+	}
+	p, err := OCIBlobPath(layout, layers[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	img, err := other.ImportOCI("imported", layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Layers[1] != other.Layers.Get(path.Base(base.Layers[0])) {
+		t.Fatalf("Expected the base layer to be %s, got %s", other.Layers.Get(path.Base(base.Layers[0])), img.Layers[1])
+	}
+}
@@ -0,0 +1,62 @@
+package image
+
+// Dangling returns the images which nothing refers to anymore: they are
+// neither the latest version of their name, nor the parent of another image,
+// nor used by a container. Images recovered as LostAndFound are always
+// considered dangling unless something refers to them.
+func (index *Index) Dangling() []*Image {
+	if err := index.rload(); err != nil {
+		return nil
+	}
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	return index.dangling()
+}
+
+func (index *Index) dangling() []*Image {
+	referenced := make(map[string]bool)
+	for name, history := range index.ByName {
+		if name != LostAndFound && history.Len() > 0 {
+			referenced[(*history)[0].Id] = true
+		}
+	}
+	for _, image := range index.ById {
+		if image.Parent != "" {
+			referenced[image.Parent] = true
+		}
+	}
+	var dangling []*Image
+	for _, id := range index.ids() {
+		if referenced[id] {
+			continue
+		}
+		if index.InUse != nil && len(index.InUse(id)) > 0 {
+			continue
+		}
+		dangling = append(dangling, index.ById[id])
+	}
+	return dangling
+}
+
+// Prune removes all dangling images from the index, and returns them.
+// Removing an image can make its parent dangling in turn, so this is
+// repeated until there is nothing left to remove.
+func (index *Index) Prune() ([]*Image, error) {
+	var pruned []*Image
+	err := index.transaction(func() error {
+		for {
+			dangling := index.dangling()
+			if len(dangling) == 0 {
+				return nil
+			}
+			for _, image := range dangling {
+				index.remove(image.Id)
+			}
+			pruned = append(pruned, dangling...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
@@ -0,0 +1,47 @@
+package image
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPrune(t *testing.T) {
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	// An old version of app, on top of an old version of base
+	oldBase := createFake(t, store, "base", nil)
+	oldApp := createFake(t, store, "app", oldBase)
+	// The current version of base, and 2 versions of app on top of it.
+	// The older one is still used by a container.
+	base := createFake(t, store, "base", nil)
+	inUse := createFake(t, store, "app", base)
+	app := createFake(t, store, "app", base)
+	store.InUse = func(id string) []string {
+		if id == inUse.Id {
+			return []string{"c1"}
+		}
+		return nil
+	}
+	dangling := store.Dangling()
+	if len(dangling) != 1 || dangling[0].Id != oldApp.Id {
+		t.Fatalf("Expected only %s to be dangling, got %v", oldApp.Id, dangling)
+	}
+	pruned, err := store.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pruning oldApp makes oldBase dangling
+	if len(pruned) != 2 {
+		t.Fatalf("Expected 2 images to be pruned, got %v", pruned)
+	}
+	for _, img := range []*Image{base, app, inUse} {
+		if store.Find(img.Id) == nil {
+			t.Errorf("%s shouldn't have been pruned", img.Id)
+		}
+	}
+	for _, img := range []*Image{oldApp, oldBase} {
+		if store.Find(img.Id) != nil {
+			t.Errorf("%s should have been pruned", img.Id)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dotcloud/docker/future"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// The name under which recovered layers are registered
+const LostAndFound = "lost+found"
+
+func (index *Index) backupPath() string {
+	return index.Path + ".bak"
+}
+
+// backup replaces the backup of the index with its current version on disk.
+// A hard link is used so that the backup is itself updated atomically.
+func (index *Index) backup() error {
+	bak := index.backupPath()
+	tmp := bak + ".tmp"
+	os.Remove(tmp)
+	if err := os.Link(index.Path, tmp); err != nil {
+		if os.IsNotExist(err) {
+			// Nothing to back up yet
+			return nil
+		}
+		return err
+	}
+	return os.Rename(tmp, bak)
+}
+
+// restoreBackup replaces a corrupted index with its most recent backup.
+func (index *Index) restoreBackup() error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	lock, err := future.Flock(index.lockPath(), true)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	jsonData, err := ioutil.ReadFile(index.backupPath())
+	if err != nil {
+		return err
+	}
+	// Make sure the backup is usable before overwriting anything
+	if err := json.Unmarshal(jsonData, NewIndex(index.Path)); err != nil {
+		return errors.New("Backup is corrupted: " + err.Error())
+	}
+	if err := WriteFileAtomic(index.Path, jsonData, 0600); err != nil {
+		return err
+	}
+	return index.load()
+}
+
+// recover makes sure the index of the store can be loaded. If it can't, the
+// most recent backup is restored instead, and layers which are not referenced
+// by the restored index are registered under LostAndFound so that they can be
+// inspected, renamed or deleted.
+func (store *Store) recover() error {
+	err := store.Index.rload()
+	if err == nil {
+		return nil
+	}
+	log.Printf("Unable to load image index %s: %s", store.Index.Path, err)
+	if err := store.Index.restoreBackup(); err != nil {
+		log.Printf("Unable to restore image index from backup: %s", err)
+		// Start over from an empty index: everything will be rebuilt below.
+		if err := os.Rename(store.Index.Path, store.Index.Path+".corrupted"); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Restored image index from %s", store.Index.backupPath())
+	}
+	recovered, err := store.rebuild()
+	if err != nil {
+		return err
+	}
+	if len(recovered) > 0 {
+		log.Printf("Recovered %d unreferenced layer(s) as '%s'", len(recovered), LostAndFound)
+	}
+	return nil
+}
+
+// rebuild registers every layer of the store that isn't referenced by any
+// image as a new image named LostAndFound, and returns the new images.
+func (store *Store) rebuild() ([]*Image, error) {
+	var recovered []*Image
+	err := store.Index.transaction(func() error {
+		referenced := make(map[string]bool)
+		for _, img := range store.Index.ById {
+			for _, layer := range img.Layers {
+				referenced[layer] = true
+			}
+		}
+		for _, layer := range store.Layers.List() {
+			if referenced[layer] || strings.HasPrefix(path.Base(layer), "tmp-") {
+				continue
+			}
+			img, err := NewImage(LostAndFound, []string{layer}, "")
+			if err != nil {
+				return err
+			}
+			store.Index.add(LostAndFound, img)
+			recovered = append(recovered, img)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recovered, nil
+}
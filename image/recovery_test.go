@@ -0,0 +1,102 @@
+package image
+
+import (
+	"github.com/dotcloud/docker/fake"
+	"github.com/dotcloud/docker/future"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestStore(t *testing.T) (*Store, string) {
+	tmp, err := ioutil.TempDir("", "docker-test-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := New(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		t.Fatal(err)
+	}
+	return store, tmp
+}
+
+func importFake(t *testing.T, store *Store, name string, parent *Image) *Image {
+	archive, err := fake.FakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := store.Import(name, archive, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// createFake registers a new image with an empty top layer on top of `parent`
+func createFake(t *testing.T, store *Store, name string, parent *Image) *Image {
+	layer := path.Join(store.Layers.Root, future.RandomId())
+	if err := os.Mkdir(layer, 0700); err != nil {
+		t.Fatal(err)
+	}
+	layers := []string{layer}
+	if parent != nil {
+		layers = append(layers, parent.Layers...)
+	}
+	var parentId string
+	if parent != nil {
+		parentId = parent.Id
+	}
+	img, err := store.Create(name, parentId, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestRecoverFromBackup(t *testing.T) {
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	foo := importFake(t, store, "foo", nil)
+	bar := createFake(t, store, "bar", foo)
+	// Corrupt the index: the backup only knows about foo
+	if err := ioutil.WriteFile(store.Index.Path, []byte("{\"ByName\": {"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := New(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img := store.Find("foo"); img == nil || img.Id != foo.Id {
+		t.Fatalf("Expected foo to be restored from backup, got %v", img)
+	}
+	if img := store.Find("bar"); img != nil {
+		t.Fatalf("bar shouldn't be in the backup")
+	}
+	// bar's top layer is not referenced anymore: it should have been recovered
+	lost := store.Find(LostAndFound)
+	if lost == nil {
+		t.Fatalf("No image was recovered")
+	}
+	if lost.Layers[0] != bar.Layers[0] {
+		t.Fatalf("Expected %s to be recovered, got %s", bar.Layers[0], lost.Layers[0])
+	}
+}
+
+func TestRecoverWithoutBackup(t *testing.T) {
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	foo := importFake(t, store, "foo", nil)
+	os.Remove(store.Index.backupPath())
+	if err := ioutil.WriteFile(store.Index.Path, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := New(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img := store.Find(LostAndFound); img == nil || img.Layers[0] != foo.Layers[0] {
+		t.Fatalf("Expected %s to be recovered, got %v", foo.Layers[0], img)
+	}
+}
@@ -0,0 +1,138 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+)
+
+// Images are signed with detached GPG signatures over a JSON payload
+// describing their content: the digests of their layers, and their parent.
+
+type signedPayload struct {
+	Name   string
+	Layers []string // Layer digests, top layer first
+	Parent string
+}
+
+// Payload returns the data covered by the signature of `image`.
+func (image *Image) Payload() ([]byte, error) {
+	name, _ := image.IdParts()
+	payload := &signedPayload{
+		Name:   name,
+		Parent: image.Parent,
+	}
+	for _, layer := range image.Layers {
+		payload.Layers = append(payload.Layers, path.Base(layer))
+	}
+	return json.Marshal(payload)
+}
+
+func (store *Store) signaturePath(image *Image) string {
+	return path.Join(store.Root, "signatures", url.QueryEscape(image.Id)+".asc")
+}
+
+// Signed returns true if a signature is stored for `image`.
+func (store *Store) Signed(image *Image) bool {
+	_, err := os.Stat(store.signaturePath(image))
+	return err == nil
+}
+
+// Sign signs `image` with the GPG key `keyId` (or the default key if empty),
+// and stores the signature alongside the image.
+func (store *Store) Sign(image *Image, keyId string) error {
+	payload, err := image.Payload()
+	if err != nil {
+		return err
+	}
+	args := []string{"--batch", "--armor", "--detach-sign"}
+	if keyId != "" {
+		args = append(args, "--local-user", keyId)
+	}
+	cmd := exec.Command("gpg", args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	signature, err := cmd.Output()
+	if err != nil {
+		return errors.New("gpg: " + err.Error() + ": " + stderr.String())
+	}
+	return store.saveSignature(image, signature)
+}
+
+// AddSignature verifies `signature` against `image`, and stores it if it
+// is valid.
+func (store *Store) AddSignature(image *Image, signature io.Reader) error {
+	data, err := ioutil.ReadAll(signature)
+	if err != nil {
+		return err
+	}
+	if err := verify(image, data); err != nil {
+		return err
+	}
+	return store.saveSignature(image, data)
+}
+
+// A SignatureError reports a signature which doesn't match its image, as
+// opposed to one which couldn't be checked.
+type SignatureError struct {
+	Id     string // The ID of the image
+	Output string // What gpg says about it
+}
+
+func (err *SignatureError) Error() string {
+	return "Invalid signature for " + err.Id + ": " + err.Output
+}
+
+// Verify checks the stored signature of `image`.
+func (store *Store) Verify(image *Image) error {
+	signature, err := ioutil.ReadFile(store.signaturePath(image))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("Image " + image.Id + " is not signed")
+		}
+		return err
+	}
+	return verify(image, signature)
+}
+
+func (store *Store) saveSignature(image *Image, signature []byte) error {
+	if err := os.MkdirAll(path.Dir(store.signaturePath(image)), 0700); err != nil {
+		return err
+	}
+	return WriteFileAtomic(store.signaturePath(image), signature, 0600)
+}
+
+func verify(image *Image, signature []byte) error {
+	payload, err := image.Payload()
+	if err != nil {
+		return err
+	}
+	// gpg wants the detached signature in a file, the data can be read
+	// from stdin.
+	sigFile, err := ioutil.TempFile("", "docker-signature")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sigFile.Name())
+	if _, err := sigFile.Write(signature); err != nil {
+		sigFile.Close()
+		return err
+	}
+	sigFile.Close()
+	cmd := exec.Command("gpg", "--batch", "--verify", sigFile.Name(), "-")
+	cmd.Stdin = bytes.NewReader(payload)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return &SignatureError{Id: image.Id, Output: string(output)}
+		}
+		return errors.New("gpg: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package image
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// setupGPG creates a throw-away keyring with a default key, and points gpg
+// to it. It returns a function restoring the environment.
+func setupGPG(t *testing.T) func() {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not available")
+	}
+	home, err := ioutil.TempDir("", "docker-test-gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHome := os.Getenv("GNUPGHOME")
+	os.Setenv("GNUPGHOME", home)
+	restore := func() {
+		os.Setenv("GNUPGHOME", oldHome)
+		os.RemoveAll(home)
+	}
+	cmd := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key", "docker-test@example.com", "default", "default", "never")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		restore()
+		t.Skipf("Unable to generate a gpg key: %s: %s", err, output)
+	}
+	return restore
+}
+
+func TestSignVerify(t *testing.T) {
+	defer setupGPG(t)()
+	store, tmp := newTestStore(t)
+	defer os.RemoveAll(tmp)
+	foo := createFake(t, store, "foo", nil)
+	bar := createFake(t, store, "bar", foo)
+	if store.Signed(foo) {
+		t.Fatalf("foo shouldn't be signed yet")
+	}
+	if err := store.Verify(foo); err == nil {
+		t.Fatalf("Verifying an unsigned image should fail")
+	}
+	if err := store.Sign(foo, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Verify(foo); err != nil {
+		t.Fatal(err)
+	}
+	// A signature for one image is not valid for another
+	signature, err := ioutil.ReadFile(store.signaturePath(foo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddSignature(bar, bytes.NewReader(signature)); err == nil {
+		t.Fatalf("foo's signature shouldn't be accepted for bar")
+	} else if _, ok := err.(*SignatureError); !ok {
+		t.Fatalf("Expected a SignatureError, got %v", err)
+	}
+	if store.Signed(bar) {
+		t.Fatalf("An invalid signature was stored")
+	}
+}
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"strings"
 	"text/template"
 )
 
@@ -11,19 +12,33 @@ lxc.utsname = {{.Config.Hostname}}
 {{else}}
 lxc.utsname = {{.Id}}
 {{end}}
-#lxc.aa_profile = unconfined
+{{if .Config.AppArmorProfile}}
+lxc.aa_profile = {{.Config.AppArmorProfile}}
+{{else if .Config.Privileged}}
+lxc.aa_profile = unconfined
+{{end}}
+{{if .Config.SELinuxLabel}}
+lxc.se_context = {{.Config.SELinuxLabel}}
+{{end}}
 
 # network configuration
 lxc.network.type = veth
 lxc.network.flags = up
-lxc.network.link = lxcbr0
+lxc.network.link = {{.NetworkSettings.Bridge}}
 lxc.network.name = eth0
 lxc.network.mtu = 1500
+lxc.network.veth.pair = {{.NetworkSettings.HostInterface}}
+{{if .Config.MacAddress}}
+lxc.network.hwaddr = {{.Config.MacAddress}}
+{{end}}
 lxc.network.ipv4 = {{.NetworkSettings.IpAddress}}/{{.NetworkSettings.IpPrefixLen}}
 
 # root filesystem
 {{$ROOTFS := .Filesystem.RootFS}}
 lxc.rootfs = {{$ROOTFS}}
+{{if .Config.ReadOnly}}
+lxc.rootfs.options = ro
+{{end}}
 
 # use a dedicated pts for the container (and limit the number of pseudo terminal
 # available)
@@ -35,6 +50,10 @@ lxc.console = none
 # no controlling tty at all
 lxc.tty = 1
 
+{{if .Config.Privileged}}
+# access to all devices
+lxc.cgroup.devices.allow = a
+{{else}}
 # no implicit access to devices
 lxc.cgroup.devices.deny = a
 
@@ -64,7 +83,13 @@ lxc.cgroup.devices.allow = c 10:200 rwm
 
 # rtc
 #lxc.cgroup.devices.allow = c 254:0 rwm
+{{end}}
 
+# host devices
+{{range .Config.Devices}}
+lxc.cgroup.devices.allow = {{.CgroupRule}}
+lxc.mount.entry = {{.PathOnHost}} {{$ROOTFS}}{{.PathInContainer}} none bind 0 0
+{{end}}
 
 # standard mount point
 lxc.mount.entry = proc {{$ROOTFS}}/proc proc nosuid,nodev,noexec 0 0
@@ -72,29 +97,66 @@ lxc.mount.entry = sysfs {{$ROOTFS}}/sys sysfs nosuid,nodev,noexec 0 0
 lxc.mount.entry = devpts {{$ROOTFS}}/dev/pts devpts newinstance,ptmxmode=0666,nosuid,noexec 0 0
 #lxc.mount.entry = varrun {{$ROOTFS}}/var/run tmpfs mode=755,size=4096k,nosuid,nodev,noexec 0 0
 #lxc.mount.entry = varlock {{$ROOTFS}}/var/lock tmpfs size=1024k,nosuid,nodev,noexec 0 0
-#lxc.mount.entry = shm {{$ROOTFS}}/dev/shm tmpfs size=65536k,nosuid,nodev,noexec 0 0
+lxc.mount.entry = shm {{$ROOTFS}}/dev/shm tmpfs {{.Config.ShmOptions}} 0 0
+
+# tmpfs mounts
+{{range .Config.TmpfsMounts}}
+lxc.mount.entry = tmpfs {{$ROOTFS}}{{.Path}} tmpfs {{.Options}} 0 0
+{{end}}
+
+# volumes
+{{range .Config.Volumes}}
+lxc.mount.entry = {{.PathOnHost}} {{$ROOTFS}}{{.PathInContainer}} none {{.MountOptions}} 0 0
+{{end}}
 
 # Inject docker-init
 lxc.mount.entry = {{.SysInitPath}} {{$ROOTFS}}/sbin/init none bind,ro 0 0
 
-# In order to get a working DNS environment, mount bind (ro) the host's /etc/resolv.conf into the container
-lxc.mount.entry = /etc/resolv.conf {{$ROOTFS}}/etc/resolv.conf none bind,ro 0 0
+# In order to get a working DNS environment, mount bind (ro) the resolv.conf generated from the host's /etc/resolv.conf into the container
+lxc.mount.entry = {{.ResolvConfPath}} {{$ROOTFS}}/etc/resolv.conf none bind,ro 0 0
+
+# The running containers, by ID, hostname and network alias
+lxc.mount.entry = {{.HostsPath}} {{$ROOTFS}}/etc/hosts none bind,ro 0 0
+lxc.mount.entry = {{.HostnamePath}} {{$ROOTFS}}/etc/hostname none bind,ro 0 0
 
 
 # drop linux capabilities (apply mainly to the user root in the container)
-lxc.cap.drop = audit_control audit_write mac_admin mac_override mknod net_raw setfcap setpcap sys_admin sys_boot sys_module sys_nice sys_pacct sys_rawio sys_resource sys_time sys_tty_config
+{{with .Config.DroppedCapabilities}}
+lxc.cap.drop = {{join . " "}}
+{{end}}
 
 # limits
 {{if .Config.Ram}}
 lxc.cgroup.memory.limit_in_bytes = {{.Config.Ram}}
 {{end}}
+{{range .Config.Ulimits}}
+lxc.prlimit.{{.Name}} = {{.Limits}}
+{{end}}
+{{if .Config.OomKillDisable}}
+lxc.cgroup.memory.oom_control = 1
+{{end}}
+{{if .Config.OomScoreAdj}}
+lxc.proc.oom_score_adj = {{.Config.OomScoreAdj}}
+{{end}}
+{{if .Config.PidsLimit}}
+lxc.cgroup.pids.max = {{.Config.PidsLimit}}
+{{end}}
+{{if .Config.BlkioWeight}}
+lxc.cgroup.blkio.weight = {{.Config.BlkioWeight}}
+{{end}}
+{{range .Config.BlkioThrottles}}
+lxc.cgroup.blkio.throttle.{{.Kind}}_device = {{.CgroupRule}}
+{{end}}
+{{if .Config.CpuShares}}
+lxc.cgroup.cpu.shares = {{.Config.CpuShares}}
+{{end}}
 `
 
 var LxcTemplateCompiled *template.Template
 
 func init() {
 	var err error
-	LxcTemplateCompiled, err = template.New("lxc").Parse(LxcTemplate)
+	LxcTemplateCompiled, err = template.New("lxc").Funcs(template.FuncMap{"join": strings.Join}).Parse(LxcTemplate)
 	if err != nil {
 		panic(err)
 	}
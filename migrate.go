@@ -0,0 +1,130 @@
+package docker
+
+import (
+	"encoding/json"
+	"github.com/dotcloud/docker/image"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// The layout of the containers directory. Its version marker and backups
+// start with a dot, which container IDs can't, so that they aren't taken
+// for containers.
+var containersLayout = &image.Layout{
+	Current: 1,
+	Migrations: []*image.Migration{
+		{Version: 1, Description: "Turn the userdata of the containers into labels", Run: migrateUserDataV1},
+	},
+	Marker:  ".VERSION",
+	Backups: ".backup-",
+	IsNew: func(root string) bool {
+		ids, err := containerIds(root)
+		return err == nil && len(ids) == 0
+	},
+	Metadata: func(root string) ([]string, error) {
+		ids, err := containerIds(root)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, id := range ids {
+			for _, name := range []string{"config.json", "userdata.json"} {
+				if _, err := os.Stat(path.Join(root, id, name)); err == nil {
+					files = append(files, path.Join(id, name))
+				}
+			}
+		}
+		return files, nil
+	},
+}
+
+// MigrateContainers upgrades the containers directory `repository` to the
+// current version of its layout, see image.Migrate. No daemon may be using
+// it meanwhile.
+func MigrateContainers(repository string, options image.MigrateOptions) ([]*image.Migration, error) {
+	return containersLayout.Migrate(repository, options)
+}
+
+// containerIds returns the IDs of the containers stored in `repository`.
+func containerIds(repository string) ([]string, error) {
+	dir, err := ioutil.ReadDir(repository)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, v := range dir {
+		if v.IsDir() && !strings.HasPrefix(v.Name(), ".") {
+			ids = append(ids, v.Name())
+		}
+	}
+	return ids, nil
+}
+
+// Version 0 -> 1: older versions of docker recorded the image and the
+// comment of the containers in their userdata.json, instead of the labels
+// of their config.
+func migrateUserDataV1(repository string) error {
+	ids, err := containerIds(repository)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := migrateUserData(path.Join(repository, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateUserData turns the userdata of the container at `root` into labels,
+// unless it already has labels. The fields of its config unknown to this
+// version are kept.
+func migrateUserData(root string) error {
+	configPath := path.Join(root, "config.json")
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Not a container
+			return nil
+		}
+		return err
+	}
+	var container map[string]json.RawMessage
+	if err := json.Unmarshal(data, &container); err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if raw, exists := container["Config"]; exists {
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return err
+		}
+	}
+	if config == nil {
+		config = make(map[string]interface{})
+	}
+	if config["Labels"] != nil {
+		return nil
+	}
+	labels := make(map[string]string)
+	if data, err := ioutil.ReadFile(path.Join(root, "userdata.json")); err == nil {
+		if err := json.Unmarshal(data, &labels); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if img, _ := config["Image"].(string); img == "" && labels["image"] != "" {
+		config["Image"] = labels["image"]
+	}
+	delete(labels, "image")
+	config["Labels"] = labels
+	if container["Config"], err = json.Marshal(config); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(container); err != nil {
+		return err
+	}
+	return image.WriteFileAtomic(configPath, data, 0600)
+}
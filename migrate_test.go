@@ -0,0 +1,106 @@
+package docker
+
+import (
+	"encoding/json"
+	"github.com/dotcloud/docker/image"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMigrateContainers(t *testing.T) {
+	repository, err := ioutil.TempDir("", "docker-test-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repository)
+	// A container created by an older version of docker
+	v0 := `{"Id":"abc","Path":"ls","Config":{"Hostname":"abc","Image":""},"Legacy":true}`
+	if err := os.Mkdir(path.Join(repository, "abc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(repository, "abc", "config.json"), []byte(v0), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(repository, "abc", "userdata.json"), []byte(`{"comment": "hello", "image": "base:1234"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Dry run: nothing should change
+	if pending, err := MigrateContainers(repository, image.MigrateOptions{DryRun: true}); err != nil {
+		t.Fatal(err)
+	} else if len(pending) != 1 {
+		t.Fatalf("Expected 1 pending migration, got %d", len(pending))
+	}
+	if data, _ := ioutil.ReadFile(path.Join(repository, "abc", "config.json")); string(data) != v0 {
+		t.Fatalf("Dry run changed the config: %s", data)
+	}
+	// For real
+	if _, err := MigrateContainers(repository, image.MigrateOptions{Backup: true}); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := containersLayout.StoredVersion(repository); version != 1 {
+		t.Fatalf("Expected version 1 after migration, got %d", version)
+	}
+	data, err := ioutil.ReadFile(path.Join(repository, "abc", "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var migrated struct {
+		Legacy bool
+		Config Config
+	}
+	if err := json.Unmarshal(data, &migrated); err != nil {
+		t.Fatal(err)
+	}
+	if migrated.Config.Labels["comment"] != "hello" || migrated.Config.Image != "base:1234" || migrated.Config.Hostname != "abc" {
+		t.Fatalf("Userdata wasn't migrated: %s", data)
+	}
+	if _, exists := migrated.Config.Labels["image"]; exists {
+		t.Fatalf("The image shouldn't be a label: %s", data)
+	}
+	if !migrated.Legacy {
+		t.Fatalf("Unknown fields should be kept: %s", data)
+	}
+	// The version marker and the backup aren't containers
+	if ids, err := containerIds(repository); err != nil || len(ids) != 1 || ids[0] != "abc" {
+		t.Fatalf("Expected only container abc, got %v (%v)", ids, err)
+	}
+	files, err := ioutil.ReadDir(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backup string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".backup-v0-") {
+			backup = path.Join(repository, f.Name())
+		}
+	}
+	if data, err := ioutil.ReadFile(path.Join(backup, "abc", "config.json")); err != nil {
+		t.Fatalf("No backup of the config: %s", err)
+	} else if string(data) != v0 {
+		t.Fatalf("Backup doesn't match the original config")
+	}
+	// Up-to-date directories are left alone
+	if applied, err := MigrateContainers(repository, image.MigrateOptions{Backup: true}); err != nil || len(applied) != 0 {
+		t.Fatalf("Expected no migration, got %v (%v)", applied, err)
+	}
+}
+
+func TestMigrateNoContainers(t *testing.T) {
+	repository, err := ioutil.TempDir("", "docker-test-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repository)
+	if applied, err := MigrateContainers(repository, image.MigrateOptions{Backup: true}); err != nil || len(applied) != 0 {
+		t.Fatalf("Expected no migration, got %v (%v)", applied, err)
+	}
+	if version, _ := containersLayout.StoredVersion(repository); version != 1 {
+		t.Fatalf("Expected a new directory to get version 1, got %d", version)
+	}
+	if files, _ := ioutil.ReadDir(repository); len(files) != 1 {
+		t.Fatalf("Expected only the version marker, got %d files", len(files))
+	}
+}
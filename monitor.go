@@ -0,0 +1,152 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The process of a container runs under a monitor: the binary of the daemon
+// run with MonitorArg, in a process of its own. The monitor is a child
+// subreaper, so the processes orphaned in the container and by lxc-start are
+// reparented to it rather than to init, and it reaps them. It records the
+// exit status of the container as soon as it exits, even if the daemon is
+// busy or gone, then kills the processes left behind and exits with that
+// status. The daemon kills the monitor to kill the container: lxc-start dies
+// with it.
+
+// MonitorArg is the first argument of the binary of the daemon run as the
+// monitor of a container:
+//
+//	dockerd -container-monitor STATUS_PATH PROGRAM [ARG...]
+const MonitorArg = "-container-monitor"
+
+// IsMonitor returns true if the binary runs as the monitor of a container.
+func IsMonitor() bool {
+	return len(os.Args) > 3 && os.Args[1] == MonitorArg
+}
+
+// exitStatusPath returns the path where the monitor of the container records
+// its exit status.
+func (container *Container) exitStatusPath() string {
+	return path.Join(container.Root, "exit-status")
+}
+
+// monitorCommand returns the command running program `name` with `args`
+// under a monitor, which records its exit status in `statusPath`.
+func monitorCommand(statusPath, name string, args ...string) *exec.Cmd {
+	return exec.Command(sysInitPath, append([]string{MonitorArg, statusPath, name}, args...)...)
+}
+
+// waitStatus returns the exit status of a process which exited with `ws`, as
+// the shells do for processes killed by signals.
+func waitStatus(ws syscall.WaitStatus) int {
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
+
+// children returns the PIDs of the children of the process, from /proc.
+func children() []int {
+	dir, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, entry := range dir {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// PID (COMM) STATE PPID ..., where COMM may hold spaces and parentheses
+		stat, err := ioutil.ReadFile(path.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		if len(fields) >= 2 {
+			if ppid, err := strconv.Atoi(fields[1]); err == nil && ppid == self {
+				pids = append(pids, pid)
+			}
+		}
+	}
+	return pids
+}
+
+// Monitor runs the monitor of a container, with the arguments which
+// monitorCommand passes. It doesn't return.
+func Monitor() {
+	statusPath, name, args := os.Args[2], os.Args[3], os.Args[4:]
+	os.Remove(statusPath)
+	if err := setSubreaper(); err != nil {
+		log.Printf("Failed to become a subreaper: %v", err)
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// The program is killed when the thread which started it exits
+	runtime.LockOSThread()
+	cmd.SysProcAttr = monitorProcAttr()
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to start %s: %v", name, err)
+		os.Exit(127)
+	}
+	// Pass the signals of the daemon on to the program
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	// Reap the orphans until the program exits
+	status := 0
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			log.Printf("Failed to wait for %s: %v", name, err)
+			status = 127
+			break
+		}
+		if pid == cmd.Process.Pid {
+			status = waitStatus(ws)
+			break
+		}
+	}
+	if err := ioutil.WriteFile(statusPath, []byte(fmt.Sprintf("%d\n", status)), 0600); err != nil {
+		log.Printf("Failed to record the exit status: %v", err)
+	}
+	// Kill the processes left behind, and those orphaned as they die
+	for {
+		for _, pid := range children() {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		if _, err := syscall.Wait4(-1, nil, 0, nil); err == syscall.ECHILD {
+			break
+		}
+	}
+	os.Exit(status)
+}
+
+// readExitStatus returns the exit status which the monitor of the container
+// recorded, if any.
+func (container *Container) readExitStatus() (int, bool) {
+	data, err := ioutil.ReadFile(container.exitStatusPath())
+	if err != nil {
+		return 0, false
+	}
+	status, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return status, err == nil
+}
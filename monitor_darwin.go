@@ -0,0 +1,14 @@
+package docker
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setSubreaper() error {
+	return errors.New("Subreapers are not implemented on darwin")
+}
+
+func monitorProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
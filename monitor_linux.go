@@ -0,0 +1,20 @@
+package docker
+
+import "syscall"
+
+// From linux/prctl.h
+const prSetChildSubreaper = 36
+
+// setSubreaper makes the process the reaper of its orphaned descendants.
+func setSubreaper() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// monitorProcAttr returns the attributes of the program run by a monitor,
+// which is killed with the monitor.
+func monitorProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
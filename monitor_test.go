@@ -0,0 +1,56 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	statusPath := path.Join(tmp, "exit-status")
+	// The shell leaves an orphan behind, which the monitor kills
+	cmd := monitorCommand(statusPath, "/bin/sh", "-c", "sleep 60 & echo $! > "+path.Join(tmp, "orphan")+"; exit 3")
+	start := time.Now()
+	err = cmd.Run()
+	if exit, ok := err.(interface{ ExitCode() int }); !ok || exit.ExitCode() != 3 {
+		t.Fatalf("Expected the monitor to exit with status 3, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("The monitor waited for the orphan")
+	}
+	if data, err := ioutil.ReadFile(statusPath); err != nil || strings.TrimSpace(string(data)) != "3" {
+		t.Fatalf("Expected the exit status 3 to be recorded, got %q (%v)", data, err)
+	}
+	data, err := ioutil.ReadFile(path.Join(tmp, "orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pid int
+	if _, err := fmt.Sscan(strings.TrimSpace(string(data)), &pid); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Fatalf("The orphan %d is still running", pid)
+	}
+}
+
+func TestWaitStatus(t *testing.T) {
+	// 9 << 0: killed by SIGKILL
+	if status := waitStatus(syscall.WaitStatus(9)); status != 137 {
+		t.Errorf("Expected 137, got %d", status)
+	}
+	// 1 << 8: exited with status 1
+	if status := waitStatus(syscall.WaitStatus(1 << 8)); status != 1 {
+		t.Errorf("Expected 1, got %d", status)
+	}
+}
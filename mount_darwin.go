@@ -5,3 +5,7 @@ import "errors"
 func mount(source string, target string, fstype string, flags uintptr, data string) (err error) {
 	return errors.New("mount is not implemented on darwin")
 }
+
+func unmount(target string) error {
+	return errors.New("unmount is not implemented on darwin")
+}
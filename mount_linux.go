@@ -5,3 +5,11 @@ import "syscall"
 func mount(source string, target string, fstype string, flags uintptr, data string) (err error) {
 	return syscall.Mount(source, target, fstype, flags, data)
 }
+
+// unmount unmounts `target`, lazily if it is busy.
+func unmount(target string) error {
+	if err := syscall.Unmount(target, 0); err != syscall.EBUSY {
+		return err
+	}
+	return syscall.Unmount(target, syscall.MNT_DETACH)
+}
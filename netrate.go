@@ -0,0 +1,84 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The bandwidth of the containers is limited with traffic control (tc) on
+// the host end of their veth pair: the traffic sent to the container leaves
+// the host through it, and is shaped by a token bucket; the traffic sent by
+// the container enters the host through it, and is policed.
+
+// How long to wait for lxc to create the veth pair of a container
+const vethTimeout = 10 * time.Second
+
+// vethName returns the name of the host end of the veth pair of the
+// container, which must fit in the 15 characters of an interface name.
+func (container *Container) vethName() string {
+	hash := sha256.Sum256([]byte(container.Id))
+	return "veth" + hex.EncodeToString(hash[:5])
+}
+
+// limitBandwidth applies the bandwidth limits of the container to its veth
+// pair, once lxc has created it.
+func (container *Container) limitBandwidth() error {
+	if container.Config.NetRateIn == 0 && container.Config.NetRateOut == 0 {
+		return nil
+	}
+	veth := container.NetworkSettings.HostInterface
+	deadline := time.Now().Add(vethTimeout)
+	for {
+		if _, err := os.Stat("/sys/class/net/" + veth); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("Unable to limit the bandwidth: interface %s not found", veth)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if rate := container.Config.NetRateIn; rate > 0 {
+		if err := tc("qdisc", "add", "dev", veth, "root", "tbf",
+			"rate", tcRate(rate), "burst", tcBurst(rate), "latency", "50ms"); err != nil {
+			return err
+		}
+	}
+	if rate := container.Config.NetRateOut; rate > 0 {
+		if err := tc("qdisc", "add", "dev", veth, "handle", "ffff:", "ingress"); err != nil {
+			return err
+		}
+		if err := tc("filter", "add", "dev", veth, "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0",
+			"police", "rate", tcRate(rate), "burst", tcBurst(rate), "drop", "flowid", ":1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tcRate returns `rate`, in bytes per second, in the units of tc.
+func tcRate(rate int64) string {
+	return strconv.FormatInt(rate, 10) + "bps"
+}
+
+// tcBurst returns the size of the bursts allowed at `rate`: a tenth of a
+// second of traffic, and at least a few packets.
+func tcBurst(rate int64) string {
+	burst := rate / 10
+	if burst < 32<<10 {
+		burst = 32 << 10
+	}
+	return strconv.FormatInt(burst, 10) + "b"
+}
+
+// Wrapper around the tc command
+func tc(args ...string) error {
+	if output, err := exec.Command("/sbin/tc", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("tc failed: tc %v: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestVethName(t *testing.T) {
+	a := &Container{Id: "a-container-with-a-very-long-name"}
+	b := &Container{Id: "another-container"}
+	if len(a.vethName()) > 15 {
+		t.Errorf("%s is too long for an interface name", a.vethName())
+	}
+	if a.vethName() == b.vethName() {
+		t.Errorf("Different containers have the same veth: %s", a.vethName())
+	}
+	if a.vethName() != (&Container{Id: a.Id}).vethName() {
+		t.Errorf("The veth of a container should only depend on its ID")
+	}
+}
+
+func TestTcBurst(t *testing.T) {
+	if burst := tcBurst(1 << 20); burst != "104857b" {
+		t.Errorf("Unexpected burst at 1m: %s", burst)
+	}
+	if burst := tcBurst(1 << 10); burst != "32768b" {
+		t.Errorf("Unexpected burst at 1k: %s", burst)
+	}
+}
@@ -0,0 +1,44 @@
+package docker
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// NetworkStats counts the traffic of a container since it started, as seen
+// from the container.
+type NetworkStats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	TxBytes   uint64
+	TxPackets uint64
+}
+
+// NetworkStats returns the counters of the veth pair of the running
+// container.
+func (container *Container) NetworkStats() (*NetworkStats, error) {
+	if !container.State.Running || container.NetworkSettings.HostInterface == "" {
+		return nil, errors.New("Container " + container.Id + " is not running")
+	}
+	dir := path.Join("/sys/class/net", container.NetworkSettings.HostInterface, "statistics")
+	// What the host end of the pair sends, the container receives
+	stats := &NetworkStats{}
+	for name, counter := range map[string]*uint64{
+		"tx_bytes":   &stats.RxBytes,
+		"tx_packets": &stats.RxPackets,
+		"rx_bytes":   &stats.TxBytes,
+		"rx_packets": &stats.TxPackets,
+	} {
+		data, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if *counter, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
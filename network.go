@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
@@ -74,6 +75,20 @@ func iptables(args ...string) error {
 	return nil
 }
 
+// deleteRules deletes all the copies of an iptables rule, which daemons which
+// crashed may have left.
+func deleteRules(args ...string) {
+	for i := 0; i < 100 && iptables(args...) == nil; i++ {
+	}
+}
+
+// appendRule appends the iptables rule `rule` of the chain `chain` of `table`,
+// after deleting the copies left by previous daemons.
+func appendRule(table, chain string, rule ...string) error {
+	deleteRules(append([]string{"-t", table, "-D", chain}, rule...)...)
+	return iptables(append([]string{"-t", table, "-A", chain}, rule...)...)
+}
+
 // Return the IPv4 address of a network interface
 func getIfaceAddr(name string) (net.Addr, error) {
 	iface, err := net.InterfaceByName(name)
@@ -101,103 +116,251 @@ func getIfaceAddr(name string) (net.Addr, error) {
 }
 
 // Port mapper takes care of mapping external ports to containers by setting
-// up iptables rules.
-// It keeps track of all mappings and is able to unmap at will
+// up iptables rules, or by running userland proxies where NAT isn't available.
+// It keeps track of all mappings and is able to unmap at will. A port is
+// mapped on several addresses of the host, or on all of them. The ports of
+// the loopback addresses are always proxied: the connections from the host
+// itself don't go through PREROUTING.
 type PortMapper struct {
-	mapping map[int]net.TCPAddr
+	lock     sync.Mutex // Protects the mappings, which containers change concurrently
+	mapping  map[hostPort]portForward
+	userland bool
+	proxies  map[hostPort]Proxy
 }
 
-func (mapper *PortMapper) cleanup() error {
-	// Ignore errors - This could mean the chains were never set up
-	iptables("-t", "nat", "-D", "PREROUTING", "-j", "DOCKER")
-	iptables("-t", "nat", "-F", "DOCKER")
-	iptables("-t", "nat", "-X", "DOCKER")
-	mapper.mapping = make(map[int]net.TCPAddr)
-	return nil
+// A hostPort is a port on an address of the host, or on all of them if the
+// address is "".
+type hostPort struct {
+	ip   string
+	port int
 }
 
+func newHostPort(ip net.IP, port int) hostPort {
+	if ip == nil {
+		return hostPort{"", port}
+	}
+	return hostPort{ip.String(), port}
+}
+
+func (p hostPort) String() string {
+	if p.ip == "" {
+		return strconv.Itoa(p.port)
+	}
+	return net.JoinHostPort(p.ip, strconv.Itoa(p.port))
+}
+
+type portForward struct {
+	hostIp net.IP // All the addresses of the host if nil
+	dest   net.TCPAddr
+}
+
+// rule returns the rule of the DOCKER chain forwarding `port`, in the format
+// of iptables -S.
+func (forward portForward) rule(port int) []string {
+	rule := []string{"DOCKER"}
+	if forward.hostIp != nil {
+		rule = append(rule, "-d", forward.hostIp.String()+"/32")
+	}
+	return append(rule, "-p", "tcp", "-m", "tcp", "--dport", strconv.Itoa(port),
+		"-j", "DNAT", "--to-destination", net.JoinHostPort(forward.dest.IP.String(), strconv.Itoa(forward.dest.Port)))
+}
+
+// setup creates the DOCKER chain, unless a previous daemon left it, and
+// jumps to it from PREROUTING for the connections to the host. Its rules are
+// left for reconcile.
 func (mapper *PortMapper) setup() error {
-	if err := iptables("-t", "nat", "-N", "DOCKER"); err != nil {
-		return errors.New("Unable to setup port networking: Failed to create DOCKER chain")
+	mapper.mapping = make(map[hostPort]portForward)
+	mapper.proxies = make(map[hostPort]Proxy)
+	if mapper.userland {
+		return nil
+	}
+	if iptables("-t", "nat", "-L", "DOCKER", "-n") != nil {
+		if err := iptables("-t", "nat", "-N", "DOCKER"); err != nil {
+			return errors.New("Unable to setup port networking: Failed to create DOCKER chain")
+		}
 	}
-	if err := iptables("-t", "nat", "-A", "PREROUTING", "-j", "DOCKER"); err != nil {
+	// Older daemons jumped for all the destinations
+	deleteRules("-t", "nat", "-D", "PREROUTING", "-j", "DOCKER")
+	if err := appendRule("nat", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "DOCKER"); err != nil {
 		return errors.New("Unable to setup port networking: Failed to inject docker in PREROUTING chain")
 	}
 	return nil
 }
 
-func (mapper *PortMapper) iptablesForward(rule string, port int, dest net.TCPAddr) error {
-	return iptables("-t", "nat", rule, "DOCKER", "-p", "tcp", "--dport", strconv.Itoa(port),
-		"-j", "DNAT", "--to-destination", net.JoinHostPort(dest.IP.String(), strconv.Itoa(dest.Port)))
+// reconcile makes the rules of the DOCKER chain match the mappings: the
+// rules which aren't mapped anymore, eg. left by a daemon which crashed,
+// are deleted, and the missing ones are added.
+func (mapper *PortMapper) reconcile() error {
+	mapper.lock.Lock()
+	defer mapper.lock.Unlock()
+	// The proxies don't outlive the daemon
+	if mapper.userland {
+		return nil
+	}
+	output, err := exec.Command("/sbin/iptables", "-t", "nat", "-S", "DOCKER").Output()
+	if err != nil {
+		return fmt.Errorf("iptables failed: iptables -t nat -S DOCKER")
+	}
+	expected := make(map[string]hostPort)
+	for key, forward := range mapper.mapping {
+		if mapper.proxies[key] == nil {
+			expected[strings.Join(forward.rule(key.port), " ")] = key
+		}
+	}
+	found := make(map[hostPort]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		rule := strings.Fields(line)
+		if len(rule) < 2 || rule[0] != "-A" {
+			continue
+		}
+		if key, exists := expected[strings.Join(rule[1:], " ")]; exists && !found[key] {
+			found[key] = true
+			continue
+		}
+		rule[0] = "-D"
+		if err := iptables(append([]string{"-t", "nat"}, rule...)...); err != nil {
+			log.Printf("Unable to delete stale rule %v: %v", line, err)
+		}
+	}
+	for key, forward := range mapper.mapping {
+		if mapper.proxies[key] == nil && !found[key] {
+			if err := iptables(append([]string{"-t", "nat", "-A"}, forward.rule(key.port)...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func (mapper *PortMapper) Map(port int, dest net.TCPAddr) error {
-	if err := mapper.iptablesForward("-A", port, dest); err != nil {
+// Map forwards the connections to `port` of `hostIp`, or of all the
+// addresses of the host if nil, to `dest`.
+func (mapper *PortMapper) Map(hostIp net.IP, port int, dest net.TCPAddr) error {
+	mapper.lock.Lock()
+	defer mapper.lock.Unlock()
+	key := newHostPort(hostIp, port)
+	if _, exists := mapper.mapping[key]; exists {
+		return fmt.Errorf("Port %v is already mapped", key)
+	}
+	forward := portForward{hostIp, dest}
+	if mapper.userland || hostIp.IsLoopback() {
+		proxy, err := newProxy(&net.TCPAddr{IP: hostIp, Port: port}, &dest)
+		if err != nil {
+			return err
+		}
+		go proxy.Run()
+		mapper.proxies[key] = proxy
+	} else if err := iptables(append([]string{"-t", "nat", "-A"}, forward.rule(port)...)...); err != nil {
 		return err
 	}
-	mapper.mapping[port] = dest
+	mapper.mapping[key] = forward
 	return nil
 }
 
-func (mapper *PortMapper) Unmap(port int) error {
-	dest, ok := mapper.mapping[port]
+// Unmap stops forwarding `port` of `hostIp`, or of all the addresses of the
+// host if nil.
+func (mapper *PortMapper) Unmap(hostIp net.IP, port int) error {
+	mapper.lock.Lock()
+	defer mapper.lock.Unlock()
+	key := newHostPort(hostIp, port)
+	forward, ok := mapper.mapping[key]
 	if !ok {
 		return errors.New("Port is not mapped")
 	}
-	if err := mapper.iptablesForward("-D", port, dest); err != nil {
+	if proxy, ok := mapper.proxies[key]; ok {
+		if err := proxy.Close(); err != nil {
+			return err
+		}
+		delete(mapper.proxies, key)
+	} else if err := iptables(append([]string{"-t", "nat", "-D"}, forward.rule(port)...)...); err != nil {
 		return err
 	}
-	delete(mapper.mapping, port)
+	delete(mapper.mapping, key)
 	return nil
 }
 
-func newPortMapper() (*PortMapper, error) {
-	mapper := &PortMapper{}
-	if err := mapper.cleanup(); err != nil {
-		return nil, err
-	}
+// newPortMapper returns a port mapper setting up iptables rules, or running
+// userland proxies if `userland` is true.
+func newPortMapper(userland bool) (*PortMapper, error) {
+	mapper := &PortMapper{userland: userland}
 	if err := mapper.setup(); err != nil {
 		return nil, err
 	}
 	return mapper, nil
 }
 
-// Port allocator: Atomatically allocate and release networking ports
+// Port allocator: Atomatically allocate and release networking ports, on an
+// address of the host or on all of them. Random ports are taken from a range,
+// in turn so that they aren't reused right away, and specific ports from
+// anywhere.
 type PortAllocator struct {
-	ports chan (int)
+	lock       sync.Mutex
+	start, end int
+	next       int
+	inUse      map[int]map[string]bool // The addresses of each port, "" for all of them
 }
 
-func (alloc *PortAllocator) populate(start, end int) {
-	alloc.ports = make(chan int, end-start)
-	for port := start; port < end; port++ {
-		alloc.ports <- port
+// free returns whether the port `p` is free. A port allocated on all the
+// addresses is allocated on each of them.
+func (alloc *PortAllocator) free(p hostPort) bool {
+	ips := alloc.inUse[p.port]
+	if p.ip == "" {
+		return len(ips) == 0
 	}
+	return !ips[p.ip] && !ips[""]
 }
 
-func (alloc *PortAllocator) Acquire() (int, error) {
-	select {
-	case port := <-alloc.ports:
-		return port, nil
-	default:
-		return -1, errors.New("No more ports available")
+func (alloc *PortAllocator) take(p hostPort) {
+	if alloc.inUse[p.port] == nil {
+		alloc.inUse[p.port] = make(map[string]bool)
 	}
-	return -1, nil
+	alloc.inUse[p.port][p.ip] = true
 }
 
-func (alloc *PortAllocator) Release(port int) error {
-	select {
-	case alloc.ports <- port:
-		return nil
-	default:
-		return errors.New("Too many ports have been released")
+// Acquire allocates a random port on `ip`, or on all the addresses if nil.
+func (alloc *PortAllocator) Acquire(ip net.IP) (int, error) {
+	alloc.lock.Lock()
+	defer alloc.lock.Unlock()
+	for i := alloc.start; i < alloc.end; i++ {
+		port := alloc.next
+		if alloc.next++; alloc.next >= alloc.end {
+			alloc.next = alloc.start
+		}
+		if p := newHostPort(ip, port); alloc.free(p) {
+			alloc.take(p)
+			return port, nil
+		}
+	}
+	return -1, errors.New("No more ports available")
+}
+
+// AcquirePort allocates the specific port `port` on `ip`, or on all the
+// addresses if nil.
+func (alloc *PortAllocator) AcquirePort(ip net.IP, port int) error {
+	alloc.lock.Lock()
+	defer alloc.lock.Unlock()
+	p := newHostPort(ip, port)
+	if !alloc.free(p) {
+		return fmt.Errorf("Port %v is already allocated", p)
+	}
+	alloc.take(p)
+	return nil
+}
+
+func (alloc *PortAllocator) Release(ip net.IP, port int) error {
+	alloc.lock.Lock()
+	defer alloc.lock.Unlock()
+	p := newHostPort(ip, port)
+	if !alloc.inUse[p.port][p.ip] {
+		return fmt.Errorf("Port %v is not allocated", p)
+	}
+	if delete(alloc.inUse[p.port], p.ip); len(alloc.inUse[p.port]) == 0 {
+		delete(alloc.inUse, p.port)
 	}
 	return nil
 }
 
 func newPortAllocator(start, end int) (*PortAllocator, error) {
-	allocator := &PortAllocator{}
-	allocator.populate(start, end)
-	return allocator, nil
+	return &PortAllocator{start: start, end: end, next: start, inUse: make(map[int]map[string]bool)}, nil
 }
 
 // IP allocator: Atomatically allocate and release networking ports
@@ -270,87 +433,134 @@ type NetworkInterface struct {
 	Gateway net.IP
 
 	manager  *NetworkManager
-	extPorts []int
+	network  *Network
+	extPorts []hostPort
 }
 
-// Allocate an external TCP port and map it to the interface
-func (iface *NetworkInterface) AllocatePort(port int) (int, error) {
-	extPort, err := iface.manager.portAllocator.Acquire()
-	if err != nil {
+// Allocate an external TCP port and map it to the interface: `hostPort`, or
+// a random port if 0, on `hostIp`, or on all the addresses of the host if nil.
+func (iface *NetworkInterface) AllocatePort(hostIp net.IP, hostPort, port int) (int, error) {
+	if hostIp != nil && hostIp.IsUnspecified() {
+		hostIp = nil
+	}
+	extPort := hostPort
+	if extPort == 0 {
+		var err error
+		if extPort, err = iface.manager.portAllocator.Acquire(hostIp); err != nil {
+			return -1, err
+		}
+	} else if err := iface.manager.portAllocator.AcquirePort(hostIp, extPort); err != nil {
 		return -1, err
 	}
-	if err := iface.manager.portMapper.Map(extPort, net.TCPAddr{iface.IPNet.IP, port}); err != nil {
-		iface.manager.portAllocator.Release(extPort)
+	if err := iface.manager.portMapper.Map(hostIp, extPort, net.TCPAddr{iface.IPNet.IP, port}); err != nil {
+		iface.manager.portAllocator.Release(hostIp, extPort)
 		return -1, err
 	}
-	iface.extPorts = append(iface.extPorts, extPort)
+	iface.extPorts = append(iface.extPorts, newHostPort(hostIp, extPort))
 	return extPort, nil
 }
 
 // Release: Network cleanup - release all resources
 func (iface *NetworkInterface) Release() error {
-	for _, port := range iface.extPorts {
-		if err := iface.manager.portMapper.Unmap(port); err != nil {
-			log.Printf("Unable to unmap port %v: %v", port, err)
+	for _, p := range iface.extPorts {
+		ip := net.ParseIP(p.ip)
+		if err := iface.manager.portMapper.Unmap(ip, p.port); err != nil {
+			log.Printf("Unable to unmap port %v: %v", p, err)
 		}
-		if err := iface.manager.portAllocator.Release(port); err != nil {
-			log.Printf("Unable to release port %v: %v", port, err)
+		if err := iface.manager.portAllocator.Release(ip, p.port); err != nil {
+			log.Printf("Unable to release port %v: %v", p, err)
 		}
 
 	}
-	return iface.manager.ipAllocator.Release(iface.IPNet.IP)
+	return iface.network.ipAllocator.Release(iface.IPNet.IP)
 }
 
-// Network Manager manages a set of network interfaces
+// Network Manager manages a set of network interfaces, on the bridges of
+// the networks, and the ports they publish on the host.
 // Only *one* manager per host machine should be used
 type NetworkManager struct {
-	bridgeIface   string
-	bridgeNetwork *net.IPNet
+	lock     sync.Mutex // Protects the networks, which commands create and remove concurrently
+	root     string     // Where the networks created by the users are stored
+	networks map[string]*Network
+	isolated bool       // Whether the DOCKER-ISOLATION chain is set up
+	iccLock  sync.Mutex // Serializes the updates of the DOCKER-ICC chain
+	iccSetup bool       // Whether the DOCKER-ICC chain is set up
 
-	ipAllocator   *IPAllocator
 	portAllocator *PortAllocator
 	portMapper    *PortMapper
 }
 
-// Allocate a network interface
-func (manager *NetworkManager) Allocate() (*NetworkInterface, error) {
-	ip, err := manager.ipAllocator.Acquire()
+// Allocate a network interface on network `name`, or on the default network
+// if empty
+func (manager *NetworkManager) Allocate(name string) (*NetworkInterface, error) {
+	network := manager.Get(name)
+	if network == nil {
+		return nil, fmt.Errorf("No such network: %s", name)
+	}
+	ip, err := network.ipAllocator.Acquire()
 	if err != nil {
 		return nil, err
 	}
 	iface := &NetworkInterface{
-		IPNet:   net.IPNet{ip, manager.bridgeNetwork.Mask},
-		Gateway: manager.bridgeNetwork.IP,
+		IPNet:   net.IPNet{IP: ip, Mask: network.ipNet.Mask},
+		Gateway: network.ipNet.IP,
 		manager: manager,
+		network: network,
 	}
 	return iface, nil
 }
 
-func newNetworkManager(bridgeIface string) (*NetworkManager, error) {
+// reconcile deletes the port mappings which no container uses anymore, and
+// restores those which are missing.
+func (manager *NetworkManager) reconcile() error {
+	return manager.portMapper.reconcile()
+}
+
+// NetworkOptions configure the networking of the containers
+type NetworkOptions struct {
+	UserlandProxy bool // Publish the ports of the containers with proxies instead of NAT
+	DisableIcc    bool // Keep the containers of the default network from talking to each other, unless they allow it
+	// The nameservers, search domains and resolver options of the
+	// containers, instead of those of the host
+	DNS        []string
+	DNSSearch  []string
+	DNSOptions []string
+}
+
+// newNetworkManager returns the network manager of the default network on
+// bridge `bridgeIface` and of the networks stored in `root`.
+func newNetworkManager(bridgeIface, root string, options NetworkOptions) (*NetworkManager, error) {
 	addr, err := getIfaceAddr(bridgeIface)
 	if err != nil {
 		return nil, err
 	}
-	network := addr.(*net.IPNet)
-
-	ipAllocator, err := newIPAllocator(network)
+	portAllocator, err := newPortAllocator(portRangeStart, portRangeEnd)
 	if err != nil {
 		return nil, err
 	}
 
-	portAllocator, err := newPortAllocator(portRangeStart, portRangeEnd)
+	portMapper, err := newPortMapper(options.UserlandProxy)
 	if err != nil {
 		return nil, err
 	}
 
-	portMapper, err := newPortMapper()
-
 	manager := &NetworkManager{
-		bridgeIface:   bridgeIface,
-		bridgeNetwork: network,
-		ipAllocator:   ipAllocator,
+		root:          root,
+		networks:      make(map[string]*Network),
 		portAllocator: portAllocator,
 		portMapper:    portMapper,
 	}
+	network, err := manager.newNetwork(DefaultNetwork, bridgeIface, addr.(*net.IPNet))
+	if err != nil {
+		return nil, err
+	}
+	network.DisableIcc = options.DisableIcc
+	if err := manager.setupHairpin(network); err != nil {
+		return nil, err
+	}
+	manager.networks[DefaultNetwork] = network
+	if err := manager.restore(); err != nil {
+		return nil, err
+	}
 	return manager, nil
 }
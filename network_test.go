@@ -2,6 +2,7 @@ package docker
 
 import (
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -128,3 +129,68 @@ func TestIPAllocator(t *testing.T) {
 		t.Fatal(ip.String())
 	}
 }
+
+func TestForwardRule(t *testing.T) {
+	dest := net.TCPAddr{IP: net.ParseIP("10.0.3.2"), Port: 80}
+	// The rules are compared with the output of iptables -S
+	for _, test := range []struct {
+		forward  portForward
+		expected string
+	}{
+		{portForward{nil, dest}, "DOCKER -p tcp -m tcp --dport 49153 -j DNAT --to-destination 10.0.3.2:80"},
+		{portForward{net.ParseIP("10.0.0.5"), dest}, "DOCKER -d 10.0.0.5/32 -p tcp -m tcp --dport 49153 -j DNAT --to-destination 10.0.3.2:80"},
+	} {
+		if rule := strings.Join(test.forward.rule(49153), " "); rule != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, rule)
+		}
+	}
+}
+
+func TestPortAllocator(t *testing.T) {
+	alloc, err := newPortAllocator(1000, 1003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alloc.AcquirePort(nil, 1001); err != nil {
+		t.Fatal(err)
+	}
+	if err := alloc.AcquirePort(nil, 1001); err == nil {
+		t.Fatal("A port can't be allocated twice")
+	}
+	if err := alloc.AcquirePort(net.ParseIP("127.0.0.1"), 1001); err == nil {
+		t.Fatal("A port allocated on all the addresses is allocated on each of them")
+	}
+	for _, expected := range []int{1000, 1002} {
+		if port, err := alloc.Acquire(nil); err != nil || port != expected {
+			t.Fatalf("Expected port %d, got %d (%v)", expected, port, err)
+		}
+	}
+	if _, err := alloc.Acquire(nil); err == nil {
+		t.Fatal("The range should be exhausted")
+	}
+	if err := alloc.Release(nil, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := alloc.Acquire(nil); err != nil || port != 1000 {
+		t.Fatalf("Expected port 1000, got %d (%v)", port, err)
+	}
+	if err := alloc.Release(nil, 80); err == nil {
+		t.Fatal("Ports which aren't allocated can't be released")
+	}
+	// The same port can be allocated on different addresses, but then not
+	// on all of them
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1"} {
+		if err := alloc.AcquirePort(net.ParseIP(ip), 80); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alloc.AcquirePort(nil, 80); err == nil {
+		t.Fatal("A port allocated on an address can't be allocated on all of them")
+	}
+	if err := alloc.Release(net.ParseIP("127.0.0.1"), 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := alloc.Release(net.ParseIP("127.0.0.1"), 80); err == nil {
+		t.Fatal("Ports are released on the address they were allocated on")
+	}
+}
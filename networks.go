@@ -0,0 +1,417 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The containers attach to a network: the default one, on bridge lxcbr0, or
+// one created with 'docker network create', on a bridge and a subnet of its
+// own. The containers of different networks can't reach each other, except
+// through the ports they publish.
+
+const (
+	DefaultNetwork = "bridge"
+	bridgePrefix   = "docker-" // The prefix of the bridges of the networks created with 'docker network create'
+	isolationChain = "DOCKER-ISOLATION"
+)
+
+var validNetworkName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+type Network struct {
+	Name    string
+	Bridge  string
+	Subnet  string // eg. 172.18.0.0/16
+	Gateway string // The address of the host on the bridge
+	// Keep the containers of the network from talking to each other, unless
+	// they allow it
+	DisableIcc bool
+
+	ipNet       *net.IPNet // The gateway, with the mask of the subnet
+	ipAllocator *IPAllocator
+}
+
+// subnet returns the subnet of the network.
+func (network *Network) subnet() *net.IPNet {
+	return &net.IPNet{IP: network.ipNet.IP.Mask(network.ipNet.Mask), Mask: network.ipNet.Mask}
+}
+
+// bridgeName returns the name of the bridge of network `name`, which must
+// fit in the 15 characters of a network interface name.
+func bridgeName(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return bridgePrefix + hex.EncodeToString(hash[:4])
+}
+
+// hairpinRule returns the rule of the POSTROUTING chain of the nat table
+// masquerading the connections of the containers to the ports published by
+// themselves or their neighbours, so that the replies go through the host
+// as well.
+func (network *Network) hairpinRule() []string {
+	return []string{"-s", network.subnet().String(), "-o", network.Bridge, "-m", "conntrack", "--ctstate", "DNAT", "-j", "MASQUERADE"}
+}
+
+// outboundRule returns the rule of the POSTROUTING chain of the nat table
+// masquerading the connections of the containers to the outside.
+func (network *Network) outboundRule() []string {
+	return []string{"-s", network.subnet().String(), "!", "-o", network.Bridge, "-j", "MASQUERADE"}
+}
+
+// isolationRules returns the rules of the DOCKER-ISOLATION chain keeping
+// the containers of the network from reaching those of the other networks.
+func (network *Network) isolationRules() [][]string {
+	return [][]string{
+		{"-i", network.Bridge, "-o", network.Bridge, "-j", "RETURN"},
+		{"-i", network.Bridge, "-o", bridgePrefix + "+", "-j", "DROP"},
+		{"-i", network.Bridge, "-o", networkBridgeIface, "-j", "DROP"},
+	}
+}
+
+// setupBridge creates the bridge of the network, unless it exists already,
+// and gives it the address of the gateway.
+func (network *Network) setupBridge() error {
+	if _, err := net.InterfaceByName(network.Bridge); err != nil {
+		if err := ipCommand("link", "add", "name", network.Bridge, "type", "bridge"); err != nil {
+			return err
+		}
+	}
+	if addr, err := getIfaceAddr(network.Bridge); err != nil {
+		if err := ipCommand("addr", "add", network.ipNet.String(), "dev", network.Bridge); err != nil {
+			return err
+		}
+	} else if addr.String() != network.ipNet.String() {
+		return fmt.Errorf("Bridge %s has address %s instead of %s", network.Bridge, addr, network.ipNet)
+	}
+	return ipCommand("link", "set", network.Bridge, "up")
+}
+
+// Wrapper around the ip command
+func ipCommand(args ...string) error {
+	if output, err := exec.Command("/sbin/ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip failed: ip %v: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// ParseSubnet returns the gateway of subnet `subnet`, with the mask of the
+// subnet: `gateway`, or the first address of the subnet if empty. Without
+// `subnet`, the first of 172.18.0.0/16 to 172.31.0.0/16 which doesn't
+// overlap with the subnets of `taken` is chosen.
+func ParseSubnet(subnet, gateway string, taken map[string]*net.IPNet) (*net.IPNet, error) {
+	var network *net.IPNet
+	if subnet == "" {
+		for i := 18; i < 32 && network == nil; i++ {
+			candidate := &net.IPNet{IP: net.IPv4(172, byte(i), 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+			if overlapping(candidate, taken) == "" {
+				network = candidate
+			}
+		}
+		if network == nil {
+			return nil, errors.New("No subnet is available, choose one with -subnet")
+		}
+	} else {
+		_, parsed, err := net.ParseCIDR(subnet)
+		if err != nil || parsed.IP.To4() == nil {
+			return nil, fmt.Errorf("Invalid subnet: %s (expected an IPv4 subnet, eg. 172.18.0.0/16)", subnet)
+		}
+		if ones, _ := parsed.Mask.Size(); ones < 16 || ones > 30 {
+			return nil, fmt.Errorf("Invalid subnet: %s (expected a /16 to /30 subnet)", subnet)
+		}
+		if other := overlapping(parsed, taken); other != "" {
+			return nil, fmt.Errorf("Subnet %s overlaps with %s", subnet, other)
+		}
+		network = &net.IPNet{IP: parsed.IP.To4(), Mask: parsed.Mask}
+	}
+	first, last := networkRange(network)
+	if gateway == "" {
+		n, _ := ipToInt(first)
+		ip, err := intToIp(n + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &net.IPNet{IP: ip, Mask: network.Mask}, nil
+	}
+	ip := net.ParseIP(gateway).To4()
+	if ip == nil || !network.Contains(ip) || ip.Equal(first) || ip.Equal(last) {
+		return nil, fmt.Errorf("Invalid gateway: %s (expected an address of subnet %s)", gateway, network)
+	}
+	return &net.IPNet{IP: ip, Mask: network.Mask}, nil
+}
+
+// overlapping returns the name of the subnet of `taken` which overlaps with
+// `subnet`, if any.
+func overlapping(subnet *net.IPNet, taken map[string]*net.IPNet) string {
+	var names []string
+	for name := range taken {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		other := taken[name]
+		if other.Contains(subnet.IP) || subnet.Contains(other.IP.Mask(other.Mask)) {
+			return name
+		}
+	}
+	return ""
+}
+
+// newNetwork returns network `name` on bridge `bridge`, where the host has
+// address `ipNet`.
+func (manager *NetworkManager) newNetwork(name, bridge string, ipNet *net.IPNet) (*Network, error) {
+	ipAllocator, err := newIPAllocator(ipNet)
+	if err != nil {
+		return nil, err
+	}
+	network := &Network{
+		Name:        name,
+		Bridge:      bridge,
+		Gateway:     ipNet.IP.String(),
+		ipNet:       ipNet,
+		ipAllocator: ipAllocator,
+	}
+	network.Subnet = network.subnet().String()
+	return network, nil
+}
+
+// Get returns network `name`, or the default network if empty, or nil if
+// it doesn't exist.
+func (manager *NetworkManager) Get(name string) *Network {
+	if name == "" {
+		name = DefaultNetwork
+	}
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return manager.networks[name]
+}
+
+// List returns the networks, sorted by name.
+func (manager *NetworkManager) List() []*Network {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	var names []string
+	for name := range manager.networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var networks []*Network
+	for _, name := range names {
+		networks = append(networks, manager.networks[name])
+	}
+	return networks
+}
+
+// Create creates network `name` on subnet `subnet` with gateway `gateway`,
+// which are chosen if empty. Its containers can talk to each other if `icc`
+// is true.
+func (manager *NetworkManager) Create(name, subnet, gateway string, icc bool) (*Network, error) {
+	if !validNetworkName.MatchString(name) {
+		return nil, fmt.Errorf("Invalid network name: %s (expected [a-zA-Z0-9][a-zA-Z0-9_.-]*)", name)
+	}
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if _, exists := manager.networks[name]; exists {
+		return nil, fmt.Errorf("Network %s already exists", name)
+	}
+	taken := make(map[string]*net.IPNet)
+	bridges := make(map[string]bool)
+	for _, network := range manager.networks {
+		taken["network "+network.Name] = network.subnet()
+		bridges[network.Bridge] = true
+	}
+	// The subnet must be routed to the bridge, not to another interface
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if bridges[iface.Name] {
+				continue
+			}
+			addrs, _ := iface.Addrs()
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+					taken["interface "+iface.Name] = ipNet
+				}
+			}
+		}
+	}
+	ipNet, err := ParseSubnet(subnet, gateway, taken)
+	if err != nil {
+		return nil, err
+	}
+	network, err := manager.newNetwork(name, bridgeName(name), ipNet)
+	if err != nil {
+		return nil, err
+	}
+	network.DisableIcc = !icc
+	if err := manager.setupNetwork(network); err != nil {
+		manager.teardownNetwork(network)
+		return nil, err
+	}
+	data, err := json.Marshal(network)
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(manager.root, name+".json"), data, 0600)
+	}
+	if err != nil {
+		manager.teardownNetwork(network)
+		return nil, err
+	}
+	manager.networks[name] = network
+	return network, nil
+}
+
+// Remove removes network `name`, which no container must use anymore.
+func (manager *NetworkManager) Remove(name string) error {
+	if name == DefaultNetwork {
+		return errors.New("The default network can't be removed")
+	}
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	network, exists := manager.networks[name]
+	if !exists {
+		return fmt.Errorf("No such network: %s", name)
+	}
+	if err := os.Remove(path.Join(manager.root, name+".json")); err != nil {
+		return err
+	}
+	manager.teardownNetwork(network)
+	delete(manager.networks, name)
+	return nil
+}
+
+// setupNetwork sets up the bridge of a network created with 'docker network
+// create', and the iptables rules isolating it and masquerading its
+// connections.
+func (manager *NetworkManager) setupNetwork(network *Network) error {
+	if err := network.setupBridge(); err != nil {
+		return err
+	}
+	if err := manager.setupIsolation(); err != nil {
+		return err
+	}
+	for _, rule := range network.isolationRules() {
+		if err := appendRule("filter", isolationChain, rule...); err != nil {
+			return fmt.Errorf("Unable to isolate network %s: %v", network.Name, err)
+		}
+	}
+	// Without NAT, the containers can't reach the outside
+	if !manager.portMapper.userland {
+		if err := appendRule("nat", "POSTROUTING", network.outboundRule()...); err != nil {
+			return fmt.Errorf("Unable to masquerade the connections of network %s: %v", network.Name, err)
+		}
+	}
+	return manager.setupHairpin(network)
+}
+
+// teardownNetwork deletes the bridge of a network, and its iptables rules.
+func (manager *NetworkManager) teardownNetwork(network *Network) {
+	for _, rule := range network.isolationRules() {
+		deleteRules(append([]string{"-D", isolationChain}, rule...)...)
+	}
+	deleteRules(append([]string{"-t", "nat", "-D", "POSTROUTING"}, network.outboundRule()...)...)
+	deleteRules(append([]string{"-t", "nat", "-D", "POSTROUTING"}, network.hairpinRule()...)...)
+	if err := ipCommand("link", "del", network.Bridge); err != nil {
+		log.Printf("Unable to delete bridge %v: %v", network.Bridge, err)
+	}
+}
+
+// setupIsolation creates the DOCKER-ISOLATION chain, the first time a
+// network needs it, and jumps to it from FORWARD. The connections to the
+// published ports go through.
+func (manager *NetworkManager) setupIsolation() error {
+	if manager.isolated {
+		return nil
+	}
+	if iptables("-L", isolationChain, "-n") != nil {
+		if err := iptables("-N", isolationChain); err != nil {
+			return errors.New("Unable to setup network isolation: Failed to create DOCKER-ISOLATION chain")
+		}
+	} else if err := iptables("-F", isolationChain); err != nil {
+		return errors.New("Unable to setup network isolation: Failed to flush DOCKER-ISOLATION chain")
+	}
+	deleteRules("-D", "FORWARD", "-j", isolationChain)
+	if err := iptables("-I", "FORWARD", "-j", isolationChain); err != nil {
+		return errors.New("Unable to setup network isolation: Failed to inject docker in FORWARD chain")
+	}
+	for _, rule := range [][]string{
+		{"-m", "conntrack", "--ctstate", "DNAT", "-j", "RETURN"},
+		{"-i", manager.networks[DefaultNetwork].Bridge, "-o", bridgePrefix + "+", "-j", "DROP"},
+	} {
+		if err := iptables(append([]string{"-A", isolationChain}, rule...)...); err != nil {
+			return fmt.Errorf("Unable to setup network isolation: %v", err)
+		}
+	}
+	manager.isolated = true
+	return nil
+}
+
+// setupHairpin lets the containers of a network connect to the ports
+// published by themselves or their neighbours.
+func (manager *NetworkManager) setupHairpin(network *Network) error {
+	// The proxies connect to the containers from the address of the bridge
+	if manager.portMapper.userland {
+		return nil
+	}
+	if err := appendRule("nat", "POSTROUTING", network.hairpinRule()...); err != nil {
+		return errors.New("Unable to setup port networking: Failed to masquerade the connections between containers")
+	}
+	return nil
+}
+
+// restore sets up the networks stored by 'docker network create'.
+func (manager *NetworkManager) restore() error {
+	if err := os.MkdirAll(manager.root, 0700); err != nil {
+		return err
+	}
+	dir, err := ioutil.ReadDir(manager.root)
+	if err != nil {
+		return err
+	}
+	for _, v := range dir {
+		if path.Ext(v.Name()) != ".json" {
+			continue
+		}
+		if err := manager.restoreNetwork(path.Join(manager.root, v.Name())); err != nil {
+			log.Printf("Failed to restore network %v: %v", strings.TrimSuffix(v.Name(), ".json"), err)
+		}
+	}
+	return nil
+}
+
+func (manager *NetworkManager) restoreNetwork(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	stored := &Network{}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return err
+	}
+	_, subnet, err := net.ParseCIDR(stored.Subnet)
+	if err != nil {
+		return err
+	}
+	gateway := net.ParseIP(stored.Gateway).To4()
+	if gateway == nil || !subnet.Contains(gateway) {
+		return fmt.Errorf("Invalid gateway: %s", stored.Gateway)
+	}
+	network, err := manager.newNetwork(stored.Name, stored.Bridge, &net.IPNet{IP: gateway, Mask: subnet.Mask})
+	if err != nil {
+		return err
+	}
+	network.DisableIcc = stored.DisableIcc
+	if err := manager.setupNetwork(network); err != nil {
+		return err
+	}
+	manager.networks[network.Name] = network
+	return nil
+}
@@ -0,0 +1,49 @@
+package docker
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseSubnet(t *testing.T) {
+	_, bridge, _ := net.ParseCIDR("10.0.3.0/24")
+	_, first, _ := net.ParseCIDR("172.18.0.0/16")
+	taken := map[string]*net.IPNet{"network bridge": bridge, "network first": first}
+
+	// The first free subnet is chosen
+	if ipNet, err := ParseSubnet("", "", taken); err != nil || ipNet.String() != "172.19.0.1/16" {
+		t.Errorf("Unexpected result: %v, %v", ipNet, err)
+	}
+	if ipNet, err := ParseSubnet("192.168.5.0/24", "", taken); err != nil || ipNet.String() != "192.168.5.1/24" {
+		t.Errorf("Unexpected result: %v, %v", ipNet, err)
+	}
+	if ipNet, err := ParseSubnet("192.168.5.7/24", "192.168.5.254", taken); err != nil || ipNet.String() != "192.168.5.254/24" {
+		t.Errorf("Unexpected result: %v, %v", ipNet, err)
+	}
+	for _, subnet := range [][2]string{
+		{"10.0.0.0/16", ""},    // Overlaps with bridge
+		{"10.0.3.128/25", ""},  // Inside bridge
+		{"172.18.0.0/24", ""},  // Inside first
+		{"10.0.0.0/8", ""},     // Too large
+		{"192.168.5.0/31", ""}, // Too small
+		{"fd00::/64", ""},      // Not IPv4
+		{"192.168.5", ""},      // Not a subnet
+		{"192.168.5.0/24", "192.168.6.1"},
+		{"192.168.5.0/24", "192.168.5.0"},
+		{"192.168.5.0/24", "192.168.5.255"},
+	} {
+		if ipNet, err := ParseSubnet(subnet[0], subnet[1], taken); err == nil {
+			t.Errorf("%s (gateway %s) should be invalid, got %v", subnet[0], subnet[1], ipNet)
+		}
+	}
+}
+
+func TestBridgeName(t *testing.T) {
+	name := bridgeName("tenant-a")
+	if len(name) > 15 {
+		t.Errorf("%s is too long for a network interface name", name)
+	}
+	if name == bridgeName("tenant-b") || name != bridgeName("tenant-a") {
+		t.Errorf("The bridges of the networks should be distinct and stable")
+	}
+}
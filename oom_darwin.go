@@ -0,0 +1,7 @@
+package docker
+
+import "errors"
+
+func watchOOM(id string, oom func()) error {
+	return errors.New("OOM notifications are not implemented on darwin")
+}
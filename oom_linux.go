@@ -0,0 +1,76 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// memoryCgroup returns the directory of the memory cgroup of container `id`,
+// once lxc created it.
+func memoryCgroup(id string) (string, error) {
+	mounts, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer mounts.Close()
+	root := ""
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		// cgroup /sys/fs/cgroup/memory cgroup rw,memory 0 0
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[2] == "cgroup" && strings.Contains(","+fields[3]+",", ",memory,") {
+			root = fields[1]
+		}
+	}
+	if root == "" {
+		return "", fmt.Errorf("The memory cgroup isn't mounted")
+	}
+	dir := path.Join(root, "lxc", id)
+	for retries := 0; retries < 50; retries++ {
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return "", fmt.Errorf("No memory cgroup in %s", dir)
+}
+
+// watchOOM calls `oom` each time the processes of container `id` run out of
+// memory, until its cgroup is removed.
+func watchOOM(id string, oom func()) error {
+	dir, err := memoryCgroup(id)
+	if err != nil {
+		return err
+	}
+	control, err := os.Open(path.Join(dir, "memory.oom_control"))
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		return errno
+	}
+	eventfd := os.NewFile(fd, "eventfd")
+	defer eventfd.Close()
+	if err := ioutil.WriteFile(path.Join(dir, "cgroup.event_control"), []byte(fmt.Sprintf("%d %d", fd, control.Fd())), 0700); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	for {
+		if _, err := eventfd.Read(buf); err != nil {
+			return err
+		}
+		// The eventfd is also notified when the cgroup is removed
+		if _, err := os.Stat(dir); err != nil {
+			return nil
+		}
+		oom()
+	}
+}
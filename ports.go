@@ -0,0 +1,98 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A PortBinding publishes a port of a container on a specific port or
+// address of the host.
+type PortBinding struct {
+	HostIp        string // All the addresses of the host if empty
+	HostPort      int    // A random port if 0
+	ContainerPort int
+}
+
+// ParsePortBinding parses a port binding given as
+// [IP:]HOSTPORT:CONTAINERPORT or IP::CONTAINERPORT.
+func ParsePortBinding(spec string) (*PortBinding, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) == 2 {
+		parts = append([]string{""}, parts...)
+	}
+	if len(parts) != 3 || (parts[0] == "" && parts[1] == "") {
+		return nil, fmt.Errorf("Invalid port binding: %s (expected [IP:]HOSTPORT:CONTAINERPORT or IP::CONTAINERPORT)", spec)
+	}
+	binding := &PortBinding{}
+	if parts[0] != "" {
+		ip := net.ParseIP(parts[0])
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("Invalid port binding: %s (%s isn't an IPv4 address)", spec, parts[0])
+		}
+		binding.HostIp = ip.String()
+	}
+	var err error
+	if parts[1] != "" {
+		if binding.HostPort, err = parsePort(parts[1]); err != nil {
+			return nil, fmt.Errorf("Invalid port binding: %s (%s)", spec, err)
+		}
+	}
+	if binding.ContainerPort, err = parsePort(parts[2]); err != nil {
+		return nil, fmt.Errorf("Invalid port binding: %s (%s)", spec, err)
+	}
+	return binding, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %s", value)
+	}
+	return port, nil
+}
+
+// PublishedPorts returns the ports of the container which are published,
+// on random ports of the host or bound to specific ones.
+func (config *Config) PublishedPorts() []int {
+	ports := append([]int{}, config.Ports...)
+	for _, binding := range config.PortBindings {
+		ports = append(ports, binding.ContainerPort)
+	}
+	return ports
+}
+
+// PublicPort returns where the private port `port` of the container is
+// published: HOSTPORT, or IP:HOSTPORT if it is only published on an address
+// of the host. It returns false if the port isn't published.
+func (settings *NetworkSettings) PublicPort(port string) (string, bool) {
+	public, exists := settings.PortMapping[port]
+	if !exists {
+		return "", false
+	}
+	if ip := settings.PortAddresses[port]; ip != "" {
+		return net.JoinHostPort(ip, public), true
+	}
+	return public, true
+}
+
+// MergePorts returns the ports of `a`, followed by those of `b` which
+// aren't in `a`.
+func MergePorts(a, b []int) []int {
+	var merged []int
+	merged = append(merged, a...)
+	for _, port := range b {
+		found := false
+		for _, p := range merged {
+			if p == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, port)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,26 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestParsePortBinding(t *testing.T) {
+	for spec, expected := range map[string]PortBinding{
+		"8080:80":           {HostPort: 8080, ContainerPort: 80},
+		"10.0.0.5:8080:80":  {HostIp: "10.0.0.5", HostPort: 8080, ContainerPort: 80},
+		"10.0.0.5::80":      {HostIp: "10.0.0.5", ContainerPort: 80},
+		"127.0.0.1:5432:54": {HostIp: "127.0.0.1", HostPort: 5432, ContainerPort: 54},
+	} {
+		binding, err := ParsePortBinding(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+		} else if *binding != expected {
+			t.Errorf("%s: expected %v, got %v", spec, expected, *binding)
+		}
+	}
+	for _, spec := range []string{"80", "::80", "8080:", "a:80", "10.0.0.5:8080:80:1", "fe80::1:8080:80", "10.0.0.5:70000:80", "0:80"} {
+		if _, err := ParsePortBinding(spec); err == nil {
+			t.Errorf("%s should be invalid", spec)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long a UDP proxy remembers a client, when neither it nor the backend
+// sent a datagram
+const udpConnTimeout = 90 * time.Second
+
+// Proxy forwards the connections of its frontend address to its backend
+// address in userland, where NAT isn't available.
+type Proxy interface {
+	// Run forwards the connections until Close is called
+	Run()
+	Close() error
+	FrontendAddr() net.Addr
+}
+
+// newProxy listens on `frontend`, a *net.TCPAddr or a *net.UDPAddr, and
+// returns the proxy forwarding it to `backend`.
+func newProxy(frontend, backend net.Addr) (Proxy, error) {
+	switch frontend := frontend.(type) {
+	case *net.TCPAddr:
+		listener, err := net.ListenTCP("tcp", frontend)
+		if err != nil {
+			return nil, err
+		}
+		return &tcpProxy{listener: listener, backend: backend.(*net.TCPAddr)}, nil
+	case *net.UDPAddr:
+		conn, err := net.ListenUDP("udp", frontend)
+		if err != nil {
+			return nil, err
+		}
+		return &udpProxy{listener: conn, backend: backend.(*net.UDPAddr), timeout: udpConnTimeout, conns: make(map[string]*net.UDPConn)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported address type: %T", frontend)
+}
+
+type tcpProxy struct {
+	listener *net.TCPListener
+	backend  *net.TCPAddr
+}
+
+func (proxy *tcpProxy) Run() {
+	for {
+		client, err := proxy.listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go proxy.forward(client)
+	}
+}
+
+func (proxy *tcpProxy) forward(client *net.TCPConn) {
+	defer client.Close()
+	backend, err := net.DialTCP("tcp", nil, proxy.backend)
+	if err != nil {
+		log.Printf("Unable to forward %v to %v: %v", client.RemoteAddr(), proxy.backend, err)
+		return
+	}
+	defer backend.Close()
+	done := make(chan bool, 2)
+	// Each half closes on its own, so that the peers see the end of stream
+	copyHalf := func(dst, src *net.TCPConn) {
+		io.Copy(dst, src)
+		dst.CloseWrite()
+		src.CloseRead()
+		done <- true
+	}
+	go copyHalf(backend, client)
+	go copyHalf(client, backend)
+	<-done
+	<-done
+}
+
+func (proxy *tcpProxy) Close() error {
+	return proxy.listener.Close()
+}
+
+func (proxy *tcpProxy) FrontendAddr() net.Addr {
+	return proxy.listener.Addr()
+}
+
+// udpProxy forwards the datagrams of each client through a connection of
+// its own to the backend, so that the replies find their way back. The
+// connection of a client is its NAT entry: it is forgotten once idle for
+// `timeout`.
+type udpProxy struct {
+	listener *net.UDPConn
+	backend  *net.UDPAddr
+	timeout  time.Duration
+
+	lock  sync.Mutex
+	conns map[string]*net.UDPConn
+}
+
+func (proxy *udpProxy) Run() {
+	buf := make([]byte, 65507)
+	for {
+		n, client, err := proxy.listener.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Stopping the UDP proxy of %v: %v", proxy.listener.LocalAddr(), err)
+			}
+			return
+		}
+		conn, err := proxy.conn(client)
+		if err != nil {
+			log.Printf("Unable to forward %v to %v: %v", client, proxy.backend, err)
+			continue
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			log.Printf("Unable to forward %v to %v: %v", client, proxy.backend, err)
+			continue
+		}
+		// The client is still active, even if the backend doesn't reply
+		conn.SetReadDeadline(time.Now().Add(proxy.timeout))
+	}
+}
+
+// conn returns the connection of `client` to the backend, which it opens
+// on its first datagram.
+func (proxy *udpProxy) conn(client *net.UDPAddr) (*net.UDPConn, error) {
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+	if conn, exists := proxy.conns[client.String()]; exists {
+		return conn, nil
+	}
+	conn, err := net.DialUDP("udp", nil, proxy.backend)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(proxy.timeout))
+	proxy.conns[client.String()] = conn
+	go proxy.replies(client, conn)
+	return conn, nil
+}
+
+// replies sends the replies of the backend back to `client`, until the
+// connection is idle for the timeout of the proxy.
+func (proxy *udpProxy) replies(client *net.UDPAddr, conn *net.UDPConn) {
+	defer func() {
+		proxy.lock.Lock()
+		if proxy.conns[client.String()] == conn {
+			delete(proxy.conns, client.String())
+		}
+		proxy.lock.Unlock()
+		conn.Close()
+	}()
+	buf := make([]byte, 65507)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := proxy.listener.WriteToUDP(buf[:n], client); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(proxy.timeout))
+	}
+}
+
+// clients returns the number of clients the proxy currently remembers.
+func (proxy *udpProxy) clients() int {
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+	return len(proxy.conns)
+}
+
+func (proxy *udpProxy) Close() error {
+	err := proxy.listener.Close()
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+	for _, conn := range proxy.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (proxy *udpProxy) FrontendAddr() net.Addr {
+	return proxy.listener.LocalAddr()
+}
@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPProxy(t *testing.T) {
+	backend, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte("echo " + line))
+			}()
+		}
+	}()
+	proxy, err := newProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, backend.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("hello\n"))
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != "echo hello\n" {
+			t.Fatalf("Expected 'echo hello', got '%s'", reply)
+		}
+	}
+	if err := proxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("tcp", proxy.FrontendAddr().String()); err == nil {
+		conn.Close()
+		t.Fatalf("A closed proxy shouldn't accept connections")
+	}
+}
+
+func TestUDPProxy(t *testing.T) {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := backend.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteToUDP(append([]byte("echo "), buf[:n]...), addr)
+		}
+	}()
+	proxy, err := newProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	udp := proxy.(*udpProxy)
+	udp.timeout = 500 * time.Millisecond
+	go proxy.Run()
+	// Each client gets its own replies
+	for _, msg := range []string{"hello", "world"} {
+		conn, err := net.Dial("udp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "echo "+msg {
+			t.Fatalf("Expected 'echo %s', got '%s'", msg, buf[:n])
+		}
+	}
+	if n := udp.clients(); n != 2 {
+		t.Fatalf("Expected a NAT entry per client, got %d", n)
+	}
+	// The idle clients are forgotten
+	for deadline := time.Now().Add(5 * time.Second); udp.clients() != 0; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("The idle clients weren't forgotten: %d left", udp.clients())
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package rcli
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+)
+
+// A Command describes a command of a service, for help and discovery.
+type Command struct {
+	Name        string
+	Summary     string // One line, for the list of commands
+	Usage       string // The arguments, eg. "[OPTIONS] CONTAINER"
+	Description string
+	Flags       []Flag
+}
+
+type Flag struct {
+	Name    string
+	Usage   string
+	Default string
+}
+
+// A Catalog is a service which lists the commands it documents. Its catalog
+// is served by 'help -json' and by GET /commands over HTTP.
+type Catalog interface {
+	Service
+	Commands() []*Command
+}
+
+// describer is the output of a command being described: Subcmd records the
+// command's flags, and the command stops at parsing them.
+type describer struct {
+	command *Command
+	flags   *flag.FlagSet
+}
+
+func (d *describer) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Describe returns the usage, description and flags of command `name` of
+// `service`. The command is called with "-help", so it must not do anything
+// when it fails to parse its arguments.
+func Describe(service Service, name string) (*Command, error) {
+	method := getMethod(service, name)
+	if method == nil {
+		return nil, errors.New("No such command: " + name)
+	}
+	d := &describer{command: &Command{Name: name}}
+	if err := method(ioutil.NopCloser(strings.NewReader("")), d, "-help"); err != nil {
+		return nil, err
+	}
+	if d.flags != nil {
+		d.flags.VisitAll(func(f *flag.Flag) {
+			d.command.Flags = append(d.command.Flags, Flag{Name: f.Name, Usage: f.Usage, Default: f.DefValue})
+		})
+	}
+	return d.command, nil
+}
+
+// CommandNames returns the names of the commands of `service`, its methods
+// CmdNAME, sorted.
+func CommandNames(service Service) []string {
+	var names []string
+	t, v := reflect.TypeOf(service), reflect.ValueOf(service)
+	for i := 0; i < t.NumMethod(); i++ {
+		name := t.Method(i).Name
+		if !strings.HasPrefix(name, "Cmd") || len(name) == 3 {
+			continue
+		}
+		if _, ok := v.Method(i).Interface().(func(io.ReadCloser, io.Writer, ...string) error); ok {
+			names = append(names, strings.ToLower(name[3:]))
+		}
+	}
+	return names
+}
@@ -0,0 +1,356 @@
+package rcli
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Version 2 of the protocol frames the output of a call, so that errors, exit
+// statuses and progress can be told apart from the output. A version 2 client
+// sends its call as a JSON object instead of an array:
+//
+//	{"Version": 2, "Args": ["ps", "-a"]}
+//
+// and the server answers with frames: a byte for the type of the frame, the
+// length of the payload as a 32-bit big-endian integer, then the payload. The
+// first frame is a version frame, and the last an exit frame. The standard
+// input is still sent as a raw stream, half-closed at EOF.
+const PROTOCOLVERSION = 2
+
+const (
+	FrameStdout       byte = iota + 1
+	FrameStderr            // Diagnostics which shouldn't be mixed with the output
+	FrameError             // The error which ended the call
+	FrameExit              // The exit status of the call, in decimal
+	FrameProgress          // Progress of a long-running operation, for humans
+	FrameVersion           // The version of the protocol spoken by the server, in decimal
+	FrameHeartbeat         // Sent periodically to detect disconnected clients, and ignored
+	FrameProgressJSON      // Progress of a long-running operation, as a JSON ProgressMessage
+)
+
+const heartbeatInterval = 5 * time.Second
+
+// Frames larger than this are rejected, as garbage from a legacy server.
+const maxFrameSize = 16 << 20
+
+// An ExitStatus error ends a call with a specific exit status, without an
+// error message, eg. the exit code of a container.
+type ExitStatus int
+
+// The exit status of calls which fail with an error, set apart from the exit
+// codes of the programs run by the commands, like the shells do.
+const StatusError = 125
+
+func (status ExitStatus) Error() string {
+	return fmt.Sprintf("Exit status %d", int(status))
+}
+
+type request struct {
+	Version int
+	Args    []string
+}
+
+// output is the output of a call, shared by its streams. It serializes
+// their writes, and tells when the client is gone: the call is cancelled as
+// soon as a write fails.
+type output struct {
+	sync.Mutex
+	w      io.Writer
+	framed bool // Whether to write frames, or the raw payloads of the legacy protocol
+	json   bool // Whether to write the frames as JSON lines of ProgressMessages instead
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newOutput(w io.Writer, framed bool) *output {
+	return &output{w: w, framed: framed, done: make(chan struct{})}
+}
+
+func (out *output) cancel() {
+	out.once.Do(func() { close(out.done) })
+}
+
+func (out *output) WriteFrame(kind byte, payload []byte) error {
+	out.Lock()
+	defer out.Unlock()
+	err := out.writeFrame(kind, payload)
+	if err != nil {
+		out.cancel()
+	}
+	return err
+}
+
+func (out *output) writeFrame(kind byte, payload []byte) error {
+	if out.json {
+		lines, err := jsonLines(kind, payload)
+		if err != nil {
+			return err
+		}
+		_, err = out.w.Write(lines)
+		return err
+	}
+	if !out.framed {
+		if kind == FrameProgressJSON {
+			payload = progressText(payload)
+		}
+		_, err := out.w.Write(payload)
+		return err
+	}
+	header := make([]byte, 5)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := out.w.Write(header); err != nil {
+		return err
+	}
+	_, err := out.w.Write(payload)
+	return err
+}
+
+// stream writes frames of a single type.
+type stream struct {
+	out  *output
+	kind byte
+	done <-chan struct{} // Closed when the call is cancelled
+}
+
+func newStream(out *output) *stream {
+	return &stream{out, FrameStdout, out.done}
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := s.out.WriteFrame(s.kind, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Stderr returns the standard error of the call writing its output to
+// `stdout`. Legacy calls only have one output stream, so it is `stdout`.
+func Stderr(stdout io.Writer) io.Writer {
+	if s, ok := stdout.(*stream); ok {
+		return &stream{s.out, FrameStderr, s.done}
+	}
+	return stdout
+}
+
+// Progress returns the stream for progress reports of the call writing its
+// output to `stdout`. Legacy calls only have one output stream, so it is `stdout`.
+func Progress(stdout io.Writer) io.Writer {
+	if s, ok := stdout.(*stream); ok {
+		return &stream{s.out, FrameProgress, s.done}
+	}
+	return stdout
+}
+
+// Done returns a channel which is closed when the client of the call writing
+// its output to `stdout` disconnects, so that long operations can be aborted.
+// It is never closed for outputs which aren't calls.
+func Done(stdout io.Writer) <-chan struct{} {
+	if s, ok := stdout.(*stream); ok {
+		return s.done
+	}
+	return nil
+}
+
+// WithCancel returns an output writing to `stdout`, whose Done channel is also
+// closed by calling `cancel`, eg. to abort a call after a timeout. `cancel`
+// must be called once the output is no longer used.
+func WithCancel(stdout io.Writer) (w io.Writer, cancel func()) {
+	s, ok := stdout.(*stream)
+	if !ok {
+		s = newStream(newOutput(stdout, false))
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	cancel = func() { once.Do(func() { close(done) }) }
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-done:
+		}
+	}()
+	return &stream{s.out, s.kind, done}, cancel
+}
+
+// ReadFrame reads the next frame sent by a version 2 server.
+func ReadFrame(r io.Reader) (kind byte, payload []byte, err error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, errors.New("Invalid frame")
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// serveFramed runs a version 2 call, and reports its outcome in frames.
+func serveFramed(conn io.Writer, stdin io.ReadCloser, service Service, args []string) error {
+	frames := newOutput(conn, true)
+	if err := frames.WriteFrame(FrameVersion, []byte(strconv.Itoa(PROTOCOLVERSION))); err != nil {
+		return err
+	}
+	// Silent calls notice that their client is gone with the heartbeats
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if frames.WriteFrame(FrameHeartbeat, nil) != nil {
+					return
+				}
+			case <-finished:
+				return
+			}
+		}
+	}()
+	status := 0
+	if err := call(service, stdin, newStream(frames), args...); err != nil {
+		if exit, ok := err.(ExitStatus); ok {
+			status = int(exit)
+		} else {
+			status = StatusError
+			if err := frames.WriteFrame(FrameError, []byte(err.Error())); err != nil {
+				return err
+			}
+		}
+	}
+	return frames.WriteFrame(FrameExit, []byte(strconv.Itoa(status)))
+}
+
+// A Conn is the connection of a call, over TCP or TLS. Closing its writing
+// end sends the end of the input of the call.
+type Conn interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// A Session is a call to a remote service, with the standard input of the
+// call as its writing end.
+type Session struct {
+	Conn
+	Version int           // The version of the protocol spoken by the server
+	frames  *bufio.Reader // nil with legacy servers
+}
+
+// Dial issues a call like Call, with version 2 of the protocol. Servers which
+// don't speak it are called again with the legacy protocol.
+func Dial(proto, addr string, args ...string) (*Session, error) {
+	conn, err := net.Dial(proto, addr)
+	if err != nil {
+		return nil, err
+	}
+	if session, err := handshake(conn.(*net.TCPConn), args); session != nil || err != nil {
+		return session, err
+	}
+	// A legacy server failed to parse the call and closes the connection
+	legacy, err := Call(proto, addr, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Conn: legacy, Version: 1}, nil
+}
+
+// DialTLS issues a call like Dial, over TLS with the settings `config`, eg.
+// the certificate which authenticates the client. Servers listening on TLS
+// all speak version 2 of the protocol.
+func DialTLS(addr string, config *tls.Config, args ...string) (*Session, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	session, err := handshake(conn, args)
+	if session == nil && err == nil {
+		return nil, fmt.Errorf("The server at %s refused the call: it doesn't accept our certificate, or doesn't speak version %d of the protocol", addr, PROTOCOLVERSION)
+	}
+	return session, err
+}
+
+// handshake sends the call `args` on `conn` with version 2 of the protocol.
+// It returns a nil session, and closes `conn`, if the server doesn't speak
+// it.
+func handshake(conn Conn, args []string) (*Session, error) {
+	cmd, err := json.Marshal(&request{Version: PROTOCOLVERSION, Args: args})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintln(conn, string(cmd)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	if kind, payload, err := ReadFrame(r); err == nil && kind == FrameVersion {
+		version, err := strconv.Atoi(string(payload))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &Session{Conn: conn, Version: version, frames: r}, nil
+	}
+	conn.Close()
+	return nil, nil
+}
+
+// Receive copies the output of the call to `stdout` and its diagnostics and
+// errors to `stderr`, until the call ends. It returns the exit status of the
+// call, which is always 0 with legacy servers.
+func (s *Session) Receive(stdout, stderr io.Writer) (int, error) {
+	if s.frames == nil {
+		_, err := io.Copy(stdout, s.Conn)
+		return 0, err
+	}
+	progress := newProgressRenderer(stderr)
+	defer progress.Break()
+	for {
+		kind, payload, err := ReadFrame(s.frames)
+		if err == io.EOF {
+			return 1, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 1, err
+		}
+		if kind != FrameProgressJSON && kind != FrameHeartbeat {
+			progress.Break()
+		}
+		switch kind {
+		case FrameStdout:
+			_, err = stdout.Write(payload)
+		case FrameStderr, FrameProgress:
+			_, err = stderr.Write(payload)
+		case FrameProgressJSON:
+			var msg ProgressMessage
+			if json.Unmarshal(payload, &msg) == nil {
+				err = progress.Render(&msg)
+			}
+		case FrameError:
+			_, err = fmt.Fprintf(stderr, "Error: %s\n", payload)
+		case FrameExit:
+			return strconv.Atoi(string(payload))
+		}
+		// Frames of unknown types come from newer servers, and are skipped
+		if err != nil {
+			return 1, err
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package rcli
 
 import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"path"
 	"fmt"
+	"strconv"
 )
 
 
@@ -18,15 +23,66 @@ func URLToCall(u *url.URL) (method string, args []string) {
 
 
 func ListenAndServeHTTP(addr string, service Service) error {
-	return http.ListenAndServe(addr, http.HandlerFunc(
+	return http.ListenAndServe(addr, HTTPHandler(service))
+}
+
+// HTTPHandler returns the handler running the commands of `service` called
+// with URLs, so that they can be served along with other handlers.
+func HTTPHandler(service Service) http.Handler {
+	return http.HandlerFunc(
 		func (w http.ResponseWriter, r *http.Request) {
+			if catalog, ok := service.(Catalog); ok && r.URL.Path == "/commands" {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(catalog.Commands())
+				return
+			}
 			cmd, args := URLToCall(r.URL)
-			if err := call(service, r.Body, &AutoFlush{w}, append([]string{cmd}, args...)...); err != nil {
-				fmt.Fprintf(w, "Error: " + err.Error() + "\n")
+			if headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "tcp") {
+				framed := headerContains(r.Header, "Accept", FramesType)
+				if err := serveHijacked(w, service, framed, append([]string{cmd}, args...)); err != nil {
+					log.Printf("Error: %v", err)
+				}
+				return
+			}
+			out := newOutput(&AutoFlush{w}, false)
+			// Clients which accept JSON lines get the output as ProgressMessages
+			if headerContains(r.Header, "Accept", JSONStreamType) {
+				w.Header().Set("Content-Type", JSONStreamType)
+				out.json = true
+			}
+			// The context of the request is done when the client disconnects,
+			// or when the request is over
+			go func() {
+				<-r.Context().Done()
+				out.cancel()
+			}()
+			// The exit status follows the output, as a trailer
+			w.Header().Set("Trailer", ExitStatusTrailer)
+			status := 0
+			if err := call(service, r.Body, newStream(out), append([]string{cmd}, args...)...); err != nil {
+				if exit, ok := err.(ExitStatus); ok {
+					status = int(exit)
+				} else if status = StatusError; out.json {
+					out.WriteFrame(FrameError, []byte(err.Error()))
+				} else {
+					fmt.Fprintf(w, "Error: %s\n", err)
+				}
 			}
-		}))
+			if out.json && status != 0 {
+				out.WriteFrame(FrameExit, []byte(strconv.Itoa(status)))
+			}
+			w.Header().Set(ExitStatusTrailer, strconv.Itoa(status))
+		})
 }
 
+// The trailer of the responses of HTTP calls with the exit status of the
+// call, in decimal
+const ExitStatusTrailer = "Docker-Exit-Status"
+
+// The content type of hijacked calls which speak version 2 of the protocol
+const FramesType = "application/vnd.docker.frames"
+
+
 
 type AutoFlush struct {
 	http.ResponseWriter
@@ -39,3 +95,45 @@ func (w *AutoFlush) Write(data []byte) (int, error) {
 	}
 	return ret, err
 }
+
+// Requests with the headers "Connection: Upgrade" and "Upgrade: tcp" are
+// upgraded to a raw stream, like the calls over TCP: the input of the call is
+// sent after the request, and half-closed at EOF, and its output follows the
+// response. Interactive calls such as 'run -i' and 'attach -i' need it, since
+// the body of a request is otherwise read whole before the command runs.
+// Clients which accept application/vnd.docker.frames get the output in the
+// frames of version 2 of the protocol instead, exit status included.
+func serveHijacked(w http.ResponseWriter, service Service, framed bool, args []string) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "The connection can't be upgraded", http.StatusInternalServerError)
+		return errors.New("The connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	defer closeConn(conn)
+	contentType := "application/vnd.docker.raw-stream"
+	if framed {
+		contentType = FramesType
+	}
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 101 UPGRADED\r\n"+
+		"Content-Type: %s\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: tcp\r\n\r\n", contentType); err != nil {
+		return err
+	}
+	// The reader of the connection may have buffered the start of the input
+	stdin := ioutil.NopCloser(rw.Reader)
+	if framed {
+		return serveFramed(conn, stdin, service, args)
+	}
+	if err := call(service, stdin, newStream(newOutput(conn, false)), args...); err != nil {
+		// The raw stream has no room for exit statuses
+		if _, ok := err.(ExitStatus); !ok {
+			fmt.Fprintf(conn, "Error: %s\n", err)
+		}
+	}
+	return nil
+}
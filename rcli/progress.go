@@ -0,0 +1,214 @@
+package rcli
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/future"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Long operations such as pull, push and commit report their progress with
+// ProgressMessages. Version 2 clients receive them in FrameProgressJSON frames
+// and render them as progress bars, HTTP clients which accept
+// application/x-json-stream receive the whole output of the call as JSON
+// lines of ProgressMessages, and the other clients receive them as text.
+
+// The content type of the output of HTTP calls as JSON lines
+const JSONStreamType = "application/x-json-stream"
+
+// A ProgressMessage reports the progress of an operation on an object, eg.
+// the download of a blob: {"Status": "Downloading", "Id": "sha256:0123",
+// "Current": 1024, "Total": 4096}. Current and Total count bytes, and Total
+// is 0 when it is unknown.
+type ProgressMessage struct {
+	Status  string `json:",omitempty"`
+	Id      string `json:",omitempty"`
+	Current int64  `json:",omitempty"`
+	Total   int64  `json:",omitempty"`
+	Error   string `json:",omitempty"`
+	// The exit status of the call, last, unless it is 0
+	ExitStatus int `json:",omitempty"`
+}
+
+// How often the progress of a stream is reported
+const progressInterval = 500 * time.Millisecond
+
+// String renders the message as a line of text, without the bar.
+func (msg *ProgressMessage) String() string {
+	if msg.Error != "" {
+		return "Error: " + msg.Error
+	}
+	s := msg.Status
+	if msg.Id != "" {
+		s = msg.Id + ": " + s
+	}
+	if msg.Total > 0 {
+		s += fmt.Sprintf(" %s/%s", future.HumanSize(msg.Current), future.HumanSize(msg.Total))
+	} else if msg.Current > 0 {
+		s += " " + future.HumanSize(msg.Current)
+	}
+	return s
+}
+
+// SendProgress reports `msg` on the output of the call writing to `stdout`.
+// Outputs which aren't calls get it as a line of text.
+func SendProgress(stdout io.Writer, msg *ProgressMessage) error {
+	s, ok := stdout.(*stream)
+	if !ok {
+		_, err := fmt.Fprintln(stdout, msg.String())
+		return err
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.out.WriteFrame(FrameProgressJSON, data)
+}
+
+type progressReader struct {
+	r      io.Reader
+	stdout io.Writer
+	msg    ProgressMessage
+	last   time.Time
+	done   bool
+}
+
+// ProgressReader returns a reader reading `r`, which reports how much of it
+// was read on `stdout` with SendProgress, as operation `status` on `id`.
+// `total` is the size of `r`, or 0 if it is unknown.
+func ProgressReader(r io.Reader, stdout io.Writer, id, status string, total int64) io.Reader {
+	p := &progressReader{r: r, stdout: stdout, msg: ProgressMessage{Status: status, Id: id, Total: total}, last: time.Now()}
+	SendProgress(stdout, &p.msg)
+	return p
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.msg.Current += int64(n)
+	if p.done {
+		return n, err
+	}
+	if err != nil || time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		p.done = err != nil
+		SendProgress(p.stdout, &p.msg)
+	}
+	return n, err
+}
+
+// jsonLines returns the frame `kind` with `payload` as JSON lines of
+// ProgressMessages. The text of the output becomes their status, line by
+// line.
+func jsonLines(kind byte, payload []byte) ([]byte, error) {
+	var messages []*ProgressMessage
+	switch kind {
+	case FrameProgressJSON:
+		return append(append([]byte{}, payload...), '\n'), nil
+	case FrameStdout, FrameStderr, FrameProgress:
+		for _, line := range strings.Split(strings.TrimRight(string(payload), "\n"), "\n") {
+			messages = append(messages, &ProgressMessage{Status: strings.TrimRight(line, "\r")})
+		}
+	case FrameError:
+		messages = append(messages, &ProgressMessage{Error: string(payload)})
+	case FrameExit:
+		status, err := strconv.Atoi(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &ProgressMessage{ExitStatus: status})
+	}
+	var lines []byte
+	for _, msg := range messages {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(append(lines, data...), '\n')
+	}
+	return lines, nil
+}
+
+// progressText returns the FrameProgressJSON `payload` as a line of text, for
+// the clients of the legacy protocol.
+func progressText(payload []byte) []byte {
+	var msg ProgressMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil
+	}
+	return []byte(msg.String() + "\n")
+}
+
+// A progressRenderer renders the progress messages received by a client.
+// On terminals, the progress of each object is a bar redrawn in place; other
+// outputs only get a line when the operation changes or completes. Progress
+// sent to the output of another call, eg. when a daemon calls another one,
+// is passed on as is.
+type progressRenderer struct {
+	w        io.Writer
+	terminal bool
+	last     *ProgressMessage
+	open     bool // Whether the cursor is at the end of a bar
+}
+
+func newProgressRenderer(w io.Writer) *progressRenderer {
+	terminal := false
+	if f, ok := w.(*os.File); ok {
+		if info, err := f.Stat(); err == nil {
+			terminal = info.Mode()&os.ModeCharDevice != 0
+		}
+	}
+	return &progressRenderer{w: w, terminal: terminal}
+}
+
+// progressBar returns a bar of `width` characters filled by `current` of
+// `total`.
+func progressBar(current, total int64, width int) string {
+	filled := width
+	if current < total {
+		filled = int(current * int64(width) / total)
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < width {
+		bar += ">" + strings.Repeat(" ", width-filled-1)
+	}
+	return "[" + bar + "]"
+}
+
+func (p *progressRenderer) Render(msg *ProgressMessage) error {
+	if _, ok := p.w.(*stream); ok {
+		return SendProgress(p.w, msg)
+	}
+	same := p.last != nil && p.last.Id == msg.Id && p.last.Status == msg.Status
+	complete := msg.Total > 0 && msg.Current >= msg.Total
+	p.last = msg
+	if !p.terminal {
+		if same && !complete {
+			return nil
+		}
+		_, err := fmt.Fprintln(p.w, msg.String())
+		return err
+	}
+	line := msg.String()
+	if msg.Total > 0 && msg.Error == "" {
+		line = fmt.Sprintf("%s %s", progressBar(msg.Current, msg.Total, 40), line)
+	}
+	if p.open && !same {
+		p.Break()
+	}
+	// Redraw the bar in place, after clearing it
+	_, err := fmt.Fprintf(p.w, "\r\033[K%s", line)
+	p.open = true
+	return err
+}
+
+// Break ends the bar being drawn, before other output is written.
+func (p *progressRenderer) Break() {
+	if p.open {
+		fmt.Fprintln(p.w)
+		p.open = false
+	}
+}
@@ -1,6 +1,7 @@
 package rcli
 
 import (
+	"crypto/tls"
 	"io"
 	"io/ioutil"
 	"net"
@@ -8,6 +9,8 @@ import (
 	"fmt"
 	"encoding/json"
 	"bufio"
+	"strings"
+	"time"
 )
 
 // Connect to a remote endpoint using protocol `proto` and address `addr`,
@@ -36,6 +39,22 @@ func ListenAndServe(proto, addr string, service Service) error {
 		return err
 	}
 	log.Printf("Listening for RCLI/%s on %s\n", proto, addr)
+	return serveListener(listener, service)
+}
+
+// Listen on TCP address `addr` for incoming rcli calls over TLS, with the
+// settings `config`, and pass them to `service`. Whether clients must
+// present a certificate, and signed by whom, is up to `config`.
+func ListenAndServeTLS(addr string, config *tls.Config, service Service) error {
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	log.Printf("Listening for RCLI/tls on %s\n", addr)
+	return serveListener(listener, service)
+}
+
+func serveListener(listener net.Listener, service Service) error {
 	defer listener.Close()
 	for {
 		if conn, err := listener.Accept(); err != nil {
@@ -46,25 +65,47 @@ func ListenAndServe(proto, addr string, service Service) error {
 					log.Printf("Error: " + err.Error() + "\n")
 					fmt.Fprintf(conn, "Error: " + err.Error() + "\n")
 				}
-				conn.Close()
+				closeConn(conn)
 			}()
 		}
 	}
 	return nil
 }
 
+// How long to wait for the client to stop sending its input once a call is over
+const lingerTimeout = 5 * time.Second
+
+// closeConn closes the connection of a call which is over. Closing a TCP
+// connection with unread input resets it, and the client may lose the end
+// of the output: so the output is half-closed first, and the input drained
+// until the client closes the connection too.
+func closeConn(conn net.Conn) {
+	if c, ok := conn.(Conn); ok {
+		c.CloseWrite()
+		c.SetReadDeadline(time.Now().Add(lingerTimeout))
+		io.Copy(ioutil.Discard, c)
+	}
+	conn.Close()
+}
 
 // Parse an rcli call on a new connection, and pass it to `service` if it
-// is valid.
+// is valid. Calls sent as a JSON object use version 2 of the protocol (see
+// PROTOCOLVERSION), and arrays the legacy protocol.
 func Serve(conn io.ReadWriter, service Service) error {
 	r := bufio.NewReader(conn)
 	var args []string
 	if line, err := r.ReadString('\n'); err != nil {
 		return err
+	} else if strings.HasPrefix(line, "{") {
+		var req request
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			return err
+		}
+		return serveFramed(conn, ioutil.NopCloser(r), service, req.Args)
 	} else if err := json.Unmarshal([]byte(line), &args); err != nil {
 		return err
 	} else {
-		return call(service, ioutil.NopCloser(r), conn, args...)
+		return call(service, ioutil.NopCloser(r), newStream(newOutput(conn, false)), args...)
 	}
 	return nil
 }
@@ -0,0 +1,57 @@
+package rcli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+type catService struct{}
+
+func (catService) Name() string { return "cat" }
+func (catService) Help() string { return "cat\n" }
+
+// CmdCat copies its input to its output, then says it is done, like
+// 'sh -c "cat; echo done"'.
+func (catService) CmdCat(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	input, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "%sdone\n", input)
+	return err
+}
+
+// The end of the input of the client reaches the command as a half-close,
+// and the output which follows it isn't cut off:
+// 'echo hi | docker run -i base sh -c "cat; echo done"'
+func TestStdinEOF(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveListener(listener, catService{})
+	defer listener.Close()
+	session, err := Dial("tcp", listener.Addr().String(), "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if _, err := io.WriteString(session, "hi\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	status, err := session.Receive(&stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 0 || stdout.String() != "hi\ndone\n" {
+		t.Fatalf("Unexpected output: %q (status %d, stderr %q)", stdout.String(), status, stderr.String())
+	}
+}
@@ -8,6 +8,7 @@ package rcli
 // are the usual suspects.
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"reflect"
@@ -17,12 +18,31 @@ import (
 	"errors"
 )
 
+// APIVERSION is the version of the protocol. It changes when commands, their
+// options or their output change incompatibly.
+const APIVERSION = 1
+
 type Service interface {
 	Name() string
 	Help() string
 }
 
 type Cmd func(io.ReadCloser, io.Writer, ...string) error
+
+// A Dispatcher is a service which wraps the commands it runs, eg. to limit
+// their duration or concurrency.
+type Dispatcher interface {
+	Service
+	Dispatch(name string, cmd Cmd) Cmd
+}
+
+// A Fallback is a service which runs the commands it doesn't implement with
+// something else, eg. external programs. Fallback returns nil for commands
+// which don't exist at all.
+type Fallback interface {
+	Service
+	Fallback(name string) Cmd
+}
 type CmdMethod func(Service, io.ReadCloser, io.Writer, ...string) error
 
 
@@ -43,6 +63,9 @@ func call(service Service, stdin io.ReadCloser, stdout io.Writer, args ...string
 	}
 	method := getMethod(service, cmd)
 	if method != nil {
+		if dispatcher, ok := service.(Dispatcher); ok {
+			method = dispatcher.Dispatch(cmd, method)
+		}
 		return method(stdin, stdout, flags.Args()[1:]...)
 	}
 	return errors.New("No such command: " + cmd)
@@ -51,13 +74,21 @@ func call(service Service, stdin io.ReadCloser, stdout io.Writer, args ...string
 func getMethod(service Service, name string) Cmd {
 	if name == "help" {
 		return func(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+			if catalog, ok := service.(Catalog); ok && len(args) == 1 && (args[0] == "-json" || args[0] == "--json") {
+				return json.NewEncoder(stdout).Encode(catalog.Commands())
+			}
 			if len(args) == 0 {
 				stdout.Write([]byte(service.Help()))
 			} else {
 				if method := getMethod(service, args[0]); method == nil {
 					return errors.New("No such command: " + args[0])
 				} else {
-					method(stdin, stdout, "--help")
+					// The usage is printed by the command itself, eg. a
+					// plugin: it runs under the same rules as the command
+					if dispatcher, ok := service.(Dispatcher); ok {
+						method = dispatcher.Dispatch(args[0], method)
+					}
+					return method(stdin, stdout, "--help")
 				}
 			}
 			return nil
@@ -66,6 +97,9 @@ func getMethod(service Service, name string) Cmd {
 	methodName := "Cmd"+strings.ToUpper(name[:1])+strings.ToLower(name[1:])
 	method, exists := reflect.TypeOf(service).MethodByName(methodName)
 	if !exists {
+		if fallback, ok := service.(Fallback); ok {
+			return fallback.Fallback(name)
+		}
 		return nil
 	}
 	return func(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
@@ -85,6 +119,11 @@ func getMethod(service Service, name string) Cmd {
 func Subcmd(output io.Writer, name, signature, description string) *flag.FlagSet {
 	flags := flag.NewFlagSet(name, flag.ContinueOnError)
 	flags.SetOutput(output)
+	if d, ok := output.(*describer); ok && d.flags == nil {
+		d.command.Usage = signature
+		d.command.Description = description
+		d.flags = flags
+	}
 	flags.Usage = func() {
 		fmt.Fprintf(output, "\nUsage: docker %s %s\n\n%s\n\n", name, signature, description)
 		flags.PrintDefaults()
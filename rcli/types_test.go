@@ -0,0 +1,47 @@
+package rcli
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// guardedService denies its command "secret", usage included.
+type guardedService struct {
+	dispatched []string
+}
+
+func (s *guardedService) Name() string { return "guarded" }
+func (s *guardedService) Help() string { return "guarded\n" }
+
+func (s *guardedService) Dispatch(name string, cmd Cmd) Cmd {
+	s.dispatched = append(s.dispatched, name)
+	return func(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+		if name == "secret" {
+			return errors.New("Not authorized")
+		}
+		return cmd(stdin, stdout, args...)
+	}
+}
+
+func (s *guardedService) CmdSecret(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	_, err := io.WriteString(stdout, "Usage: secret\n")
+	return err
+}
+
+func TestHelpDispatched(t *testing.T) {
+	service := &guardedService{}
+	var stdout bytes.Buffer
+	if err := call(service, ioutil.NopCloser(&bytes.Buffer{}), &stdout, "help", "secret"); err == nil || err.Error() != "Not authorized" {
+		t.Fatalf("Expected the usage of secret to be denied, got %v", err)
+	}
+	if stdout.Len() != 0 {
+		t.Fatalf("Unexpected output: %q", stdout.String())
+	}
+	if expected := []string{"help", "secret"}; !reflect.DeepEqual(service.dispatched, expected) {
+		t.Fatalf("Expected %v to be dispatched, got %v", expected, service.dispatched)
+	}
+}
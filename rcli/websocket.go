@@ -0,0 +1,238 @@
+package rcli
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The HTTP listener upgrades some requests to WebSockets (RFC 6455), so that
+// browsers can stream the input and the output of containers. Only the server
+// side is implemented.
+
+// The types of the messages of a WebSocket
+const (
+	WebSocketText   byte = 1
+	WebSocketBinary byte = 2
+)
+
+const (
+	wsContinuation byte = 0
+	wsClose        byte = 8
+	wsPing         byte = 9
+	wsPong         byte = 10
+)
+
+// The GUID which the accept key of the handshake is derived with
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// A WebSocket is a connection upgraded from an HTTP request, which messages
+// are exchanged on.
+type WebSocket struct {
+	conn net.Conn
+	r    *bufio.Reader
+	lock sync.Mutex // Serializes the writes
+	once sync.Once
+}
+
+// headerContains returns whether the comma-separated list of header `name`
+// of `h` has `token`, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin returns whether request `r` comes from a page served by the
+// listener, or from a client which isn't a browser. Otherwise, any web page
+// could drive the containers, since WebSockets aren't subject to the same
+// origin policy.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// UpgradeWebSocket upgrades request `r` to a WebSocket. Failed upgrades are
+// answered with an HTTP error.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("Not a WebSocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusBadRequest)
+		return nil, errors.New("Unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("Missing Sec-WebSocket-Key")
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "Cross-origin WebSockets are forbidden", http.StatusForbidden)
+		return nil, errors.New("Cross-origin WebSocket from " + r.Header.Get("Origin"))
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSockets are not supported", http.StatusInternalServerError)
+		return nil, errors.New("The connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum([]byte(key + wsGUID))
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(hash[:])+"\r\n\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocket{conn: conn, r: rw.Reader}, nil
+}
+
+// readFrame reads the next frame sent by the client, unmasked.
+func (ws *WebSocket) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.r, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("Unmasked WebSocket frame")
+	}
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(ws.r, ext); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(ws.r, ext); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext)
+	}
+	if size > maxFrameSize {
+		return false, 0, nil, errors.New("WebSocket frame too large")
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.r, mask); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// ReadMessage reads the next text or binary message sent by the client. The
+// pings of the client are answered along the way. It returns io.EOF once the
+// client closes the WebSocket.
+func (ws *WebSocket) ReadMessage() (kind byte, message []byte, err error) {
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch opcode {
+		case wsClose:
+			// Echo the status code of the client, as the closing handshake
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			ws.close(payload)
+			return 0, nil, io.EOF
+		case wsPing:
+			if err := ws.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+		case wsPong:
+		case WebSocketText, WebSocketBinary, wsContinuation:
+			if (opcode == wsContinuation) != (kind != 0) {
+				return 0, nil, errors.New("Unexpected WebSocket continuation frame")
+			}
+			if opcode != wsContinuation {
+				kind = opcode
+			}
+			if len(message)+len(payload) > maxFrameSize {
+				return 0, nil, errors.New("WebSocket message too large")
+			}
+			message = append(message, payload...)
+			if fin {
+				return kind, message, nil
+			}
+		default:
+			return 0, nil, errors.New("Unknown WebSocket opcode")
+		}
+	}
+}
+
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	header := []byte{0x80 | opcode, 0}
+	switch size := len(payload); {
+	case size < 126:
+		header[1] = byte(size)
+	case size <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(size))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(size))
+	}
+	if _, err := ws.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteMessage sends a text or binary message to the client. It is safe to
+// call from several goroutines.
+func (ws *WebSocket) WriteMessage(kind byte, message []byte) error {
+	return ws.writeFrame(kind, message)
+}
+
+// close sends a close frame with status code `code`, then closes the
+// connection, once.
+func (ws *WebSocket) close(code []byte) error {
+	var err error
+	ws.once.Do(func() {
+		ws.writeFrame(wsClose, code)
+		err = ws.conn.Close()
+	})
+	return err
+}
+
+// Close closes the WebSocket, telling the client that it is done.
+func (ws *WebSocket) Close() error {
+	// 1000: normal closure
+	return ws.close([]byte{0x03, 0xe8})
+}
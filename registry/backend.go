@@ -0,0 +1,38 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// A Backend is a remote location where images can be pushed and pulled,
+// exchanged as OCI image layouts (see image.ExportOCI and image.ImportOCI).
+type Backend interface {
+	Push(name, ref, dir string, stdout io.Writer) error
+	Pull(name, ref, dir string, stdout io.Writer) error
+	String() string
+}
+
+// NewBackend returns the backend at `location`: an S3 bucket for s3:// URLs,
+// a registry otherwise. Requests are sent with `client`.
+func NewBackend(location string, client *http.Client) (Backend, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "s3" {
+		s3, err := NewS3(u)
+		if err != nil {
+			return nil, err
+		}
+		s3.Client = client
+		return s3, nil
+	}
+	registry, err := NewRegistry(location)
+	if err != nil {
+		return nil, err
+	}
+	registry.Client = client
+	return registry, nil
+}
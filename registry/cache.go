@@ -0,0 +1,224 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Cache keeps downloaded archives so that pulling an unchanged remote
+// archive doesn't download it again. Archives are stored by the digest of
+// their content, and each URL remembers the ETag and Last-Modified date of
+// its last download to revalidate it with a conditional request. Archives
+// served without either can't be revalidated, so they aren't kept:
+//
+//	ROOT/urls/HASH_OF_URL.json	metadata of the last download of a URL
+//	ROOT/blobs/DIGEST		the content of an archive
+type Cache struct {
+	Root    string
+	Client  *http.Client
+	MaxSize int64 // The blobs are pruned down to this size, least recently used first, if not 0
+}
+
+type cacheEntry struct {
+	URL          string
+	ETag         string
+	LastModified string
+	Digest       string
+}
+
+func NewCache(root string, client *http.Client) (*Cache, error) {
+	for _, dir := range []string{"urls", "blobs"} {
+		if err := os.MkdirAll(path.Join(root, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &Cache{Root: root, Client: client}, nil
+}
+
+func (cache *Cache) entryPath(u *url.URL) string {
+	return path.Join(cache.Root, "urls", fmt.Sprintf("%x.json", sha256.Sum256([]byte(u.String()))))
+}
+
+func (cache *Cache) blobPath(digest string) string {
+	return path.Join(cache.Root, "blobs", digest)
+}
+
+func (cache *Cache) entry(u *url.URL) *cacheEntry {
+	data, err := ioutil.ReadFile(cache.entryPath(u))
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil || entry.URL != u.String() {
+		return nil
+	}
+	if _, err := os.Stat(cache.blobPath(entry.Digest)); err != nil {
+		return nil
+	}
+	return entry
+}
+
+// Get returns the content at `u`, from the cache if the server reports that it
+// didn't change since it was cached. `cached` tells whether the cache was used.
+// The download is aborted if `cancel` is closed.
+func (cache *Cache) Get(u *url.URL, cancel <-chan struct{}) (content io.ReadCloser, cached bool, err error) {
+	return cache.Fetch(u, cancel, nil)
+}
+
+// Fetch is like Get, but the body of the download is read through `wrap` if
+// it is not nil, eg. to report its progress. `wrap` is passed the length of
+// the body, or -1 if it is unknown.
+func (cache *Cache) Fetch(u *url.URL, cancel <-chan struct{}, wrap func(body io.Reader, size int64) io.Reader) (content io.ReadCloser, cached bool, err error) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		select {
+		case <-cancel:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	entry := cache.entry(u)
+	if entry != nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+	resp, err := cache.Client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		f, err := os.Open(cache.blobPath(entry.Digest))
+		if err != nil {
+			return nil, false, err
+		}
+		// The blobs used last are pruned last
+		now := time.Now()
+		os.Chtimes(cache.blobPath(entry.Digest), now, now)
+		return f, true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("%s: %s", u.String(), resp.Status)
+	}
+	tmp, err := ioutil.TempFile(path.Join(cache.Root, "blobs"), "tmp-")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	var body io.Reader = resp.Body
+	if wrap != nil {
+		body = wrap(body, resp.ContentLength)
+	}
+	_, err = io.Copy(io.MultiWriter(tmp, h), body)
+	tmp.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	entry = &cacheEntry{
+		URL:          u.String(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Digest:       fmt.Sprintf("sha256-%x", h.Sum(nil)),
+	}
+	if entry.ETag == "" && entry.LastModified == "" {
+		os.Remove(cache.entryPath(u))
+		// The download is still readable once its file is removed
+		f, err := os.Open(tmp.Name())
+		if err != nil {
+			return nil, false, err
+		}
+		return f, false, nil
+	}
+	// Identical content downloaded from another URL is only stored once
+	if err := os.Rename(tmp.Name(), cache.blobPath(entry.Digest)); err != nil {
+		return nil, false, err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := ioutil.WriteFile(cache.entryPath(u), data, 0600); err != nil {
+		return nil, false, err
+	}
+	f, err := os.Open(cache.blobPath(entry.Digest))
+	if err != nil {
+		return nil, false, err
+	}
+	if cache.MaxSize > 0 {
+		if err := cache.prune(cache.MaxSize, entry.Digest); err != nil {
+			f.Close()
+			return nil, false, err
+		}
+	}
+	return f, false, nil
+}
+
+// prune removes the blobs used least recently, and the URLs downloaded as
+// them, until the blobs take `size` bytes at most, or only the blob `keep`
+// is left.
+func (cache *Cache) prune(size int64, keep string) error {
+	blobs, err := ioutil.ReadDir(path.Join(cache.Root, "blobs"))
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, blob := range blobs {
+		total += blob.Size()
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].ModTime().Before(blobs[j].ModTime()) })
+	removed := make(map[string]bool)
+	for _, blob := range blobs {
+		if total <= size {
+			break
+		}
+		// Downloads in progress are still needed
+		if blob.Name() == keep || strings.HasPrefix(blob.Name(), "tmp-") {
+			continue
+		}
+		if err := os.Remove(cache.blobPath(blob.Name())); err != nil {
+			return err
+		}
+		removed[blob.Name()] = true
+		total -= blob.Size()
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(path.Join(cache.Root, "urls"))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		filename := path.Join(cache.Root, "urls", e.Name())
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		entry := &cacheEntry{}
+		if json.Unmarshal(data, entry) != nil || removed[entry.Digest] {
+			os.Remove(filename)
+		}
+	}
+	return nil
+}
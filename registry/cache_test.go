@@ -0,0 +1,162 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	content, etag := "v1", `"1"`
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nocache" {
+			fmt.Fprint(w, content)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, content)
+	}))
+	defer srv.Close()
+	tmp, err := ioutil.TempDir("", "docker-test-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cache, err := NewCache(tmp, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(p string, expected string, expectCached bool) {
+		u, _ := url.Parse(srv.URL + p)
+		body, cached, err := cache.Get(u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer body.Close()
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected || cached != expectCached {
+			t.Fatalf("%s: expected '%s' (cached: %v), got '%s' (cached: %v)", p, expected, expectCached, data, cached)
+		}
+	}
+	get("/base", "v1", false)
+	get("/base", "v1", true)
+	if downloads != 1 {
+		t.Fatalf("Expected a single download, got %d", downloads)
+	}
+	// The archive changed on the server
+	content, etag = "v2", `"2"`
+	get("/base", "v2", false)
+	get("/base", "v2", true)
+	// Without an ETag or a modification date, nothing can be revalidated
+	get("/nocache", "v2", false)
+	get("/nocache", "v2", false)
+	if blobs, _ := ioutil.ReadDir(path.Join(tmp, "blobs")); len(blobs) != 2 {
+		t.Fatalf("Expected the blobs of v1 and v2 only, got %d", len(blobs))
+	}
+	// Cancelled downloads are aborted
+	cancel := make(chan struct{})
+	close(cancel)
+	u, _ := url.Parse(srv.URL + "/cancelled")
+	if _, _, err := cache.Get(u, cancel); err == nil {
+		t.Fatalf("A cancelled download should fail")
+	}
+}
+
+func TestCacheFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"1"`)
+		if r.Header.Get("If-None-Match") == `"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "content")
+	}))
+	defer srv.Close()
+	tmp, err := ioutil.TempDir("", "docker-test-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cache, err := NewCache(tmp, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrapped int
+	var size int64
+	wrap := func(body io.Reader, length int64) io.Reader {
+		wrapped++
+		size = length
+		return body
+	}
+	u, _ := url.Parse(srv.URL + "/archive")
+	for i := 0; i < 2; i++ {
+		body, _, err := cache.Fetch(u, nil, wrap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+	}
+	// The download goes through the wrapper, not the cached copy
+	if wrapped != 1 || size != int64(len("content")) {
+		t.Fatalf("Expected the download of 7 bytes to be wrapped once, got %d wrappings of %d bytes", wrapped, size)
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"1"`)
+		if r.Header.Get("If-None-Match") == `"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer srv.Close()
+	tmp, err := ioutil.TempDir("", "docker-test-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cache, err := NewCache(tmp, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.MaxSize = int64(len("/first") + len("/second"))
+	get := func(p string) bool {
+		u, _ := url.Parse(srv.URL + p)
+		body, cached, err := cache.Get(u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+		return cached
+	}
+	get("/first")
+	get("/second")
+	if !get("/first") || !get("/second") {
+		t.Fatal("The blobs within the size limit should be kept")
+	}
+	// The blob of /first was used least recently
+	get("/third")
+	if get("/first") {
+		t.Fatal("The blob used least recently should be pruned")
+	}
+	if entries, _ := ioutil.ReadDir(path.Join(tmp, "urls")); len(entries) != 2 {
+		t.Fatalf("Expected the URLs of the pruned blobs to be removed, got %d", len(entries))
+	}
+}
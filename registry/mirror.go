@@ -0,0 +1,88 @@
+package registry
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/image"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// A Mirror is a plain HTTP server (typically an S3 bucket) hosting image
+// archives with the following layout:
+//
+//	BASE/NAMESPACE/NAME		the latest version of image NAMESPACE/NAME
+//	BASE/NAMESPACE/NAME:TAG		the version of NAMESPACE/NAME tagged TAG
+//	BASE/NAMESPACE/NAME.tags	the available tags of NAMESPACE/NAME, one per line
+//
+// Top-level images have no NAMESPACE component.
+type Mirror struct {
+	Base   *url.URL
+	Client *http.Client
+}
+
+// FIXME: hardcode a mirror URL that does not depend on a single provider.
+const DefaultMirror = "http://s3.amazonaws.com/docker.io/images"
+
+func NewMirror(base string) (*Mirror, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("Invalid mirror URL: " + base)
+	}
+	return &Mirror{Base: u, Client: http.DefaultClient}, nil
+}
+
+func (mirror *Mirror) url(name, suffix string) *url.URL {
+	namespace, repository := image.SplitName(name)
+	u := *mirror.Base
+	u.Path = path.Join(u.Path, namespace, repository) + suffix
+	return &u
+}
+
+// ImageURL returns the location of image `name` on the mirror. If `tag` is
+// not empty, the location of that specific version is returned instead.
+func (mirror *Mirror) ImageURL(name, tag string) *url.URL {
+	if tag == "" {
+		return mirror.url(name, "")
+	}
+	return mirror.url(name, ":"+tag)
+}
+
+// Tags returns the tags of image `name` available on the mirror.
+func (mirror *Mirror) Tags(name string) ([]string, error) {
+	body, err := mirror.get(mirror.url(name, ".tags"))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var tags []string
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		if tag := strings.TrimSpace(scanner.Text()); tag != "" && !strings.HasPrefix(tag, "#") {
+			tags = append(tags, tag)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (mirror *Mirror) get(u *url.URL) (io.ReadCloser, error) {
+	resp, err := mirror.Client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", u.String(), resp.Status)
+	}
+	return resp.Body, nil
+}
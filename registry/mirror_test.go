@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestImageURL(t *testing.T) {
+	mirror, err := NewMirror("http://example.com/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range [][3]string{
+		{"base", "", "http://example.com/images/base"},
+		{"sendhub/base", "", "http://example.com/images/sendhub/base"},
+		{"sendhub/base", "1.0", "http://example.com/images/sendhub/base:1.0"},
+	} {
+		if u := mirror.ImageURL(test[0], test[1]).String(); u != test[2] {
+			t.Errorf("Expected %s, got %s", test[2], u)
+		}
+	}
+	if _, err := NewMirror("example.com"); err == nil {
+		t.Errorf("A mirror URL without a scheme should be refused")
+	}
+}
+
+func TestTags(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/sendhub/base.tags" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "# tags\n1.0\n\n1.1\n")
+	}))
+	defer srv.Close()
+	mirror, err := NewMirror(srv.URL + "/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := mirror.Tags("sendhub/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags[0] != "1.0" || tags[1] != "1.1" {
+		t.Fatalf("Unexpected tags %v", tags)
+	}
+	if _, err := mirror.Tags("missing"); err == nil {
+		t.Fatalf("Listing the tags of a missing image should fail")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/index.json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `[
+			{"Name": "base", "Description": "Ubuntu quantal base image", "Popularity": 10},
+			{"Name": "sendhub/python", "Description": "Python 2.7 on top of base", "Popularity": 42},
+			{"Name": "sendhub/redis", "Description": "Redis server", "Popularity": 5}
+		]`)
+	}))
+	defer srv.Close()
+	mirror, err := NewMirror(srv.URL + "/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := mirror.Search("BASE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Name != "sendhub/python" || results[1].Name != "base" {
+		t.Fatalf("Unexpected results %v", results)
+	}
+	if results, err := mirror.Search("nothing"); err != nil || len(results) != 0 {
+		t.Fatalf("Expected no results, got %v (%v)", results, err)
+	}
+}
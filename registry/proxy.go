@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ProxyConfig selects the HTTP proxy used to reach remote hosts. Empty fields
+// default to the usual environment variables: HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY (or their lowercase versions).
+type ProxyConfig struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string // Comma-separated hosts, domains (.example.com), IPs or CIDRs to reach directly
+}
+
+func getenv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Resolve returns a copy of `config` with empty fields filled from the environment.
+func (config *ProxyConfig) Resolve() *ProxyConfig {
+	resolved := &ProxyConfig{}
+	if config != nil {
+		*resolved = *config
+	}
+	if resolved.HTTPProxy == "" {
+		resolved.HTTPProxy = getenv("HTTP_PROXY", "http_proxy")
+	}
+	if resolved.HTTPSProxy == "" {
+		resolved.HTTPSProxy = getenv("HTTPS_PROXY", "https_proxy")
+	}
+	if resolved.NoProxy == "" {
+		resolved.NoProxy = getenv("NO_PROXY", "no_proxy")
+	}
+	return resolved
+}
+
+// Proxy returns the proxy to use for `req`, or nil to connect directly.
+// It has the signature expected by http.Transport.
+func (config *ProxyConfig) Proxy(req *http.Request) (*url.URL, error) {
+	return config.ProxyURL(req.URL)
+}
+
+// ProxyURL returns the proxy to use to reach `u`, or nil to connect directly.
+func (config *ProxyConfig) ProxyURL(u *url.URL) (*url.URL, error) {
+	var proxy string
+	switch u.Scheme {
+	case "http":
+		proxy = config.HTTPProxy
+	case "https":
+		proxy = config.HTTPSProxy
+	}
+	if proxy == "" || !config.useProxy(u) {
+		return nil, nil
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	return url.Parse(proxy)
+}
+
+// useProxy returns false if `u` matches an entry of NoProxy.
+func (config *ProxyConfig) useProxy(u *url.URL) bool {
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = u.Host, ""
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(config.NoProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return false
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return false
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if entry = strings.TrimPrefix(entry, "."); entry == host || strings.HasSuffix(host, "."+entry) {
+			return false
+		}
+	}
+	return true
+}
+
+// Client returns an HTTP client going through the proxy.
+func (config *ProxyConfig) Client() *http.Client {
+	return &http.Client{Transport: &http.Transport{Proxy: config.Proxy}}
+}
+
+// Environ returns the environment of the current process with the proxy
+// variables overridden, for external commands such as curl.
+func (config *ProxyConfig) Environ() []string {
+	overrides := map[string]string{
+		"http_proxy":  config.HTTPProxy,
+		"https_proxy": config.HTTPSProxy,
+		"no_proxy":    config.NoProxy,
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		name := strings.ToLower(strings.SplitN(kv, "=", 2)[0])
+		if _, overridden := overrides[name]; !overridden {
+			env = append(env, kv)
+		}
+	}
+	for name, value := range overrides {
+		if value != "" {
+			env = append(env, name+"="+value, strings.ToUpper(name)+"="+value)
+		}
+	}
+	return env
+}
@@ -0,0 +1,82 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestProxyURL(t *testing.T) {
+	config := &ProxyConfig{
+		HTTPProxy:  "proxy.corp:3128",
+		HTTPSProxy: "http://secure.corp:3128",
+		NoProxy:    "localhost, .internal,example.com:8080,10.0.0.0/8",
+	}
+	for _, test := range [][2]string{
+		{"http://s3.amazonaws.com/images/base", "http://proxy.corp:3128"},
+		{"https://registry.example.org/v2/", "http://secure.corp:3128"},
+		{"http://localhost/base", ""},
+		{"http://mirror.internal/base", ""},
+		{"http://internal/base", ""},
+		{"http://example.com:8080/base", ""},
+		{"http://example.com/base", "http://proxy.corp:3128"},
+		{"http://10.1.2.3/base", ""},
+		{"http://192.168.1.1/base", "http://proxy.corp:3128"},
+	} {
+		u, err := url.Parse(test[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy, err := config.ProxyURL(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != test[1] {
+			t.Errorf("%s: expected proxy '%s', got '%s'", test[0], test[1], got)
+		}
+	}
+}
+
+func TestProxyResolve(t *testing.T) {
+	os.Setenv("HTTP_PROXY", "env.corp:3128")
+	os.Setenv("NO_PROXY", "*")
+	defer os.Unsetenv("HTTP_PROXY")
+	defer os.Unsetenv("NO_PROXY")
+	config := (&ProxyConfig{HTTPSProxy: "override.corp:3128"}).Resolve()
+	if config.HTTPProxy != "env.corp:3128" || config.HTTPSProxy != "override.corp:3128" || config.NoProxy != "*" {
+		t.Fatalf("Unexpected configuration %#v", config)
+	}
+	u, _ := url.Parse("http://anywhere/")
+	if proxy, _ := config.ProxyURL(u); proxy != nil {
+		t.Fatalf("NO_PROXY=* should disable the proxy, got %s", proxy)
+	}
+}
+
+func TestProxyClient(t *testing.T) {
+	// A proxy receives absolute URLs in its requests
+	var requested string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		fmt.Fprint(w, "1.0\n")
+	}))
+	defer proxy.Close()
+	mirror, err := NewMirror("http://mirror.example.com/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror.Client = (&ProxyConfig{HTTPProxy: proxy.URL}).Client()
+	tags, err := mirror.Tags("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || requested != "http://mirror.example.com/images/base.tags" {
+		t.Fatalf("The request didn't go through the proxy (requested '%s')", requested)
+	}
+}
@@ -0,0 +1,474 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 stores images in an Amazon S3 bucket, as tar archives of their OCI
+// image layout (see 'docker save'):
+//
+//	s3://BUCKET/PREFIX/NAMESPACE/NAME:TAG
+//
+// The location may carry the following options in its query string:
+//
+//	region=REGION		region of the bucket (default: $AWS_REGION, or us-east-1)
+//	sse=AES256|aws:kms	server-side encryption of the uploaded images
+//	kms-key=ID		KMS key used with sse=aws:kms
+//	endpoint=URL		S3-compatible endpoint to use instead of AWS
+type S3 struct {
+	Bucket      string
+	Prefix      string
+	Region      string
+	Endpoint    *url.URL
+	Encryption  string
+	KMSKeyId    string
+	Credentials *Credentials
+	PartSize    int64 // Size of the parts of multipart uploads
+	Client      *http.Client
+}
+
+// Credentials are the AWS credentials used to sign requests.
+type Credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// S3 refuses multipart uploads with parts smaller than 5MB
+const DefaultPartSize = 5 * 1024 * 1024
+
+func NewS3(u *url.URL) (*S3, error) {
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, errors.New("Invalid S3 URL: " + u.String())
+	}
+	q := u.Query()
+	s3 := &S3{
+		Bucket:     u.Host,
+		Prefix:     strings.Trim(u.Path, "/"),
+		Region:     q.Get("region"),
+		Encryption: q.Get("sse"),
+		KMSKeyId:   q.Get("kms-key"),
+		PartSize:   DefaultPartSize,
+		Client:     http.DefaultClient,
+	}
+	if s3.Region == "" {
+		if s3.Region = os.Getenv("AWS_REGION"); s3.Region == "" {
+			s3.Region = "us-east-1"
+		}
+	}
+	switch s3.Encryption {
+	case "", "AES256", "aws:kms":
+	default:
+		return nil, errors.New("Unsupported server-side encryption: " + s3.Encryption)
+	}
+	endpoint := q.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + s3.Region + ".amazonaws.com"
+	}
+	var err error
+	if s3.Endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	if s3.Credentials, err = LoadCredentials(); err != nil {
+		return nil, err
+	}
+	return s3, nil
+}
+
+// LoadCredentials reads AWS credentials from the environment
+// ($AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY, $AWS_SESSION_TOKEN) or, failing
+// that, from the shared credentials file (~/.aws/credentials, profile
+// $AWS_PROFILE or 'default').
+func LoadCredentials() (*Credentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &Credentials{
+			AccessKeyId:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if filename == "" {
+		filename = path.Join(os.Getenv("HOME"), ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	return SharedCredentials(filename, profile)
+}
+
+// SharedCredentials reads the credentials of `profile` in the AWS shared
+// credentials file `filename`.
+func SharedCredentials(filename, profile string) (*Credentials, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.New("No AWS credentials found: " + err.Error())
+	}
+	defer f.Close()
+	creds := &Credentials{}
+	var current string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if current != profile || len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyId = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyId == "" {
+		return nil, fmt.Errorf("No AWS credentials for profile %s in %s", profile, filename)
+	}
+	return creds, nil
+}
+
+func (s3 *S3) String() string {
+	return "s3://" + path.Join(s3.Bucket, s3.Prefix)
+}
+
+func (s3 *S3) key(name, ref string) string {
+	return path.Join(s3.Prefix, name) + ":" + ref
+}
+
+// Push uploads the OCI image layout in `dir` as NAME:REF.
+func (s3 *S3) Push(name, ref, dir string, stdout io.Writer) error {
+	archive, err := image.Tar(dir, image.Uncompressed)
+	if err != nil {
+		return err
+	}
+	key := s3.key(name, ref)
+	fmt.Fprintf(stdout, "Uploading to %s/%s\n", s3.String(), key)
+	return s3.Upload(key, rcli.ProgressReader(archive, stdout, name+":"+ref, "Uploading", 0))
+}
+
+// Pull downloads NAME:REF into the OCI image layout in `dir`.
+func (s3 *S3) Pull(name, ref, dir string, stdout io.Writer) error {
+	key := s3.key(name, ref)
+	fmt.Fprintf(stdout, "Downloading %s/%s\n", s3.String(), key)
+	archive, err := s3.Get(key)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return image.Untar(rcli.ProgressReader(archive, stdout, name+":"+ref, "Downloading", 0), dir)
+}
+
+// Images lists the images available in the bucket, as NAME:TAG.
+func (s3 *S3) Images() ([]string, error) {
+	prefix := s3.Prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	keys, err := s3.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if idx := strings.LastIndex(name, ":"); idx < 0 || image.ValidateName(name[:idx]) != nil {
+			continue
+		}
+		images = append(images, name)
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// Get downloads object `key`.
+func (s3 *S3) Get(key string) (io.ReadCloser, error) {
+	resp, err := s3.do("GET", key, nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns the keys of all the objects whose key starts with `prefix`.
+func (s3 *S3) List(prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		result := &listBucketResult{}
+		if err := s3.doXML("GET", "", query, nil, result); err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// Upload stores `content` as object `key`, using a multipart upload so that
+// archives of any size can be streamed without knowing their size in advance.
+func (s3 *S3) Upload(key string, content io.Reader) error {
+	header := http.Header{}
+	if s3.Encryption != "" {
+		header.Set("x-amz-server-side-encryption", s3.Encryption)
+		if s3.KMSKeyId != "" {
+			header.Set("x-amz-server-side-encryption-aws-kms-key-id", s3.KMSKeyId)
+		}
+	}
+	initiated := &struct{ UploadId string }{}
+	if err := s3.doXML("POST", key, url.Values{"uploads": {""}}, header, initiated); err != nil {
+		return err
+	}
+	uploadId := url.Values{"uploadId": {initiated.UploadId}}
+	complete := &completeMultipartUpload{}
+	buf := make([]byte, s3.PartSize)
+	for partNumber := 1; ; partNumber++ {
+		n, err := io.ReadFull(content, buf)
+		if err == io.EOF && partNumber > 1 {
+			break
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s3.abort(key, uploadId)
+			return err
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": uploadId["uploadId"]}
+		resp, err := s3.do("PUT", key, query, nil, bytes.NewReader(buf[:n]), http.StatusOK)
+		if err != nil {
+			s3.abort(key, uploadId)
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+		if n < len(buf) {
+			break
+		}
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		s3.abort(key, uploadId)
+		return err
+	}
+	// Errors of CompleteMultipartUpload may come with a 200 status
+	resp, err := s3.do("POST", key, uploadId, nil, bytes.NewReader(body), http.StatusOK)
+	if err != nil {
+		s3.abort(key, uploadId)
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if s3err := parseS3Error(data); s3err != nil {
+		s3.abort(key, uploadId)
+		return s3err
+	}
+	return nil
+}
+
+func (s3 *S3) abort(key string, uploadId url.Values) {
+	if resp, err := s3.do("DELETE", key, uploadId, nil, nil, http.StatusNoContent); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func parseS3Error(data []byte) error {
+	s3err := &struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{}
+	if xml.Unmarshal(data, s3err) != nil {
+		return nil
+	}
+	return fmt.Errorf("S3 error %s: %s", s3err.Code, s3err.Message)
+}
+
+func (s3 *S3) doXML(method, key string, query url.Values, header http.Header, result interface{}) error {
+	resp, err := s3.do(method, key, query, header, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(result)
+}
+
+// do sends a signed request for object `key` (or the bucket itself, if `key`
+// is empty), using path-style addressing.
+func (s3 *S3) do(method, key string, query url.Values, header http.Header, body io.Reader, expect int) (*http.Response, error) {
+	u := *s3.Endpoint
+	rawPath := "/" + s3.Bucket
+	if key != "" {
+		rawPath += "/" + key
+	}
+	u.Path = path.Join(u.Path, rawPath)
+	u.RawPath = awsEscapePath(u.Path)
+	u.RawQuery = awsQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s3.Credentials.Sign(req, s3.Region, "s3", time.Now())
+	resp, err := s3.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expect {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		if s3err := parseS3Error(data); s3err != nil {
+			return nil, s3err
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, u.String(), resp.Status)
+	}
+	return resp, nil
+}
+
+// Sign adds an AWS signature version 4 to `req`. Every header already set on
+// the request is signed. The payload itself is not.
+func (creds *Credentials) Sign(req *http.Request, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		awsQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but unreserved characters, as
+// required by AWS signatures.
+func awsEscape(s string) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func awsEscapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = awsEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// awsQuery encodes `query` in the canonical form used by AWS signatures.
+func awsQuery(query url.Values) string {
+	var pairs []string
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// A SearchResult describes an image available on a mirror, as listed in the
+// index of the mirror (BASE/index.json, a JSON array of SearchResults).
+type SearchResult struct {
+	Name        string
+	Description string
+	Popularity  int
+}
+
+type searchResults []*SearchResult
+
+func (r searchResults) Len() int      { return len(r) }
+func (r searchResults) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r searchResults) Less(i, j int) bool {
+	if r[i].Popularity != r[j].Popularity {
+		return r[i].Popularity > r[j].Popularity
+	}
+	return r[i].Name < r[j].Name
+}
+
+// Search returns the images of the mirror whose name or description contain
+// `term` (case-insensitive), most popular first.
+func (mirror *Mirror) Search(term string) ([]*SearchResult, error) {
+	body, err := mirror.get(mirror.url("index.json", ""))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var all []*SearchResult
+	if err := json.NewDecoder(body).Decode(&all); err != nil {
+		return nil, err
+	}
+	term = strings.ToLower(term)
+	var results searchResults
+	for _, result := range all {
+		if strings.Contains(strings.ToLower(result.Name), term) || strings.Contains(strings.ToLower(result.Description), term) {
+			results = append(results, result)
+		}
+	}
+	sort.Sort(results)
+	return results, nil
+}
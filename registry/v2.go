@@ -0,0 +1,334 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A Registry is a server speaking the blob/manifest protocol of the
+// docker registry API v2:
+//
+//	HEAD /v2/NAME/blobs/DIGEST		check whether a blob exists
+//	GET  /v2/NAME/blobs/DIGEST		download a blob
+//	POST /v2/NAME/blobs/uploads/		start an upload session
+//	PATCH, GET, PUT on the session URL	upload a chunk, query progress, commit
+//	GET, PUT /v2/NAME/manifests/REF		download or upload a manifest
+//
+// Images are exchanged through an OCI image layout (see image.ExportOCI).
+type Registry struct {
+	Base      *url.URL
+	Client    *http.Client
+	ChunkSize int64 // Size of the chunks uploaded at once
+	Retries   int   // Number of times an interrupted upload is resumed
+}
+
+const DefaultChunkSize = 5 * 1024 * 1024
+
+func NewRegistry(base string) (*Registry, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("Invalid registry URL: " + base)
+	}
+	return &Registry{
+		Base:      u,
+		Client:    http.DefaultClient,
+		ChunkSize: DefaultChunkSize,
+		Retries:   3,
+	}, nil
+}
+
+func (r *Registry) String() string {
+	return r.Base.String()
+}
+
+func (r *Registry) url(name string, elem ...string) *url.URL {
+	u := *r.Base
+	u.Path = path.Join(append([]string{u.Path, "v2", name}, elem...)...)
+	return &u
+}
+
+func (r *Registry) do(method string, u *url.URL, body io.Reader, header http.Header, expect ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expect {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("%s %s: %s", method, u.String(), resp.Status)
+}
+
+// HasBlob returns true if the registry already has blob `digest` of image `name`.
+func (r *Registry) HasBlob(name, digest string) (bool, error) {
+	resp, err := r.do("HEAD", r.url(name, "blobs", digest), nil, nil, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// Push uploads the image described by the first manifest of the OCI image
+// layout in `dir` as NAME:REF. Blobs already present on the registry are skipped.
+func (r *Registry) Push(name, ref, dir string, stdout io.Writer) error {
+	index, err := image.ReadOCIIndex(dir)
+	if err != nil {
+		return err
+	}
+	manifestPath, err := image.OCIBlobPath(dir, index.Manifests[0].Digest)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	manifest := &image.OCIManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return err
+	}
+	for _, desc := range append(manifest.Layers, manifest.Config) {
+		if exists, err := r.HasBlob(name, desc.Digest); err != nil {
+			return err
+		} else if exists {
+			rcli.SendProgress(stdout, &rcli.ProgressMessage{Status: "Already exists", Id: shortDigest(desc.Digest)})
+			continue
+		}
+		if err := r.uploadBlob(name, dir, desc, stdout); err != nil {
+			return err
+		}
+	}
+	header := http.Header{"Content-Type": {image.OCIMediaTypeManifest}}
+	resp, err := r.do("PUT", r.url(name, "manifests", ref), bytes.NewReader(data), header, http.StatusCreated, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// uploadBlob uploads a blob in chunks of r.ChunkSize bytes. If a chunk fails,
+// the registry is asked how much it received and the upload resumes from there.
+// The progress of the upload is reported on `stdout` after each chunk.
+func (r *Registry) uploadBlob(name, dir string, desc image.OCIDescriptor, stdout io.Writer) error {
+	p, err := image.OCIBlobPath(dir, desc.Digest)
+	if err != nil {
+		return err
+	}
+	blob, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	uploads := r.url(name, "blobs", "uploads")
+	uploads.Path += "/"
+	resp, err := r.do("POST", uploads, nil, nil, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	location, err := r.location(resp)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	retries := r.Retries
+	progress := &rcli.ProgressMessage{Status: "Uploading", Id: shortDigest(desc.Digest), Total: desc.Size}
+	for offset < desc.Size {
+		progress.Current = offset
+		rcli.SendProgress(stdout, progress)
+		size := r.ChunkSize
+		if offset+size > desc.Size {
+			size = desc.Size - offset
+		}
+		chunk := make([]byte, size)
+		if _, err := blob.ReadAt(chunk, offset); err != nil {
+			return err
+		}
+		header := http.Header{
+			"Content-Type":  {"application/octet-stream"},
+			"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+size-1)},
+		}
+		resp, err := r.do("PATCH", location, bytes.NewReader(chunk), header, http.StatusAccepted, http.StatusNoContent)
+		if err == nil {
+			resp.Body.Close()
+			if location, err = r.location(resp); err != nil {
+				return err
+			}
+			offset += size
+			continue
+		}
+		if retries == 0 {
+			return err
+		}
+		retries--
+		// Resume from what the registry actually received
+		if offset, err = r.uploadOffset(location); err != nil {
+			return err
+		}
+	}
+	q := location.Query()
+	q.Set("digest", desc.Digest)
+	location.RawQuery = q.Encode()
+	resp, err = r.do("PUT", location, nil, nil, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	progress.Current = desc.Size
+	rcli.SendProgress(stdout, progress)
+	return nil
+}
+
+// shortDigest returns the start of the hash of `digest`, to tell its blob
+// apart in progress reports.
+func shortDigest(digest string) string {
+	if i := strings.Index(digest, ":"); i >= 0 {
+		digest = digest[i+1:]
+	}
+	if len(digest) > 12 {
+		digest = digest[:12]
+	}
+	return digest
+}
+
+// uploadOffset returns the number of bytes received so far by an upload session.
+func (r *Registry) uploadOffset(location *url.URL) (int64, error) {
+	resp, err := r.do("GET", location, nil, nil, http.StatusNoContent)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	// Range: 0-END, where END is the offset of the last byte received
+	rng := resp.Header.Get("Range")
+	if rng == "" {
+		return 0, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, errors.New("Invalid Range header: " + rng)
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return end + 1, nil
+}
+
+func (r *Registry) location(resp *http.Response) (*url.URL, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, errors.New("No upload location returned by the registry")
+	}
+	u, err := r.Base.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Pull downloads NAME:REF into the OCI image layout in `dir`, ready to be
+// imported with image.ImportOCI. Blobs already in `dir` are not downloaded again.
+func (r *Registry) Pull(name, ref, dir string, stdout io.Writer) error {
+	header := http.Header{"Accept": {image.OCIMediaTypeManifest}}
+	resp, err := r.do("GET", r.url(name, "manifests", ref), nil, header, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	manifestDesc := image.OCIDescriptor{
+		MediaType: image.OCIMediaTypeManifest,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		Size:      int64(len(data)),
+	}
+	if strings.HasPrefix(ref, "sha256:") {
+		if ref != manifestDesc.Digest {
+			return fmt.Errorf("Digest mismatch for manifest %s: got %s", ref, manifestDesc.Digest)
+		}
+	} else {
+		manifestDesc.Annotations = map[string]string{image.OCIAnnotationRef: name + ":" + ref}
+	}
+	manifest := &image.OCIManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Join(dir, "blobs", "sha256"), 0700); err != nil {
+		return err
+	}
+	if err := r.writeBlob(dir, manifestDesc.Digest, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	for _, desc := range append(manifest.Layers, manifest.Config) {
+		p, err := image.OCIBlobPath(dir, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		resp, err := r.do("GET", r.url(name, "blobs", desc.Digest), nil, nil, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		err = r.writeBlob(dir, desc.Digest, rcli.ProgressReader(resp.Body, stdout, shortDigest(desc.Digest), "Downloading", desc.Size))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return image.WriteOCIIndex(dir, manifestDesc)
+}
+
+// writeBlob stores `content` as blob `digest` of the layout in `dir`, after
+// checking that it matches the digest.
+func (r *Registry) writeBlob(dir, digest string, content io.Reader) error {
+	p, err := image.OCIBlobPath(dir, digest)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(p), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), content)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	if actual := fmt.Sprintf("sha256:%x", h.Sum(nil)); actual != digest {
+		return fmt.Errorf("Digest mismatch for blob %s: got %s", digest, actual)
+	}
+	return os.Rename(tmp.Name(), p)
+}
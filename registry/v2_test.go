@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/dotcloud/docker/fake"
+	"github.com/dotcloud/docker/image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry is an in-memory registry. When failPatch is set, the next
+// chunk upload only stores half of its data before failing.
+type fakeRegistry struct {
+	sync.Mutex
+	blobs     map[string][]byte
+	uploads   map[string]*bytes.Buffer
+	manifests map[string][]byte
+	failPatch bool
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:     make(map[string][]byte),
+		uploads:   make(map[string]*bytes.Buffer),
+		manifests: make(map[string][]byte),
+	}
+}
+
+func (reg *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.Lock()
+	defer reg.Unlock()
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/upload/"):
+		upload, exists := reg.uploads[p]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		switch r.Method {
+		case "PATCH":
+			if reg.failPatch {
+				reg.failPatch = false
+				upload.Write(data[:len(data)/2])
+				http.Error(w, "connection lost", http.StatusInternalServerError)
+				return
+			}
+			upload.Write(data)
+			w.Header().Set("Location", p)
+			w.WriteHeader(http.StatusAccepted)
+		case "GET":
+			w.Header().Set("Range", fmt.Sprintf("0-%d", upload.Len()-1))
+			w.WriteHeader(http.StatusNoContent)
+		case "PUT":
+			digest := r.URL.Query().Get("digest")
+			if fmt.Sprintf("sha256:%x", sha256.Sum256(upload.Bytes())) != digest {
+				http.Error(w, "digest mismatch", http.StatusBadRequest)
+				return
+			}
+			reg.blobs[digest] = upload.Bytes()
+			delete(reg.uploads, p)
+			w.WriteHeader(http.StatusCreated)
+		}
+	case strings.HasSuffix(p, "/blobs/uploads/"):
+		location := fmt.Sprintf("/upload/%d", len(reg.uploads)+len(reg.blobs))
+		reg.uploads[location] = &bytes.Buffer{}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(p, "/blobs/"):
+		blob, exists := reg.blobs[p[strings.LastIndex(p, "/")+1:]]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(blob)
+	case strings.Contains(p, "/manifests/"):
+		if r.Method == "PUT" {
+			reg.manifests[p], _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		manifest, exists := reg.manifests[p]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(manifest)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestLayout(t *testing.T) (string, string) {
+	tmp, err := ioutil.TempDir("", "docker-test-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := image.New(tmp + "/store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := fake.FakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := store.Import("sendhub/app", archive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ExportOCI(img, tmp+"/layout"); err != nil {
+		t.Fatal(err)
+	}
+	return tmp + "/layout", tmp
+}
+
+func TestPushPull(t *testing.T) {
+	layout, tmp := newTestLayout(t)
+	defer os.RemoveAll(tmp)
+	reg := newFakeRegistry()
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	r, err := NewRegistry(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Force several chunks, and an interruption in the middle of one
+	r.ChunkSize = 1000
+	reg.failPatch = true
+	if err := r.Push("sendhub/app", "1.0", layout, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	// The layer and the config
+	if len(reg.blobs) != 2 {
+		t.Fatalf("Expected 2 blobs on the registry, found %d", len(reg.blobs))
+	}
+	if _, exists := reg.manifests["/v2/sendhub/app/manifests/1.0"]; !exists {
+		t.Fatalf("The manifest wasn't uploaded")
+	}
+	// Pushing again must not upload anything
+	reg.uploads = make(map[string]*bytes.Buffer)
+	if err := r.Push("sendhub/app", "1.1", layout, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(reg.uploads) != 0 {
+		t.Fatalf("Existing blobs were uploaded again")
+	}
+
+	pulled := tmp + "/pulled"
+	if err := r.Pull("sendhub/app", "1.0", pulled, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	store, err := image.New(tmp + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := store.ImportOCI("sendhub/app", pulled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Tag != "1.0" {
+		t.Fatalf("Expected the pulled image to be tagged 1.0, got %s", img.Tag)
+	}
+	if err := r.Pull("sendhub/app", "2.0", tmp+"/missing", ioutil.Discard); err == nil {
+		t.Fatalf("Pulling a missing image should fail")
+	}
+}
+
+func TestPullCorruptedBlob(t *testing.T) {
+	layout, tmp := newTestLayout(t)
+	defer os.RemoveAll(tmp)
+	reg := newFakeRegistry()
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	r, err := NewRegistry(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Push("app", "latest", layout, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for digest, blob := range reg.blobs {
+		reg.blobs[digest] = append(blob, 0)
+	}
+	if err := r.Pull("app", "latest", tmp+"/pulled", ioutil.Discard); err == nil {
+		t.Fatalf("Pulling a corrupted blob should fail")
+	}
+}
@@ -0,0 +1,114 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// The /etc/resolv.conf of the containers is generated from the one of the
+// host, without the nameservers on the loopback of the host which the
+// containers can't reach, and from the DNS options of the daemon. It is
+// updated as the one of the host changes, eg. when DHCP renews its lease.
+
+const (
+	hostResolvConf = "/etc/resolv.conf"
+	// How often the resolv.conf of the host is checked for changes
+	resolvConfInterval = 5 * time.Second
+)
+
+// The nameservers of the containers when the host only has local ones
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// ResolvConfPath returns the path of the /etc/resolv.conf of the container
+// on the host.
+func (container *Container) ResolvConfPath() string {
+	return path.Join(container.Root, "resolv.conf")
+}
+
+// writeResolvConf writes the /etc/resolv.conf of the container. It is
+// rewritten in place, since it is bind-mounted in the container.
+func (container *Container) writeResolvConf(resolvConf []byte) error {
+	return ioutil.WriteFile(container.ResolvConfPath(), resolvConf, 0644)
+}
+
+// generateResolvConf returns the resolv.conf of the containers, from the
+// resolv.conf of the host `host` and the DNS options of `options`, which
+// replace those of the host.
+func generateResolvConf(host []byte, options NetworkOptions) []byte {
+	var nameservers, search, resolvOptions []string
+	for _, line := range strings.Split(string(host), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if ip := net.ParseIP(fields[1]); ip != nil && !ip.IsLoopback() {
+				nameservers = append(nameservers, fields[1])
+			}
+		case "domain", "search":
+			// The last one wins
+			search = fields[1:]
+		case "options":
+			resolvOptions = append(resolvOptions, fields[1:]...)
+		}
+	}
+	if len(options.DNS) > 0 {
+		nameservers = options.DNS
+	} else if len(nameservers) == 0 {
+		nameservers = defaultNameservers
+	}
+	if len(options.DNSSearch) > 0 {
+		search = options.DNSSearch
+	}
+	if len(options.DNSOptions) > 0 {
+		resolvOptions = options.DNSOptions
+	}
+	var resolvConf bytes.Buffer
+	fmt.Fprintf(&resolvConf, "# Generated by docker from %s and its DNS options\n", hostResolvConf)
+	if len(search) > 0 {
+		fmt.Fprintf(&resolvConf, "search %s\n", strings.Join(search, " "))
+	}
+	for _, nameserver := range nameservers {
+		fmt.Fprintf(&resolvConf, "nameserver %s\n", nameserver)
+	}
+	if len(resolvOptions) > 0 {
+		fmt.Fprintf(&resolvConf, "options %s\n", strings.Join(resolvOptions, " "))
+	}
+	return resolvConf.Bytes()
+}
+
+// resolvConf returns the resolv.conf of the containers, from the current
+// resolv.conf of the host.
+func (docker *Docker) resolvConf() ([]byte, error) {
+	host, err := ioutil.ReadFile(hostResolvConf)
+	if err != nil {
+		return nil, err
+	}
+	return generateResolvConf(host, docker.options), nil
+}
+
+// watchResolvConf rewrites the /etc/resolv.conf of the running containers
+// when the resolv.conf of the host changes, until the daemon exits.
+func (docker *Docker) watchResolvConf() {
+	last, _ := ioutil.ReadFile(hostResolvConf)
+	for range time.Tick(resolvConfInterval) {
+		host, err := ioutil.ReadFile(hostResolvConf)
+		if err != nil || bytes.Equal(host, last) {
+			continue
+		}
+		last = host
+		resolvConf := generateResolvConf(host, docker.options)
+		for _, container := range docker.running() {
+			if err := container.writeResolvConf(resolvConf); err != nil {
+				log.Printf("%v: Failed to update /etc/resolv.conf: %v", container.Id, err)
+			}
+		}
+	}
+}
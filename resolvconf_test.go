@@ -0,0 +1,44 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestGenerateResolvConf(t *testing.T) {
+	host := []byte(`# Generated by NetworkManager
+domain corp.example.com
+search example.com example.org
+nameserver 127.0.0.53
+nameserver 10.1.0.2
+nameserver ::1
+options edns0
+`)
+	expected := `# Generated by docker from /etc/resolv.conf and its DNS options
+search example.com example.org
+nameserver 10.1.0.2
+options edns0
+`
+	if resolvConf := string(generateResolvConf(host, NetworkOptions{})); resolvConf != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, resolvConf)
+	}
+
+	// The containers can't reach the local resolvers of the host
+	expected = `# Generated by docker from /etc/resolv.conf and its DNS options
+nameserver 8.8.8.8
+nameserver 8.8.4.4
+`
+	if resolvConf := string(generateResolvConf([]byte("nameserver 127.0.1.1\n"), NetworkOptions{})); resolvConf != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, resolvConf)
+	}
+
+	// The options of the daemon replace those of the host
+	expected = `# Generated by docker from /etc/resolv.conf and its DNS options
+search svc.example.com
+nameserver 1.1.1.1
+options ndots:2 timeout:1
+`
+	options := NetworkOptions{DNS: []string{"1.1.1.1"}, DNSSearch: []string{"svc.example.com"}, DNSOptions: []string{"ndots:2", "timeout:1"}}
+	if resolvConf := string(generateResolvConf(host, options)); resolvConf != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, resolvConf)
+	}
+}
@@ -0,0 +1,173 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// The AppArmor profile of containers which aren't privileged, provided by lxc
+const defaultAppArmorProfile = "lxc-container-default"
+
+// The parts of the SELinux label of containers, unless overridden
+var defaultSELinuxLabel = map[string]string{
+	"user":  "system_u",
+	"role":  "system_r",
+	"type":  "svirt_lxc_net_t",
+	"level": "s0",
+}
+
+// The MCS categories, c0 to c1023, of which the containers labelled with the
+// default level get a pair of their own, so that they can't reach the files
+// of each other
+const mcsCategories = 1024
+
+func appArmorEnabled() bool {
+	data, err := ioutil.ReadFile("/sys/module/apparmor/parameters/enabled")
+	return err == nil && strings.TrimSpace(string(data)) == "Y"
+}
+
+func seLinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// ApplySecurityOpts sets the AppArmor profile and the SELinux label of
+// `config` from `opts`, given as:
+//
+//	apparmor=PROFILE	run the container under AppArmor profile PROFILE
+//	label=user:USER		set a part of the SELinux label (user, role, type or level)
+//	label=disable		don't label the container
+//
+// Containers get a default profile and label when the host supports them;
+// Create gives those with the default level categories of their own.
+// Options for a security module the host doesn't support are refused.
+func ApplySecurityOpts(config *Config, opts []string) error {
+	var profile string
+	label := make(map[string]string)
+	for key, value := range defaultSELinuxLabel {
+		label[key] = value
+	}
+	disableLabel, setLabel := false, false
+	for _, opt := range opts {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("Invalid security option: %s (expected KEY=VALUE)", opt)
+		}
+		switch parts[0] {
+		case "apparmor":
+			profile = parts[1]
+		case "label":
+			if parts[1] == "disable" {
+				disableLabel = true
+				continue
+			}
+			part := strings.SplitN(parts[1], ":", 2)
+			if _, exists := defaultSELinuxLabel[part[0]]; !exists || len(part) != 2 || part[1] == "" {
+				return fmt.Errorf("Invalid security option: %s (expected label=user|role|type|level:VALUE or label=disable)", opt)
+			}
+			label[part[0]] = part[1]
+			setLabel = true
+		default:
+			return fmt.Errorf("Invalid security option: %s (valid options: apparmor, label)", opt)
+		}
+	}
+	if appArmorEnabled() {
+		if profile == "" {
+			profile = defaultAppArmorProfile
+			if config.Privileged {
+				profile = "unconfined"
+			}
+		}
+		config.AppArmorProfile = profile
+	} else if profile != "" {
+		return fmt.Errorf("AppArmor is not enabled on this host")
+	}
+	if seLinuxEnabled() {
+		if !disableLabel && !config.Privileged || setLabel {
+			config.SELinuxLabel = strings.Join([]string{label["user"], label["role"], label["type"], label["level"]}, ":")
+		}
+	} else if setLabel {
+		return fmt.Errorf("SELinux is not enabled on this host")
+	}
+	return nil
+}
+
+// selinuxLevel returns the level of SELinux label `label`, the part after
+// the type, which has colons itself once it has categories.
+func selinuxLevel(label string) string {
+	parts := strings.SplitN(label, ":", 4)
+	if len(parts) != 4 {
+		return ""
+	}
+	return parts[3]
+}
+
+// isMCSLevel returns whether `level` is a level allocated by
+// allocateMCSLevel, the default one with a pair of categories.
+func isMCSLevel(level string) bool {
+	var c1, c2 int
+	n, err := fmt.Sscanf(level, defaultSELinuxLabel["level"]+":c%d,c%d", &c1, &c2)
+	return err == nil && n == 2 && level == fmt.Sprintf("%s:c%d,c%d", defaultSELinuxLabel["level"], c1, c2)
+}
+
+// allocateMCSLevel replaces the default level of the SELinux label of
+// `config`, if any, with a pair of categories no other container has. Levels
+// set with label=level:LEVEL are kept, and shared if need be.
+func (docker *Docker) allocateMCSLevel(config *Config) error {
+	if selinuxLevel(config.SELinuxLabel) != defaultSELinuxLabel["level"] {
+		return nil
+	}
+	docker.mcsLock.Lock()
+	defer docker.mcsLock.Unlock()
+	// Give up well before the pairs run out, rather than looping
+	if len(docker.mcsLevels) >= mcsCategories*(mcsCategories-1)/4 {
+		return errors.New("No more SELinux categories available")
+	}
+	for {
+		c1, c2 := rand.Intn(mcsCategories), rand.Intn(mcsCategories)
+		if c1 == c2 {
+			continue
+		}
+		if c1 > c2 {
+			c1, c2 = c2, c1
+		}
+		level := fmt.Sprintf("%s:c%d,c%d", defaultSELinuxLabel["level"], c1, c2)
+		if docker.mcsLevels[level] {
+			continue
+		}
+		docker.mcsLevels[level] = true
+		config.SELinuxLabel = strings.TrimSuffix(config.SELinuxLabel, defaultSELinuxLabel["level"]) + level
+		return nil
+	}
+}
+
+// reserveMCSLevel records the level of the label of `container` as taken,
+// as the containers are restored.
+func (docker *Docker) reserveMCSLevel(container *Container) {
+	if level := selinuxLevel(container.Config.SELinuxLabel); level != "" {
+		docker.mcsLock.Lock()
+		docker.mcsLevels[level] = true
+		docker.mcsLock.Unlock()
+	}
+}
+
+// releaseMCSLevel releases the level of the label of `container`, once it
+// is destroyed, unless another container has it as well.
+func (docker *Docker) releaseMCSLevel(container *Container) {
+	level := selinuxLevel(container.Config.SELinuxLabel)
+	if level == "" {
+		return
+	}
+	for _, c := range docker.List() {
+		if c != container && selinuxLevel(c.Config.SELinuxLabel) == level {
+			return
+		}
+	}
+	docker.mcsLock.Lock()
+	delete(docker.mcsLevels, level)
+	docker.mcsLock.Unlock()
+}
@@ -0,0 +1,66 @@
+package docker
+
+import (
+	"container/list"
+	"testing"
+)
+
+func TestApplySecurityOpts(t *testing.T) {
+	for _, opt := range []string{"apparmor", "apparmor=", "seccomp=unconfined", "label=name:x", "label=type", "label=enable"} {
+		if err := ApplySecurityOpts(&Config{}, []string{opt}); err == nil {
+			t.Errorf("%s: expected an error", opt)
+		}
+	}
+	config := &Config{}
+	err := ApplySecurityOpts(config, []string{"apparmor=docker-test", "label=type:svirt_apache_t"})
+	if !appArmorEnabled() || !seLinuxEnabled() {
+		if err == nil {
+			t.Fatalf("Options of a security module which is not enabled should be refused")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AppArmorProfile != "docker-test" || config.SELinuxLabel != "system_u:system_r:svirt_apache_t:s0" {
+		t.Fatalf("Unexpected profile '%s' and label '%s'", config.AppArmorProfile, config.SELinuxLabel)
+	}
+}
+
+func TestAllocateMCSLevel(t *testing.T) {
+	docker := &Docker{containers: list.New(), mcsLevels: make(map[string]bool)}
+	label := "system_u:system_r:svirt_lxc_net_t:s0"
+	levels := make(map[string]bool)
+	var containers []*Container
+	for i := 0; i < 100; i++ {
+		config := &Config{SELinuxLabel: label}
+		if err := docker.allocateMCSLevel(config); err != nil {
+			t.Fatal(err)
+		}
+		level := selinuxLevel(config.SELinuxLabel)
+		if !isMCSLevel(level) || config.SELinuxLabel != label+level[len("s0"):] {
+			t.Fatalf("Unexpected label '%s'", config.SELinuxLabel)
+		}
+		if levels[level] {
+			t.Fatalf("Level %s was allocated twice", level)
+		}
+		levels[level] = true
+		container := &Container{Config: config}
+		docker.containers.PushBack(container)
+		containers = append(containers, container)
+	}
+	// Levels set by hand are kept
+	config := &Config{SELinuxLabel: "system_u:system_r:svirt_lxc_net_t:s0:c1,c2"}
+	if err := docker.allocateMCSLevel(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.SELinuxLabel != "system_u:system_r:svirt_lxc_net_t:s0:c1,c2" {
+		t.Fatalf("Unexpected label '%s'", config.SELinuxLabel)
+	}
+	// Levels are released with their container
+	docker.containers.Remove(docker.containers.Front())
+	docker.releaseMCSLevel(containers[0])
+	if len(docker.mcsLevels) != 99 || docker.mcsLevels[selinuxLevel(containers[0].Config.SELinuxLabel)] {
+		t.Fatalf("Expected the level of the container to be released, got %v", docker.mcsLevels)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"github.com/dotcloud/docker"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// Containers run with -rm are removed once they exit. The logs of the other
+// containers last until 'docker rm'; with -log-spool, the daemon archives
+// those of the containers removed on exit to the spool, where 'docker logs'
+// still finds them by ID.
+
+// runAutoRemove removes the containers run with -rm as they exit, from
+// their monitor, and those which exited while no daemon ran.
+func (srv *Server) runAutoRemove() {
+	srv.containers.OnExit(func(container *docker.Container) {
+		if container.Config.AutoRemove {
+			srv.autoRemove(container)
+		}
+	})
+	for _, container := range srv.containers.List() {
+		if container.Config.AutoRemove && !container.State.Running {
+			go srv.autoRemove(container)
+		}
+	}
+}
+
+// autoRemove archives the logs of `container` to the spool, if any, then
+// removes it. Containers whose logs can't be archived are kept.
+func (srv *Server) autoRemove(container *docker.Container) {
+	if srv.options.LogSpool != "" {
+		if err := container.ArchiveLogs(srv.options.LogSpool); err != nil {
+			log.Printf("%v: Failed to archive the logs, keeping the container: %v", container.Id, err)
+			return
+		}
+	}
+	// It may have been removed or restarted meanwhile
+	if container.State.Running || !srv.containers.Exists(container.Id) {
+		return
+	}
+	if err := srv.containers.Destroy(container); err != nil {
+		log.Printf("%v: Failed to remove on exit: %v", container.Id, err)
+	}
+}
+
+// spooledLogs returns the directory of the archived logs of the removed
+// container `name`, its ID or a unique prefix of it, or "" if there is none.
+func (srv *Server) spooledLogs(name string) string {
+	if srv.options.LogSpool == "" || name == "" || path.Base(name) != name || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	dir, err := ioutil.ReadDir(srv.options.LogSpool)
+	if err != nil {
+		return ""
+	}
+	var found string
+	for _, entry := range dir {
+		if entry.Name() == name {
+			return path.Join(srv.options.LogSpool, name)
+		}
+		if strings.HasPrefix(entry.Name(), name) {
+			if found != "" {
+				return ""
+			}
+			found = path.Join(srv.options.LogSpool, entry.Name())
+		}
+	}
+	return found
+}
+
+// writeLogs copies the logs `logs` to `stdout`, then closes them. Missing
+// logs are skipped.
+func writeLogs(stdout io.Writer, logs ...io.ReadCloser) error {
+	var err error
+	for _, l := range logs {
+		if l == nil {
+			continue
+		}
+		if err == nil {
+			_, err = io.Copy(stdout, l)
+		}
+		l.Close()
+	}
+	return err
+}
+
+// openLog opens the file `file`, or returns nil if it can't.
+func openLog(file string) io.ReadCloser {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	return f
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// A backup is a tar archive of the state of a daemon, which RestoreBackup
+// unpacks in the storage root of a fresh host:
+//
+//	backup.json			the version of docker and the volumes
+//	images/index.json		the image index
+//	layers/ID.tar			the layers of the images and the containers
+//	containers/ID/config.json	the configuration and state of a container
+//	containers/ID/rw.tar		the changes made to its filesystem
+//	volumes/N.tar			a volume directory, or volumes/N for a file
+//
+// The logs of the containers are not included.
+type backupManifest struct {
+	Version string
+	Created time.Time
+	Volumes []*backupVolume
+}
+
+type backupVolume struct {
+	Path string // On the host
+	File string // In the backup
+}
+
+// 'docker backup' streams a backup of the images, containers and volumes.
+func (srv *Server) CmdBackup(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "backup", "[OPTIONS] > ARCHIVE", "Stream a backup of the images, containers and volumes, to restore with 'dockerd -restore-backup ARCHIVE'")
+	fl_volumes := cmd.Bool("volumes", true, "Include the volumes of the containers, restored with 'dockerd -restore-volumes'")
+	fl_no_freeze := cmd.Bool("no-freeze", false, "Don't freeze the running containers while backing up their changes: they may be inconsistent")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 0 {
+		cmd.Usage()
+		return nil
+	}
+	progress := rcli.Progress(stdout)
+	index, err := srv.images.Index.Snapshot()
+	if err != nil {
+		return err
+	}
+	snapshot := struct{ ById map[string]*image.Image }{}
+	if err := json.Unmarshal(index, &snapshot); err != nil {
+		return err
+	}
+	// The layers of the images in the snapshot, and of the containers
+	layers := make(map[string]bool)
+	for _, img := range snapshot.ById {
+		for _, layer := range img.Layers {
+			layers[layer] = true
+		}
+	}
+	containers := srv.containers.List()
+	manifest := &backupManifest{Version: docker.VERSION, Created: time.Now()}
+	volumes := make(map[string]bool)
+	for _, container := range containers {
+		for _, layer := range container.Filesystem.Layers {
+			layers[layer] = true
+		}
+		for _, volume := range container.Config.Volumes {
+			if !*fl_volumes || volumes[volume.PathOnHost] {
+				continue
+			}
+			volumes[volume.PathOnHost] = true
+			st, err := os.Stat(volume.PathOnHost)
+			if err != nil {
+				fmt.Fprintf(rcli.Stderr(stdout), "Warning: skipping volume %s: %v\n", volume.PathOnHost, err)
+				continue
+			}
+			file := fmt.Sprintf("volumes/%d", len(manifest.Volumes))
+			if st.IsDir() {
+				file += ".tar"
+			}
+			manifest.Volumes = append(manifest.Volumes, &backupVolume{Path: volume.PathOnHost, File: file})
+		}
+	}
+	tw := tar.NewWriter(stdout)
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeBackupEntry(tw, "backup.json", bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err := writeBackupEntry(tw, "images/index.json", bytes.NewReader(index)); err != nil {
+		return err
+	}
+	for layer := range layers {
+		fmt.Fprintf(progress, "Backing up layer %s\n", path.Base(layer))
+		archive, err := image.Tar(layer, image.Uncompressed)
+		if err != nil {
+			return err
+		}
+		if err := writeBackupEntry(tw, "layers/"+path.Base(layer)+".tar", archive); err != nil {
+			return err
+		}
+	}
+	for _, container := range containers {
+		fmt.Fprintf(progress, "Backing up container %s\n", container.Id)
+		config, err := os.Open(path.Join(container.Root, "config.json"))
+		if err != nil {
+			return err
+		}
+		err = writeBackupEntry(tw, "containers/"+container.Id+"/config.json", config)
+		config.Close()
+		if err != nil {
+			return err
+		}
+		if err := writeBackupChanges(tw, container, !*fl_no_freeze); err != nil {
+			return err
+		}
+	}
+	for _, volume := range manifest.Volumes {
+		fmt.Fprintf(progress, "Backing up volume %s\n", volume.Path)
+		if err := writeBackupVolume(tw, volume); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeBackupChanges adds the changes made to the filesystem of `container`
+// to the backup, freezing it meanwhile if it is running and `freeze` is true.
+func writeBackupChanges(tw *tar.Writer, container *docker.Container, freeze bool) error {
+	if freeze && container.State.Running {
+		if err := container.Freeze(); err != nil {
+			return err
+		}
+		defer container.Unfreeze()
+	}
+	rw, err := image.Tar(container.Filesystem.RWPath, image.Uncompressed)
+	if err != nil {
+		return err
+	}
+	return writeBackupEntry(tw, "containers/"+container.Id+"/rw.tar", rw)
+}
+
+func writeBackupVolume(tw *tar.Writer, volume *backupVolume) error {
+	if strings.HasSuffix(volume.File, ".tar") {
+		content, err := image.Tar(volume.Path, image.Uncompressed)
+		if err != nil {
+			return err
+		}
+		return writeBackupEntry(tw, volume.File, content)
+	}
+	f, err := os.Open(volume.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeBackupEntry(tw, volume.File, f)
+}
+
+// writeBackupEntry adds `content` to the backup as the file `name`. Tar needs
+// the size of a file before its content, so the content is spooled first.
+func writeBackupEntry(tw *tar.Writer, name string, content io.Reader) error {
+	spool, err := ioutil.TempFile(rootPath, "backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, content)
+	if err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, 0); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, spool)
+	return err
+}
+
+// RestoreBackup rebuilds the storage root from `archive`, a backup made by
+// 'docker backup'. The storage root must not have any images or containers
+// yet, and no daemon may be using it. The volumes are written to their paths
+// on the host, anywhere, so they are skipped unless `volumes` is true.
+func RestoreBackup(archive io.Reader, volumes bool, log io.Writer) error {
+	lock, err := lockRoot(rootPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if _, err := os.Stat(path.Join(rootPath, "images", "index.json")); err == nil {
+		return fmt.Errorf("%s already has images: backups are restored on fresh hosts", rootPath)
+	}
+	containers, _ := ioutil.ReadDir(path.Join(rootPath, "containers"))
+	for _, v := range containers {
+		// The version marker of the containers starts with a dot, and IDs
+		// can't
+		if !strings.HasPrefix(v.Name(), ".") {
+			return fmt.Errorf("%s already has containers: backups are restored on fresh hosts", rootPath)
+		}
+	}
+	var manifest *backupManifest
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		parts := strings.Split(hdr.Name, "/")
+		for _, part := range parts {
+			if part == "" || part == "." || part == ".." {
+				return errors.New("Invalid backup: unexpected file " + hdr.Name)
+			}
+		}
+		switch {
+		case hdr.Name == "backup.json":
+			manifest = &backupManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return err
+			}
+			if manifest.Version != docker.VERSION {
+				fmt.Fprintf(log, "Warning: the backup was made by docker %s\n", manifest.Version)
+			}
+		case manifest == nil:
+			return errors.New("Invalid backup: backup.json must come first")
+		case hdr.Name == "images/index.json":
+			err = writeRestored(path.Join(rootPath, "images", "index.json"), tr)
+		case len(parts) == 2 && parts[0] == "layers" && strings.HasSuffix(parts[1], ".tar"):
+			id := strings.TrimSuffix(parts[1], ".tar")
+			fmt.Fprintf(log, "Restoring layer %s\n", id)
+			err = untarRestored(path.Join(rootPath, "images", "layers", id), tr)
+		case len(parts) == 3 && parts[0] == "containers" && parts[2] == "config.json":
+			fmt.Fprintf(log, "Restoring container %s\n", parts[1])
+			err = writeRestored(path.Join(rootPath, "containers", parts[1], "config.json"), tr)
+		case len(parts) == 3 && parts[0] == "containers" && parts[2] == "rw.tar":
+			err = untarRestored(path.Join(rootPath, "containers", parts[1], "rw"), tr)
+		case parts[0] == "volumes":
+			err = restoreVolume(manifest, hdr.Name, tr, volumes, log)
+		default:
+			return errors.New("Invalid backup: unexpected file " + hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if manifest == nil {
+		return errors.New("Invalid backup: backup.json is missing")
+	}
+	return nil
+}
+
+func restoreVolume(manifest *backupManifest, name string, content io.Reader, restore bool, log io.Writer) error {
+	for _, volume := range manifest.Volumes {
+		if volume.File != name {
+			continue
+		}
+		if !path.IsAbs(volume.Path) || path.Clean(volume.Path) != volume.Path || volume.Path == "/" {
+			return errors.New("Invalid backup: invalid volume path " + volume.Path)
+		}
+		if !restore {
+			fmt.Fprintf(log, "Skipping volume %s: restore it with -restore-volumes\n", volume.Path)
+			return nil
+		}
+		fmt.Fprintf(log, "Restoring volume %s\n", volume.Path)
+		if strings.HasSuffix(name, ".tar") {
+			return untarRestored(volume.Path, content)
+		}
+		return writeRestored(volume.Path, content)
+	}
+	return errors.New("Invalid backup: unexpected file " + name)
+}
+
+// writeRestored writes `content` to the file `filename` and its parents.
+func writeRestored(filename string, content io.Reader) error {
+	if err := os.MkdirAll(path.Dir(filename), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, content)
+	return err
+}
+
+// untarRestored unpacks the archive `content` in the directory `dir`.
+func untarRestored(dir string, content io.Reader) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return image.Untar(content, dir)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"strings"
+)
+
+// How many containers batch commands operate on at once
+const batchWorkers = 8
+
+// forEachContainer runs `f` on each of the containers `names`, several at a
+// time, carrying on past failures. It prints the ID of each container `f`
+// succeeded on, and an error for the others, in the order of `names`. The
+// returned error lists the names which failed.
+func (srv *Server) forEachContainer(stdout io.Writer, names []string, f func(*docker.Container) error) error {
+	type result struct {
+		id  string
+		err error
+	}
+	results := make([]chan result, len(names))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	workers := make(chan struct{}, batchWorkers)
+	go func() {
+		for i, name := range names {
+			workers <- struct{}{}
+			go func(name string, done chan result) {
+				defer func() { <-workers }()
+				container := srv.containers.Get(name)
+				if container == nil {
+					done <- result{err: errors.New("No such container")}
+					return
+				}
+				done <- result{id: container.Id, err: f(container)}
+			}(name, results[i])
+		}
+	}()
+	var failed []string
+	for i, name := range names {
+		r := <-results[i]
+		if r.err != nil {
+			fmt.Fprintf(rcli.Stderr(stdout), "Error: %s: %s\n", name, r.err)
+			failed = append(failed, name)
+			continue
+		}
+		fmt.Fprintln(stdout, r.id)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed on %d of %d containers: %s", len(failed), len(names), strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/future"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"strings"
+)
+
+// 'docker build NAME < RECIPE' builds image NAME from a recipe read on stdin,
+// one instruction per line:
+//
+//	from IMAGE	start from image IMAGE
+//	run COMMAND	run COMMAND with /bin/sh -c, and commit the result
+//
+// Blank lines and lines starting with # are skipped. Each instruction run on
+// top of an image is remembered in the build cache of the image store, so
+// that rebuilding an unchanged recipe reuses the images it produced.
+
+func (srv *Server) CmdBuild(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "build", "[OPTIONS] NAME < RECIPE", "Build an image from a recipe read on stdin")
+	fl_no_cache := cmd.Bool("no-cache", false, "Run every instruction, instead of reusing the images of previous builds")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	name := cmd.Arg(0)
+	if err := image.ValidateName(name); err != nil {
+		return err
+	}
+	var img *image.Image
+	scanner := bufio.NewScanner(stdin)
+	for line := 1; scanner.Scan(); line++ {
+		instruction := strings.TrimSpace(scanner.Text())
+		if instruction == "" || strings.HasPrefix(instruction, "#") {
+			continue
+		}
+		fields := strings.SplitN(instruction, " ", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			return fmt.Errorf("Line %d: expected INSTRUCTION ARGUMENT, got '%s'", line, instruction)
+		}
+		arg := strings.TrimSpace(fields[1])
+		switch strings.ToLower(fields[0]) {
+		case "from":
+			if img = srv.images.Find(arg); img == nil {
+				return fmt.Errorf("Line %d: no such image: %s", line, arg)
+			}
+			fmt.Fprintf(stdout, "From %s\n", img.Id)
+		case "run":
+			if img == nil {
+				return fmt.Errorf("Line %d: 'run' before 'from'", line)
+			}
+			if cached := srv.images.CachedBuild(img.Id, instruction); cached != nil && !*fl_no_cache {
+				fmt.Fprintf(stdout, "Run %s: using the cached image %s\n", arg, cached.Id)
+				img = cached
+				continue
+			}
+			fmt.Fprintf(stdout, "Run %s\n", arg)
+			built, err := srv.buildRun(stdout, name, img, arg)
+			if err != nil {
+				return fmt.Errorf("Line %d: %v", line, err)
+			}
+			if err := srv.images.CacheBuild(instruction, built); err != nil {
+				return err
+			}
+			img = built
+		default:
+			return fmt.Errorf("Line %d: unknown instruction '%s'", line, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if img == nil {
+		return errors.New("The recipe is empty")
+	}
+	fmt.Fprintln(stdout, img.Id)
+	return nil
+}
+
+// buildRun runs `command` in a container of image `parent`, with its output
+// on `stdout`, and commits its changes as a new image `name`.
+func (srv *Server) buildRun(stdout io.Writer, name string, parent *image.Image, command string) (*image.Image, error) {
+	container, err := srv.CreateContainer(parent, &docker.Config{}, "/bin/sh", "-c", command)
+	if err != nil {
+		return nil, err
+	}
+	defer srv.containers.Destroy(container)
+	cmd_stdout, err := container.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd_stderr, err := container.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := container.Start(); err != nil {
+		return nil, err
+	}
+	sending_stdout := future.Go(func() error {
+		_, err := io.Copy(stdout, cmd_stdout)
+		return err
+	})
+	sending_stderr := future.Go(func() error {
+		_, err := io.Copy(stdout, cmd_stderr)
+		return err
+	})
+	<-sending_stdout
+	<-sending_stderr
+	container.Wait()
+	if code := container.State.ExitCode; code != 0 {
+		return nil, fmt.Errorf("'%s' exited with status %d", command, code)
+	}
+	rwTar, err := image.Tar(container.Filesystem.RWPath, image.Uncompressed)
+	if err != nil {
+		return nil, err
+	}
+	img, err := srv.images.Import(name, rwTar, parent)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.images.SetCreatedBy(img.Id, "/bin/sh -c "+command, ""); err != nil {
+		return nil, err
+	}
+	return srv.images.Find(img.Id), nil
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	srv, root := newTestServer(t)
+	defer os.RemoveAll(root)
+	base := importTestImage(t, srv, "base", nil)
+	built := importTestImage(t, srv, "app", base)
+	if err := srv.images.CacheBuild("run make install", built); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged instructions reuse the images of the previous builds
+	output, err := dispatch(srv, "build", srv.CmdBuild, "# The app\nfrom base\n\nrun make install\n", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "using the cached image "+built.Id) || !strings.HasSuffix(output, "\n"+built.Id+"\n") {
+		t.Fatalf("Expected the cached image to be used, got:\n%s", output)
+	}
+	for recipe, expected := range map[string]string{
+		"run make\n":               "Line 1: 'run' before 'from'",
+		"from nothing\n":           "Line 1: no such image: nothing",
+		"from base\ncopy . /\n":    "Line 2: unknown instruction 'copy'",
+		"from base\nrun\n":         "Line 2: expected INSTRUCTION ARGUMENT, got 'run'",
+		"# Nothing to build yet\n": "The recipe is empty",
+	} {
+		if _, err := dispatch(srv, "build", srv.CmdBuild, recipe, "app"); err == nil || err.Error() != expected {
+			t.Errorf("%q: expected '%s', got %v", recipe, expected, err)
+		}
+	}
+	if _, err := dispatch(srv, "build", srv.CmdBuild, "from base\n", "a/b/c"); err == nil {
+		t.Errorf("Expected invalid names to be refused")
+	}
+}
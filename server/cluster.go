@@ -0,0 +1,364 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/future"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The name of the local daemon among the nodes of the cluster
+const localNode = "local"
+
+// A cluster is the pool of daemons which 'docker cluster' treats as one: the
+// local daemon, and the remote daemons registered with 'docker cluster add',
+// which are stored in ROOT/cluster.json.
+type cluster struct {
+	path   string
+	lock   sync.Mutex
+	client *tls.Config // The TLS settings of the calls to the remote daemons
+	Nodes  []string    // The remote daemons, as HOST:PORT
+
+	statsLock sync.Mutex
+	stats     map[string]*nodeStats // The last stats of the nodes, see infos
+}
+
+// How long the stats of a node are used to schedule containers before they
+// are fetched again
+const nodeStatsTTL = 10 * time.Second
+
+// nodeStats are the stats of a node as of `updated`, or the error which
+// fetching them returned.
+type nodeStats struct {
+	info    *jsonInfo
+	err     error
+	updated time.Time
+}
+
+func loadCluster(filename string) (*cluster, error) {
+	c := &cluster{path: filename}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// save writes the cluster to disk. The caller must hold the lock.
+func (c *cluster) save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *cluster) add(node string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, n := range c.Nodes {
+		if n == node {
+			return fmt.Errorf("%s is already in the cluster", node)
+		}
+	}
+	c.Nodes = append(c.Nodes, node)
+	return c.save()
+}
+
+func (c *cluster) remove(node string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, n := range c.Nodes {
+		if n == node {
+			c.Nodes = append(c.Nodes[:i], c.Nodes[i+1:]...)
+			return c.save()
+		}
+	}
+	return fmt.Errorf("%s is not in the cluster", node)
+}
+
+// nodes returns the nodes of the cluster, the local daemon first.
+func (c *cluster) nodes() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{localNode}, c.Nodes...)
+}
+
+// nodeAddr returns the address of the daemon `node`.
+func nodeAddr(node string) string {
+	if node == localNode {
+		return rcliAddr
+	}
+	return node
+}
+
+// A nodeResult is the output of a command run on a node of the cluster.
+type nodeResult struct {
+	node   string
+	output string
+	err    error
+}
+
+// call runs the command `args` on all the nodes of the cluster at once, and
+// returns their results in the order of the nodes.
+func (c *cluster) call(args ...string) []*nodeResult {
+	return c.callNodes(c.nodes(), args...)
+}
+
+// callNodes runs the command `args` on `nodes` at once, and returns their
+// results in the order of `nodes`.
+func (c *cluster) callNodes(nodes []string, args ...string) []*nodeResult {
+	results := make([]*nodeResult, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			output, err := callDaemon(c.client, nodeAddr(node), nil, ioutil.Discard, args...)
+			results[i] = &nodeResult{node, output, err}
+		}(i, node)
+	}
+	wg.Wait()
+	return results
+}
+
+// infos returns the stats of `nodes`, in their order. Stats older than
+// nodeStatsTTL are fetched again, all at once.
+func (c *cluster) infos(nodes []string) []*nodeStats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	if c.stats == nil {
+		c.stats = make(map[string]*nodeStats)
+	}
+	var stale []string
+	for _, node := range nodes {
+		if stats, exists := c.stats[node]; !exists || time.Since(stats.updated) > nodeStatsTTL {
+			stale = append(stale, node)
+		}
+	}
+	for _, result := range c.callNodes(stale, "info", "-json") {
+		stats := &nodeStats{info: &jsonInfo{}, err: result.err, updated: time.Now()}
+		if stats.err == nil {
+			stats.err = json.Unmarshal([]byte(result.output), stats.info)
+		}
+		c.stats[result.node] = stats
+	}
+	infos := make([]*nodeStats, len(nodes))
+	for i, node := range nodes {
+		infos[i] = c.stats[node]
+	}
+	return infos
+}
+
+// schedule returns the node which should run a new container of image `img`
+// needing `memory` bytes: the node with the most memory available among
+// those which have the image, and the least busy one on a tie. The stats of
+// the node chosen account for the new container until they are fetched
+// again, so that the containers scheduled meanwhile spread over the nodes.
+func (c *cluster) schedule(img string, memory int64) (string, error) {
+	nodes := c.nodes()
+	images := c.callNodes(nodes, "inspect", img)
+	infos := c.infos(nodes)
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	var best *jsonInfo
+	var node string
+	for i, stats := range infos {
+		if stats.err != nil || images[i].err != nil {
+			continue
+		}
+		info := stats.info
+		if info.MemAvailable < memory {
+			continue
+		}
+		if best == nil || info.MemAvailable > best.MemAvailable ||
+			(info.MemAvailable == best.MemAvailable && info.Running < best.Running) {
+			best, node = info, nodes[i]
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("No node of the cluster has image %s and %s of memory available", img, future.HumanSize(memory))
+	}
+	best.MemAvailable -= memory
+	best.Running++
+	return node, nil
+}
+
+// 'docker cluster': manage the daemons of the cluster, and use them as one
+func (srv *Server) CmdCluster(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "cluster", "COMMAND [OPTIONS]", "Manage a cluster of docker daemons\n\nCommands:\n"+
+		"    add       Add a daemon to the cluster\n"+
+		"    rm        Remove a daemon from the cluster\n"+
+		"    ls        List the daemons of the cluster\n"+
+		"    ps        List the containers of all the daemons\n"+
+		"    images    List the images of all the daemons\n"+
+		"    run       Run a command in a new container on the daemon with the most memory available")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	switch cmd.Arg(0) {
+	case "add":
+		return srv.cmdClusterAdd(stdin, stdout, cmd.Args()[1:]...)
+	case "rm":
+		return srv.cmdClusterRm(stdin, stdout, cmd.Args()[1:]...)
+	case "ls":
+		return srv.cmdClusterLs(stdin, stdout, cmd.Args()[1:]...)
+	case "ps":
+		return srv.cmdClusterPs(stdin, stdout, cmd.Args()[1:]...)
+	case "images":
+		return srv.cmdClusterImages(stdin, stdout, cmd.Args()[1:]...)
+	case "run":
+		return srv.cmdClusterRun(stdin, stdout, cmd.Args()[1:]...)
+	}
+	return errors.New("No such cluster command: " + cmd.Arg(0))
+}
+
+func (srv *Server) cmdClusterAdd(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "cluster add", "tcp://HOST[:PORT]", "Add a daemon to the cluster")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	addr, err := parseDaemonAddr(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	if _, err := callDaemon(srv.tlsClient, addr, nil, ioutil.Discard, "version"); err != nil {
+		return fmt.Errorf("Unable to reach the daemon at %s: %v", addr, err)
+	}
+	return srv.cluster.add(addr)
+}
+
+func (srv *Server) cmdClusterRm(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "cluster rm", "tcp://HOST[:PORT]", "Remove a daemon from the cluster")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	addr, err := parseDaemonAddr(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	return srv.cluster.remove(addr)
+}
+
+func (srv *Server) cmdClusterLs(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "cluster ls", "", "List the daemons of the cluster, and their load")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "NODE\tCONTAINERS\tRUNNING\tMEMORY AVAILABLE\tSTATUS\n")
+	for _, result := range srv.cluster.call("info", "-json") {
+		info := &jsonInfo{}
+		if result.err == nil {
+			result.err = json.Unmarshal([]byte(result.output), info)
+		}
+		if result.err != nil {
+			fmt.Fprintf(w, "%s\t\t\t\tError: %v\n", result.node, result.err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\tUp\n", result.node, info.Containers, info.Running, future.HumanSize(info.MemAvailable))
+	}
+	return w.Flush()
+}
+
+func (srv *Server) cmdClusterPs(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	w := tabwriter.NewWriter(stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "NODE\tID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\n")
+	for _, result := range srv.cluster.call(append(append([]string{"ps"}, args...), "-json")...) {
+		var containers []*jsonContainer
+		if result.err == nil {
+			result.err = json.Unmarshal([]byte(result.output), &containers)
+		}
+		if result.err != nil {
+			fmt.Fprintf(rcli.Stderr(stdout), "Error: %s: %v\n", result.node, result.err)
+			continue
+		}
+		for _, c := range containers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s ago\t%s\n", result.node, c.Id, c.Image, docker.Trunc(c.Command, 20),
+				future.HumanDuration(time.Now().Sub(c.Created)), c.Status)
+		}
+	}
+	return w.Flush()
+}
+
+func (srv *Server) cmdClusterImages(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "NODE\tNAME\tTAG\tID\tCREATED\n")
+	for _, result := range srv.cluster.call(append(append([]string{"images"}, args...), "-json")...) {
+		var images []*jsonImage
+		if result.err == nil {
+			result.err = json.Unmarshal([]byte(result.output), &images)
+		}
+		if result.err != nil {
+			fmt.Fprintf(rcli.Stderr(stdout), "Error: %s: %v\n", result.node, result.err)
+			continue
+		}
+		for _, img := range images {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s ago\n", result.node, img.Name, img.Tag, img.Id,
+				future.HumanDuration(time.Now().Sub(img.Created)))
+		}
+	}
+	return w.Flush()
+}
+
+func (srv *Server) cmdClusterRun(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "cluster run", "[OPTIONS] IMAGE COMMAND [ARG...]", "Run a command in a new container on the daemon of the cluster with the most memory available")
+	flags := newRunFlags(cmd)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 2 {
+		cmd.Usage()
+		return nil
+	}
+	if *flags.stdin || *flags.tty {
+		return errors.New("'cluster run' can't attach to containers: -i and -t are not supported")
+	}
+	if *flags.cidfile != "" {
+		return errors.New("-cidfile doesn't apply to 'cluster run'")
+	}
+	if _, err := flags.config(); err != nil {
+		return err
+	}
+	node, err := srv.cluster.schedule(cmd.Arg(0), int64(flags.memory))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(rcli.Progress(stdout), "Running on %s\n", node)
+	id, err := callDaemon(srv.tlsClient, nodeAddr(node), nil, rcli.Stderr(stdout), append([]string{"run"}, args...)...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, id)
+	return nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/future"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The columns which 'docker ps -columns' picks from, by name. Each renders
+// the field of a container, truncated unless `full` is true.
+var psColumns = map[string]func(container *docker.Container, full bool) string{
+	"ID": func(container *docker.Container, full bool) string {
+		if !full {
+			return docker.TruncateId(container.Id)
+		}
+		return container.Id
+	},
+	"IMAGE": func(container *docker.Container, full bool) string { return container.Config.Image },
+	"COMMAND": func(container *docker.Container, full bool) string {
+		command := fmt.Sprintf("%s %s", container.Path, strings.Join(container.Args, " "))
+		if !full {
+			command = docker.Trunc(command, 20)
+		}
+		return command
+	},
+	"CREATED": func(container *docker.Container, full bool) string {
+		return future.HumanDuration(time.Now().Sub(container.Created)) + " ago"
+	},
+	"STATUS":  func(container *docker.Container, full bool) string { return container.Status() },
+	"COMMENT": func(container *docker.Container, full bool) string { return container.Label("comment") },
+	"PORTS":   func(container *docker.Container, full bool) string { return portsSummary(container) },
+	// The ID of the container, then its aliases on its network
+	"NAMES": func(container *docker.Container, full bool) string {
+		id := container.Id
+		if !full {
+			id = docker.TruncateId(id)
+		}
+		return strings.Join(append([]string{id}, container.Config.NetworkAliases...), ",")
+	},
+	// The size of the changes to the filesystem of the container
+	"SIZE": func(container *docker.Container, full bool) string {
+		size, err := container.Filesystem.Size()
+		if err != nil {
+			return "-"
+		}
+		return future.HumanSize(size)
+	},
+}
+
+// The columns of 'docker ps' by default
+const defaultPsColumns = "ID,IMAGE,COMMAND,CREATED,STATUS,PORTS,COMMENT"
+
+// parsePsColumns returns the names of the columns of `spec`, separated by
+// commas, in the order given, eg. 'id,image,ports'.
+func parsePsColumns(spec string) ([]string, error) {
+	var columns []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if _, exists := psColumns[name]; !exists {
+			var names []string
+			for name := range psColumns {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("Unknown column '%s' (expected %s)", name, strings.Join(names, ", "))
+		}
+		columns = append(columns, name)
+	}
+	return columns, nil
+}
+
+// publishedPorts returns the ports which the container publishes on the
+// host, sorted by private port.
+func publishedPorts(container *docker.Container) []*jsonPort {
+	var ports []*jsonPort
+	for private, public := range container.NetworkSettings.PortMapping {
+		ports = append(ports, &jsonPort{
+			PrivatePort: private,
+			PublicPort:  public,
+			HostIp:      container.NetworkSettings.PortAddresses[private],
+		})
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		a, _ := strconv.Atoi(ports[i].PrivatePort)
+		b, _ := strconv.Atoi(ports[j].PrivatePort)
+		return a < b
+	})
+	return ports
+}
+
+// portsSummary returns the ports which the container publishes on the host,
+// as IP:PUBLIC->PRIVATE/tcp, separated by commas. IP is 0.0.0.0 for the ports
+// published on all the addresses of the host.
+func portsSummary(container *docker.Container) string {
+	var ports []string
+	for _, port := range publishedPorts(container) {
+		ip := port.HostIp
+		if ip == "" {
+			ip = "0.0.0.0"
+		}
+		ports = append(ports, fmt.Sprintf("%s->%s/tcp", net.JoinHostPort(ip, port.PublicPort), port.PrivatePort))
+	}
+	return strings.Join(ports, ", ")
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"strings"
+)
+
+// The commands whose arguments complete to container or image names
+var (
+	completeContainers = []string{"attach", "checkpoint", "clone", "commit", "diff", "inspect", "kill", "label", "logs",
+		"migrate", "port", "rename", "restart", "restore", "rm", "start", "stats", "stop", "tar", "update", "wait"}
+	completeImages = []string{"create", "history", "images", "inspect", "label", "push", "rmi", "run", "save", "scale", "sign"}
+)
+
+// 'docker completion bash|zsh': generate a shell completion script from the
+// command catalog. Container and image names are completed with 'docker names'.
+func (srv *Server) CmdCompletion(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "completion", "bash|zsh",
+		"Output a shell completion script, eg. 'docker completion bash > /etc/bash_completion.d/docker'")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	script := bashCompletion(srv.Commands())
+	switch cmd.Arg(0) {
+	case "bash":
+	case "zsh":
+		// zsh runs bash completion functions through bashcompinit
+		script = "autoload -U +X bashcompinit && bashcompinit\n" + script
+	default:
+		return errors.New("Unsupported shell: " + cmd.Arg(0))
+	}
+	_, err := io.WriteString(stdout, script)
+	return err
+}
+
+// 'docker names containers|images': list the names to complete (hidden)
+func (srv *Server) CmdNames(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: docker names containers|images")
+	}
+	switch args[0] {
+	case "containers":
+		for _, container := range srv.containers.List() {
+			fmt.Fprintln(stdout, container.Id)
+		}
+	case "images":
+		for _, namespace := range srv.images.Namespaces() {
+			for _, name := range srv.images.NamesIn(namespace) {
+				fmt.Fprintln(stdout, name)
+			}
+		}
+	default:
+		return errors.New("Usage: docker names containers|images")
+	}
+	return nil
+}
+
+func bashCompletion(commands []*rcli.Command) string {
+	var names []string
+	var flags bytes.Buffer
+	for _, command := range commands {
+		names = append(names, command.Name)
+		if len(command.Flags) == 0 {
+			continue
+		}
+		var words []string
+		for _, flag := range command.Flags {
+			words = append(words, "-"+flag.Name)
+		}
+		fmt.Fprintf(&flags, "\t\t%s) words=\"%s\" ;;\n", command.Name, strings.Join(words, " "))
+	}
+	return `# docker completion, generated by 'docker completion'
+_docker() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" cmd="${COMP_WORDS[1]}" words=""
+	if [ "$COMP_CWORD" -eq 1 ] || [ "$cmd" = help ]; then
+		words="` + strings.Join(names, " ") + `"
+	elif [ "${cur:0:1}" = - ]; then
+		case "$cmd" in
+` + flags.String() + `		esac
+	else
+		case "$cmd" in
+		` + strings.Join(completeContainers, "|") + `) words="$words $(docker names containers 2>/dev/null)" ;;
+		esac
+		case "$cmd" in
+		` + strings.Join(completeImages, "|") + `) words="$words $(docker names images 2>/dev/null)" ;;
+		esac
+	fi
+	COMPREPLY=( $(compgen -W "$words" -- "$cur") )
+}
+complete -F _docker docker
+`
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The commands limited by Options.MaxHeavy
+var heavyCommands = map[string]bool{
+	"pull":       true,
+	"push":       true,
+	"put":        true,
+	"import":     true,
+	"commit":     true,
+	"build":      true,
+	"tar":        true,
+	"save":       true,
+	"load":       true,
+	"checkpoint": true,
+	"restore":    true,
+	"migrate":    true,
+	"backup":     true,
+}
+
+// Timeouts is a flag.Value collecting timeouts of commands, as
+// COMMAND=DURATION, eg. pull=10m.
+type Timeouts map[string]time.Duration
+
+func (t Timeouts) String() string {
+	var s []string
+	for name, timeout := range t {
+		s = append(s, name+"="+timeout.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (t Timeouts) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Invalid timeout: %v (expected COMMAND=DURATION)", value)
+	}
+	timeout, err := time.ParseDuration(parts[1])
+	if err != nil || timeout <= 0 {
+		return fmt.Errorf("Invalid timeout: %v (expected a positive duration, eg. 10m)", value)
+	}
+	t[parts[0]] = timeout
+	return nil
+}
+
+// Dispatch wraps command `name` with the middlewares, which may deny it
+// before it is limited.
+func (srv *Server) Dispatch(name string, cmd rcli.Cmd) rcli.Cmd {
+	return srv.authorize(name, srv.limit(name, cmd))
+}
+
+// limit wraps command `name` with the limits of the server's options: the
+// number of heavy commands running at once, and the timeout of the command.
+// Commands which time out are cancelled, see rcli.Done, and waited for
+// timeoutGrace.
+func (srv *Server) limit(name string, cmd rcli.Cmd) rcli.Cmd {
+	heavy := srv.heavy != nil && heavyCommands[name]
+	timeout := srv.options.Timeouts[name]
+	if !heavy && timeout == 0 {
+		return cmd
+	}
+	return func(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+		if heavy {
+			if err := srv.acquireHeavy(name, stdout); err != nil {
+				return err
+			}
+		}
+		run := func(stdout io.Writer) error {
+			if heavy {
+				defer func() { <-srv.heavy }()
+			}
+			return cmd(stdin, stdout, args...)
+		}
+		if timeout == 0 {
+			return run(stdout)
+		}
+		out, cancel := rcli.WithCancel(stdout)
+		defer cancel()
+		result := make(chan error, 1)
+		go func() { result <- run(out) }()
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(timeout):
+		}
+		// Commands may not notice the cancellation right away, and they
+		// may not stop at all: then the client is told not to assume
+		// they failed.
+		cancel()
+		select {
+		case <-result:
+			return fmt.Errorf("'%s' timed out after %s", name, timeout)
+		case <-time.After(timeoutGrace):
+			return fmt.Errorf("'%s' timed out after %s, and is still running", name, timeout)
+		}
+	}
+}
+
+// How long commands which time out have to return once cancelled
+const timeoutGrace = 10 * time.Second
+
+// acquireHeavy takes a slot for heavy command `name`, waiting for one if
+// Options.QueueHeavy is set.
+func (srv *Server) acquireHeavy(name string, stdout io.Writer) error {
+	select {
+	case srv.heavy <- struct{}{}:
+		return nil
+	default:
+	}
+	if !srv.options.QueueHeavy {
+		return fmt.Errorf("Too many heavy operations running (%d max), try '%s' again later", cap(srv.heavy), name)
+	}
+	fmt.Fprintf(rcli.Progress(stdout), "Waiting for one of %d heavy operations to finish\n", cap(srv.heavy))
+	select {
+	case srv.heavy <- struct{}{}:
+		return nil
+	case <-rcli.Done(stdout):
+		return errors.New("Client disconnected")
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker"
+	"net"
+	"strings"
+)
+
+// Nameservers is a flag.Value collecting the nameservers of the containers,
+// which replace those of the host
+type Nameservers []string
+
+func (n *Nameservers) String() string {
+	return strings.Join(*n, ",")
+}
+
+func (n *Nameservers) Set(value string) error {
+	if net.ParseIP(value) == nil {
+		return fmt.Errorf("Invalid DNS server: %s", value)
+	}
+	*n = append(*n, value)
+	return nil
+}
+
+// SearchDomains is a flag.Value collecting the search domains of the
+// containers, which replace those of the host
+type SearchDomains []string
+
+func (s *SearchDomains) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *SearchDomains) Set(value string) error {
+	if err := docker.ValidateHostname(value); err != nil {
+		return err
+	}
+	*s = append(*s, value)
+	return nil
+}
+
+// ResolverOptions is a flag.Value collecting the resolver options of the
+// containers, such as ndots:2, which replace those of the host
+type ResolverOptions []string
+
+func (o *ResolverOptions) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *ResolverOptions) Set(value string) error {
+	if value == "" || strings.ContainsAny(value, " \t\n") {
+		return fmt.Errorf("Invalid resolver option: %q", value)
+	}
+	*o = append(*o, value)
+	return nil
+}
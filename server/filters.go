@@ -0,0 +1,293 @@
+package server
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/image"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// filters is a flag.Value collecting KEY=VALUE filters. Values given for the
+// same key are alternatives; different keys must all match.
+type filters map[string][]string
+
+func (f filters) String() string {
+	var s []string
+	for key, values := range f {
+		for _, value := range values {
+			s = append(s, key+"="+value)
+		}
+	}
+	sort.Strings(s)
+	return strings.Join(s, " ")
+}
+
+func (f filters) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("Invalid filter: %v (expected KEY=VALUE)", value)
+	}
+	f[parts[0]] = append(f[parts[0]], parts[1])
+	return nil
+}
+
+// check returns an error if `f` has a key which isn't in `keys`.
+func (f filters) check(keys ...string) error {
+	for key := range f {
+		valid := false
+		for _, k := range keys {
+			valid = valid || k == key
+		}
+		if !valid {
+			return fmt.Errorf("Invalid filter '%s' (valid filters: %s)", key, strings.Join(keys, ", "))
+		}
+	}
+	return nil
+}
+
+// labels returns the label filters of `f`. They must all match.
+func (f filters) labels() labels {
+	l := labels{}
+	for _, value := range f["label"] {
+		l.Set(value)
+	}
+	return l
+}
+
+// containerTime returns the creation date of container `value`, or the date
+// `value` itself in RFC 3339 format.
+func (srv *Server) containerTime(value string) (time.Time, error) {
+	if container := srv.containers.Get(value); container != nil {
+		return container.Created, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("No such container, and invalid date: %s", value)
+	}
+	return t, nil
+}
+
+// containerFilter returns a function selecting the containers matching `f`:
+//
+//	status=running|stopped	containers in that state
+//	image=IMAGE		containers created from IMAGE (a name or an ID)
+//	id=PREFIX		containers whose ID starts with PREFIX
+//	label=KEY[=VALUE]	containers with that label
+//	before=CONTAINER|DATE	containers created before CONTAINER, or DATE (RFC 3339)
+//	since=CONTAINER|DATE	containers created after CONTAINER, or DATE (RFC 3339)
+func (srv *Server) containerFilter(f filters) (func(*docker.Container) bool, error) {
+	if err := f.check("status", "image", "id", "label", "before", "since"); err != nil {
+		return nil, err
+	}
+	for _, status := range f["status"] {
+		if status != "running" && status != "stopped" {
+			return nil, fmt.Errorf("Invalid status '%s' (expected running or stopped)", status)
+		}
+	}
+	var before, since []time.Time
+	for _, value := range f["before"] {
+		t, err := srv.containerTime(value)
+		if err != nil {
+			return nil, err
+		}
+		before = append(before, t)
+	}
+	for _, value := range f["since"] {
+		t, err := srv.containerTime(value)
+		if err != nil {
+			return nil, err
+		}
+		since = append(since, t)
+	}
+	images := make(map[string]bool)
+	for _, value := range f["image"] {
+		if img := srv.images.Find(value); img != nil {
+			images[img.Id] = true
+		}
+	}
+	labels := f.labels()
+	return func(container *docker.Container) bool {
+		if len(f["status"]) > 0 && !anyOf(f["status"], func(status string) bool {
+			return (status == "running") == container.State.Running
+		}) {
+			return false
+		}
+		if len(f["image"]) > 0 && !images[container.Config.Image] && !anyOf(f["image"], func(name string) bool {
+			// Images deleted since still match by name
+			return strings.HasPrefix(container.Config.Image, name+":")
+		}) {
+			return false
+		}
+		if len(f["id"]) > 0 && !anyOf(f["id"], func(prefix string) bool {
+			return strings.HasPrefix(container.Id, prefix)
+		}) {
+			return false
+		}
+		for _, t := range before {
+			if !container.Created.Before(t) {
+				return false
+			}
+		}
+		for _, t := range since {
+			if !container.Created.After(t) {
+				return false
+			}
+		}
+		return labels.Match(container.Config.Labels)
+	}, nil
+}
+
+func anyOf(values []string, match func(string) bool) bool {
+	for _, value := range values {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageTime returns the creation date of image `value`, or the date `value`
+// itself in RFC 3339 format.
+func (srv *Server) imageTime(value string) (time.Time, error) {
+	if img := srv.images.Find(value); img != nil {
+		return img.Created, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("No such image, and invalid date: %s", value)
+	}
+	return t, nil
+}
+
+// imageFilter returns a function selecting the images matching `f`:
+//
+//	dangling=true|false	images which are (or aren't) dangling
+//	label=KEY[=VALUE]	images with that label
+//	before=IMAGE|DATE	images created before IMAGE, or DATE (RFC 3339)
+//	since=IMAGE|DATE	images created after IMAGE, or DATE (RFC 3339)
+//	parent=IMAGE		images created on top of IMAGE
+func (srv *Server) imageFilter(f filters) (func(*image.Image) bool, error) {
+	if err := f.check("dangling", "label", "before", "since", "parent"); err != nil {
+		return nil, err
+	}
+	var dangling map[string]bool
+	for _, value := range f["dangling"] {
+		if value != "true" && value != "false" {
+			return nil, fmt.Errorf("Invalid dangling filter '%s' (expected true or false)", value)
+		}
+		dangling = make(map[string]bool)
+		for _, img := range srv.images.Dangling() {
+			dangling[img.Id] = true
+		}
+	}
+	var before, since []time.Time
+	for _, value := range f["before"] {
+		t, err := srv.imageTime(value)
+		if err != nil {
+			return nil, err
+		}
+		before = append(before, t)
+	}
+	for _, value := range f["since"] {
+		t, err := srv.imageTime(value)
+		if err != nil {
+			return nil, err
+		}
+		since = append(since, t)
+	}
+	parents := make(map[string]bool)
+	for _, value := range f["parent"] {
+		img := srv.images.Find(value)
+		if img == nil {
+			return nil, fmt.Errorf("No such image: %s", value)
+		}
+		parents[img.Id] = true
+	}
+	labels := f.labels()
+	return func(img *image.Image) bool {
+		if dangling != nil && !anyOf(f["dangling"], func(value string) bool {
+			return (value == "true") == dangling[img.Id]
+		}) {
+			return false
+		}
+		if len(parents) > 0 && !parents[img.Parent] {
+			return false
+		}
+		for _, t := range before {
+			if !img.Created.Before(t) {
+				return false
+			}
+		}
+		for _, t := range since {
+			if !img.Created.After(t) {
+				return false
+			}
+		}
+		return labels.Match(img.Labels)
+	}, nil
+}
+
+// matchImageName returns true if the image `name`:`tag` matches `pattern`.
+// The pattern is NAME, NAMESPACE/ or NAME:TAG, where the name and tag may
+// contain shell wildcards.
+func matchImageName(pattern, name, tag string) bool {
+	if pattern == "" || pattern == name {
+		return true
+	}
+	if namespace, _ := image.SplitName(name); namespace != "" && pattern == namespace+"/" {
+		return true
+	}
+	patternName, patternTag := pattern, ""
+	if idx := strings.LastIndex(pattern, ":"); idx > strings.LastIndex(pattern, "/") {
+		patternName, patternTag = pattern[:idx], pattern[idx+1:]
+	}
+	if matched, err := path.Match(patternName, name); err != nil || !matched {
+		return false
+	}
+	if patternTag == "" {
+		return true
+	}
+	matched, err := path.Match(patternTag, tag)
+	return err == nil && matched
+}
+
+// containerSorter sorts containers with an arbitrary comparison.
+type containerSorter struct {
+	containers []*docker.Container
+	less       func(a, b *docker.Container) bool
+}
+
+func (s *containerSorter) Len() int           { return len(s.containers) }
+func (s *containerSorter) Less(i, j int) bool { return s.less(s.containers[i], s.containers[j]) }
+func (s *containerSorter) Swap(i, j int) {
+	s.containers[i], s.containers[j] = s.containers[j], s.containers[i]
+}
+
+// sortContainers sorts `containers` by `key`:
+//
+//	created		most recently created first
+//	id		by ID, alphabetically
+//	status		running containers first, most recently started first
+func sortContainers(containers []*docker.Container, key string) error {
+	var less func(a, b *docker.Container) bool
+	switch key {
+	case "created":
+		less = func(a, b *docker.Container) bool { return a.Created.After(b.Created) }
+	case "id":
+		less = func(a, b *docker.Container) bool { return a.Id < b.Id }
+	case "status":
+		less = func(a, b *docker.Container) bool {
+			if a.State.Running != b.State.Running {
+				return a.State.Running
+			}
+			return a.State.StartedAt.After(b.State.StartedAt)
+		}
+	default:
+		return fmt.Errorf("Invalid sort key '%s' (expected created, id or status)", key)
+	}
+	sort.Stable(&containerSorter{containers, less})
+	return nil
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// formatFuncs are the functions available to -format templates, in addition
+// to the text/template builtins.
+var formatFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// parseFormat parses the template given to a -format flag, eg.
+// '{{.Id}} {{.State}}' or '{{json .Config.Labels}}'.
+func parseFormat(format string) (*template.Template, error) {
+	return template.New("format").Funcs(formatFuncs).Parse(format)
+}
+
+// writeFormat renders `obj` through `tmpl`, followed by a newline.
+func writeFormat(w io.Writer, tmpl *template.Template, obj interface{}) error {
+	if err := tmpl.Execute(w, obj); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{'\n'})
+	return err
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a port hook may take to register a container
+const hookTimeout = 30 * time.Second
+
+// PortHooks is a flag.Value collecting the port hooks which register the
+// containers as they start and stop, so that load balancers can route to
+// them:
+//
+//	/PATH/TO/SCRIPT			run SCRIPT start|stop CONTAINER, with the registration as JSON on stdin
+//	http://HOST/PATH		POST the registration as JSON to the URL
+//	etcd://HOST:PORT/PREFIX		set the registration as the etcd key PREFIX/CONTAINER while the container runs
+type PortHooks []string
+
+func (h *PortHooks) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *PortHooks) Set(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "etcd") ||
+		(u.Scheme == "" && !path.IsAbs(value)) || (u.Scheme != "" && u.Host == "") {
+		return fmt.Errorf("Invalid port hook: %v (expected a script, http://HOST/PATH or etcd://HOST:PORT/PREFIX)", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// runPortHooks registers the containers with the port hooks as they start
+// and stop, until the daemon exits. The registrations are queued in order,
+// without limit, so that slow hooks neither miss one nor hold up the
+// containers.
+func (srv *Server) runPortHooks() {
+	queue := newRegistrationQueue()
+	srv.containers.OnChange(func(container *docker.Container, running bool) {
+		registration := &jsonRegistration{Action: "stop", Container: container.Id}
+		if running {
+			registration.Action = "start"
+			registration.IpAddress = container.NetworkSettings.IpAddress
+			registration.Ports = container.NetworkSettings.PortMapping
+			registration.Labels = container.Config.Labels
+		}
+		queue.push(registration)
+	})
+	go func() {
+		for {
+			registration := queue.pop()
+			for _, hook := range srv.options.PortHooks {
+				if err := callPortHook(hook, registration); err != nil {
+					log.Printf("Port hook %v failed for %v: %v", hook, registration.Container, err)
+				}
+			}
+		}
+	}()
+}
+
+// registrationQueue is an unbounded FIFO of registrations.
+type registrationQueue struct {
+	lock          sync.Mutex
+	cond          *sync.Cond
+	registrations []*jsonRegistration
+}
+
+func newRegistrationQueue() *registrationQueue {
+	queue := &registrationQueue{}
+	queue.cond = sync.NewCond(&queue.lock)
+	return queue
+}
+
+func (queue *registrationQueue) push(registration *jsonRegistration) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.registrations = append(queue.registrations, registration)
+	queue.cond.Signal()
+}
+
+// pop blocks until a registration is queued, and dequeues it.
+func (queue *registrationQueue) pop() *jsonRegistration {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for len(queue.registrations) == 0 {
+		queue.cond.Wait()
+	}
+	registration := queue.registrations[0]
+	queue.registrations[0] = nil
+	queue.registrations = queue.registrations[1:]
+	return registration
+}
+
+func callPortHook(hook string, registration *jsonRegistration) error {
+	data, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	u, _ := url.Parse(hook)
+	var req *http.Request
+	switch u.Scheme {
+	case "":
+		cmd := exec.CommandContext(ctx, hook, registration.Action, registration.Container)
+		cmd.Stdin = bytes.NewReader(data)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	case "etcd":
+		key := fmt.Sprintf("http://%s/v2/keys%s/%s", u.Host, strings.TrimSuffix(u.Path, "/"), registration.Container)
+		if registration.Action == "stop" {
+			req, err = http.NewRequestWithContext(ctx, "DELETE", key, nil)
+		} else {
+			form := url.Values{"value": {string(data)}}
+			req, err = http.NewRequestWithContext(ctx, "PUT", key, strings.NewReader(form.Encode()))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+		}
+	default:
+		req, err = http.NewRequestWithContext(ctx, "POST", hook, bytes.NewReader(data))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// Deleting a key which doesn't exist is fine
+	if resp.StatusCode >= 300 && !(u.Scheme == "etcd" && resp.StatusCode == http.StatusNotFound) {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
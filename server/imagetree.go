@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/future"
+	"github.com/dotcloud/docker/image"
+	"io"
+	"sort"
+)
+
+// 'docker images -tree' shows the images nested under their parents, with
+// the size of their own layer, their virtual size (the size of all their
+// layers), and what removing them would free: the size of their layers which
+// no other image, and no container, uses.
+
+// An imageNode is an image of the tree, with the images whose parent it is.
+type imageNode struct {
+	image    *image.Image
+	children []*imageNode
+}
+
+// imageTree returns the trees of the images of the store, whose roots are
+// the images without parents in the store, the oldest first.
+func (srv *Server) imageTree() []*imageNode {
+	nodes := make(map[string]*imageNode)
+	var ordered []*imageNode
+	for _, namespace := range srv.images.Namespaces() {
+		for _, name := range srv.images.NamesIn(namespace) {
+			for _, img := range srv.images.History(name) {
+				node := &imageNode{image: img}
+				nodes[img.Id] = node
+				ordered = append(ordered, node)
+			}
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].image.Created.Before(ordered[j].image.Created) })
+	var roots []*imageNode
+	for _, node := range ordered {
+		if parent, exists := nodes[node.image.Parent]; exists && parent != node {
+			parent.children = append(parent.children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
+
+// layerSizes computes the sizes of the layers of images, once per layer.
+type layerSizes map[string]int64
+
+func (sizes layerSizes) get(layer string) int64 {
+	if size, exists := sizes[layer]; exists {
+		return size
+	}
+	size, _ := image.LayerSize(layer)
+	sizes[layer] = size
+	return size
+}
+
+// containerLayers returns the layers used by the containers, which removing
+// an image doesn't free.
+func (srv *Server) containerLayers() map[string]bool {
+	layers := make(map[string]bool)
+	for _, container := range srv.containers.List() {
+		for _, layer := range container.Filesystem.Layers {
+			layers[layer] = true
+		}
+	}
+	return layers
+}
+
+// writeImageTree renders the trees of `roots` to `stdout`. The layers of
+// `inUse` are used by containers.
+func writeImageTree(stdout io.Writer, roots []*imageNode, inUse map[string]bool) {
+	// How many images use each layer
+	users := make(map[string]int)
+	var count func(nodes []*imageNode)
+	count = func(nodes []*imageNode) {
+		for _, node := range nodes {
+			for _, layer := range node.image.Layers {
+				users[layer]++
+			}
+			count(node.children)
+		}
+	}
+	count(roots)
+
+	sizes := make(layerSizes)
+	var write func(nodes []*imageNode, prefix string)
+	write = func(nodes []*imageNode, prefix string) {
+		for idx, node := range nodes {
+			branch, indent := "├─", "│ "
+			if idx == len(nodes)-1 {
+				branch, indent = "└─", "  "
+			}
+			var own, virtual, frees int64
+			for i, layer := range node.image.Layers {
+				size := sizes.get(layer)
+				virtual += size
+				if i == 0 {
+					own = size
+				}
+				if users[layer] == 1 && !inUse[layer] {
+					frees += size
+				}
+			}
+			id := node.image.Id
+			if !node.image.IdIsFinal() {
+				id += "..."
+			}
+			if node.image.Tag != "" {
+				id += " (" + node.image.Tag + ")"
+			}
+			fmt.Fprintf(stdout, "%s%s%s  Size: %s (virtual %s, rmi frees %s)\n", prefix, branch, id,
+				future.HumanSize(own), future.HumanSize(virtual), future.HumanSize(frees))
+			write(node.children, prefix+indent)
+		}
+	}
+	write(roots, "")
+
+	var total int64
+	for layer := range users {
+		total += sizes.get(layer)
+	}
+	fmt.Fprintf(stdout, "Total: %d layers, %s\n", len(users), future.HumanSize(total))
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"github.com/dotcloud/docker/image"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestImageTreeFrees(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-imagetree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	layers := make(map[string]string)
+	for _, name := range []string{"base", "app"} {
+		layers[name] = path.Join(root, name)
+		if err := os.Mkdir(layers[name], 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(layers[name], "data"), make([]byte, 1000), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := &imageNode{image: &image.Image{Id: "base", Layers: []string{layers["base"]}}}
+	app := &imageNode{image: &image.Image{Id: "app", Layers: []string{layers["app"], layers["base"]}, Parent: "base"}}
+	base.children = []*imageNode{app}
+
+	var out bytes.Buffer
+	writeImageTree(&out, []*imageNode{base}, nil)
+	if !strings.Contains(out.String(), "app...  Size: 1.0 kB (virtual 2.0 kB, rmi frees 1.0 kB)") {
+		t.Fatalf("Expected removing app to free its own layer, got:\n%s", out.String())
+	}
+	// The layers of the containers aren't freed
+	out.Reset()
+	writeImageTree(&out, []*imageNode{base}, map[string]bool{layers["app"]: true})
+	if !strings.Contains(out.String(), "app...  Size: 1.0 kB (virtual 2.0 kB, rmi frees 0 B)") {
+		t.Fatalf("Expected removing app to free nothing, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// The structures below are printed by the -json flag of ps, images, info,
+// version, port, diff, events, stats and network ls, and sent to the port hooks. Scripts depend on them: fields may be added, but never
+// renamed or removed.
+
+type jsonContainer struct {
+	Id        string
+	Image     string
+	Command   string
+	Created   time.Time
+	Running   bool
+	ExitCode  int
+	Started   time.Time
+	Finished  time.Time
+	Uptime    string `json:",omitempty"` // See jsonInspect
+	Status    string
+	Labels    map[string]string
+	OOMKilled bool
+	Ports     []*jsonPort `json:",omitempty"` // The ports published on the host, while it runs
+}
+
+type jsonStats struct {
+	Container string
+	Labels    map[string]string `json:",omitempty"`
+	*docker.NetworkStats
+}
+
+// A container as returned by inspect, with its network usage if it is running
+type jsonInspect struct {
+	*docker.Container
+	NetworkStats *docker.NetworkStats `json:",omitempty"`
+	// How long the container has been running, or ran until it last
+	// stopped, eg. "1h2m3s"
+	Uptime string `json:",omitempty"`
+}
+
+// An image as returned by inspect, with the images which share its layers,
+// eg. its copies made by 'docker cp' without -clone. Its layers are only
+// removed once all of them are.
+type jsonInspectImage struct {
+	*image.Image
+	SharedWith []string
+}
+
+// A network, with the containers attached to it and their address if they
+// are running
+type jsonNetwork struct {
+	*docker.Network
+	Containers map[string]string
+}
+
+type jsonImage struct {
+	Name      string
+	Tag       string
+	Id        string
+	Parent    string
+	Created   time.Time
+	Labels    map[string]string
+	CreatedBy string `json:",omitempty"`
+	Comment   string `json:",omitempty"`
+}
+
+type jsonInfo struct {
+	Version       string
+	Containers    int
+	Running       int
+	Stopped       int
+	Images        int
+	Layers        int
+	KernelVersion string
+	StorageDriver string
+	Root          string
+	DiskUsage     int64  `json:",omitempty"` // In bytes, with -size
+	DiskError     string `json:",omitempty"` // Why the disk usage is unknown, with -size
+	MemTotal      int64  // In bytes
+	MemAvailable  int64  // In bytes
+	Debug         bool
+	Listeners     []string
+}
+
+type jsonEvent struct {
+	Time      time.Time
+	Container string
+	Action    string
+}
+
+type jsonRegistration struct {
+	Action    string // start or stop
+	Container string
+	IpAddress string            `json:",omitempty"`
+	Ports     map[string]string `json:",omitempty"` // Port of the container => port of the host
+	Labels    map[string]string `json:",omitempty"`
+}
+
+type jsonAuthzRequest struct {
+	Command string
+	Args    []string
+}
+
+type jsonAuthzResponse struct {
+	Allow bool
+	Msg   string   `json:",omitempty"` // Why the command is denied
+	Args  []string `json:",omitempty"` // Replace the arguments of the command
+}
+
+type jsonVersion struct {
+	Version    string
+	ApiVersion int
+	GoVersion  string
+	GitCommit  string
+}
+
+type jsonPort struct {
+	PrivatePort string
+	PublicPort  string
+	HostIp      string `json:",omitempty"` // The address of the host the port is published on, if not all of them
+}
+
+type jsonChange struct {
+	Kind string // "add", "modify" or "delete"
+	Path string
+}
+
+// formatUptime returns `uptime` to the second, or "" if it is 0.
+func formatUptime(uptime time.Duration) string {
+	if uptime == 0 {
+		return ""
+	}
+	return uptime.Round(time.Second).String()
+}
+
+func newJSONContainer(container *docker.Container) *jsonContainer {
+	return &jsonContainer{
+		Id:        container.Id,
+		Image:     container.Config.Image,
+		Command:   strings.TrimSpace(container.Path + " " + strings.Join(container.Args, " ")),
+		Created:   container.Created,
+		Running:   container.State.Running,
+		ExitCode:  container.State.ExitCode,
+		Started:   container.State.StartedAt,
+		Finished:  container.State.FinishedAt,
+		Uptime:    formatUptime(container.State.Uptime()),
+		Status:    container.Status(),
+		Labels:    container.Config.Labels,
+		OOMKilled: container.State.OOMKilled,
+		Ports:     publishedPorts(container),
+	}
+}
+
+func newJSONVersion() *jsonVersion {
+	version := &jsonVersion{
+		Version:    docker.VERSION,
+		ApiVersion: rcli.APIVERSION,
+		GoVersion:  runtime.Version(),
+		GitCommit:  docker.GITCOMMIT,
+	}
+	if version.GitCommit == "" {
+		version.GitCommit = "N/A"
+	}
+	return version
+}
+
+func newJSONImage(name string, img *image.Image) *jsonImage {
+	return &jsonImage{
+		Name:      name,
+		Tag:       img.Tag,
+		Id:        img.Id,
+		Parent:    img.Parent,
+		Created:   img.Created,
+		Labels:    img.Labels,
+		CreatedBy: img.CreatedBy,
+		Comment:   img.Comment,
+	}
+}
+
+func newJSONChange(change docker.Change) *jsonChange {
+	kind := "modify"
+	switch change.Kind {
+	case docker.ChangeAdd:
+		kind = "add"
+	case docker.ChangeDelete:
+		kind = "delete"
+	}
+	return &jsonChange{Kind: kind, Path: change.Path}
+}
+
+// writeJSON prints `v` as indented JSON, followed by a newline.
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
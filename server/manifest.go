@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A manifest describes an application made of several containers, which
+// 'docker up' brings up and 'docker down' tears down as a unit:
+//
+//	{
+//		"Name": "blog",
+//		"Containers": {
+//			"db": {"Image": "postgres", "Command": ["/usr/bin/postgres"], "Ports": [5432]},
+//			"web": {
+//				"Image": "blog", "Command": ["/usr/bin/blog"], "Ports": [80],
+//				"Env": ["MODE=production"], "Volumes": ["/srv/blog:/var/www:ro"],
+//				"Links": ["db"], "DependsOn": ["cache"]
+//			},
+//			"cache": {"Image": "memcached", "Command": ["/usr/bin/memcached", "-u", "nobody"]}
+//		}
+//	}
+//
+// The keys are case-insensitive. The container NAME of application APP is
+// created as APP-NAME. It only starts while the containers it links to or
+// depends on are running, and finds the containers it links to in its
+// environment: DB_IP=IP and DB_PORT_5432=IP:5432.
+type manifest struct {
+	Name       string
+	Containers map[string]*manifestContainer
+}
+
+type manifestContainer struct {
+	Image     string
+	Command   []string
+	User      string
+	Ports     []int
+	Env       []string
+	Volumes   []string
+	Links     []string
+	DependsOn []string
+	Labels    map[string]string
+	Restart   string
+}
+
+var validManifestName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.]*$`)
+
+// parseManifest reads and checks a manifest in JSON.
+func parseManifest(r io.Reader) (*manifest, error) {
+	m := &manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("Invalid manifest: %v", err)
+	}
+	if m.Name != "" && !validManifestName.MatchString(m.Name) {
+		return nil, fmt.Errorf("Invalid application name in the manifest: %s", m.Name)
+	}
+	if len(m.Containers) == 0 {
+		return nil, fmt.Errorf("Invalid manifest: no containers")
+	}
+	for name, c := range m.Containers {
+		if !validManifestName.MatchString(name) {
+			return nil, fmt.Errorf("Invalid container name in the manifest: %s", name)
+		}
+		if c.Image == "" || len(c.Command) == 0 {
+			return nil, fmt.Errorf("Container %s: an image and a command are required", name)
+		}
+		for _, dependency := range c.dependencies() {
+			if _, exists := m.Containers[dependency]; !exists {
+				return nil, fmt.Errorf("Container %s: depends on unknown container %s", name, dependency)
+			}
+		}
+		if _, err := c.config(); err != nil {
+			return nil, fmt.Errorf("Container %s: %v", name, err)
+		}
+	}
+	if _, err := m.order(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// order returns the names of the containers of the manifest, each after the
+// containers it depends on.
+func (m *manifest) order() ([]string, error) {
+	var names []string
+	for name := range m.Containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ordered []string
+	done := make(map[string]bool)
+	visiting := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if done[name] {
+			return nil
+		}
+		path = append(path, name)
+		if visiting[name] {
+			return fmt.Errorf("Dependency cycle in the manifest: %s", strings.Join(path, " -> "))
+		}
+		visiting[name] = true
+		dependencies := m.Containers[name].dependencies()
+		sort.Strings(dependencies)
+		for _, dependency := range dependencies {
+			if err := visit(dependency, path); err != nil {
+				return err
+			}
+		}
+		done[name] = true
+		ordered = append(ordered, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// dependencies returns the names of the containers which the container links
+// to or depends on.
+func (c *manifestContainer) dependencies() []string {
+	return append(append([]string{}, c.Links...), c.DependsOn...)
+}
+
+// config returns the configuration of the container, without the variables
+// of its links and its dependencies.
+func (c *manifestContainer) config() (*docker.Config, error) {
+	if _, _, err := docker.ParseRestartPolicy(c.Restart); err != nil {
+		return nil, err
+	}
+	config := &docker.Config{
+		User:          c.User,
+		Ports:         c.Ports,
+		RestartPolicy: c.Restart,
+		Labels:        make(map[string]string),
+		Env:           append([]string{}, c.Env...),
+	}
+	for key, value := range c.Labels {
+		config.Labels[key] = value
+	}
+	for _, env := range c.Env {
+		if err := docker.ValidateEnv(env); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range c.Volumes {
+		volume, err := docker.ParseVolume(spec)
+		if err != nil {
+			return nil, err
+		}
+		config.Volumes = append(config.Volumes, volume)
+	}
+	return config, nil
+}
+
+// linkEnv returns the variables of the environment pointing to the linked
+// container `name`: NAME_IP, and NAME_PORT_N for each of its ports.
+func linkEnv(name string, container *docker.Container) []string {
+	prefix := strings.ToUpper(strings.Map(func(r rune) rune {
+		if r == '.' {
+			return '_'
+		}
+		return r
+	}, name))
+	ip := container.NetworkSettings.IpAddress
+	env := []string{prefix + "_IP=" + ip}
+	for _, port := range container.Config.Ports {
+		env = append(env, fmt.Sprintf("%s_PORT_%d=%s:%d", prefix, port, ip, port))
+	}
+	return env
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// A Request is a command about to run, as seen by the middlewares.
+type Request struct {
+	Command string
+	Args    []string
+}
+
+// A Middleware inspects the commands before they run. It may deny a command
+// by returning an error, or change its arguments.
+type Middleware func(req *Request) error
+
+// Use appends middleware `m` to the chain run before each command. The
+// middlewares must be set up before the server starts serving.
+func (srv *Server) Use(m Middleware) {
+	srv.middlewares = append(srv.middlewares, m)
+}
+
+// authorize runs the middlewares before command `name`, which runs with the
+// arguments they leave unless one of them denies it.
+func (srv *Server) authorize(name string, cmd rcli.Cmd) rcli.Cmd {
+	if len(srv.middlewares) == 0 {
+		return cmd
+	}
+	return func(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+		req := &Request{Command: name, Args: args}
+		for _, m := range srv.middlewares {
+			if err := m(req); err != nil {
+				return err
+			}
+		}
+		return cmd(stdin, stdout, req.Args...)
+	}
+}
+
+// logCommands is a middleware logging the commands as they run.
+func logCommands(req *Request) error {
+	log.Printf("Running '%s' %s", req.Command, strings.Join(req.Args, " "))
+	return nil
+}
+
+// AuthzPlugins is a flag.Value collecting the authorization plugins which
+// allow, deny or rewrite the commands before they run:
+//
+//	/PATH/TO/SCRIPT		run SCRIPT with the request as JSON on stdin, and the response as JSON on stdout
+//	http://HOST/PATH	POST the request as JSON to the URL, and read the response as JSON
+//	unix:///PATH/TO/SOCKET	the same over the unix socket
+//
+// The response is {"Allow": true|false, "Msg": "...", "Args": [...]}, where
+// Msg explains a denial and Args, if set, replace the arguments of the command.
+// Commands are denied if a plugin fails.
+type AuthzPlugins []string
+
+func (p *AuthzPlugins) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *AuthzPlugins) Set(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "unix") ||
+		(u.Scheme == "" && !path.IsAbs(value)) || (u.Scheme == "unix" && !path.IsAbs(u.Path)) ||
+		((u.Scheme == "http" || u.Scheme == "https") && u.Host == "") {
+		return fmt.Errorf("Invalid authorization plugin: %v (expected a script, http://HOST/PATH or unix:///PATH/TO/SOCKET)", value)
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+// authzPlugin returns the middleware asking authorization plugin `plugin`.
+func authzPlugin(plugin string) Middleware {
+	return func(req *Request) error {
+		resp, err := callAuthzPlugin(plugin, req)
+		if err != nil {
+			log.Printf("Authorization plugin %v failed for '%s': %v", plugin, req.Command, err)
+			return fmt.Errorf("Authorization of '%s' failed", req.Command)
+		}
+		if !resp.Allow {
+			if resp.Msg == "" {
+				resp.Msg = "denied by policy"
+			}
+			return fmt.Errorf("Not authorized to run '%s': %s", req.Command, resp.Msg)
+		}
+		if resp.Args != nil {
+			req.Args = resp.Args
+		}
+		return nil
+	}
+}
+
+func callAuthzPlugin(plugin string, req *Request) (*jsonAuthzResponse, error) {
+	data, err := json.Marshal(&jsonAuthzRequest{Command: req.Command, Args: req.Args})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	var output []byte
+	u, _ := url.Parse(plugin)
+	if u.Scheme == "" {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, plugin)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stderr = &stderr
+		if output, err = cmd.Output(); err != nil {
+			return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+	} else {
+		client := http.DefaultClient
+		target := plugin
+		if u.Scheme == "unix" {
+			socket := u.Path
+			client = &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			}}
+			target = "http://plugin/authorize"
+		}
+		r, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(r)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("%s", resp.Status)
+		}
+		if output, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	var resp jsonAuthzResponse
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return nil, errors.New("Invalid response: " + err.Error())
+	}
+	return &resp, nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// 'docker network': manage the networks the containers attach to
+func (srv *Server) CmdNetwork(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "network", "COMMAND [OPTIONS]", "Manage the networks of the containers\n\nCommands:\n"+
+		"    ls        List the networks\n"+
+		"    inspect   Return low-level information on networks\n"+
+		"    create    Create a network on a bridge and a subnet of its own\n"+
+		"    rm        Remove networks")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	switch cmd.Arg(0) {
+	case "ls":
+		return srv.cmdNetworkLs(stdin, stdout, cmd.Args()[1:]...)
+	case "inspect":
+		return srv.cmdNetworkInspect(stdin, stdout, cmd.Args()[1:]...)
+	case "create":
+		return srv.cmdNetworkCreate(stdin, stdout, cmd.Args()[1:]...)
+	case "rm":
+		return srv.cmdNetworkRm(stdin, stdout, cmd.Args()[1:]...)
+	}
+	return errors.New("No such network command: " + cmd.Arg(0))
+}
+
+// networkContainers returns the containers of network `name`, with their
+// address if they are running.
+func (srv *Server) networkContainers(name string) map[string]string {
+	containers := make(map[string]string)
+	for _, container := range srv.containers.List() {
+		if container.NetworkName() == name {
+			containers[container.Id] = container.NetworkSettings.IpAddress
+		}
+	}
+	return containers
+}
+
+func (srv *Server) cmdNetworkLs(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "network ls", "[OPTIONS]", "List the networks")
+	fl_json := cmd.Bool("json", false, "Output JSON")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	var networks []*jsonNetwork
+	for _, network := range srv.containers.Networks() {
+		networks = append(networks, &jsonNetwork{Network: network, Containers: srv.networkContainers(network.Name)})
+	}
+	if *fl_json {
+		return json.NewEncoder(stdout).Encode(networks)
+	}
+	w := tabwriter.NewWriter(stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "NAME\tBRIDGE\tSUBNET\tGATEWAY\tICC\tCONTAINERS\n")
+	for _, network := range networks {
+		icc := "yes"
+		if network.DisableIcc {
+			icc = "no"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", network.Name, network.Bridge, network.Subnet, network.Gateway, icc, len(network.Containers))
+	}
+	return w.Flush()
+}
+
+func (srv *Server) cmdNetworkInspect(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "network inspect", "NETWORK [NETWORK...]",
+		"Return low-level information on networks. Several networks are returned as a JSON array.")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	var networks []*jsonNetwork
+	var missing []string
+	for _, name := range cmd.Args() {
+		if network := srv.containers.Network(name); network != nil {
+			networks = append(networks, &jsonNetwork{Network: network, Containers: srv.networkContainers(network.Name)})
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	if len(networks) > 0 {
+		var data []byte
+		var err error
+		if cmd.NArg() == 1 {
+			data, err = json.Marshal(networks[0])
+		} else {
+			data, err = json.Marshal(networks)
+		}
+		if err != nil {
+			return err
+		}
+		indented := new(bytes.Buffer)
+		if err = json.Indent(indented, data, "", "    "); err != nil {
+			return err
+		}
+		if _, err := io.Copy(stdout, indented); err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("No such network: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (srv *Server) cmdNetworkCreate(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "network create", "[OPTIONS] NAME",
+		"Create a network on a bridge and a subnet of its own. Its containers can't reach those of the other networks, except through the ports they publish.")
+	fl_subnet := cmd.String("subnet", "", "Subnet of the network, such as 172.18.0.0/16 (default: the first free /16 of 172.18.0.0 to 172.31.0.0)")
+	fl_gateway := cmd.String("gateway", "", "Address of the host on the network (default: the first address of the subnet)")
+	fl_icc := cmd.Bool("icc", !srv.options.DisableIcc, "Let the containers of the network talk to each other. Otherwise, they only accept the connections of the containers which depend on them or which their label "+docker.IccAllowLabel+" lists")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	network, err := srv.containers.CreateNetwork(cmd.Arg(0), *fl_subnet, *fl_gateway, *fl_icc)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, network.Name)
+	return nil
+}
+
+func (srv *Server) cmdNetworkRm(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "network rm", "NETWORK [NETWORK...]", "Remove networks, which no container must use")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	for _, name := range cmd.Args() {
+		if err := srv.containers.RemoveNetwork(name); err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, name)
+	}
+	return nil
+}
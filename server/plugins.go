@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// Plugins are executables named docker-COMMAND in Options.PluginsDir, which
+// run the commands that aren't built in.
+const pluginPrefix = "docker-"
+
+var validPluginName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// plugin returns the path of the plugin running command `name`, if any.
+func (srv *Server) plugin(name string) string {
+	if srv.options.PluginsDir == "" || !validPluginName.MatchString(name) {
+		return ""
+	}
+	plugin := path.Join(srv.options.PluginsDir, pluginPrefix+name)
+	if st, err := os.Stat(plugin); err != nil || !st.Mode().IsRegular() || st.Mode()&0111 == 0 {
+		return ""
+	}
+	return plugin
+}
+
+// plugins returns the names of the commands run by plugins, sorted.
+func (srv *Server) plugins() []string {
+	if srv.options.PluginsDir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(srv.options.PluginsDir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, f := range files {
+		name := strings.TrimPrefix(f.Name(), pluginPrefix)
+		if strings.HasPrefix(f.Name(), pluginPrefix) && srv.plugin(name) != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Fallback runs the commands which aren't built in with their plugin. The
+// plugin gets the arguments and the input and outputs of the command, and
+// the address of the daemon in DOCKER_HOST to run other commands.
+func (srv *Server) Fallback(name string) rcli.Cmd {
+	plugin := srv.plugin(name)
+	if plugin == "" {
+		return nil
+	}
+	return func(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+		cmd := exec.Command(plugin, args...)
+		cmd.Env = append(os.Environ(), "DOCKER_HOST=tcp://"+rcliAddr)
+		cmd.Stdin = stdin
+		cmd.Stdout = stdout
+		cmd.Stderr = rcli.Stderr(stdout)
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		// Kill the plugin if the client goes away or the command times out
+		exited := make(chan struct{})
+		defer close(exited)
+		go func() {
+			select {
+			case <-rcli.Done(stdout):
+				cmd.Process.Kill()
+			case <-exited:
+			}
+		}()
+		if err := cmd.Wait(); err != nil {
+			if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Exited() {
+				return rcli.ExitStatus(status.ExitStatus())
+			}
+			return fmt.Errorf("Plugin %s failed: %v", name, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// The local daemon only listens on the loopback interface. Daemons run with
+// -H also listen on tcp://HOST[:PORT] over TLS, for the other daemons
+// (migrate, push tcp://, cluster) and remote clients. Both ends authenticate
+// with certificates signed by the CA of -tlscacert: the certificate of a
+// daemon serves it as a server and as a client of the other daemons.
+
+// The port the daemons listen on with -H, unless set
+const remotePort = "4243"
+
+// TLSOptions are the certificates which authenticate the daemon to its
+// remote clients and to the other daemons, and them to the daemon.
+type TLSOptions struct {
+	CACert string // The CA which signs the certificates of the daemons and of their clients
+	Cert   string // The certificate of the daemon, valid for server and client authentication
+	Key    string // The private key of the certificate
+}
+
+// configs returns the TLS settings of the remote listener, which only
+// accepts clients with a certificate signed by the CA, and of the calls to
+// the other daemons.
+func (options *TLSOptions) configs() (server, client *tls.Config, err error) {
+	if options.CACert == "" || options.Cert == "" || options.Key == "" {
+		return nil, nil, errors.New("TLS requires a CA, a certificate and a key (-tlscacert, -tlscert and -tlskey)")
+	}
+	pem, err := ioutil.ReadFile(options.CACert)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("No certificate found in %s", options.CACert)
+	}
+	cert, err := tls.LoadX509KeyPair(options.Cert, options.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca,
+		MinVersion:   tls.VersionTLS12,
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      ca,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return server, client, nil
+}
+
+// parseDaemonAddr returns the address of the daemon at `target`, given as
+// tcp://HOST[:PORT]. The port is remotePort if not set.
+func parseDaemonAddr(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "tcp" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return "", fmt.Errorf("Invalid daemon address: %s (expected tcp://HOST[:PORT])", target)
+	}
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), remotePort), nil
+	}
+	return u.Host, nil
+}
+
+// callDaemon runs the command `args` on the daemon at `addr` with `stdin` as
+// its input, and returns its output. Its diagnostics go to `stderr`. The
+// local daemon is called on the loopback interface, the others over TLS with
+// the settings `config`, which is nil if the daemon wasn't given
+// certificates.
+func callDaemon(config *tls.Config, addr string, stdin io.Reader, stderr io.Writer, args ...string) (string, error) {
+	var session *rcli.Session
+	var err error
+	if addr == rcliAddr {
+		session, err = rcli.Dial("tcp", addr, args...)
+	} else if config == nil {
+		return "", fmt.Errorf("Calling the daemon at %s requires certificates: run the daemon with -tlscacert, -tlscert and -tlskey", addr)
+	} else {
+		session, err = rcli.DialTLS(addr, config, args...)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	if session.Version < 2 {
+		return "", fmt.Errorf("The daemon at %s is too old", addr)
+	}
+	sent := make(chan error, 1)
+	go func() {
+		var err error
+		if stdin != nil {
+			_, err = io.Copy(session, stdin)
+		}
+		session.CloseWrite()
+		sent <- err
+	}()
+	var stdout, diagnostics bytes.Buffer
+	status, err := session.Receive(&stdout, io.MultiWriter(stderr, &diagnostics))
+	if err != nil {
+		return "", err
+	}
+	if status != 0 {
+		return "", fmt.Errorf("'%s' failed on %s: %s", args[0], addr, strings.TrimSpace(diagnostics.String()))
+	}
+	if err := <-sent; err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
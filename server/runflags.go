@@ -0,0 +1,552 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// runFlags are the options of the containers created by 'docker run',
+// 'docker create' and 'docker scale'.
+type runFlags struct {
+	user           *string
+	stdin          *bool
+	tty            *bool
+	comment        *string
+	cidfile        *string
+	publish        publish
+	expose         ports
+	publishAll     *bool
+	labels         labels
+	memory         byteSize
+	cpuShares      *int64
+	pidsLimit      *int64
+	blkioWeight    *int64
+	blkioThrottles []*docker.BlkioThrottle
+	oomKillDisable *bool
+	oomScoreAdj    *int64
+	restart        *string
+	autoRemove     *bool
+	privileged     *bool
+	capAdd         capabilities
+	capDrop        capabilities
+	devices        devices
+	readOnly       *bool
+	tmpfs          tmpfsMounts
+	shmSize        byteSize
+	ulimits        Ulimits
+	groupAdd       groups
+	securityOpts   securityOpts
+	env            env
+	volumes        volumes
+	dependsOn      containerIds
+	macAddress     *string
+	netRateIn      byteSize
+	netRateOut     byteSize
+	networkAliases hostnames
+	network        *string
+	hostname       string
+	domainname     *string
+}
+
+func newRunFlags(cmd *flag.FlagSet) *runFlags {
+	flags := &runFlags{labels: labels{}, ulimits: Ulimits{}}
+	flags.user = cmd.String("u", "", "Username or UID, and optionally a group name or GID, as USER[:GROUP]")
+	flags.stdin = cmd.Bool("i", false, "Keep stdin open even if not attached")
+	flags.tty = cmd.Bool("t", false, "Allocate a pseudo-tty")
+	flags.comment = cmd.String("c", "", "Comment (a shortcut for -label comment=COMMENT)")
+	flags.cidfile = cmd.String("cidfile", "", "Write the ID of the container to this file, which must not exist (an absolute path on the docker host)")
+	cmd.Var(&flags.publish, "p", "Publish a port of the container on a random port of the host, or as [IP:]HOSTPORT:PORT or IP::PORT (can be repeated)")
+	cmd.Var(&flags.expose, "expose", "Expose a port of the container without publishing it (can be repeated)")
+	flags.publishAll = cmd.Bool("P", false, "Publish all the exposed ports, including those of the image, on random ports of the host")
+	cmd.Var(flags.labels, "label", "Set label KEY=VALUE on the container (can be repeated)")
+	cmd.Var(&flags.memory, "m", "Memory limit, in bytes or with a unit (k, m or g)")
+	flags.cpuShares = cmd.Int64("cpu-shares", 0, "CPU shares, relative to the other containers (1024 by default)")
+	flags.pidsLimit = cmd.Int64("pids-limit", 0, "Maximum number of processes in the container (0: no limit)")
+	flags.blkioWeight = cmd.Int64("blkio-weight", 0, "Relative block IO weight, from 10 to 1000 (0: the default weight)")
+	cmd.Var(&throttles{"read_bps", &flags.blkioThrottles}, "device-read-bps", "Limit reads from a block device, as DEVICE:RATE in bytes (or k, m, g) per second (can be repeated)")
+	cmd.Var(&throttles{"write_bps", &flags.blkioThrottles}, "device-write-bps", "Limit writes to a block device, as DEVICE:RATE in bytes (or k, m, g) per second (can be repeated)")
+	cmd.Var(&throttles{"read_iops", &flags.blkioThrottles}, "device-read-iops", "Limit reads from a block device, as DEVICE:RATE in operations per second (can be repeated)")
+	cmd.Var(&throttles{"write_iops", &flags.blkioThrottles}, "device-write-iops", "Limit writes to a block device, as DEVICE:RATE in operations per second (can be repeated)")
+	flags.oomKillDisable = cmd.Bool("oom-kill-disable", false, "Pause the processes of the container instead of killing them when it runs out of memory (requires -m)")
+	flags.oomScoreAdj = cmd.Int64("oom-score-adj", 0, "Adjust the likelihood of the processes of the container to be killed when the host runs out of memory, from -1000 to 1000")
+	flags.restart = cmd.String("restart", "no", "Restart policy when the container exits: no, always or on-failure[:MAX]")
+	flags.autoRemove = cmd.Bool("rm", false, "Remove the container once it exits, keeping its logs if the daemon runs with -log-spool")
+	flags.privileged = cmd.Bool("privileged", false, "Give all capabilities and access to all devices to the container")
+	cmd.Var(&flags.capAdd, "cap-add", "Add a Linux capability, or ALL (can be repeated)")
+	cmd.Var(&flags.capDrop, "cap-drop", "Drop a Linux capability, or ALL (can be repeated)")
+	cmd.Var(&flags.devices, "device", "Expose host device HOST[:CONTAINER[:PERMISSIONS]], with permissions r, w and m (can be repeated)")
+	flags.readOnly = cmd.Bool("read-only", false, "Mount the root filesystem of the container read-only, with a tmpfs on /tmp and /run")
+	cmd.Var(&flags.tmpfs, "tmpfs", "Mount a tmpfs on PATH[:OPTIONS], such as /cache:size=64m (can be repeated)")
+	cmd.Var(&flags.shmSize, "shm-size", "Size of /dev/shm, in bytes or with a unit (k, m or g), 64m by default")
+	cmd.Var(flags.ulimits, "ulimit", "Set resource limit NAME=SOFT[:HARD], such as nofile=4096, over the defaults of the daemon (can be repeated)")
+	cmd.Var(&flags.groupAdd, "group-add", "Add a supplementary group, a name or a GID (can be repeated)")
+	cmd.Var(&flags.securityOpts, "security-opt", "Set security option apparmor=PROFILE, label=user|role|type|level:VALUE or label=disable (can be repeated)")
+	cmd.Var(&flags.env, "e", "Set variable KEY=VALUE in the environment of the container (can be repeated)")
+	cmd.Var(&flags.volumes, "v", "Bind-mount a host directory or file as HOST:CONTAINER[:ro|rw] (can be repeated)")
+	cmd.Var(&flags.dependsOn, "depends-on", "Only start the container while container ID is running (can be repeated)")
+	flags.macAddress = cmd.String("mac-address", "", "MAC address of the container, such as 02:42:ac:11:00:02 (default: random)")
+	cmd.Var(&flags.netRateIn, "net-rate-in", "Limit the traffic sent to the container, in bytes (or k, m, g) per second")
+	cmd.Var(&flags.netRateOut, "net-rate-out", "Limit the traffic sent by the container, in bytes (or k, m, g) per second")
+	cmd.Var(&flags.networkAliases, "network-alias", "Make the container reachable from the other containers under this name as well (can be repeated)")
+	cmd.StringVar(&flags.hostname, "h", "", "Hostname of the container (default: its ID)")
+	cmd.StringVar(&flags.hostname, "hostname", "", "Hostname of the container (default: its ID)")
+	flags.domainname = cmd.String("domainname", "", "Domain name of the container, which qualifies its hostname")
+	flags.network = cmd.String("net", docker.DefaultNetwork, "Attach the container to this network, created with 'docker network create'")
+	return flags
+}
+
+// config returns the configuration of a container created with `flags`.
+func (flags *runFlags) config() (*docker.Config, error) {
+	if _, _, err := docker.ParseRestartPolicy(*flags.restart); err != nil {
+		return nil, err
+	}
+	if name, _, _ := docker.ParseRestartPolicy(*flags.restart); *flags.autoRemove && name != "" && name != "no" {
+		return nil, errors.New("-rm doesn't apply to containers which restart: they would be removed instead")
+	}
+	if *flags.cpuShares < 0 {
+		return nil, fmt.Errorf("Invalid CPU shares: %d", *flags.cpuShares)
+	}
+	for _, device := range flags.devices {
+		if _, err := device.CgroupRule(); err != nil {
+			return nil, err
+		}
+	}
+	if *flags.pidsLimit < 0 {
+		return nil, fmt.Errorf("Invalid pids limit: %d", *flags.pidsLimit)
+	}
+	if weight := *flags.blkioWeight; weight != 0 && (weight < 10 || weight > 1000) {
+		return nil, fmt.Errorf("Invalid block IO weight: %d (expected 10 to 1000)", weight)
+	}
+	for _, throttle := range flags.blkioThrottles {
+		if _, err := throttle.CgroupRule(); err != nil {
+			return nil, err
+		}
+	}
+	if *flags.oomKillDisable && flags.memory == 0 {
+		return nil, errors.New("-oom-kill-disable requires a memory limit (-m): the host could run out of memory")
+	}
+	if *flags.oomScoreAdj < -1000 || *flags.oomScoreAdj > 1000 {
+		return nil, fmt.Errorf("Invalid OOM score adjustment: %d (expected -1000 to 1000)", *flags.oomScoreAdj)
+	}
+	if parts := strings.Split(*flags.user, ":"); len(parts) > 2 || (len(parts) == 2 && (parts[0] == "" || parts[1] == "")) {
+		return nil, fmt.Errorf("Invalid user: %s (expected USER[:GROUP])", *flags.user)
+	}
+	for _, name := range []string{flags.hostname, *flags.domainname} {
+		if name != "" {
+			if err := docker.ValidateHostname(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var macAddress string
+	if *flags.macAddress != "" {
+		var err error
+		if macAddress, err = docker.ParseMacAddress(*flags.macAddress); err != nil {
+			return nil, err
+		}
+	}
+	// The containers of the default network don't record it
+	network := *flags.network
+	if network == docker.DefaultNetwork {
+		network = ""
+	}
+	// Containers created from the same flags don't share their labels
+	containerLabels := make(map[string]string)
+	for key, value := range flags.labels {
+		containerLabels[key] = value
+	}
+	if *flags.comment != "" {
+		containerLabels["comment"] = *flags.comment
+	}
+	config := &docker.Config{
+		User:           *flags.user,
+		GroupAdd:       flags.groupAdd,
+		Ram:            int64(flags.memory),
+		CpuShares:      *flags.cpuShares,
+		PidsLimit:      *flags.pidsLimit,
+		BlkioWeight:    *flags.blkioWeight,
+		BlkioThrottles: flags.blkioThrottles,
+		OomKillDisable: *flags.oomKillDisable,
+		OomScoreAdj:    *flags.oomScoreAdj,
+		Ports:          flags.publish.ports,
+		PortBindings:   flags.publish.bindings,
+		ExposedPorts:   flags.expose,
+		Tty:            *flags.tty,
+		OpenStdin:      *flags.stdin,
+		Labels:         containerLabels,
+		RestartPolicy:  *flags.restart,
+		AutoRemove:     *flags.autoRemove,
+		Privileged:     *flags.privileged,
+		CapAdd:         flags.capAdd,
+		CapDrop:        flags.capDrop,
+		Devices:        flags.devices,
+		ReadOnly:       *flags.readOnly,
+		Tmpfs:          flags.tmpfs,
+		ShmSize:        int64(flags.shmSize),
+		Env:            flags.env,
+		Volumes:        flags.volumes,
+		DependsOn:      flags.dependsOn,
+		MacAddress:     macAddress,
+		NetRateIn:      int64(flags.netRateIn),
+		NetRateOut:     int64(flags.netRateOut),
+		NetworkAliases: flags.networkAliases,
+		Network:        network,
+		Hostname:       flags.hostname,
+		Domainname:     *flags.domainname,
+	}
+	published := make(map[int]bool)
+	for _, port := range config.PublishedPorts() {
+		if published[port] {
+			return nil, fmt.Errorf("Port %d is published twice", port)
+		}
+		published[port] = true
+	}
+	if err := docker.ApplySecurityOpts(config, flags.securityOpts); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// createFromFlags creates a container from `args`, IMAGE COMMAND [ARG...],
+// with the options `flags`. Without a command, the container runs an
+// interactive shell.
+func (srv *Server) createFromFlags(args []string, flags *runFlags) (*docker.Container, error) {
+	if *flags.cidfile != "" && !path.IsAbs(*flags.cidfile) {
+		return nil, errors.New("The cidfile must be an absolute path: " + *flags.cidfile)
+	}
+	var name string
+	var cmdline []string
+	if len(args) >= 1 {
+		name = args[0]
+	}
+	if len(args) >= 2 {
+		cmdline = args[1:]
+	}
+	// Choose a default image if needed
+	if name == "" {
+		name = "base"
+	}
+	// Choose a default command if needed
+	if len(cmdline) == 0 {
+		*flags.stdin = true
+		*flags.tty = true
+		cmdline = []string{"/bin/bash", "-i"}
+	}
+	config, err := flags.config()
+	if err != nil {
+		return nil, err
+	}
+	config.Ulimits = flags.ulimits.merge(srv.options.DefaultUlimits)
+	// Find the image
+	img := srv.images.Find(name)
+	if img == nil {
+		return nil, errors.New("No such image: " + name)
+	}
+	// The container exposes the ports of its image as well
+	config.ExposedPorts = docker.MergePorts(img.ExposedPorts, config.ExposedPorts)
+	if *flags.publishAll {
+		// The exposed ports which aren't published yet
+		published := config.PublishedPorts()
+		config.Ports = append(config.Ports, docker.MergePorts(published, config.ExposedPorts)[len(published):]...)
+	}
+	// Create new container
+	container, err := srv.CreateContainer(img, config, cmdline[0], cmdline[1:]...)
+	if err != nil {
+		return nil, errors.New("Error creating container: " + err.Error())
+	}
+	if *flags.cidfile != "" {
+		if err := writeCidfile(*flags.cidfile, container.Id); err != nil {
+			srv.containers.Destroy(container)
+			return nil, err
+		}
+	}
+	return container, nil
+}
+
+// byteSize is a flag.Value for a number of bytes, optionally followed by a
+// unit: k, m or g.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	number, unit := value, int64(1)
+	if n := len(value); n > 0 {
+		switch strings.ToLower(value[n-1:]) {
+		case "k":
+			unit = 1 << 10
+		case "m":
+			unit = 1 << 20
+		case "g":
+			unit = 1 << 30
+		}
+		if unit != 1 {
+			number = value[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("Invalid size: %v", value)
+	}
+	*s = byteSize(size * unit)
+	return nil
+}
+
+// capabilities is a flag.Value collecting Linux capabilities.
+type capabilities []string
+
+func (c *capabilities) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *capabilities) Set(value string) error {
+	capability, err := docker.NormalizeCapability(value)
+	if err != nil {
+		return err
+	}
+	*c = append(*c, capability)
+	return nil
+}
+
+// devices is a flag.Value collecting host devices.
+type devices []*docker.Device
+
+func (d *devices) String() string {
+	return fmt.Sprint(*d)
+}
+
+func (d *devices) Set(value string) error {
+	device, err := docker.ParseDevice(value)
+	if err != nil {
+		return err
+	}
+	*d = append(*d, device)
+	return nil
+}
+
+// tmpfsMounts is a flag.Value collecting tmpfs mounts.
+type tmpfsMounts []*docker.TmpfsMount
+
+func (t *tmpfsMounts) String() string {
+	return fmt.Sprint(*t)
+}
+
+func (t *tmpfsMounts) Set(value string) error {
+	mount, err := docker.ParseTmpfs(value)
+	if err != nil {
+		return err
+	}
+	*t = append(*t, mount)
+	return nil
+}
+
+// Ulimits is a flag.Value collecting resource limits by name.
+type Ulimits map[string]*docker.Ulimit
+
+func (u Ulimits) String() string {
+	return fmt.Sprint(u.merge(nil))
+}
+
+func (u Ulimits) Set(value string) error {
+	ulimit, err := docker.ParseUlimit(value)
+	if err != nil {
+		return err
+	}
+	u[ulimit.Name] = ulimit
+	return nil
+}
+
+// merge returns the limits of `u`, and those of `defaults` which `u`
+// doesn't override, sorted by name.
+func (u Ulimits) merge(defaults Ulimits) []*docker.Ulimit {
+	var names []string
+	for name := range u {
+		names = append(names, name)
+	}
+	for name := range defaults {
+		if _, exists := u[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var ulimits []*docker.Ulimit
+	for _, name := range names {
+		if ulimit, exists := u[name]; exists {
+			ulimits = append(ulimits, ulimit)
+		} else {
+			ulimits = append(ulimits, defaults[name])
+		}
+	}
+	return ulimits
+}
+
+// throttles is a flag.Value collecting block IO throttles of one kind, given
+// as DEVICE:RATE.
+type throttles struct {
+	kind string
+	list *[]*docker.BlkioThrottle
+}
+
+func (t *throttles) String() string {
+	return ""
+}
+
+func (t *throttles) Set(value string) error {
+	idx := strings.LastIndex(value, ":")
+	if idx < 1 {
+		return fmt.Errorf("Invalid throttle: %v (expected DEVICE:RATE)", value)
+	}
+	var rate byteSize
+	if strings.HasSuffix(t.kind, "_iops") {
+		n, err := strconv.ParseInt(value[idx+1:], 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Invalid throttle: %v (invalid rate)", value)
+		}
+		rate = byteSize(n)
+	} else if err := rate.Set(value[idx+1:]); err != nil || rate == 0 {
+		return fmt.Errorf("Invalid throttle: %v (invalid rate)", value)
+	}
+	*t.list = append(*t.list, &docker.BlkioThrottle{Kind: t.kind, Path: value[:idx], Rate: int64(rate)})
+	return nil
+}
+
+// groups is a flag.Value collecting group names or IDs.
+type groups []string
+
+func (g *groups) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *groups) Set(value string) error {
+	if value == "" || strings.ContainsAny(value, ":, ") {
+		return fmt.Errorf("Invalid group: %v", value)
+	}
+	*g = append(*g, value)
+	return nil
+}
+
+// securityOpts is a flag.Value collecting security options.
+type securityOpts []string
+
+func (s *securityOpts) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *securityOpts) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// env is a flag.Value collecting variables of the environment.
+type env []string
+
+func (e *env) String() string {
+	return strings.Join(*e, " ")
+}
+
+func (e *env) Set(value string) error {
+	if err := docker.ValidateEnv(value); err != nil {
+		return err
+	}
+	*e = append(*e, value)
+	return nil
+}
+
+// volumes is a flag.Value collecting bind-mounted volumes.
+type volumes []*docker.Volume
+
+func (v *volumes) String() string {
+	return fmt.Sprint(*v)
+}
+
+func (v *volumes) Set(value string) error {
+	volume, err := docker.ParseVolume(value)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, volume)
+	return nil
+}
+
+// containerIds is a flag.Value collecting container IDs.
+type containerIds []string
+
+func (c *containerIds) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *containerIds) Set(value string) error {
+	if value == "" {
+		return errors.New("Invalid container ID: empty")
+	}
+	*c = append(*c, value)
+	return nil
+}
+
+// hostnames is a flag.Value collecting host names.
+type hostnames []string
+
+func (h *hostnames) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *hostnames) Set(value string) error {
+	if err := docker.ValidateHostname(value); err != nil {
+		return err
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// publish is a flag.Value collecting the ports published with -p: PORT on a
+// random port of the host, or a port binding.
+type publish struct {
+	ports    ports
+	bindings []*docker.PortBinding
+}
+
+func (p *publish) String() string {
+	specs := []string{p.ports.String()}
+	for _, binding := range p.bindings {
+		specs = append(specs, fmt.Sprintf("%s:%d:%d", binding.HostIp, binding.HostPort, binding.ContainerPort))
+	}
+	return strings.Join(specs, " ")
+}
+
+func (p *publish) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return p.ports.Set(value)
+	}
+	binding, err := docker.ParsePortBinding(value)
+	if err != nil {
+		return err
+	}
+	if binding.HostIp != "" && !isHostAddress(binding.HostIp) {
+		return fmt.Errorf("Invalid port binding: %s (%s isn't an address of the host)", value, binding.HostIp)
+	}
+	p.bindings = append(p.bindings, binding)
+	return nil
+}
+
+// isHostAddress returns true if `ip` is the address of an interface of the host.
+func isHostAddress(ip string) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.String() == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -3,72 +3,201 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/dotcloud/docker"
 	"github.com/dotcloud/docker/future"
 	"github.com/dotcloud/docker/image"
 	"github.com/dotcloud/docker/rcli"
+	"github.com/dotcloud/docker/registry"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"text/tabwriter"
+	"text/template"
 	"time"
 )
 
-const VERSION = "0.0.1"
+// The storage root of the daemon, which the tests change
+var rootPath = "/var/lib/docker"
+
+const (
+	// The addresses the daemon listens on
+	rcliAddr = "127.0.0.1:4242"
+	httpAddr = "127.0.0.1:8080"
+)
 
 func (srv *Server) ListenAndServe() error {
-	go rcli.ListenAndServeHTTP("127.0.0.1:8080", srv)
+	go http.ListenAndServe(httpAddr, srv.httpHandler())
+	if srv.remoteAddr != "" {
+		go func() {
+			if err := rcli.ListenAndServeTLS(srv.remoteAddr, srv.tlsServer, srv); err != nil {
+				log.Printf("Failed to listen on %s: %v", srv.remoteAddr, err)
+			}
+		}()
+	}
 	// FIXME: we want to use unix sockets here, but net.UnixConn doesn't expose
 	// CloseWrite(), which we need to cleanly signal that stdin is closed without
 	// closing the connection.
 	// See http://code.google.com/p/go/issues/detail?id=3345
-	return rcli.ListenAndServe("tcp", "127.0.0.1:4242", srv)
+	return rcli.ListenAndServe("tcp", rcliAddr, srv)
 }
 
 func (srv *Server) Name() string {
 	return "docker"
 }
 
+// The commands listed first by 'docker help', in order, with their summary.
+// The others follow, see listCommands.
+var commands = [][2]string{
+	{"run", "Run a command in a container"},
+	{"create", "Create a container without starting it"},
+	{"scale", "Run N replicas of an image"},
+	{"up", "Bring up the containers of an application"},
+	{"down", "Stop and remove the containers of an application"},
+	{"ps", "Display a list of containers"},
+	{"pull", "Download a tarball and create a container from it"},
+	{"push", "Upload an image to a registry"},
+	{"search", "Search for images on the mirror"},
+	{"sign", "Sign an image, or verify its signature"},
+	{"put", "Upload a tarball and create a container from it"},
+	{"import", "Create a new image from a host directory or a git repository"},
+	{"save", "Stream an image as a tar archive in the OCI image layout"},
+	{"load", "Import an image from a tar archive in the OCI image layout"},
+	{"port", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT"},
+	{"rm", "Remove containers"},
+	{"kill", "Kill a running container"},
+	{"wait", "Block until containers exit, then print their exit codes"},
+	{"stats", "Display the network usage of running containers"},
+	{"metrics", "Output the metrics of the running containers for Prometheus"},
+	{"stop", "Stop a running container"},
+	{"start", "Start a stopped container"},
+	{"restart", "Restart a running container"},
+	{"logs", "Fetch the logs of a container"},
+	{"diff", "Inspect changes on a container's filesystem"},
+	{"commit", "Save the state of a container"},
+	{"build", "Build an image from a recipe"},
+	{"clone", "Create a new container from another container"},
+	{"rename", "Change the ID or the comment of a container"},
+	{"label", "Show or change the labels of a container or an image"},
+	{"update", "Change the limits, restart policy and labels of containers"},
+	{"events", "Stream the events of the containers"},
+	{"checkpoint", "Save the state of a running container"},
+	{"restore", "Resume a container from a checkpoint"},
+	{"migrate", "Move a running container to another docker daemon"},
+	{"cluster", "Manage a cluster of docker daemons"},
+	{"network", "Manage the networks of the containers"},
+	{"backup", "Stream a backup of the images, containers and volumes"},
+	{"attach", "Attach to the standard inputs and outputs of a running container"},
+	{"info", "Display system-wide information"},
+	{"version", "Show the docker version information"},
+	{"completion", "Output a shell completion script"},
+	{"tar", "Stream the contents of a container as a tar archive"},
+	{"web", "Generate a web UI"},
+	{"images", "List images"},
+	{"history", "Show the history of an image"},
+	{"fsck", "Check the consistency of the image store"},
+	{"image", "Manage images (prune, layers)"},
+	{"inspect", "Return low-level information on containers or images"},
+	{"rmi", "Remove an image"},
+	{"cp", "Create a copy of an image under another name"},
+	{"cat", "Write the contents of a container's file to standard output"},
+	{"write", "Write the contents of standard input to a container's file"},
+	{"ls", "List the contents of a container's directory"},
+	{"reset", "Reset changes to a container's filesystem"},
+	{"layers", "List filesystem layers (debug only)"},
+	{"mount", "Mount a container's filesystem (debug only)"},
+	{"umount", "Umount a container's filesystem (debug only)"},
+	{"mirror", "Copy the standard input to the standard output (debug only)"},
+	{"debug", "Log the standard input on the daemon (debug only)"},
+}
+
+// The commands left out of 'docker help', for the shell completion
+var hiddenCommands = map[string]bool{"names": true}
+
+// listCommands returns the commands of the server, with their summary:
+// those of `commands` first, in order, then the others, summarized by their
+// description, so that none is left out.
+func (srv *Server) listCommands() [][2]string {
+	names := rcli.CommandNames(srv)
+	exists := make(map[string]bool)
+	for _, name := range names {
+		exists[name] = !hiddenCommands[name]
+	}
+	var list [][2]string
+	for _, cmd := range commands {
+		if exists[cmd[0]] {
+			list = append(list, cmd)
+			delete(exists, cmd[0])
+		}
+	}
+	for _, name := range names {
+		if !exists[name] {
+			continue
+		}
+		var summary string
+		if command, err := rcli.Describe(srv, name); err == nil {
+			summary = strings.SplitN(command.Description, "\n", 2)[0]
+			if i := strings.Index(summary, ". "); i >= 0 {
+				summary = summary[:i]
+			}
+			summary = strings.TrimSuffix(summary, ".")
+			if summary != "" {
+				summary = strings.ToUpper(summary[:1]) + summary[1:]
+			}
+		}
+		list = append(list, [2]string{name, summary})
+	}
+	return list
+}
+
 func (srv *Server) Help() string {
 	help := "Usage: docker COMMAND [arg...]\n\nA self-sufficient runtime for linux containers.\n\nCommands:\n"
-	for _, cmd := range [][]interface{}{
-		{"run", "Run a command in a container"},
-		{"ps", "Display a list of containers"},
-		{"pull", "Download a tarball and create a container from it"},
-		{"put", "Upload a tarball and create a container from it"},
-		{"port", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT"},
-		{"rm", "Remove containers"},
-		{"kill", "Kill a running container"},
-		{"wait", "Wait for the state of a container to change"},
-		{"stop", "Stop a running container"},
-		{"start", "Start a stopped container"},
-		{"restart", "Restart a running container"},
-		{"logs", "Fetch the logs of a container"},
-		{"diff", "Inspect changes on a container's filesystem"},
-		{"commit", "Save the state of a container"},
-		{"attach", "Attach to the standard inputs and outputs of a running container"},
-		{"wait", "Block until a container exits, then print its exit code"},
-		{"info", "Display system-wide information"},
-		{"tar", "Stream the contents of a container as a tar archive"},
-		{"web", "Generate a web UI"},
-		{"images", "List images"},
-	} {
-		help += fmt.Sprintf("    %-10.10s%s\n", cmd...)
+	for _, cmd := range srv.listCommands() {
+		help += fmt.Sprintf("    %-12s%s\n", cmd[0], cmd[1])
+	}
+	if plugins := srv.plugins(); len(plugins) > 0 {
+		help += "\nPlugins:\n"
+		for _, name := range plugins {
+			help += fmt.Sprintf("    %s\n", name)
+		}
 	}
 	return help
 }
 
-// 'docker wait': block until a container stops
+// Commands describes the commands listed by 'docker help', plugins included,
+// for 'docker help -json' and GET /commands.
+func (srv *Server) Commands() []*rcli.Command {
+	var catalog []*rcli.Command
+	for _, cmd := range srv.listCommands() {
+		command, err := rcli.Describe(srv, cmd[0])
+		if err != nil {
+			continue
+		}
+		command.Summary = cmd[1]
+		catalog = append(catalog, command)
+	}
+	for _, name := range srv.plugins() {
+		catalog = append(catalog, &rcli.Command{Name: name, Summary: "Run by the plugin " + pluginPrefix + name})
+	}
+	return catalog
+}
+
+// 'docker wait': block until containers stop
 func (srv *Server) CmdWait(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "wait", "[OPTIONS] NAME", "Block until a container stops, then print its exit code.")
+	cmd := rcli.Subcmd(stdout, "wait", "[OPTIONS] NAME...", "Block until the containers stop, then print their names and exit codes as they stop. Exits with the exit code of the last one.")
+	fl_any := cmd.Bool("any", false, "Return as soon as one of the containers stops, with its exit code")
 	if err := cmd.Parse(args); err != nil {
 		cmd.Usage()
 		return nil
@@ -77,27 +206,167 @@ func (srv *Server) CmdWait(stdin io.ReadCloser, stdout io.Writer, args ...string
 		cmd.Usage()
 		return nil
 	}
+	var containers []*docker.Container
 	for _, name := range cmd.Args() {
-		if container := srv.containers.Get(name); container != nil {
-			fmt.Fprintln(stdout, container.Wait())
-		} else {
+		container := srv.containers.Get(name)
+		if container == nil {
 			return errors.New("No such container: " + name)
 		}
+		containers = append(containers, container)
+	}
+	type exit struct {
+		name   string
+		status int
+	}
+	exited := make(chan exit, len(containers))
+	for i, container := range containers {
+		go func(name string, container *docker.Container) {
+			exited <- exit{name, container.Wait()}
+		}(cmd.Arg(i), container)
+	}
+	status := 0
+	for range containers {
+		select {
+		case e := <-exited:
+			status = e.status
+			fmt.Fprintf(stdout, "%s %d\n", e.name, e.status)
+		case <-rcli.Done(stdout):
+			return errors.New("Client disconnected")
+		}
+		if *fl_any {
+			break
+		}
+	}
+	if status != 0 {
+		return rcli.ExitStatus(status)
 	}
 	return nil
 }
 
+// 'docker events': stream the events of the containers as they happen
+func (srv *Server) CmdEvents(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "events", "[OPTIONS] [CONTAINER...]", "Stream the events of the containers (create, start, die, oom, destroy)")
+	fl_json := cmd.Bool("json", false, "Output one JSON object per event")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, name := range cmd.Args() {
+		// Events carry the full IDs
+		if container := srv.containers.Get(name); container != nil {
+			name = container.Id
+		}
+		names[name] = true
+	}
+	events := srv.containers.Events.Subscribe()
+	defer srv.containers.Events.Unsubscribe(events)
+	for {
+		select {
+		case event := <-events:
+			if len(names) > 0 && !names[event.Container] {
+				continue
+			}
+			var err error
+			if *fl_json {
+				var data []byte
+				if data, err = json.Marshal(&jsonEvent{event.Time, event.Container, event.Action}); err == nil {
+					_, err = fmt.Fprintf(stdout, "%s\n", data)
+				}
+			} else {
+				_, err = fmt.Fprintf(stdout, "%s %s %s\n", event.Time.Format(time.RFC3339), event.Container, event.Action)
+			}
+			if err != nil {
+				return err
+			}
+		case <-rcli.Done(stdout):
+			return nil
+		}
+	}
+}
+
 // 'docker info': display system-wide information.
 func (srv *Server) CmdInfo(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	fmt.Fprintf(stdout, "containers: %d\nversion: %s\nimages: %d\n",
-		len(srv.containers.List()),
-		VERSION,
-		len(srv.images.ById))
+	cmd := rcli.Subcmd(stdout, "info", "[OPTIONS]", "Display system-wide information")
+	fl_json := cmd.Bool("json", false, "Output JSON")
+	fl_size := cmd.Bool("size", false, "Display the disk usage of the root, which takes a walk through all of it")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	info := &jsonInfo{
+		Version:       docker.VERSION,
+		Images:        srv.images.Count(),
+		Layers:        len(srv.images.Layers.List()),
+		StorageDriver: "aufs",
+		Root:          rootPath,
+		Debug:         srv.options.Debug,
+		Listeners:     []string{"tcp://" + rcliAddr, "http://" + httpAddr},
+	}
+	if srv.remoteAddr != "" {
+		info.Listeners = append(info.Listeners, "tcp+tls://"+srv.remoteAddr)
+	}
+	for _, container := range srv.containers.List() {
+		info.Containers++
+		if container.State.Running {
+			info.Running++
+		} else {
+			info.Stopped++
+		}
+	}
+	var err error
+	if info.KernelVersion, err = future.KernelVersion(); err != nil {
+		info.KernelVersion = "unknown"
+	}
+	if *fl_size {
+		if info.DiskUsage, err = future.DiskUsage(rootPath); err != nil {
+			info.DiskUsage, info.DiskError = 0, err.Error()
+		}
+	}
+	if info.MemTotal, info.MemAvailable, err = future.MemInfo(); err != nil {
+		return err
+	}
+	if *fl_json {
+		return writeJSON(stdout, info)
+	}
+	fmt.Fprintf(stdout, "containers: %d (%d running, %d stopped)\nversion: %s\nimages: %d\nlayers: %d\n",
+		info.Containers, info.Running, info.Stopped,
+		info.Version,
+		info.Images,
+		info.Layers)
+	fmt.Fprintf(stdout, "kernel version: %s\nstorage driver: %s\nroot: %s\n",
+		info.KernelVersion,
+		info.StorageDriver,
+		info.Root)
+	if info.DiskError != "" {
+		fmt.Fprintf(stdout, "disk usage: unknown (%s)\n", info.DiskError)
+	} else if *fl_size {
+		fmt.Fprintf(stdout, "disk usage: %s\n", future.HumanSize(info.DiskUsage))
+	}
+	fmt.Fprintf(stdout, "memory: %s available of %s\ndebug: %v\nlisteners: %s\n",
+		future.HumanSize(info.MemAvailable),
+		future.HumanSize(info.MemTotal),
+		info.Debug,
+		strings.Join(info.Listeners, ", "))
+	return nil
+}
+
+// 'docker version': display the version of the daemon. The client adds its own.
+func (srv *Server) CmdVersion(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "version", "[OPTIONS]", "Show the docker version information")
+	fl_json := cmd.Bool("json", false, "Output JSON")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	version := newJSONVersion()
+	if *fl_json {
+		return writeJSON(stdout, version)
+	}
+	fmt.Fprintf(stdout, "Server version: %s\nServer API version: %d\nGo version (server): %s\nGit commit (server): %s\n",
+		version.Version, version.ApiVersion, version.GoVersion, version.GitCommit)
 	return nil
 }
 
 func (srv *Server) CmdStop(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "stop", "[OPTIONS] NAME", "Stop a running container")
+	cmd := rcli.Subcmd(stdout, "stop", "[OPTIONS] NAME [NAME...]", "Stop running containers")
 	if err := cmd.Parse(args); err != nil {
 		cmd.Usage()
 		return nil
@@ -106,44 +375,228 @@ func (srv *Server) CmdStop(stdin io.ReadCloser, stdout io.Writer, args ...string
 		cmd.Usage()
 		return nil
 	}
-	for _, name := range cmd.Args() {
-		if container := srv.containers.Get(name); container != nil {
-			if err := container.Stop(); err != nil {
-				return err
+	return srv.forEachContainer(stdout, cmd.Args(), func(container *docker.Container) error {
+		return container.Stop()
+	})
+}
+
+// 'docker checkpoint': save the processes and the filesystem changes of a
+// running container, to resume them later with 'docker restore'
+func (srv *Server) CmdCheckpoint(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "checkpoint", "[OPTIONS] CONTAINER", "Save the state of a running container, and stop it")
+	fl_dir := cmd.String("dir", "", "Save the checkpoint in this directory on the docker host (default: in the container)")
+	fl_leave := cmd.Bool("leave-running", false, "Leave the container running after the checkpoint")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	container := srv.containers.Get(cmd.Arg(0))
+	if container == nil {
+		return errors.New("No such container: " + cmd.Arg(0))
+	}
+	dir := *fl_dir
+	if dir == "" {
+		dir = path.Join(container.Root, "checkpoint")
+	} else if !path.IsAbs(dir) {
+		return errors.New("The checkpoint directory must be an absolute path: " + dir)
+	}
+	if err := container.Checkpoint(dir, *fl_leave); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, dir)
+	return nil
+}
+
+// 'docker restore': resume a container from a checkpoint
+func (srv *Server) CmdRestore(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "restore", "[OPTIONS] CONTAINER | -dir DIR | -archive",
+		"Resume a container from its checkpoint, or from the checkpoint in DIR or on stdin, possibly taken on another host")
+	fl_dir := cmd.String("dir", "", "Restore the checkpoint in this directory on the docker host (default: in the container)")
+	fl_archive := cmd.Bool("archive", false, "Read the checkpoint as a tar archive on stdin")
+	fl_image := cmd.String("image", "", "Create the container of a checkpoint taken on another host from this image")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 1 || (cmd.NArg() == 0 && *fl_dir == "" && !*fl_archive) || (*fl_dir != "" && *fl_archive) {
+		cmd.Usage()
+		return nil
+	}
+	if *fl_dir != "" && !path.IsAbs(*fl_dir) {
+		return errors.New("The checkpoint directory must be an absolute path: " + *fl_dir)
+	}
+	var img *image.Image
+	if *fl_image != "" {
+		if img = srv.images.Find(*fl_image); img == nil {
+			return errors.New("No such image: " + *fl_image)
+		}
+	}
+	if *fl_archive {
+		tmp, err := ioutil.TempDir("", "docker-checkpoint")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		if err := image.Untar(stdin, tmp); err != nil {
+			return err
+		}
+		*fl_dir = tmp
+	}
+	var container *docker.Container
+	if cmd.NArg() == 1 {
+		if container = srv.containers.Get(cmd.Arg(0)); container == nil {
+			return errors.New("No such container: " + cmd.Arg(0))
+		}
+	}
+	dir := *fl_dir
+	if container == nil {
+		// A checkpoint taken on another host
+		var err error
+		resolve := func(name string) *image.Image {
+			if img != nil {
+				return img
 			}
-			fmt.Fprintln(stdout, container.Id)
-		} else {
-			return errors.New("No such container: " + name)
+			return srv.images.Find(name)
 		}
+		if container, err = srv.containers.LoadCheckpoint(dir, resolve); err != nil {
+			return err
+		}
+	} else if dir == "" {
+		dir = path.Join(container.Root, "checkpoint")
+	}
+	if err := container.Restore(dir); err != nil {
+		return err
 	}
+	fmt.Fprintln(stdout, container.Id)
 	return nil
 }
 
-func (srv *Server) CmdRestart(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "restart", "[OPTIONS] NAME", "Restart a running container")
+// 'docker migrate': move a running container to another daemon. Its image and
+// its checkpoint are sent to the other daemon, which resumes it. The local
+// container is left stopped, with the label migrated-to=DAEMON.
+func (srv *Server) CmdMigrate(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "migrate", "CONTAINER tcp://HOST[:PORT]", "Move a running container to another docker daemon")
 	if err := cmd.Parse(args); err != nil {
-		cmd.Usage()
 		return nil
 	}
-	if cmd.NArg() < 1 {
+	if cmd.NArg() != 2 {
 		cmd.Usage()
 		return nil
 	}
-	for _, name := range cmd.Args() {
-		if container := srv.containers.Get(name); container != nil {
-			if err := container.Restart(); err != nil {
-				return err
-			}
-			fmt.Fprintln(stdout, container.Id)
-		} else {
-			return errors.New("No such container: " + name)
+	container := srv.containers.Get(cmd.Arg(0))
+	if container == nil {
+		return errors.New("No such container: " + cmd.Arg(0))
+	}
+	addr, err := parseDaemonAddr(cmd.Arg(1))
+	if err != nil {
+		return err
+	}
+	img := srv.images.Find(container.Config.Image)
+	if img == nil {
+		return fmt.Errorf("The image of container %v was deleted", container.Id)
+	}
+	progress := rcli.Progress(stdout)
+	dir, err := ioutil.TempDir("", "docker-migrate")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	fmt.Fprintf(progress, "Checkpointing %s\n", container.Id)
+	if err := container.Checkpoint(dir, false); err != nil {
+		return err
+	}
+	remoteId, err := srv.sendCheckpoint(img, dir, addr, progress)
+	if err != nil {
+		// Resume the container here rather than leave it stopped
+		if restoreErr := container.Restore(dir); restoreErr != nil {
+			return fmt.Errorf("%v (and resuming the container failed: %v)", err, restoreErr)
 		}
+		return err
+	}
+	if err := container.SetLabel("migrated-to", cmd.Arg(1)); err != nil {
+		return err
 	}
+	fmt.Fprintln(stdout, remoteId)
 	return nil
 }
 
-func (srv *Server) CmdStart(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "start", "[OPTIONS] NAME", "Start a stopped container")
+// sendCheckpoint sends `img` and the checkpoint in `dir` to the daemon at
+// `addr`, which resumes the container. It returns the ID of the container on
+// the other daemon.
+func (srv *Server) sendCheckpoint(img *image.Image, dir, addr string, progress io.Writer) (string, error) {
+	remoteImg, err := srv.pushToDaemon(img, addr, progress)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(progress, "Sending the checkpoint to %s\n", addr)
+	archive, err := image.Tar(dir, image.Uncompressed)
+	if err != nil {
+		return "", err
+	}
+	return callDaemon(srv.tlsClient, addr, archive, progress, "restore", "-archive", "-image", remoteImg)
+}
+
+// pushToDaemon sends `img` to the daemon at `addr`, without the layers which
+// it already has, and returns the ID of the image on that daemon.
+func (srv *Server) pushToDaemon(img *image.Image, addr string, progress io.Writer) (string, error) {
+	name, _ := img.IdParts()
+	tmp, err := srv.images.Layers.Mktemp()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := srv.images.ExportOCI(img, tmp); err != nil {
+		return "", err
+	}
+	layers, err := image.ReadOCILayers(tmp)
+	if err != nil {
+		return "", err
+	}
+	// The other daemon may have the layers under the IDs they have here,
+	// eg. if it pulled the image too, or under the IDs of their export if
+	// it was sent the image before
+	query := []string{"image", "layers"}
+	for _, layer := range layers {
+		query = append(query, image.OCILayerIds(layer)...)
+	}
+	output, err := callDaemon(srv.tlsClient, addr, nil, progress, query...)
+	if err != nil {
+		return "", err
+	}
+	existing := make(map[string]bool)
+	for _, id := range strings.Fields(output) {
+		existing[id] = true
+	}
+	missing := 0
+	for _, layer := range layers {
+		found := false
+		for _, id := range image.OCILayerIds(layer) {
+			found = found || existing[id]
+		}
+		if !found {
+			missing++
+			continue
+		}
+		blob, err := image.OCIBlobPath(tmp, layer.Digest)
+		if err != nil {
+			return "", err
+		}
+		if err := os.Remove(blob); err != nil {
+			return "", err
+		}
+	}
+	fmt.Fprintf(progress, "Pushing %s to %s (%d of %d layers missing)\n", img.Id, addr, missing, len(layers))
+	archive, err := image.Tar(tmp, image.Uncompressed)
+	if err != nil {
+		return "", err
+	}
+	return callDaemon(srv.tlsClient, addr, rcli.ProgressReader(archive, progress, img.Id, "Pushing", 0), progress, "load", name)
+}
+
+func (srv *Server) CmdRestart(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "restart", "[OPTIONS] NAME [NAME...]", "Restart running containers")
 	if err := cmd.Parse(args); err != nil {
 		cmd.Usage()
 		return nil
@@ -152,17 +605,24 @@ func (srv *Server) CmdStart(stdin io.ReadCloser, stdout io.Writer, args ...strin
 		cmd.Usage()
 		return nil
 	}
-	for _, name := range cmd.Args() {
-		if container := srv.containers.Get(name); container != nil {
-			if err := container.Start(); err != nil {
-				return err
-			}
-			fmt.Fprintln(stdout, container.Id)
-		} else {
-			return errors.New("No such container: " + name)
-		}
+	return srv.forEachContainer(stdout, cmd.Args(), func(container *docker.Container) error {
+		return container.Restart()
+	})
+}
+
+func (srv *Server) CmdStart(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "start", "[OPTIONS] NAME [NAME...]", "Start created or stopped containers")
+	if err := cmd.Parse(args); err != nil {
+		cmd.Usage()
+		return nil
 	}
-	return nil
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	return srv.forEachContainer(stdout, cmd.Args(), func(container *docker.Container) error {
+		return container.Start()
+	})
 }
 
 func (srv *Server) CmdUmount(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
@@ -189,7 +649,7 @@ func (srv *Server) CmdUmount(stdin io.ReadCloser, stdout io.Writer, args ...stri
 }
 
 func (srv *Server) CmdMount(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "umount", "[OPTIONS] NAME", "mount a container's filesystem (debug only)")
+	cmd := rcli.Subcmd(stdout, "mount", "[OPTIONS] NAME", "mount a container's filesystem (debug only)")
 	if err := cmd.Parse(args); err != nil {
 		cmd.Usage()
 		return nil
@@ -280,7 +740,9 @@ func (srv *Server) CmdLs(stdin io.ReadCloser, stdout io.Writer, args ...string)
 }
 
 func (srv *Server) CmdInspect(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "inspect", "[OPTIONS] CONTAINER", "Return low-level information on a container")
+	cmd := rcli.Subcmd(stdout, "inspect", "[OPTIONS] CONTAINER|IMAGE [CONTAINER|IMAGE...]",
+		"Return low-level information on containers or images. Several targets are returned as a JSON array.")
+	fl_format := cmd.String("format", "", "Render each target through a Go template, eg. '{{.NetworkSettings.IpAddress}}'")
 	if err := cmd.Parse(args); err != nil {
 		cmd.Usage()
 		return nil
@@ -289,31 +751,70 @@ func (srv *Server) CmdInspect(stdin io.ReadCloser, stdout io.Writer, args ...str
 		cmd.Usage()
 		return nil
 	}
-	name := cmd.Arg(0)
-	var obj interface{}
-	if container := srv.containers.Get(name); container != nil {
-		obj = container
-	} else if image := srv.images.Find(name); image != nil {
-		obj = image
-	} else {
-		return errors.New("No such container or image: " + name)
+	var format *template.Template
+	if *fl_format != "" {
+		var err error
+		if format, err = parseFormat(*fl_format); err != nil {
+			return err
+		}
 	}
-	data, err := json.Marshal(obj)
-	if err != nil {
-		return err
+	// Inspect every target, and report the missing ones at the end
+	var objs []interface{}
+	var missing []string
+	for _, name := range cmd.Args() {
+		var obj interface{}
+		if container := srv.containers.Get(name); container != nil {
+			inspected := &jsonInspect{Container: container, Uptime: formatUptime(container.State.Uptime())}
+			if container.State.Running {
+				inspected.NetworkStats, _ = container.NetworkStats()
+			}
+			obj = inspected
+		} else if img := srv.images.Find(name); img != nil {
+			inspected := &jsonInspectImage{Image: img, SharedWith: []string{}}
+			for _, alias := range srv.images.Aliases(img) {
+				inspected.SharedWith = append(inspected.SharedWith, alias.Id)
+			}
+			obj = inspected
+		} else {
+			missing = append(missing, name)
+			continue
+		}
+		if format != nil {
+			if err := writeFormat(stdout, format, obj); err != nil {
+				return err
+			}
+		}
+		objs = append(objs, obj)
 	}
-	indented := new(bytes.Buffer)
-	if err = json.Indent(indented, data, "", "    "); err != nil {
-		return err
+	if format == nil && len(objs) > 0 {
+		// A single target is returned as an object, like it always was
+		var data []byte
+		var err error
+		if cmd.NArg() == 1 {
+			data, err = json.Marshal(objs[0])
+		} else {
+			data, err = json.Marshal(objs)
+		}
+		if err != nil {
+			return err
+		}
+		indented := new(bytes.Buffer)
+		if err = json.Indent(indented, data, "", "    "); err != nil {
+			return err
+		}
+		if _, err := io.Copy(stdout, indented); err != nil {
+			return err
+		}
 	}
-	if _, err := io.Copy(stdout, indented); err != nil {
-		return err
+	if len(missing) > 0 {
+		return errors.New("No such container or image: " + strings.Join(missing, ", "))
 	}
 	return nil
 }
 
 func (srv *Server) CmdPort(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	cmd := rcli.Subcmd(stdout, "port", "[OPTIONS] CONTAINER PRIVATE_PORT", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT")
+	fl_json := cmd.Bool("json", false, "Output JSON")
 	if err := cmd.Parse(args); err != nil {
 		cmd.Usage()
 		return nil
@@ -327,8 +828,14 @@ func (srv *Server) CmdPort(stdin io.ReadCloser, stdout io.Writer, args ...string
 	if container := srv.containers.Get(name); container == nil {
 		return errors.New("No such container: " + name)
 	} else {
-		if frontend, exists := container.NetworkSettings.PortMapping[privatePort]; !exists {
+		if frontend, exists := container.NetworkSettings.PublicPort(privatePort); !exists {
 			return fmt.Errorf("No private port '%s' allocated on %s", privatePort, name)
+		} else if *fl_json {
+			return writeJSON(stdout, &jsonPort{
+				PrivatePort: privatePort,
+				PublicPort:  container.NetworkSettings.PortMapping[privatePort],
+				HostIp:      container.NetworkSettings.PortAddresses[privatePort],
+			})
 		} else {
 			fmt.Fprintln(stdout, frontend)
 		}
@@ -336,10 +843,12 @@ func (srv *Server) CmdPort(stdin io.ReadCloser, stdout io.Writer, args ...string
 	return nil
 }
 
-// 'docker rmi NAME' removes all images with the name NAME
+// 'docker rmi NAME' untags all versions of the image NAME.
+// 'docker rmi ID' removes a single version of an image.
 func (srv *Server) CmdRmi(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "rmimage", "[OPTIONS] IMAGE", "Remove an image")
+	cmd := rcli.Subcmd(stdout, "rmi", "[OPTIONS] IMAGE [IMAGE...]", "Remove an image")
 	fl_regexp := cmd.Bool("r", false, "Use IMAGE as a regular expression instead of an exact name")
+	fl_force := cmd.Bool("f", false, "Remove the image even if containers are using it")
 	if err := cmd.Parse(args); err != nil {
 		cmd.Usage()
 		return nil
@@ -349,38 +858,55 @@ func (srv *Server) CmdRmi(stdin io.ReadCloser, stdout io.Writer, args ...string)
 		return nil
 	}
 	for _, name := range cmd.Args() {
-		var err error
 		if *fl_regexp {
-			err = srv.images.DeleteMatch(name)
+			if err := srv.images.DeleteMatch(name, *fl_force); err != nil {
+				return rmiError(err)
+			}
+			continue
+		}
+		img := srv.images.Find(name)
+		if img == nil {
+			return errors.New("No such image: " + name)
+		}
+		// Removing by ID only affects that version; removing by name
+		// affects all versions of the name.
+		var targets []*image.Image
+		if img.Id == name {
+			targets = []*image.Image{img}
+			if err := srv.images.DeleteId(img.Id, *fl_force); err != nil {
+				return rmiError(err)
+			}
 		} else {
-			image := srv.images.Find(name)
-			if image == nil {
-				return errors.New("No such image: " + name)
+			targets = srv.images.History(name)
+			if err := srv.images.Delete(name, *fl_force); err != nil {
+				return rmiError(err)
 			}
-			err = srv.images.Delete(name)
+			fmt.Fprintf(stdout, "Untagged: %s\n", name)
 		}
-		if err != nil {
-			return err
+		// The layers of an image stay around as long as another name
+		// references them, so only report images which are really gone.
+		for _, target := range targets {
+			if len(srv.images.Aliases(target)) == 0 {
+				fmt.Fprintf(stdout, "Deleted: %s\n", target.Id)
+			}
 		}
 	}
 	return nil
 }
 
+func rmiError(err error) error {
+	if _, inUse := err.(*image.ImageInUseError); inUse {
+		return errors.New("Conflict: " + err.Error() + ". Use -f to remove anyway.")
+	}
+	return err
+}
+
 func (srv *Server) CmdRm(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "rm", "[OPTIONS] CONTAINER", "Remove a container")
+	cmd := rcli.Subcmd(stdout, "rm", "[OPTIONS] CONTAINER [CONTAINER...]", "Remove containers")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	for _, name := range cmd.Args() {
-		container := srv.containers.Get(name)
-		if container == nil {
-			return errors.New("No such container: " + name)
-		}
-		if err := srv.containers.Destroy(container); err != nil {
-			fmt.Fprintln(stdout, "Error destroying container "+name+": "+err.Error())
-		}
-	}
-	return nil
+	return srv.forEachContainer(stdout, cmd.Args(), srv.containers.Destroy)
 }
 
 // 'docker kill NAME' kills a running container
@@ -389,20 +915,16 @@ func (srv *Server) CmdKill(stdin io.ReadCloser, stdout io.Writer, args ...string
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	for _, name := range cmd.Args() {
-		container := srv.containers.Get(name)
-		if container == nil {
-			return errors.New("No such container: " + name)
-		}
-		if err := container.Kill(); err != nil {
-			fmt.Fprintln(stdout, "Error killing container "+name+": "+err.Error())
-		}
-	}
-	return nil
+	return srv.forEachContainer(stdout, cmd.Args(), func(container *docker.Container) error {
+		return container.Kill()
+	})
 }
 
 func (srv *Server) CmdPull(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "pull", "[OPTIONS] NAME", "Download a new image from a remote location")
+	cmd := rcli.Subcmd(stdout, "pull", "[OPTIONS] NAME[:TAG]|URL [NAME]", "Download a new image from a remote location")
+	fl_all := cmd.Bool("a", false, "Download all the tagged versions of NAME")
+	fl_nocache := cmd.Bool("no-cache", false, "Download the archive even if the cached copy is up to date")
+	fl_registry := cmd.String("registry", "", "Pull NAME from this registry or S3 bucket (s3://BUCKET[/PREFIX]) instead of the mirror")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -410,31 +932,280 @@ func (srv *Server) CmdPull(stdin io.ReadCloser, stdout io.Writer, args ...string
 	if name == "" {
 		return errors.New("Not enough arguments")
 	}
+	if reg, err := srv.getRegistry(*fl_registry); err != nil {
+		return err
+	} else if reg != nil {
+		if *fl_all {
+			return errors.New("-a is not supported with a registry")
+		}
+		return srv.pullRegistry(stdout, reg, name)
+	}
 	u, err := url.Parse(name)
 	if err != nil {
 		return err
 	}
-	if u.Scheme == "" {
-		u.Scheme = "http"
+	if u.Host != "" {
+		// Pulling an arbitrary URL: name the image after the archive
+		if name = cmd.Arg(1); name == "" {
+			name = archiveName(u.Path)
+		}
+		if u.Scheme == "" {
+			u.Scheme = "http"
+		}
+		_, err := srv.pull(stdout, u, name, "", *fl_nocache)
+		return err
+	}
+	// Pulling an image by name from the mirror
+	var tag string
+	if idx := strings.LastIndex(name, ":"); idx >= 0 {
+		name, tag = name[:idx], name[idx+1:]
+	}
+	if err := image.ValidateName(name); err != nil {
+		return err
+	}
+	if !*fl_all {
+		_, err := srv.pull(stdout, srv.mirror.ImageURL(name, tag), name, tag, *fl_nocache)
+		return err
+	}
+	if tag != "" {
+		return errors.New("Can't pull all tags of a specific tag")
+	}
+	tags, err := srv.mirror.Tags(name)
+	if err != nil {
+		return err
 	}
-	// FIXME: hardcode a mirror URL that does not depend on a single provider.
-	if u.Host == "" {
-		u.Host = "s3.amazonaws.com"
-		u.Path = path.Join("/docker.io/images", u.Path)
+	if len(tags) == 0 {
+		return errors.New("No tags found for " + name)
 	}
+	for _, tag := range tags {
+		if _, err := srv.pull(stdout, srv.mirror.ImageURL(name, tag), name, tag, *fl_nocache); err != nil {
+			return fmt.Errorf("Error pulling %s:%s: %s", name, tag, err)
+		}
+	}
+	return nil
+}
+
+// 'docker search TERM': find images on the mirror
+func (srv *Server) CmdSearch(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "search", "[OPTIONS] TERM", "Search the mirror for images")
+	fl_full := cmd.Bool("notrunc", false, "Don't truncate output")
+	fl_s3 := cmd.String("s3", "", "List the images of an S3 bucket (s3://BUCKET[/PREFIX]) matching TERM instead")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	if *fl_s3 != "" {
+		u, err := url.Parse(*fl_s3)
+		if err != nil {
+			return err
+		}
+		bucket, err := registry.NewS3(u)
+		if err != nil {
+			return err
+		}
+		bucket.Client = srv.client
+		images, err := bucket.Images()
+		if err != nil {
+			return err
+		}
+		for _, name := range images {
+			if strings.Contains(strings.ToLower(name), strings.ToLower(cmd.Arg(0))) {
+				fmt.Fprintln(stdout, name)
+			}
+		}
+		return nil
+	}
+	results, err := srv.mirror.Search(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "NAME\tDESCRIPTION\tPOPULARITY\n")
+	for _, result := range results {
+		description := result.Description
+		if !*fl_full {
+			description = docker.Trunc(description, 45)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", result.Name, description, result.Popularity)
+	}
+	w.Flush()
+	return nil
+}
+
+// pull downloads the archive at `u` and imports it as image `name`, tagged
+// with `tag` if it is not empty.
+func (srv *Server) pull(stdout io.Writer, u *url.URL, name, tag string, noCache bool) (*image.Image, error) {
 	fmt.Fprintf(stdout, "Downloading from %s\n", u.String())
-	// Download with curl (pretty progress bar)
-	// If curl is not available, fallback to http.Get()
-	archive, err := future.Curl(u.String(), stdout)
+	var archive io.Reader
+	if noCache {
+		// Download with curl (pretty progress bar)
+		// If curl is not available, fallback to http.Get()
+		var err error
+		curl, err := future.Curl(u.String(), srv.proxy.Environ(), rcli.Progress(stdout))
+		if err != nil {
+			if resp, err := srv.client.Get(u.String()); err != nil {
+				return nil, err
+			} else {
+				curl = resp.Body
+			}
+		}
+		// Abort the download if the client disconnects
+		if closer, ok := curl.(io.Closer); ok {
+			defer future.CloseOnCancel(closer, rcli.Done(stdout))()
+		}
+		archive = curl
+	} else {
+		download := func(body io.Reader, size int64) io.Reader {
+			if size < 0 {
+				size = 0
+			}
+			return rcli.ProgressReader(body, rcli.Progress(stdout), name, "Downloading", size)
+		}
+		cached, fromCache, err := srv.cache.Fetch(u, rcli.Done(stdout), download)
+		if err != nil {
+			return nil, err
+		}
+		defer cached.Close()
+		if fromCache {
+			fmt.Fprintf(stdout, "%s hasn't changed, using the cached copy\n", u.String())
+		}
+		archive = cached
+		if f, ok := cached.(*os.File); ok {
+			if info, err := f.Stat(); err == nil {
+				archive = rcli.ProgressReader(cached, rcli.Progress(stdout), name, "Extracting", info.Size())
+			}
+		}
+	}
+	// The signature is fetched first: failing to download it is worth
+	// trying again, and leaves nothing behind
+	signature, err := srv.fetchSignature(u)
 	if err != nil {
-		if resp, err := http.Get(u.String()); err != nil {
+		return nil, err
+	}
+	if tag != "" {
+		fmt.Fprintf(stdout, "Unpacking to %s:%s\n", name, tag)
+	} else {
+		fmt.Fprintf(stdout, "Unpacking to %s\n", name)
+	}
+	img, err := srv.images.ImportTag(name, tag, archive, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.verifyPulled(stdout, img, signature); err != nil {
+		// Images whose signature doesn't match are dropped; so are those
+		// which couldn't be checked, when signatures are required
+		if _, mismatch := err.(*image.SignatureError); mismatch || srv.options.RequireSignatures {
+			srv.images.DeleteId(img.Id, true)
+		}
+		return nil, err
+	}
+	fmt.Fprintln(stdout, img.Id)
+	return img, nil
+}
+
+// fetchSignature downloads the signature published next to the archive at
+// `u` (at the same URL, with a .asc suffix). It returns nil if there is
+// none, and an error worth retrying if it can't tell.
+func (srv *Server) fetchSignature(u *url.URL) ([]byte, error) {
+	sigURL := *u
+	sigURL.Path += ".asc"
+	resp, err := srv.client.Get(sigURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't fetch the signature %s, try again: %v", sigURL.String(), err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		if srv.options.RequireSignatures {
+			return nil, fmt.Errorf("Refusing unsigned image (%s: %s)", sigURL.String(), resp.Status)
+		}
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("Couldn't fetch the signature %s, try again: %s", sigURL.String(), resp.Status)
+	}
+	signature, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't fetch the signature %s, try again: %v", sigURL.String(), err)
+	}
+	return signature, nil
+}
+
+// verifyPulled checks `signature`, fetched by fetchSignature, against the
+// pulled image `img`, and stores it. Images without signatures pass.
+func (srv *Server) verifyPulled(stdout io.Writer, img *image.Image, signature []byte) error {
+	if signature == nil {
+		return nil
+	}
+	if err := srv.images.AddSignature(img, bytes.NewReader(signature)); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Verified signature of %s\n", img.Id)
+	return nil
+}
+
+// 'docker sign IMAGE': sign an image with gpg
+func (srv *Server) CmdSign(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "sign", "[OPTIONS] IMAGE", "Sign an image with the daemon's gpg key")
+	fl_key := cmd.String("u", "", "Use this key instead of the default one")
+	fl_verify := cmd.Bool("verify", false, "Verify the signature of the image instead of signing it")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	img := srv.images.Find(cmd.Arg(0))
+	if img == nil {
+		return errors.New("No such image: " + cmd.Arg(0))
+	}
+	if *fl_verify {
+		if err := srv.images.Verify(img); err != nil {
 			return err
-		} else {
-			archive = resp.Body
 		}
+		fmt.Fprintf(stdout, "Good signature for %s\n", img.Id)
+		return nil
+	}
+	if err := srv.images.Sign(img, *fl_key); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, img.Id)
+	return nil
+}
+
+// getRegistry returns the registry or S3 bucket at `location`, or the default
+// registry of the daemon if `location` is empty. It returns nil if neither is set.
+func (srv *Server) getRegistry(location string) (registry.Backend, error) {
+	if location != "" {
+		return registry.NewBackend(location, srv.client)
+	}
+	return srv.registry, nil
+}
+
+func (srv *Server) pullRegistry(stdout io.Writer, reg registry.Backend, name string) error {
+	ref := "latest"
+	if idx := strings.LastIndex(name, ":"); idx >= 0 {
+		name, ref = name[:idx], name[idx+1:]
 	}
-	fmt.Fprintf(stdout, "Unpacking to %s\n", name)
-	img, err := srv.images.Import(name, archive, nil)
+	if err := image.ValidateName(name); err != nil {
+		return err
+	}
+	if srv.options.RequireSignatures {
+		return fmt.Errorf("Refusing unsigned image %s:%s: registries don't carry signatures", name, ref)
+	}
+	tmp, err := srv.images.Layers.Mktemp()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	fmt.Fprintf(stdout, "Pulling %s:%s from %s\n", name, ref, reg.String())
+	if err := reg.Pull(name, ref, tmp, stdout); err != nil {
+		return err
+	}
+	img, err := srv.images.ImportOCI(name, tmp)
 	if err != nil {
 		return err
 	}
@@ -442,6 +1213,73 @@ func (srv *Server) CmdPull(stdin io.ReadCloser, stdout io.Writer, args ...string
 	return nil
 }
 
+func (srv *Server) CmdPush(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "push", "[OPTIONS] NAME[:TAG] [tcp://HOST[:PORT]]", "Upload an image to a registry, or directly to another docker daemon")
+	fl_registry := cmd.String("registry", "", "URL of the registry or S3 bucket (defaults to the registry of the daemon)")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 && cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	if cmd.NArg() == 2 {
+		if *fl_registry != "" {
+			return errors.New("-registry doesn't apply to pushes to a daemon")
+		}
+		addr, err := parseDaemonAddr(cmd.Arg(1))
+		if err != nil {
+			return err
+		}
+		img := srv.images.Find(cmd.Arg(0))
+		if img == nil {
+			return errors.New("No such image: " + cmd.Arg(0))
+		}
+		remoteImg, err := srv.pushToDaemon(img, addr, rcli.Progress(stdout))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, remoteImg)
+		return nil
+	}
+	reg, err := srv.getRegistry(*fl_registry)
+	if err != nil {
+		return err
+	}
+	if reg == nil {
+		return errors.New("No registry configured: use -registry")
+	}
+	img := srv.images.Find(cmd.Arg(0))
+	if img == nil {
+		return errors.New("No such image: " + cmd.Arg(0))
+	}
+	name, _ := img.IdParts()
+	ref := img.Tag
+	if ref == "" {
+		ref = "latest"
+	}
+	tmp, err := srv.images.Layers.Mktemp()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := srv.images.ExportOCI(img, tmp); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Pushing %s to %s as %s:%s\n", img.Id, reg.String(), name, ref)
+	return reg.Push(name, ref, tmp, stdout)
+}
+
+// archiveName derives an image name from the path of an archive,
+// eg. '/foo/bar.tar.gz' => 'bar'
+func archiveName(archivePath string) string {
+	name := path.Base(archivePath)
+	for _, ext := range []string{".gz", ".bz2", ".xz", ".tgz", ".tar"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
 func (srv *Server) CmdPut(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	cmd := rcli.Subcmd(stdout, "put", "[OPTIONS] NAME", "Import a new image from a local archive.")
 	if err := cmd.Parse(args); err != nil {
@@ -459,42 +1297,222 @@ func (srv *Server) CmdPut(stdin io.ReadCloser, stdout io.Writer, args ...string)
 	return nil
 }
 
+func (srv *Server) CmdImport(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "import", "[OPTIONS] NAME[:TAG]", "Create a new image from a directory of the docker host or a git repository")
+	fl_dir := cmd.String("dir", "", "Absolute path of the directory to import")
+	fl_git := cmd.String("git", "", "URL[#REF] of a git repository (https://, git:// or ssh://) to import, at branch, tag or commit REF")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 || (*fl_dir == "") == (*fl_git == "") {
+		cmd.Usage()
+		return nil
+	}
+	name, tag := cmd.Arg(0), ""
+	if idx := strings.LastIndex(name, ":"); idx >= 0 {
+		name, tag = name[:idx], name[idx+1:]
+	}
+	if err := image.ValidateName(name); err != nil {
+		return err
+	}
+	if *fl_git != "" {
+		tmp, err := srv.images.Layers.Mktemp()
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		repo, ref := *fl_git, ""
+		if idx := strings.LastIndex(repo, "#"); idx >= 0 {
+			repo, ref = repo[:idx], repo[idx+1:]
+		}
+		fmt.Fprintf(stdout, "Cloning %s\n", *fl_git)
+		src := path.Join(tmp, "src")
+		if err := future.GitClone(repo, ref, src, rcli.Progress(stdout)); err != nil {
+			return err
+		}
+		// Only import the tree, not the history
+		if err := os.RemoveAll(path.Join(src, ".git")); err != nil {
+			return err
+		}
+		*fl_dir = src
+	}
+	if !path.IsAbs(*fl_dir) {
+		return errors.New("The path to import must be absolute: " + *fl_dir)
+	}
+	if st, err := os.Stat(*fl_dir); err != nil {
+		return err
+	} else if !st.IsDir() {
+		return errors.New("Not a directory: " + *fl_dir)
+	}
+	archive, err := image.Tar(*fl_dir, image.Uncompressed)
+	if err != nil {
+		return err
+	}
+	img, err := srv.images.ImportTag(name, tag, archive, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, img.Id)
+	return nil
+}
+
+func (srv *Server) CmdSave(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "save", "IMAGE", "Stream an image as a tar archive in the OCI image layout")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	img := srv.images.Find(cmd.Arg(0))
+	if img == nil {
+		return errors.New("No such image: " + cmd.Arg(0))
+	}
+	tmp, err := srv.images.Layers.Mktemp()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := srv.images.ExportOCI(img, tmp); err != nil {
+		return err
+	}
+	data, err := image.Tar(tmp, image.Uncompressed)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(stdout, data)
+	return err
+}
+
+func (srv *Server) CmdLoad(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "load", "NAME", "Import an image from a tar archive in the OCI image layout")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	name := cmd.Arg(0)
+	if name == "" {
+		return errors.New("Not enough arguments")
+	}
+	if srv.options.RequireSignatures {
+		// Our signatures cover layer IDs, which don't survive a round-trip through the OCI layout
+		return errors.New("Refusing to load an unsigned image: signatures are required")
+	}
+	tmp, err := srv.images.Layers.Mktemp()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := image.Untar(stdin, tmp); err != nil {
+		return err
+	}
+	img, err := srv.images.ImportOCI(name, tmp)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, img.Id)
+	return nil
+}
+
 func (srv *Server) CmdImages(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "images", "[OPTIONS] [NAME]", "List images")
+	cmd := rcli.Subcmd(stdout, "images", "[OPTIONS] [NAME[:TAG]|NAMESPACE/]", "List images. NAME and TAG may contain wildcards, eg. 'sendhub/*:1.*'")
 	limit := cmd.Int("l", 0, "Only show the N most recent versions of each image")
 	quiet := cmd.Bool("q", false, "only show numeric IDs")
-	cmd.Parse(args)
+	fl_dangling := cmd.Bool("dangling", false, "Only show dangling images (see 'docker image prune')")
+	fl_labels := labels{}
+	cmd.Var(fl_labels, "label", "Only show images with label KEY, or KEY=VALUE (can be repeated)")
+	fl_filters := filters{}
+	cmd.Var(fl_filters, "filter", "Only show images matching KEY=VALUE: dangling, label, before, since or parent (can be repeated)")
+	fl_format := cmd.String("format", "", "Render each image through a Go template, eg. '{{.Name}}:{{.Tag}} {{.Id}}'")
+	fl_json := cmd.Bool("json", false, "Output JSON")
+	fl_tree := cmd.Bool("tree", false, "Show all the images nested under their parents, with their sizes")
+	fl_verbose := cmd.Bool("verbose", false, "Also show the command and the comment each image was committed with")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
 	if cmd.NArg() > 1 {
 		cmd.Usage()
 		return nil
 	}
+	if *fl_tree {
+		writeImageTree(stdout, srv.imageTree(), srv.containerLayers())
+		return nil
+	}
 	var nameFilter string
 	if cmd.NArg() == 1 {
 		nameFilter = cmd.Arg(0)
 	}
+	match, err := srv.imageFilter(fl_filters)
+	if err != nil {
+		return err
+	}
+	var format *template.Template
+	if *fl_format != "" {
+		if format, err = parseFormat(*fl_format); err != nil {
+			return err
+		}
+		*quiet = true
+	}
+	list := []*jsonImage{}
+	if *fl_json {
+		*quiet = true
+	}
+	var dangling map[string]bool
+	if *fl_dangling {
+		dangling = make(map[string]bool)
+		for _, img := range srv.images.Dangling() {
+			dangling[img.Id] = true
+		}
+	}
 	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
 	if !*quiet {
-		fmt.Fprintf(w, "NAME\tID\tCREATED\tPARENT\n")
-	}
-	for _, name := range srv.images.Names() {
-		if nameFilter != "" && nameFilter != name {
-			continue
+		fmt.Fprintf(w, "NAME\tTAG\tID\tCREATED\tPARENT")
+		if *fl_verbose {
+			fmt.Fprintf(w, "\tCREATED BY\tCOMMENT")
 		}
-		for idx, img := range *srv.images.ByName[name] {
+		fmt.Fprintf(w, "\n")
+	}
+	// List images grouped by namespace, top-level images first.
+	// 'docker images NAMESPACE/' lists all the images of a namespace.
+	var names []string
+	for _, namespace := range srv.images.Namespaces() {
+		names = append(names, srv.images.NamesIn(namespace)...)
+	}
+	for _, name := range names {
+		for idx, img := range srv.images.History(name) {
 			if *limit > 0 && idx >= *limit {
 				break
 			}
-			if !*quiet {
+			if !matchImageName(nameFilter, name, img.Tag) {
+				continue
+			}
+			if dangling != nil && !dangling[img.Id] {
+				continue
+			}
+			if !fl_labels.Match(img.Labels) || !match(img) {
+				continue
+			}
+			if *fl_json {
+				list = append(list, newJSONImage(name, img))
+			} else if !*quiet {
 				id := img.Id
 				if !img.IdIsFinal() {
 					id += "..."
 				}
-				for idx, field := range []string{
+				fields := []string{
 					/* NAME */ name,
+					/* TAG */ img.Tag,
 					/* ID */ id,
 					/* CREATED */ future.HumanDuration(time.Now().Sub(img.Created)) + " ago",
 					/* PARENT */ img.Parent,
-				} {
+				}
+				if *fl_verbose {
+					fields = append(fields,
+						/* CREATED BY */ img.CreatedBy,
+						/* COMMENT */ img.Comment,
+					)
+				}
+				for idx, field := range fields {
 					if idx == 0 {
 						w.Write([]byte(field))
 					} else {
@@ -502,11 +1520,21 @@ func (srv *Server) CmdImages(stdin io.ReadCloser, stdout io.Writer, args ...stri
 					}
 				}
 				w.Write([]byte{'\n'})
+			} else if format != nil {
+				if err := writeFormat(stdout, format, struct {
+					*image.Image
+					Name string
+				}{img, name}); err != nil {
+					return err
+				}
 			} else {
 				stdout.Write([]byte(img.Id + "\n"))
 			}
 		}
 	}
+	if *fl_json {
+		return writeJSON(stdout, list)
+	}
 	if !*quiet {
 		w.Flush()
 	}
@@ -514,37 +1542,186 @@ func (srv *Server) CmdImages(stdin io.ReadCloser, stdout io.Writer, args ...stri
 
 }
 
+// 'docker history IMAGE': show the image and its ancestors, with the commands
+// and the comments they were committed with
+func (srv *Server) CmdHistory(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "history", "[OPTIONS] IMAGE", "Show the history of an image: the image and its parents, most recent first")
+	fl_full := cmd.Bool("notrunc", false, "Don't truncate output")
+	fl_json := cmd.Bool("json", false, "Output JSON")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	img := srv.images.Find(cmd.Arg(0))
+	if img == nil {
+		return errors.New("No such image: " + cmd.Arg(0))
+	}
+	list := []*jsonImage{}
+	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
+	if !*fl_json {
+		fmt.Fprintf(w, "ID\tCREATED\tCREATED BY\tCOMMENT\n")
+	}
+	for seen := make(map[string]bool); img != nil && !seen[img.Id]; img = srv.images.Find(img.Parent) {
+		seen[img.Id] = true
+		if *fl_json {
+			name, _ := img.IdParts()
+			list = append(list, newJSONImage(name, img))
+			continue
+		}
+		createdBy := img.CreatedBy
+		if !*fl_full {
+			createdBy = docker.Trunc(createdBy, 45)
+		}
+		fmt.Fprintf(w, "%s\t%s ago\t%s\t%s\n", img.Id, future.HumanDuration(time.Now().Sub(img.Created)), createdBy, img.Comment)
+	}
+	if *fl_json {
+		return writeJSON(stdout, list)
+	}
+	return w.Flush()
+}
+
+// 'docker image SUBCOMMAND': manage images
+func (srv *Server) CmdImage(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "image", "COMMAND [OPTIONS]", "Manage images\n\nCommands:\n    prune     Remove dangling images\n    layers    List the layers of the image store")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	switch cmd.Arg(0) {
+	case "prune":
+		return srv.cmdImagePrune(stdin, stdout, cmd.Args()[1:]...)
+	case "layers":
+		return srv.cmdImageLayers(stdin, stdout, cmd.Args()[1:]...)
+	}
+	return errors.New("No such image command: " + cmd.Arg(0))
+}
+
+// 'docker image prune': remove dangling images
+func (srv *Server) cmdImagePrune(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "image prune", "[OPTIONS]", "Remove images which are not the latest version of their name, not the parent of another image and not used by any container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	pruned, err := srv.images.Prune()
+	if err != nil {
+		return err
+	}
+	for _, img := range pruned {
+		fmt.Fprintf(stdout, "Deleted: %s\n", img.Id)
+	}
+	return nil
+}
+
+// 'docker image layers': list the layers of the image store. Daemons pushing
+// an image to this one use it to only send the missing layers.
+func (srv *Server) cmdImageLayers(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "image layers", "[ID...]", "List the layers of the image store, or those of layers ID which it has")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() == 0 {
+		for _, layer := range srv.images.Layers.List() {
+			fmt.Fprintln(stdout, path.Base(layer))
+		}
+		return nil
+	}
+	for _, id := range cmd.Args() {
+		if id != "" && path.Base(id) == id && srv.images.Layers.Exists(id) {
+			fmt.Fprintln(stdout, id)
+		}
+	}
+	return nil
+}
+
 func (srv *Server) CmdPs(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	cmd := rcli.Subcmd(stdout,
 		"ps", "[OPTIONS]", "List containers")
 	quiet := cmd.Bool("q", false, "Only display numeric IDs")
 	fl_all := cmd.Bool("a", false, "Show all containers. Only running containers are shown by default.")
 	fl_full := cmd.Bool("notrunc", false, "Don't truncate output")
+	fl_labels := labels{}
+	cmd.Var(fl_labels, "label", "Only show containers with label KEY, or KEY=VALUE (can be repeated)")
+	fl_filters := filters{}
+	cmd.Var(fl_filters, "filter", "Only show containers matching KEY=VALUE: status, image, id, label, before or since (can be repeated)")
+	fl_format := cmd.String("format", "", "Render each container through a Go template, eg. '{{.Id}} {{.State}}'")
+	fl_json := cmd.Bool("json", false, "Output JSON")
+	fl_sort := cmd.String("sort", "created", "Sort by created, id or status")
+	fl_last := cmd.Int("n", 0, "Show the N most recently created containers, including stopped ones")
+	fl_latest := cmd.Bool("l", false, "Show the most recently created container, including stopped ones. Same as -n 1")
+	fl_since := cmd.String("since", "", "Show containers created after CONTAINER, including stopped ones. Same as -filter since=CONTAINER")
+	fl_before := cmd.String("before", "", "Show containers created before CONTAINER, including stopped ones. Same as -filter before=CONTAINER")
+	fl_columns := cmd.String("columns", defaultPsColumns, "The columns to display, in order, separated by commas: ID, IMAGE, COMMAND, CREATED, STATUS, COMMENT, PORTS, NAMES or SIZE")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	w := tabwriter.NewWriter(stdout, 12, 1, 3, ' ', 0)
-	if !*quiet {
-		fmt.Fprintf(w, "ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tCOMMENT\n")
+	columns, err := parsePsColumns(*fl_columns)
+	if err != nil {
+		return err
+	}
+	if *fl_latest {
+		*fl_last = 1
+	}
+	if *fl_since != "" {
+		fl_filters.Set("since=" + *fl_since)
+	}
+	if *fl_before != "" {
+		fl_filters.Set("before=" + *fl_before)
+	}
+	if *fl_last > 0 || *fl_since != "" || *fl_before != "" {
+		*fl_all = true
+	}
+	match, err := srv.containerFilter(fl_filters)
+	if err != nil {
+		return err
+	}
+	var format *template.Template
+	if *fl_format != "" {
+		if format, err = parseFormat(*fl_format); err != nil {
+			return err
+		}
+		*quiet = true
 	}
+	// Filtering on the status overrides the default of only showing running containers
+	if len(fl_filters["status"]) > 0 {
+		*fl_all = true
+	}
+	// The list is sorted by creation date, most recent first
+	var containers []*docker.Container
 	for _, container := range srv.containers.List() {
-		comment := container.GetUserData("comment")
 		if !container.State.Running && !*fl_all {
 			continue
 		}
-		if !*quiet {
-			command := fmt.Sprintf("%s %s", container.Path, strings.Join(container.Args, " "))
-			if !*fl_full {
-				command = docker.Trunc(command, 20)
-			}
-			for idx, field := range []string{
-				/* ID */ container.Id,
-				/* IMAGE */ container.GetUserData("image"),
-				/* COMMAND */ command,
-				/* CREATED */ future.HumanDuration(time.Now().Sub(container.Created)) + " ago",
-				/* STATUS */ container.State.String(),
-				/* COMMENT */ comment,
-			} {
+		if !fl_labels.Match(container.Config.Labels) || !match(container) {
+			continue
+		}
+		containers = append(containers, container)
+	}
+	if *fl_last > 0 && len(containers) > *fl_last {
+		containers = containers[:*fl_last]
+	}
+	if err := sortContainers(containers, *fl_sort); err != nil {
+		return err
+	}
+	list := []*jsonContainer{}
+	if *fl_json {
+		*quiet = true
+	}
+	w := tabwriter.NewWriter(stdout, 12, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintf(w, "%s\n", strings.Join(columns, "\t"))
+	}
+	for _, container := range containers {
+		if *fl_json {
+			list = append(list, newJSONContainer(container))
+		} else if !*quiet {
+			for idx, column := range columns {
+				field := psColumns[column](container, *fl_full)
 				if idx == 0 {
 					w.Write([]byte(field))
 				} else {
@@ -552,10 +1729,21 @@ func (srv *Server) CmdPs(stdin io.ReadCloser, stdout io.Writer, args ...string)
 				}
 			}
 			w.Write([]byte{'\n'})
+		} else if format != nil {
+			if err := writeFormat(stdout, format, container); err != nil {
+				return err
+			}
 		} else {
-			stdout.Write([]byte(container.Id + "\n"))
+			id := container.Id
+			if !*fl_full {
+				id = docker.TruncateId(id)
+			}
+			stdout.Write([]byte(id + "\n"))
 		}
 	}
+	if *fl_json {
+		return writeJSON(stdout, list)
+	}
 	if !*quiet {
 		w.Flush()
 	}
@@ -575,14 +1763,49 @@ func (srv *Server) CmdLayers(stdin io.ReadCloser, stdout io.Writer, args ...stri
 	return nil
 }
 
+// 'docker fsck': check the image index against the layers on disk
+func (srv *Server) CmdFsck(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout,
+		"fsck", "[OPTIONS]",
+		"Check the consistency of the image store")
+	fl_repair := cmd.Bool("repair", false, "Remove dangling images, clear broken parents and quarantine orphaned layers")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	problems, err := srv.images.Fsck()
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(stdout, problem.String())
+	}
+	if len(problems) == 0 {
+		fmt.Fprintln(stdout, "No problems found")
+		return nil
+	}
+	if !*fl_repair {
+		return fmt.Errorf("%d problem(s) found. Use -repair to fix them.", len(problems))
+	}
+	if err := srv.images.Repair(problems); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Repaired %d problem(s). Orphaned layers were moved to %s\n", len(problems), srv.images.QuarantinePath())
+	return nil
+}
+
 func (srv *Server) CmdCp(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	cmd := rcli.Subcmd(stdout,
 		"cp", "[OPTIONS] IMAGE NAME",
-		"Create a copy of IMAGE and call it NAME")
+		"Create a copy of IMAGE and call it NAME. The copy shares the layers of IMAGE, unless -clone is given")
+	fl_clone := cmd.Bool("clone", false, "Copy the layers of IMAGE as well, so that the copy is independent of it")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	if newImage, err := srv.images.Copy(cmd.Arg(0), cmd.Arg(1)); err != nil {
+	copyImage := srv.images.Copy
+	if *fl_clone {
+		copyImage = srv.images.Clone
+	}
+	if newImage, err := copyImage(cmd.Arg(0), cmd.Arg(1)); err != nil {
 		return err
 	} else {
 		fmt.Fprintln(stdout, newImage.Id)
@@ -594,6 +1817,13 @@ func (srv *Server) CmdCommit(stdin io.ReadCloser, stdout io.Writer, args ...stri
 	cmd := rcli.Subcmd(stdout,
 		"commit", "[OPTIONS] CONTAINER [DEST]",
 		"Create a new image from a container's changes")
+	fl_labels := labels{}
+	cmd.Var(fl_labels, "label", "Set label KEY=VALUE on the new image (can be repeated)")
+	var fl_expose ports
+	cmd.Var(&fl_expose, "expose", "Expose a port in the new image, besides those of the container (can be repeated)")
+	fl_comment := cmd.String("m", "", "Comment of the new image, shown by 'docker history'. The comment of the container by default")
+	var fl_exclude excludes
+	cmd.Var(&fl_exclude, "exclude", "Leave the paths matching PATTERN out of the new image, besides those of the label "+docker.CommitExcludeLabel+" of the container, eg. '/tmp' or '*.pyc' (can be repeated)")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -602,22 +1832,232 @@ func (srv *Server) CmdCommit(stdin io.ReadCloser, stdout io.Writer, args ...stri
 		cmd.Usage()
 		return nil
 	}
-	if container := srv.containers.Get(containerName); container != nil {
-		// FIXME: freeze the container before copying it to avoid data corruption?
-		rwTar, err := image.Tar(container.Filesystem.RWPath, image.Uncompressed)
-		if err != nil {
-			return err
-		}
-		// Create a new image from the container's base layers + a new layer from container changes
-		parentImg := srv.images.Find(container.GetUserData("image"))
-		img, err := srv.images.Import(imgName, rwTar, parentImg)
-		if err != nil {
-			return err
-		}
-		fmt.Fprintln(stdout, img.Id)
+	if container := srv.containers.Get(containerName); container != nil {
+		// FIXME: freeze the container before copying it to avoid data corruption?
+		rwTar, err := image.TarFilter(container.Filesystem.RWPath, image.Uncompressed, append(container.CommitExcludes(), fl_exclude...))
+		if err != nil {
+			return err
+		}
+		// Create a new image from the container's base layers + a new layer from container changes
+		parentImg := srv.images.Find(container.Config.Image)
+		img, err := srv.images.Import(imgName, rcli.ProgressReader(rwTar, rcli.Progress(stdout), container.Id, "Committing", 0), parentImg)
+		if err != nil {
+			return err
+		}
+		if len(fl_labels) > 0 {
+			if err := srv.images.SetLabels(img.Id, fl_labels); err != nil {
+				return err
+			}
+		}
+		comment := *fl_comment
+		if comment == "" {
+			comment = container.Label("comment")
+		}
+		if err := srv.images.SetCreatedBy(img.Id, strings.TrimSpace(container.Path+" "+strings.Join(container.Args, " ")), comment); err != nil {
+			return err
+		}
+		// The image exposes the ports the container listens on
+		exposed := docker.MergePorts(docker.MergePorts(container.Config.ExposedPorts, container.Config.PublishedPorts()), fl_expose)
+		if len(exposed) > 0 {
+			if err := srv.images.SetExposedPorts(img.Id, exposed); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(stdout, img.Id)
+		return nil
+	}
+	return errors.New("No such container: " + containerName)
+}
+
+func (srv *Server) CmdClone(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout,
+		"clone", "[OPTIONS] CONTAINER",
+		"Create a new container with the same image, command and configuration as CONTAINER")
+	fl_rw := cmd.Bool("rw", false, "Also copy the changes made to the filesystem of CONTAINER")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	source := srv.containers.Get(cmd.Arg(0))
+	if source == nil {
+		return errors.New("No such container: " + cmd.Arg(0))
+	}
+	container, err := srv.containers.Clone(source, srv.containers.NewId(), *fl_rw)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, container.Id)
+	return nil
+}
+
+func (srv *Server) CmdRename(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout,
+		"rename", "[OPTIONS] CONTAINER [NEW_ID]",
+		"Change the ID or the comment of a stopped container")
+	fl_comment := cmd.String("m", "", "Replace the comment of the container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 || cmd.NArg() > 2 || (cmd.NArg() == 1 && *fl_comment == "") {
+		cmd.Usage()
+		return nil
+	}
+	container := srv.containers.Get(cmd.Arg(0))
+	if container == nil {
+		return errors.New("No such container: " + cmd.Arg(0))
+	}
+	if *fl_comment != "" {
+		if err := container.SetLabel("comment", *fl_comment); err != nil {
+			return err
+		}
+	}
+	if cmd.NArg() == 2 {
+		if err := srv.containers.Rename(container, cmd.Arg(1)); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(stdout, container.Id)
+	return nil
+}
+
+// 'docker update': change the limits, restart policy and labels of
+// containers. Running containers get their new limits right away.
+func (srv *Server) CmdUpdate(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "update", "[OPTIONS] CONTAINER [CONTAINER...]", "Change the limits, restart policy and labels of containers")
+	var fl_memory byteSize
+	cmd.Var(&fl_memory, "m", "Memory limit, in bytes or with a unit (k, m or g), 0 for no limit")
+	fl_cpuShares := cmd.Int64("cpu-shares", 0, "CPU shares, relative to the other containers, 0 for the default")
+	fl_restart := cmd.String("restart", "", "Restart policy when the container exits: no, always or on-failure[:MAX]")
+	fl_labels := labels{}
+	cmd.Var(fl_labels, "label", "Set label KEY=VALUE, or remove label KEY (can be repeated)")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	set := make(map[string]bool)
+	cmd.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if len(set) == 0 {
+		return errors.New("Nothing to update (see 'docker update -help')")
+	}
+	if *fl_cpuShares < 0 {
+		return fmt.Errorf("Invalid CPU shares: %d", *fl_cpuShares)
+	}
+	if set["restart"] {
+		if _, _, err := docker.ParseRestartPolicy(*fl_restart); err != nil {
+			return err
+		}
+	}
+	return srv.forEachContainer(stdout, cmd.Args(), func(container *docker.Container) error {
+		if set["m"] || set["cpu-shares"] {
+			ram, cpuShares := container.Config.Ram, container.Config.CpuShares
+			if set["m"] {
+				ram = int64(fl_memory)
+			}
+			if set["cpu-shares"] {
+				cpuShares = *fl_cpuShares
+			}
+			if err := container.SetResources(ram, cpuShares); err != nil {
+				return err
+			}
+		}
+		if set["restart"] {
+			if err := container.SetRestartPolicy(*fl_restart); err != nil {
+				return err
+			}
+		}
+		for key, value := range fl_labels {
+			if err := container.SetLabel(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (srv *Server) CmdLabel(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout,
+		"label", "get CONTAINER|IMAGE [KEY] | set CONTAINER|IMAGE KEY=VALUE... | rm CONTAINER|IMAGE KEY...",
+		"Show or change the labels of a container or an image")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 2 {
+		cmd.Usage()
+		return nil
+	}
+	action, target, keys := cmd.Arg(0), cmd.Arg(1), cmd.Args()[2:]
+	// Containers take precedence over images
+	var current map[string]string
+	var setLabels func(map[string]string) error
+	if container := srv.containers.Get(target); container != nil {
+		current = container.Config.Labels
+		setLabels = func(changes map[string]string) error {
+			for key, value := range changes {
+				if err := container.SetLabel(key, value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	} else if img := srv.images.Find(target); img != nil {
+		current = img.Labels
+		setLabels = func(changes map[string]string) error {
+			return srv.images.SetLabels(img.Id, changes)
+		}
+	} else {
+		return errors.New("No such container or image: " + target)
+	}
+	changes := labels{}
+	switch action {
+	case "get":
+		if len(keys) > 1 {
+			cmd.Usage()
+			return nil
+		}
+		if len(keys) == 1 {
+			if value, exists := current[keys[0]]; exists {
+				fmt.Fprintln(stdout, value)
+				return nil
+			}
+			return errors.New("No such label: " + keys[0])
+		}
+		var sorted []string
+		for key := range current {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			fmt.Fprintf(stdout, "%s=%s\n", key, current[key])
+		}
+		return nil
+	case "set":
+		for _, kv := range keys {
+			if !strings.Contains(kv, "=") {
+				return fmt.Errorf("Invalid label: %v (expected KEY=VALUE)", kv)
+			}
+			if err := changes.Set(kv); err != nil {
+				return err
+			}
+		}
+	case "rm":
+		for _, key := range keys {
+			changes[key] = ""
+		}
+	default:
+		cmd.Usage()
+		return nil
+	}
+	if len(changes) == 0 {
+		cmd.Usage()
 		return nil
 	}
-	return errors.New("No such container: " + containerName)
+	return setLabels(changes)
 }
 
 func (srv *Server) CmdTar(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
@@ -625,6 +2065,7 @@ func (srv *Server) CmdTar(stdin io.ReadCloser, stdout io.Writer, args ...string)
 		"tar", "CONTAINER",
 		"Stream the contents of a container as a tar archive")
 	fl_sparse := cmd.Bool("s", false, "Generate a sparse tar stream (top layer + reference to bottom layers)")
+	fl_no_freeze := cmd.Bool("no-freeze", false, "Don't freeze a running container while archiving it: the archive may be inconsistent")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -633,11 +2074,22 @@ func (srv *Server) CmdTar(stdin io.ReadCloser, stdout io.Writer, args ...string)
 	}
 	name := cmd.Arg(0)
 	if container := srv.containers.Get(name); container != nil {
-		data, err := container.Filesystem.Tar()
-		if err != nil {
-			return err
+		var data io.Reader
+		if container.State.Running && !*fl_no_freeze {
+			spool, err := spoolFrozen(container)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(spool.Name())
+			defer spool.Close()
+			data = spool
+		} else {
+			var err error
+			if data, err = container.Filesystem.Tar(); err != nil {
+				return err
+			}
 		}
-		// Stream the entire contents of the container (basically a volatile snapshot)
+		// Stream the entire contents of the container
 		if _, err := io.Copy(stdout, data); err != nil {
 			return err
 		}
@@ -646,10 +2098,39 @@ func (srv *Server) CmdTar(stdin io.ReadCloser, stdout io.Writer, args ...string)
 	return errors.New("No such container: " + name)
 }
 
+// spoolFrozen spools the contents of the running container `container` as a
+// tar archive to a temporary file, which the caller removes. The container is
+// frozen meanwhile, so that the archive is a consistent snapshot, but not
+// while the client reads it, however slowly.
+func spoolFrozen(container *docker.Container) (*os.File, error) {
+	if err := container.Freeze(); err != nil {
+		return nil, err
+	}
+	defer container.Unfreeze()
+	data, err := container.Filesystem.Tar()
+	if err != nil {
+		return nil, err
+	}
+	spool, err := ioutil.TempFile(rootPath, "tar-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(spool, data); err == nil {
+		_, err = spool.Seek(0, 0)
+	}
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, err
+	}
+	return spool, nil
+}
+
 func (srv *Server) CmdDiff(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	cmd := rcli.Subcmd(stdout,
 		"diff", "CONTAINER [OPTIONS]",
 		"Inspect changes on a container's filesystem")
+	fl_json := cmd.Bool("json", false, "Output JSON")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -663,6 +2144,13 @@ func (srv *Server) CmdDiff(stdin io.ReadCloser, stdout io.Writer, args ...string
 		if err != nil {
 			return err
 		}
+		if *fl_json {
+			list := []*jsonChange{}
+			for _, change := range changes {
+				list = append(list, newJSONChange(change))
+			}
+			return writeJSON(stdout, list)
+		}
 		for _, change := range changes {
 			fmt.Fprintln(stdout, change.String())
 		}
@@ -701,38 +2189,30 @@ func (srv *Server) CmdLogs(stdin io.ReadCloser, stdout io.Writer, args ...string
 	}
 	name := cmd.Arg(0)
 	if container := srv.containers.Get(name); container != nil {
-		if _, err := io.Copy(stdout, container.StdoutLog()); err != nil {
-			return err
-		}
-		if _, err := io.Copy(stdout, container.StderrLog()); err != nil {
-			return err
-		}
-		return nil
+		return writeLogs(stdout, container.StdoutLog(), container.StderrLog())
+	}
+	// The container may have been removed on exit
+	if spooled := srv.spooledLogs(name); spooled != "" {
+		return writeLogs(stdout, openLog(path.Join(spooled, "stdout.log")), openLog(path.Join(spooled, "stderr.log")))
 	}
 	return errors.New("No such container: " + cmd.Arg(0))
 }
 
-func (srv *Server) CreateContainer(img *image.Image, ports []int, user string, tty bool, openStdin bool, comment string, cmd string, args ...string) (*docker.Container, error) {
-	id := future.RandomId()[:8]
-	container, err := srv.containers.Create(id, cmd, args, img.Layers,
-		&docker.Config{Hostname: id, Ports: ports, User: user, Tty: tty, OpenStdin: openStdin})
-	if err != nil {
-		return nil, err
-	}
-	if err := container.SetUserData("image", img.Id); err != nil {
-		srv.containers.Destroy(container)
-		return nil, errors.New("Error setting container userdata: " + err.Error())
-	}
-	if err := container.SetUserData("comment", comment); err != nil {
-		srv.containers.Destroy(container)
-		return nil, errors.New("Error setting container userdata: " + err.Error())
-	}
-	return container, nil
+// CreateContainer creates a container from `img` with the options `config`,
+// running `cmd` with `args`.
+func (srv *Server) CreateContainer(img *image.Image, config *docker.Config, cmd string, args ...string) (*docker.Container, error) {
+	id := srv.containers.NewId()
+	config.Image = img.Id
+	if config.Hostname == "" {
+		config.Hostname = docker.TruncateId(id)
+	}
+	return srv.containers.Create(id, cmd, args, img.Layers, config)
 }
 
 func (srv *Server) CmdAttach(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "attach", "[OPTIONS]", "Attach to a running container")
-	fl_i := cmd.Bool("i", false, "Attach to stdin")
+	cmd := rcli.Subcmd(stdout, "attach", "[OPTIONS] CONTAINER", "Attach to a running container")
+	fl_i := cmd.Bool("i", false, "Attach to stdin. Closing it closes the stdin of the container, unless -keep-stdin is set")
+	fl_keep := cmd.Bool("keep-stdin", false, "Keep the stdin of the container open when detaching, so that it can be attached again")
 	fl_o := cmd.Bool("o", true, "Attach to stdout")
 	fl_e := cmd.Bool("e", true, "Attach to stderr")
 	if err := cmd.Parse(args); err != nil {
@@ -748,19 +2228,30 @@ func (srv *Server) CmdAttach(stdin io.ReadCloser, stdout io.Writer, args ...stri
 		return errors.New("No such container: " + name)
 	}
 	var wg sync.WaitGroup
+	var pipes []io.Closer
 	if *fl_i {
+		if !container.Config.OpenStdin {
+			return errors.New("The stdin of " + name + " is closed: run it with -i to attach to it")
+		}
 		c_stdin, err := container.StdinPipe()
 		if err != nil {
 			return err
 		}
 		wg.Add(1)
-		go func() { io.Copy(c_stdin, stdin); wg.Add(-1) }()
+		go func() {
+			// Pass the end of the input on to the container
+			if _, err := io.Copy(c_stdin, stdin); err == nil && !*fl_keep {
+				c_stdin.Close()
+			}
+			wg.Add(-1)
+		}()
 	}
 	if *fl_o {
 		c_stdout, err := container.StdoutPipe()
 		if err != nil {
 			return err
 		}
+		pipes = append(pipes, c_stdout)
 		wg.Add(1)
 		go func() { io.Copy(stdout, c_stdout); wg.Add(-1) }()
 	}
@@ -769,14 +2260,71 @@ func (srv *Server) CmdAttach(stdin io.ReadCloser, stdout io.Writer, args ...stri
 		if err != nil {
 			return err
 		}
+		pipes = append(pipes, c_stderr)
 		wg.Add(1)
 		go func() { io.Copy(stdout, c_stderr); wg.Add(-1) }()
 	}
-	wg.Wait()
+	detached := make(chan struct{})
+	go func() { wg.Wait(); close(detached) }()
+	select {
+	case <-detached:
+	case <-rcli.Done(stdout):
+		// The client is gone: stop copying the output of the container
+		for _, pipe := range pipes {
+			pipe.Close()
+		}
+		return errors.New("Client disconnected")
+	}
+	return nil
+}
+
+// labels is a flag.Value collecting KEY=VALUE pairs. A lone KEY has an
+// empty value.
+type labels map[string]string
+
+func (l labels) String() string {
+	return fmt.Sprint(map[string]string(l))
+}
+
+func (l labels) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if parts[0] == "" {
+		return fmt.Errorf("Invalid label: %v", value)
+	}
+	if len(parts) == 1 {
+		parts = append(parts, "")
+	}
+	l[parts[0]] = parts[1]
+	return nil
+}
+
+// Match returns true if `have` has all the labels of `l`. Labels of `l`
+// with an empty value only need to be present.
+func (l labels) Match(have map[string]string) bool {
+	for key, value := range l {
+		if actual, exists := have[key]; !exists || (value != "" && actual != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// excludes is a flag.Value collecting the patterns of paths to leave out of
+// an archive.
+type excludes []string
+
+func (e *excludes) String() string {
+	return fmt.Sprint(*e)
+}
+
+func (e *excludes) Set(value string) error {
+	if strings.Trim(value, "/") == "" {
+		return fmt.Errorf("Invalid pattern: %v", value)
+	}
+	*e = append(*e, value)
 	return nil
 }
 
-// Ports type - Used to parse multiple -p flags
 type ports []int
 
 func (p *ports) String() string {
@@ -792,44 +2340,43 @@ func (p *ports) Set(value string) error {
 	return nil
 }
 
+// 'docker create': create a container without starting it. 'docker start'
+// starts it. Its address and ports are reserved right away, so that they can
+// be known before it starts.
+func (srv *Server) CmdCreate(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "create", "[OPTIONS] IMAGE COMMAND [ARG...]", "Create a new container, without starting it")
+	flags := newRunFlags(cmd)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	container, err := srv.createFromFlags(cmd.Args(), flags)
+	if err != nil {
+		return err
+	}
+	if err := container.Reserve(); err != nil {
+		srv.containers.Destroy(container)
+		return errors.New("Error reserving the network: " + err.Error())
+	}
+	fmt.Fprintln(stdout, container.Id)
+	return nil
+}
+
 func (srv *Server) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	cmd := rcli.Subcmd(stdout, "run", "[OPTIONS] IMAGE COMMAND [ARG...]", "Run a command in a new container")
-	fl_user := cmd.String("u", "", "Username or UID")
 	fl_attach := cmd.Bool("a", false, "Attach stdin and stdout")
-	fl_stdin := cmd.Bool("i", false, "Keep stdin open even if not attached")
-	fl_tty := cmd.Bool("t", false, "Allocate a pseudo-tty")
-	fl_comment := cmd.String("c", "", "Comment")
-	var fl_ports ports
-	cmd.Var(&fl_ports, "p", "Map a network port to the container")
+	flags := newRunFlags(cmd)
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	name := cmd.Arg(0)
-	var cmdline []string
-	if len(cmd.Args()) >= 2 {
-		cmdline = cmd.Args()[1:]
-	}
-	// Choose a default image if needed
-	if name == "" {
-		name = "base"
-	}
-	// Choose a default command if needed
-	if len(cmdline) == 0 {
-		*fl_stdin = true
-		*fl_tty = true
+	// The default command is an interactive shell
+	if cmd.NArg() < 2 {
 		*fl_attach = true
-		cmdline = []string{"/bin/bash", "-i"}
-	}
-	// Find the image
-	img := srv.images.Find(name)
-	if img == nil {
-		return errors.New("No such image: " + name)
 	}
-	// Create new container
-	container, err := srv.CreateContainer(img, fl_ports, *fl_user, *fl_tty, *fl_stdin, *fl_comment, cmdline[0], cmdline[1:]...)
+	container, err := srv.createFromFlags(cmd.Args(), flags)
 	if err != nil {
-		return errors.New("Error creating container: " + err.Error())
+		return err
 	}
+	fl_stdin := flags.stdin
 	if *fl_stdin {
 		cmd_stdin, err := container.StdinPipe()
 		if err != nil {
@@ -856,6 +2403,9 @@ func (srv *Server) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...string)
 		if err := container.Start(); err != nil {
 			return err
 		}
+		// If the client disconnects, the container keeps running detached
+		defer future.CloseOnCancel(cmd_stdout, rcli.Done(stdout))()
+		defer future.CloseOnCancel(cmd_stderr, rcli.Done(stdout))()
 		sending_stdout := future.Go(func() error {
 			_, err := io.Copy(stdout, cmd_stdout)
 			return err
@@ -872,33 +2422,421 @@ func (srv *Server) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...string)
 		if err_sending_stderr != nil {
 			return err_sending_stderr
 		}
-		container.Wait()
+		// The client exits with the exit code of the container
+		if status := container.Wait(); status != 0 {
+			return rcli.ExitStatus(status)
+		}
 	} else {
 		if err := container.Start(); err != nil {
 			return err
 		}
+		// Scripts capture the ID: nothing else may be printed on stdout
 		fmt.Fprintln(stdout, container.Id)
 	}
 	return nil
 }
 
-func New() (*Server, error) {
+// 'docker scale IMAGE N' runs N replicas of IMAGE, named NAME-1 to NAME-N,
+// creating and starting the missing replicas and removing the excess ones.
+func (srv *Server) CmdScale(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "scale", "[OPTIONS] IMAGE N [--] [COMMAND ARG...]", "Run N replicas of an image")
+	fl_name := cmd.String("name", "", "Name the replicas NAME-1 to NAME-N (default: the name of the image)")
+	flags := newRunFlags(cmd)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 2 {
+		cmd.Usage()
+		return nil
+	}
+	n, err := strconv.Atoi(cmd.Arg(1))
+	if err != nil || n < 0 {
+		return fmt.Errorf("Invalid number of replicas: %v", cmd.Arg(1))
+	}
+	if *flags.cidfile != "" {
+		return errors.New("-cidfile doesn't apply to replicas")
+	}
+	if *flags.macAddress != "" {
+		return errors.New("-mac-address doesn't apply to replicas: they can't share a MAC address")
+	}
+	for _, binding := range flags.publish.bindings {
+		if binding.HostPort != 0 {
+			return errors.New("-p with a host port doesn't apply to replicas: they can't share a port of the host")
+		}
+	}
+	cmdline := cmd.Args()[2:]
+	if len(cmdline) > 0 && cmdline[0] == "--" {
+		cmdline = cmdline[1:]
+	}
+	name := *fl_name
+	if name == "" {
+		img := srv.images.Find(cmd.Arg(0))
+		if img == nil {
+			return errors.New("No such image: " + cmd.Arg(0))
+		}
+		// IDs are NAME:HASH, with longer hashes than IdParts expects
+		imgName := img.Id
+		if i := strings.LastIndex(imgName, ":"); i >= 0 {
+			imgName = imgName[:i]
+		}
+		name = path.Base(imgName)
+	}
+	// The replicas are found by their labels, whatever their ID
+	replicas := make(map[int]*docker.Container)
+	for _, container := range srv.containers.List() {
+		if container.Label("scale") != name {
+			continue
+		}
+		if index, err := strconv.Atoi(container.Label("scale.index")); err == nil {
+			replicas[index] = container
+		}
+	}
+	// Scale down, from the last replica
+	var excess []int
+	for index := range replicas {
+		if index > n {
+			excess = append(excess, index)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(excess)))
+	for _, index := range excess {
+		if err := srv.containers.Destroy(replicas[index]); err != nil {
+			return err
+		}
+		delete(replicas, index)
+	}
+	// Scale up
+	for index := 1; index <= n; index++ {
+		container, exists := replicas[index]
+		if !exists {
+			container, err = srv.createFromFlags(append([]string{cmd.Arg(0)}, cmdline...), flags)
+			if err != nil {
+				return err
+			}
+			if err := srv.containers.Rename(container, fmt.Sprintf("%s-%d", name, index)); err != nil {
+				srv.containers.Destroy(container)
+				return err
+			}
+			if err := container.SetLabel("scale", name); err != nil {
+				return err
+			}
+			if err := container.SetLabel("scale.index", strconv.Itoa(index)); err != nil {
+				return err
+			}
+			replicas[index] = container
+		}
+		if !container.State.Running {
+			if err := container.Start(); err != nil {
+				return err
+			}
+		}
+	}
+	var scaled []*docker.Container
+	for index := 1; index <= n; index++ {
+		scaled = append(scaled, replicas[index])
+	}
+	printPortMappings(stdout, scaled)
+	return nil
+}
+
+// 'docker up' brings up the containers of the application described by the
+// manifest read on stdin, creating the missing ones.
+func (srv *Server) CmdUp(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "up", "[OPTIONS] < MANIFEST", "Bring up the containers of an application")
+	fl_name := cmd.String("name", "", "Name of the application (default: the name in the manifest)")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 0 {
+		cmd.Usage()
+		return nil
+	}
+	m, err := parseManifest(stdin)
+	if err != nil {
+		return err
+	}
+	if *fl_name != "" {
+		m.Name = *fl_name
+	}
+	if !validManifestName.MatchString(m.Name) {
+		return fmt.Errorf("Invalid application name: '%s' (set it in the manifest or with -name)", m.Name)
+	}
+	order, _ := m.order()
+	var containers []*docker.Container
+	started := make(map[string]*docker.Container)
+	for _, name := range order {
+		id := m.Name + "-" + name
+		container := srv.containers.Get(id)
+		if container != nil && container.Label("app") != m.Name {
+			return fmt.Errorf("Container %s already exists and is not part of %s", id, m.Name)
+		}
+		if container == nil {
+			spec := m.Containers[name]
+			config, _ := spec.config()
+			config.Labels["app"] = m.Name
+			config.Labels["app.container"] = name
+			config.Ulimits = Ulimits{}.merge(srv.options.DefaultUlimits)
+			for _, link := range spec.Links {
+				config.Env = append(config.Env, linkEnv(link, started[link])...)
+			}
+			for _, dependency := range spec.dependencies() {
+				config.DependsOn = append(config.DependsOn, m.Name+"-"+dependency)
+			}
+			img := srv.images.Find(spec.Image)
+			if img == nil {
+				return errors.New("No such image: " + spec.Image)
+			}
+			container, err = srv.CreateContainer(img, config, spec.Command[0], spec.Command[1:]...)
+			if err != nil {
+				return errors.New("Error creating container: " + err.Error())
+			}
+			if err := srv.containers.Rename(container, id); err != nil {
+				srv.containers.Destroy(container)
+				return err
+			}
+		}
+		if !container.State.Running {
+			if err := container.Start(); err != nil {
+				return err
+			}
+		}
+		started[name] = container
+		containers = append(containers, container)
+	}
+	printPortMappings(stdout, containers)
+	return nil
+}
+
+// 'docker down APP' removes the containers of the application APP, in the
+// reverse order of their creation.
+func (srv *Server) CmdDown(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "down", "APP", "Stop and remove the containers of an application")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	// List returns the most recent containers first
+	var containers []*docker.Container
+	for _, container := range srv.containers.List() {
+		if container.Label("app") == cmd.Arg(0) {
+			containers = append(containers, container)
+		}
+	}
+	if len(containers) == 0 {
+		return errors.New("No such application: " + cmd.Arg(0))
+	}
+	for _, container := range containers {
+		if err := srv.containers.Destroy(container); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printPortMappings prints the address and the port mappings of `containers`.
+func printPortMappings(stdout io.Writer, containers []*docker.Container) {
+	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "NAME\tIP ADDRESS\tPORTS\n")
+	for _, container := range containers {
+		var mappings []string
+		for private := range container.NetworkSettings.PortMapping {
+			public, _ := container.NetworkSettings.PublicPort(private)
+			mappings = append(mappings, public+"->"+private)
+		}
+		sort.Strings(mappings)
+		fmt.Fprintf(w, "%s\t%s\t%s\n", container.Id, container.NetworkSettings.IpAddress, strings.Join(mappings, ", "))
+	}
+	w.Flush()
+}
+
+// writeCidfile writes the container ID `id` to the file `filename`, which
+// must not exist. The file appears with its full content, or not at all.
+func writeCidfile(filename, id string) error {
+	if _, err := os.Lstat(filename); err == nil {
+		return errors.New("The cidfile already exists: " + filename)
+	}
+	f, err := ioutil.TempFile(path.Dir(filename), "."+path.Base(filename)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = fmt.Fprintln(f, id)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	// Unlike a rename, a link fails if somebody created the file meanwhile
+	if err := os.Link(f.Name(), filename); err != nil {
+		return fmt.Errorf("Unable to write the cidfile: %s", err)
+	}
+	return nil
+}
+
+// Options configure the behavior of the server
+type Options struct {
+	RequireSignatures bool                  // Refuse to pull images without a valid signature
+	Registry          string                // URL of the default registry for push and pull, if any
+	Proxy             *registry.ProxyConfig // Overrides the proxy settings of the environment
+	Debug             bool                  // Log the source location of messages
+	Timeouts          Timeouts              // Cancel the commands running for longer than their timeout
+	MaxHeavy          int                   // How many heavy commands (pull, push, commit, tar...) may run at once, if not 0
+	QueueHeavy        bool                  // Queue the heavy commands beyond MaxHeavy instead of rejecting them
+	DefaultUlimits    Ulimits               // Resource limits of the containers which don't set them
+	PortHooks         PortHooks             // Register the ports of the containers as they start and stop
+	PluginsDir        string                // Where to find the plugins running the commands which aren't built in
+	AuthzPlugins      AuthzPlugins          // Allow, deny or rewrite the commands before they run
+	LogCommands       bool                  // Log the commands as they run
+	UserlandProxy     bool                  // Publish the ports of the containers with proxies instead of NAT
+	DisableIcc        bool                  // Keep the containers of the default network, and by default of new networks, from talking to each other
+	DNS               Nameservers           // The nameservers of the containers, instead of those of the host
+	DNSSearch         SearchDomains         // The search domains of the containers, instead of those of the host
+	DNSOptions        ResolverOptions       // The resolver options of the containers, instead of those of the host
+	LogSpool          string                // Where to archive the logs of the containers removed on exit, if anywhere
+	Listen            string                // Where to listen for the other daemons and remote clients, as tcp://HOST[:PORT], if anywhere (requires TLS)
+	TLS               *TLSOptions           // The certificates of the remote listener and of the calls to the other daemons
+	CacheSize         int64                 // The size of the cache of the downloaded archives, if limited
+}
+
+func New(options *Options) (*Server, error) {
 	future.Seed()
-	images, err := image.New("/var/lib/docker/images")
+	lock, err := lockRoot(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	images, err := image.New(path.Join(rootPath, "images"))
+	if err != nil {
+		return nil, err
+	}
+	containers, err := docker.New(docker.NetworkOptions{
+		UserlandProxy: options.UserlandProxy,
+		DisableIcc:    options.DisableIcc,
+		DNS:           options.DNS,
+		DNSSearch:     options.DNSSearch,
+		DNSOptions:    options.DNSOptions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Keep images from being deleted from under the containers using them
+	images.InUse = containers.ImageUsers
+	// Settings left empty fall back to HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	proxy := options.Proxy.Resolve()
+	client := proxy.Client()
+	mirror, err := registry.NewMirror(registry.DefaultMirror)
 	if err != nil {
 		return nil, err
 	}
-	containers, err := docker.New()
+	mirror.Client = client
+	cache, err := registry.NewCache(path.Join(images.Root, "cache"), client)
+	if err != nil {
+		return nil, err
+	}
+	cache.MaxSize = options.CacheSize
+	cluster, err := loadCluster(path.Join(rootPath, "cluster.json"))
 	if err != nil {
 		return nil, err
 	}
 	srv := &Server{
 		images:     images,
 		containers: containers,
+		mirror:     mirror,
+		proxy:      proxy,
+		client:     client,
+		cache:      cache,
+		options:    options,
+		lock:       lock,
+		cluster:    cluster,
+	}
+	if options.TLS != nil {
+		if srv.tlsServer, srv.tlsClient, err = options.TLS.configs(); err != nil {
+			return nil, err
+		}
+	}
+	cluster.client = srv.tlsClient
+	if options.Listen != "" {
+		// The protocol has no other authentication than certificates
+		if srv.tlsServer == nil {
+			return nil, errors.New("Listening on " + options.Listen + " requires TLS: set -tlscacert, -tlscert and -tlskey")
+		}
+		if srv.remoteAddr, err = parseDaemonAddr(options.Listen); err != nil {
+			return nil, err
+		}
+	}
+	if options.MaxHeavy > 0 {
+		srv.heavy = make(chan struct{}, options.MaxHeavy)
+	}
+	if len(options.PortHooks) > 0 {
+		srv.runPortHooks()
+	}
+	if options.LogSpool != "" {
+		if err := os.MkdirAll(options.LogSpool, 0700); err != nil {
+			return nil, err
+		}
+	}
+	srv.runAutoRemove()
+	if options.LogCommands {
+		srv.Use(logCommands)
+	}
+	for _, plugin := range options.AuthzPlugins {
+		srv.Use(authzPlugin(plugin))
+	}
+	if options.Registry != "" {
+		if srv.registry, err = registry.NewBackend(options.Registry, client); err != nil {
+			return nil, err
+		}
 	}
 	return srv, nil
 }
 
+// MigrateStores upgrades the image store and the containers of the storage
+// root, see image.Migrate. No daemon may be using it meanwhile.
+func MigrateStores(options image.MigrateOptions) error {
+	lock, err := lockRoot(rootPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if _, err := image.Migrate(path.Join(rootPath, "images"), options); err != nil {
+		return err
+	}
+	_, err = docker.MigrateContainers(path.Join(rootPath, "containers"), options)
+	return err
+}
+
+// lockRoot makes sure no other daemon is using the storage root `root`, and
+// records our pid for the benefit of the next one. The lock is held for as
+// long as the returned file stays open.
+func lockRoot(root string) (*os.File, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	pidfile := path.Join(root, "docker.pid")
+	lock, err := future.TryFlock(pidfile)
+	if err != nil {
+		if pid, e := ioutil.ReadFile(pidfile); e == nil && len(pid) > 0 {
+			return nil, fmt.Errorf("Another docker daemon (pid %s) is already using %s", strings.TrimSpace(string(pid)), root)
+		}
+		return nil, fmt.Errorf("Unable to lock %s: %s", root, err)
+	}
+	if err := lock.Truncate(0); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(lock, "%d\n", os.Getpid()); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
 func (srv *Server) CmdMirror(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	_, err := io.Copy(stdout, stdin)
 	return err
@@ -927,18 +2865,31 @@ func (srv *Server) CmdWeb(stdin io.ReadCloser, stdout io.Writer, args ...string)
 		return nil
 	}
 	if *showurl {
-		fmt.Fprintln(stdout, "http://localhost:4242/web")
-	} else {
-		if file, err := os.Open("dockerweb.html"); err != nil {
-			return err
-		} else if _, err := io.Copy(stdout, file); err != nil {
-			return err
-		}
+		fmt.Fprintln(stdout, "http://"+httpAddr+"/web/")
+		return nil
 	}
-	return nil
+	index, err := webAssets.ReadFile("web/index.html")
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(index)
+	return err
 }
 
 type Server struct {
-	containers *docker.Docker
-	images     *image.Store
+	containers  *docker.Docker
+	images      *image.Store
+	mirror      *registry.Mirror
+	registry    registry.Backend
+	proxy       *registry.ProxyConfig
+	client      *http.Client
+	cache       *registry.Cache
+	heavy       chan struct{} // Slots of the heavy commands running, if limited
+	options     *Options
+	lock        *os.File
+	cluster     *cluster
+	middlewares []Middleware // Run before each command, see Use
+	remoteAddr  string       // The address of the remote listener, if any
+	tlsServer   *tls.Config  // The TLS settings of the remote listener
+	tlsClient   *tls.Config  // The TLS settings of the calls to the other daemons
 }
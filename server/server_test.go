@@ -0,0 +1,697 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/fake"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server with an empty image store and no
+// containers, and the directory to remove once done.
+func newTestServer(t *testing.T) (*Server, string) {
+	root, err := ioutil.TempDir("", "docker-test-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := image.New(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return &Server{options: &Options{}, images: images}, root
+}
+
+// withTestContainers gives `srv` a container store under `root`. Like the
+// tests of package docker, it needs the networking of the host.
+func withTestContainers(t *testing.T, srv *Server, root string) {
+	containers, err := docker.NewFromDirectory(path.Join(root, "docker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.containers = containers
+}
+
+// importTestImage imports a fake image `name` on top of `parent`, if any.
+func importTestImage(t *testing.T, srv *Server, name string, parent *image.Image) *image.Image {
+	archive, err := fake.FakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := srv.images.Import(name, archive, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// dispatch runs command `cmd` of `srv` as `name`, through the middlewares
+// and the limits, with `input` on stdin, and returns its output.
+func dispatch(srv *Server, name string, cmd rcli.Cmd, input string, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	err := srv.Dispatch(name, cmd)(ioutil.NopCloser(strings.NewReader(input)), &stdout, args...)
+	return stdout.String(), err
+}
+
+// callFramed runs the command `args` of `srv` as a client of the daemon
+// would, with version 2 of the protocol, so that its output isn't mixed with
+// its progress reports. It returns its output, its diagnostics and its exit
+// status.
+func callFramed(t *testing.T, srv *Server, args ...string) (string, string, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		rcli.Serve(conn, srv)
+		conn.Close()
+	}()
+	session, err := rcli.Dial("tcp", listener.Addr().String(), args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	session.CloseWrite()
+	var stdout, stderr bytes.Buffer
+	status, err := session.Receive(&stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), status
+}
+
+func TestHelpListsCommands(t *testing.T) {
+	srv := &Server{options: &Options{}}
+	help := srv.Help()
+	for _, name := range rcli.CommandNames(srv) {
+		if listed := strings.Contains(help, "\n    "+name+" "); listed == hiddenCommands[name] {
+			t.Errorf("%s: expected listed to be %v in:\n%s", name, !hiddenCommands[name], help)
+		}
+	}
+	if !strings.Contains(help, "\n    inspect     Return low-level information") {
+		t.Fatalf("Expected inspect to be listed with its summary in:\n%s", help)
+	}
+}
+
+func TestFetchSignature(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/signed.tar.asc":
+			w.Write([]byte("signature"))
+		case "/flaky.tar.asc":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	srv := &Server{options: &Options{}, client: http.DefaultClient}
+	fetch := func(name string) ([]byte, error) {
+		u, err := url.Parse(server.URL + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv.fetchSignature(u)
+	}
+	if signature, err := fetch("signed.tar"); err != nil || string(signature) != "signature" {
+		t.Fatalf("Unexpected signature %q (%v)", signature, err)
+	}
+	if signature, err := fetch("unsigned.tar"); err != nil || signature != nil {
+		t.Fatalf("Expected no signature, got %q (%v)", signature, err)
+	}
+	if _, err := fetch("flaky.tar"); err == nil || !strings.Contains(err.Error(), "try again") {
+		t.Fatalf("Expected an error worth retrying, got %v", err)
+	}
+	srv.options.RequireSignatures = true
+	if _, err := fetch("unsigned.tar"); err == nil || !strings.Contains(err.Error(), "Refusing unsigned image") {
+		t.Fatalf("Expected unsigned images to be refused, got %v", err)
+	}
+}
+
+func TestScale(t *testing.T) {
+	srv, root := newTestServer(t)
+	defer os.RemoveAll(root)
+	importTestImage(t, srv, "base", nil)
+	if output, err := dispatch(srv, "scale", srv.CmdScale, "", "base"); err != nil || !strings.Contains(output, "Usage: docker scale") {
+		t.Fatalf("Expected the usage, got %q (%v)", output, err)
+	}
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"base", "many"}, "Invalid number of replicas: many"},
+		{[]string{"base", "-1"}, "Invalid number of replicas: -1"},
+		{[]string{"-cidfile", "/tmp/cid", "base", "2"}, "-cidfile doesn't apply to replicas"},
+		{[]string{"-mac-address", "02:42:ac:11:00:02", "base", "2"}, "-mac-address doesn't apply to replicas"},
+		{[]string{"-p", "8080:80", "base", "2"}, "-p with a host port doesn't apply to replicas"},
+		{[]string{"missing", "2"}, "No such image: missing"},
+	} {
+		if _, err := dispatch(srv, "scale", srv.CmdScale, "", test.args...); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected error '%s', got %v", test.args, test.expected, err)
+		}
+	}
+}
+
+func TestScaleToZero(t *testing.T) {
+	srv, root := newTestServer(t)
+	defer os.RemoveAll(root)
+	img := importTestImage(t, srv, "base", nil)
+	withTestContainers(t, srv, root)
+	other, err := srv.CreateContainer(img, &docker.Config{}, "ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replicas created by an earlier 'docker scale base 2'
+	for index := 1; index <= 2; index++ {
+		replica, err := srv.CreateContainer(img, &docker.Config{Labels: map[string]string{"scale": "base", "scale.index": strconv.Itoa(index)}}, "ls")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.containers.Rename(replica, fmt.Sprintf("base-%d", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output, err := dispatch(srv, "scale", srv.CmdScale, "", "base", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(output), "\n"); len(lines) != 1 || strings.Join(strings.Fields(lines[0]), " ") != "NAME IP ADDRESS PORTS" {
+		t.Fatalf("Expected an empty table of replicas, got %q", output)
+	}
+	if srv.containers.Get("base-1") != nil || srv.containers.Get("base-2") != nil {
+		t.Fatalf("The replicas should have been removed")
+	}
+	if srv.containers.Get(other.Id) == nil {
+		t.Fatalf("Only the replicas should be removed")
+	}
+}
+
+func TestUp(t *testing.T) {
+	srv, root := newTestServer(t)
+	defer os.RemoveAll(root)
+	if output, err := dispatch(srv, "up", srv.CmdUp, "", "blog"); err != nil || !strings.Contains(output, "Usage: docker up") {
+		t.Fatalf("Expected the usage, got %q (%v)", output, err)
+	}
+	for _, test := range []struct {
+		manifest string
+		expected string
+	}{
+		{`{"Name": "blog"`, "Invalid manifest"},
+		{`{"Name": "blog"}`, "Invalid manifest: no containers"},
+		{`{"Name": "my blog", "Containers": {"web": {"Image": "blog", "Command": ["run"]}}}`, "Invalid application name in the manifest: my blog"},
+		{`{"Containers": {"web": {"Image": "blog", "Command": ["run"]}}}`, "Invalid application name: ''"},
+		{`{"Name": "blog", "Containers": {"web": {"Image": "blog"}}}`, "Container web: an image and a command are required"},
+		{`{"Name": "blog", "Containers": {"web": {"Image": "blog", "Command": ["run"], "Links": ["db"]}}}`, "Container web: depends on unknown container db"},
+		{`{"Name": "blog", "Containers": {
+			"a": {"Image": "blog", "Command": ["run"], "DependsOn": ["b"]},
+			"b": {"Image": "blog", "Command": ["run"], "Links": ["a"]}
+		}}`, "Dependency cycle in the manifest: a -> b -> a"},
+	} {
+		if _, err := dispatch(srv, "up", srv.CmdUp, test.manifest); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected error '%s', got %v", test.manifest, test.expected, err)
+		}
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	srv, root := newTestServer(t)
+	defer os.RemoveAll(root)
+	img := importTestImage(t, srv, "base", nil)
+	withTestContainers(t, srv, root)
+	if _, err := dispatch(srv, "up", srv.CmdUp, `{"Name": "blog", "Containers": {"web": {"Image": "missing", "Command": ["run"]}}}`); err == nil || err.Error() != "No such image: missing" {
+		t.Fatalf("Expected a missing image to be reported, got %v", err)
+	}
+	other, err := srv.CreateContainer(img, &docker.Config{}, "ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.containers.Rename(other, "blog-db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dispatch(srv, "up", srv.CmdUp, `{"Name": "blog", "Containers": {"db": {"Image": "base", "Command": ["run"]}}}`); err == nil || err.Error() != "Container blog-db already exists and is not part of blog" {
+		t.Fatalf("Expected the other container to be left alone, got %v", err)
+	}
+
+	if output, err := dispatch(srv, "down", srv.CmdDown, ""); err != nil || !strings.Contains(output, "Usage: docker down") {
+		t.Fatalf("Expected the usage, got %q (%v)", output, err)
+	}
+	if _, err := dispatch(srv, "down", srv.CmdDown, "", "blog"); err == nil || err.Error() != "No such application: blog" {
+		t.Fatalf("Expected an unknown application to be reported, got %v", err)
+	}
+	// The containers of an application brought up earlier
+	for _, name := range []string{"web", "cache"} {
+		container, err := srv.CreateContainer(img, &docker.Config{Labels: map[string]string{"app": "shop", "app.container": name}}, "ls")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.containers.Rename(container, "shop-"+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if output, err := dispatch(srv, "down", srv.CmdDown, "", "shop"); err != nil || output != "" {
+		t.Fatalf("Expected no output, got %q (%v)", output, err)
+	}
+	if srv.containers.Get("shop-web") != nil || srv.containers.Get("shop-cache") != nil {
+		t.Fatalf("The containers of the application should have been removed")
+	}
+	if srv.containers.Get("blog-db") == nil {
+		t.Fatalf("Only the containers of the application should be removed")
+	}
+}
+
+// testNode is a remote daemon of a cluster, with a container and an image.
+type testNode struct{}
+
+func (testNode) Name() string { return "node" }
+func (testNode) Help() string { return "node\n" }
+
+func (testNode) CmdVersion(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	_, err := io.WriteString(stdout, "Version: test\n")
+	return err
+}
+
+func (testNode) CmdInfo(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	return writeJSON(stdout, &jsonInfo{Containers: 3, Running: 1, MemAvailable: 512 * 1000 * 1000})
+}
+
+func (testNode) CmdPs(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	return writeJSON(stdout, []*jsonContainer{{Id: "c0ffee", Image: "base:1234", Command: "sleep 60", Created: time.Now(), Status: "Up 1 minute"}})
+}
+
+func (testNode) CmdImages(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	return writeJSON(stdout, []*jsonImage{{Name: "base", Tag: "1234", Id: "base:1234", Created: time.Now()}})
+}
+
+func (testNode) CmdInspect(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	if len(args) != 1 || args[0] != "base" {
+		return errors.New("No such image")
+	}
+	_, err := io.WriteString(stdout, "{}\n")
+	return err
+}
+
+func (testNode) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	_, err := io.WriteString(stdout, "facade\n")
+	return err
+}
+
+// listenTestNode serves `node` over TLS on the loopback interface, and
+// returns its address and the TLS settings of its clients.
+func listenTestNode(t *testing.T, node rcli.Service) (net.Listener, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				rcli.Serve(conn, node)
+				conn.Close()
+			}()
+		}
+	}()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return listener, &tls.Config{RootCAs: roots}
+}
+
+func TestCluster(t *testing.T) {
+	srv, root := newTestServer(t)
+	defer os.RemoveAll(root)
+	srv.cluster = &cluster{path: path.Join(root, "cluster.json")}
+	if output, err := dispatch(srv, "cluster", srv.CmdCluster, ""); err != nil || !strings.Contains(output, "Usage: docker cluster") {
+		t.Fatalf("Expected the usage, got %q (%v)", output, err)
+	}
+	if _, err := dispatch(srv, "cluster", srv.CmdCluster, "", "join"); err == nil || err.Error() != "No such cluster command: join" {
+		t.Fatalf("Expected an unknown command to be reported, got %v", err)
+	}
+	if _, err := dispatch(srv, "cluster", srv.CmdCluster, "", "add", "http://example.com"); err == nil || !strings.Contains(err.Error(), "Invalid daemon address") {
+		t.Fatalf("Expected an invalid address to be reported, got %v", err)
+	}
+	listener, client := listenTestNode(t, testNode{})
+	defer listener.Close()
+	addr := listener.Addr().String()
+	if _, err := dispatch(srv, "cluster", srv.CmdCluster, "", "add", "tcp://"+addr); err == nil || !strings.Contains(err.Error(), "requires certificates") {
+		t.Fatalf("Expected the daemon to be unreachable without certificates, got %v", err)
+	}
+	srv.tlsClient, srv.cluster.client = client, client
+	if _, err := dispatch(srv, "cluster", srv.CmdCluster, "", "add", "tcp://"+addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dispatch(srv, "cluster", srv.CmdCluster, "", "add", "tcp://"+addr); err == nil || err.Error() != addr+" is already in the cluster" {
+		t.Fatalf("Expected the node to be added only once, got %v", err)
+	}
+	if saved, err := loadCluster(srv.cluster.path); err != nil || len(saved.Nodes) != 1 || saved.Nodes[0] != addr {
+		t.Fatalf("The node wasn't saved: %v (%v)", saved, err)
+	}
+
+	// The local daemon doesn't run: only the node answers
+	row := func(output, prefix string) string {
+		for _, line := range strings.Split(output, "\n") {
+			if strings.HasPrefix(line, prefix) {
+				return strings.Join(strings.Fields(line), " ")
+			}
+		}
+		return ""
+	}
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"ls"}, addr + " 3 1 512.0 MB Up"},
+		{[]string{"ps"}, addr + " c0ffee base:1234 sleep 60"},
+		{[]string{"images"}, addr + " base 1234 base:1234"},
+	} {
+		output, err := dispatch(srv, "cluster", srv.CmdCluster, "", test.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := row(output, addr); !strings.HasPrefix(r, test.expected) {
+			t.Errorf("%v: expected a row '%s...', got %q", test.args, test.expected, output)
+		}
+	}
+
+	if output, err := dispatch(srv, "cluster", srv.CmdCluster, "", "run", "base"); err != nil || !strings.Contains(output, "Usage: docker cluster run") {
+		t.Fatalf("Expected the usage, got %q (%v)", output, err)
+	}
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"run", "-i", "base", "sh"}, "'cluster run' can't attach to containers"},
+		{[]string{"run", "-cidfile", "/tmp/cid", "base", "ls"}, "-cidfile doesn't apply to 'cluster run'"},
+		{[]string{"run", "-m", "1g", "base", "ls"}, "No node of the cluster has image base and 1.1 GB of memory available"},
+		{[]string{"run", "missing", "ls"}, "No node of the cluster has image missing"},
+	} {
+		if _, err := dispatch(srv, "cluster", srv.CmdCluster, "", test.args...); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%v: expected error '%s', got %v", test.args, test.expected, err)
+		}
+	}
+	if output, err := dispatch(srv, "cluster", srv.CmdCluster, "", "run", "base", "ls"); err != nil || !strings.Contains(output, "Running on "+addr+"\nfacade\n") {
+		t.Fatalf("Expected the container to run on the node, got %q (%v)", output, err)
+	}
+
+	if _, err := dispatch(srv, "cluster", srv.CmdCluster, "", "rm", "tcp://"+addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dispatch(srv, "cluster", srv.CmdCluster, "", "rm", "tcp://"+addr); err == nil || err.Error() != addr+" is not in the cluster" {
+		t.Fatalf("Expected the node to be removed, got %v", err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	srv, root := newTestServer(t)
+	defer os.RemoveAll(root)
+	defer func(saved string) { rootPath = saved }(rootPath)
+	rootPath = root
+	img := importTestImage(t, srv, "base", nil)
+	withTestContainers(t, srv, root)
+	if output, err := dispatch(srv, "backup", srv.CmdBackup, "", "now"); err != nil || !strings.Contains(output, "Usage: docker backup") {
+		t.Fatalf("Expected the usage, got %q (%v)", output, err)
+	}
+	volume := path.Join(root, "volume")
+	if err := os.Mkdir(volume, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(volume, "data"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	container, err := srv.CreateContainer(img, &docker.Config{Volumes: []*docker.Volume{{PathOnHost: volume, PathInContainer: "/data"}}}, "ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(container.Filesystem.RWPath, "changed"), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries := func(archive string) []string {
+		var names []string
+		tr := tar.NewReader(strings.NewReader(archive))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return names
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+		}
+	}
+	expected := []string{
+		"backup.json",
+		"images/index.json",
+		"layers/" + path.Base(img.Layers[0]) + ".tar",
+		"containers/" + container.Id + "/config.json",
+		"containers/" + container.Id + "/rw.tar",
+		"volumes/0.tar",
+	}
+	archive, progress, status := callFramed(t, srv, "backup")
+	if status != 0 {
+		t.Fatalf("The backup failed: %s", progress)
+	}
+	if names := entries(archive); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected the entries %v, got %v", expected, names)
+	}
+	if !strings.Contains(progress, "Backing up container "+container.Id) {
+		t.Fatalf("Expected the progress of the backup, got %q", progress)
+	}
+	if output, progress, status := callFramed(t, srv, "backup", "-volumes=false"); status != 0 {
+		t.Fatalf("The backup failed: %s", progress)
+	} else if names := entries(output); !reflect.DeepEqual(names, expected[:len(expected)-1]) {
+		t.Fatalf("Expected the entries %v, got %v", expected[:len(expected)-1], names)
+	}
+
+	// Restored on a fresh host, without the volumes
+	rootPath = path.Join(root, "restored")
+	if err := RestoreBackup(strings.NewReader(archive), false, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{
+		"images/index.json",
+		"images/layers/" + path.Base(img.Layers[0]),
+		"containers/" + container.Id + "/config.json",
+		"containers/" + container.Id + "/rw/changed",
+	} {
+		if _, err := os.Stat(path.Join(rootPath, file)); err != nil {
+			t.Errorf("%s wasn't restored: %v", file, err)
+		}
+	}
+	if err := RestoreBackup(strings.NewReader(archive), false, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "already has images") {
+		t.Fatalf("Expected a host with images to be refused, got %v", err)
+	}
+}
+
+func TestPsFilters(t *testing.T) {
+	srv, root := newTestServer(t)
+	defer os.RemoveAll(root)
+	if output, err := dispatch(srv, "ps", srv.CmdPs, "", "-filter", "status"); err != nil || !strings.Contains(output, "Invalid filter: status (expected KEY=VALUE)") {
+		t.Fatalf("Expected the usage, got %q (%v)", output, err)
+	}
+	if _, err := dispatch(srv, "ps", srv.CmdPs, "", "-filter", "color=red"); err == nil || !strings.HasPrefix(err.Error(), "Invalid filter 'color'") {
+		t.Fatalf("Expected an unknown filter to be reported, got %v", err)
+	}
+	if _, err := dispatch(srv, "ps", srv.CmdPs, "", "-filter", "status=paused"); err == nil || err.Error() != "Invalid status 'paused' (expected running or stopped)" {
+		t.Fatalf("Expected an invalid status to be reported, got %v", err)
+	}
+
+	base := importTestImage(t, srv, "base", nil)
+	other := importTestImage(t, srv, "other", nil)
+	withTestContainers(t, srv, root)
+	if _, err := dispatch(srv, "ps", srv.CmdPs, "", "-filter", "before=yesterday"); err == nil || err.Error() != "No such container, and invalid date: yesterday" {
+		t.Fatalf("Expected an invalid date to be reported, got %v", err)
+	}
+	var ids []string
+	for _, test := range []struct {
+		img    *image.Image
+		labels map[string]string
+	}{
+		{base, map[string]string{"tier": "web"}},
+		{base, map[string]string{"tier": "db"}},
+		{other, map[string]string{"tier": "web"}},
+	} {
+		container, err := srv.CreateContainer(test.img, &docker.Config{Labels: test.labels}, "ls")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, container.Id)
+	}
+	f := func(filters ...string) []string {
+		var args []string
+		for _, filter := range filters {
+			args = append(args, "-filter", filter)
+		}
+		return args
+	}
+	for _, test := range []struct {
+		args     []string
+		expected []string
+	}{
+		{nil, nil}, // Only the running containers by default
+		{f("status=running"), nil},
+		{f("status=stopped"), ids},
+		{f("status=stopped", "label=tier=web"), []string{ids[0], ids[2]}},
+		{f("status=stopped", "image=base"), ids[:2]},
+		{f("status=stopped", "image=base", "label=tier=web"), ids[:1]},
+		{f("status=stopped", "id="+ids[1][:12]), ids[1:2]},
+		{f("since=" + ids[0]), nil},
+		{append(f("since="+ids[0]), "-a"), ids[1:]},
+		{append(f("before="+ids[2]), "-a"), ids[:2]},
+		{append(f("since="+ids[0], "before="+ids[2]), "-a"), ids[1:2]},
+		{[]string{"-since", ids[0]}, ids[1:]}, // Same as -filter since=ID -a
+	} {
+		args := append([]string{"-q", "-notrunc"}, test.args...)
+		output, err := dispatch(srv, "ps", srv.CmdPs, "", args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := strings.Fields(output)
+		sort.Strings(listed)
+		expected := append([]string{}, test.expected...)
+		sort.Strings(expected)
+		if strings.Join(listed, " ") != strings.Join(expected, " ") {
+			t.Errorf("%v: expected %v, got %v", test.args, expected, listed)
+		}
+	}
+}
+
+func TestImagesFilters(t *testing.T) {
+	srv, root := newTestServer(t)
+	defer os.RemoveAll(root)
+	// Each version has a layer of its own
+	importTag := func(name, tag string, parent *image.Image) *image.Image {
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		content := name + ":" + tag
+		if err := tw.WriteHeader(&tar.Header{Name: "version", Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, content)
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		img, err := srv.images.ImportTag(name, tag, &archive, parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	old := importTag("base", "1.0", nil) // Dangling once replaced
+	base := importTag("base", "1.1", nil)
+	web := importTag("sendhub/web", "2.0", base)
+	if err := srv.images.Index.SetLabels(web.Id, map[string]string{"tier": "web"}); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := dispatch(srv, "images", srv.CmdImages, "", "base", "web"); err != nil || !strings.Contains(output, "Usage: docker images") {
+		t.Fatalf("Expected the usage, got %q (%v)", output, err)
+	}
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"-filter", "color=red"}, "Invalid filter 'color'"},
+		{[]string{"-filter", "dangling=maybe"}, "Invalid dangling filter 'maybe' (expected true or false)"},
+		{[]string{"-filter", "parent=missing"}, "No such image: missing"},
+		{[]string{"-filter", "since=yesterday"}, "No such image, and invalid date: yesterday"},
+	} {
+		if _, err := dispatch(srv, "images", srv.CmdImages, "", test.args...); err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+			t.Errorf("%v: expected error '%s', got %v", test.args, test.expected, err)
+		}
+	}
+	ids := func(images ...*image.Image) []string {
+		var ids []string
+		for _, img := range images {
+			ids = append(ids, img.Id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	for _, test := range []struct {
+		args     []string
+		expected []string
+	}{
+		{nil, ids(old, base, web)},
+		{[]string{"base"}, ids(old, base)},
+		{[]string{"base:1.*"}, ids(old, base)},
+		{[]string{"base:1.1"}, ids(base)},
+		{[]string{"sendhub/"}, ids(web)},
+		{[]string{"send*/w?b"}, ids(web)},
+		{[]string{"*:2.*"}, nil}, // Wildcards don't cross namespaces
+		{[]string{"*/*:2.*"}, ids(web)},
+		{[]string{"-filter", "dangling=true"}, ids(old)},
+		{[]string{"-filter", "dangling=false"}, ids(base, web)},
+		{[]string{"-filter", "label=tier=web"}, ids(web)},
+		{[]string{"-filter", "label=tier=db"}, nil},
+		{[]string{"-filter", "parent=" + base.Id}, ids(web)},
+		{[]string{"-filter", "since=" + old.Id}, ids(base, web)},
+		{[]string{"-filter", "before=" + web.Id}, ids(old, base)},
+		{[]string{"-filter", "since=" + old.Id, "base"}, ids(base)},
+	} {
+		output, err := dispatch(srv, "images", srv.CmdImages, "", append([]string{"-q"}, test.args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := strings.Fields(output)
+		sort.Strings(listed)
+		if strings.Join(listed, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("%v: expected %v, got %v", test.args, test.expected, listed)
+		}
+	}
+}
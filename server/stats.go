@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/future"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// runningStats returns the network counters of the running containers of
+// `names`, or of all the running containers.
+func (srv *Server) runningStats(names []string) ([]*jsonStats, error) {
+	var containers []*docker.Container
+	if len(names) == 0 {
+		for _, container := range srv.containers.List() {
+			if container.State.Running {
+				containers = append(containers, container)
+			}
+		}
+	}
+	for _, name := range names {
+		container := srv.containers.Get(name)
+		if container == nil {
+			return nil, fmt.Errorf("No such container: %s", name)
+		}
+		containers = append(containers, container)
+	}
+	var stats []*jsonStats
+	for _, container := range containers {
+		network, err := container.NetworkStats()
+		if err != nil {
+			// The containers listed by default may stop meanwhile
+			if len(names) == 0 {
+				continue
+			}
+			return nil, err
+		}
+		stats = append(stats, &jsonStats{Container: container.Id, Labels: container.Config.Labels, NetworkStats: network})
+	}
+	return stats, nil
+}
+
+// 'docker stats': the network usage of the running containers since they
+// started.
+func (srv *Server) CmdStats(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "stats", "[OPTIONS] [CONTAINER...]", "Display the network usage of running containers since they started")
+	fl_json := cmd.Bool("json", false, "Output a JSON array")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	stats, err := srv.runningStats(cmd.Args())
+	if err != nil {
+		return err
+	}
+	if *fl_json {
+		return writeJSON(stdout, stats)
+	}
+	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "CONTAINER\tNET RX\tNET TX\tRX PACKETS\tTX PACKETS\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", s.Container,
+			future.HumanSize(int64(s.RxBytes)), future.HumanSize(int64(s.TxBytes)), s.RxPackets, s.TxPackets)
+	}
+	w.Flush()
+	return nil
+}
+
+// 'docker metrics': the counters of the running containers in the text
+// format of Prometheus, which scrapes them from http://HOST:8080/metrics.
+func (srv *Server) CmdMetrics(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "metrics", "", "Output the metrics of the running containers for Prometheus")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	stats, err := srv.runningStats(nil)
+	if err != nil {
+		return err
+	}
+	for _, metric := range []struct {
+		name, help string
+		value      func(*docker.NetworkStats) uint64
+	}{
+		{"docker_container_network_receive_bytes_total", "Bytes received by the container since it started",
+			func(s *docker.NetworkStats) uint64 { return s.RxBytes }},
+		{"docker_container_network_receive_packets_total", "Packets received by the container since it started",
+			func(s *docker.NetworkStats) uint64 { return s.RxPackets }},
+		{"docker_container_network_transmit_bytes_total", "Bytes sent by the container since it started",
+			func(s *docker.NetworkStats) uint64 { return s.TxBytes }},
+		{"docker_container_network_transmit_packets_total", "Packets sent by the container since it started",
+			func(s *docker.NetworkStats) uint64 { return s.TxPackets }},
+	} {
+		fmt.Fprintf(stdout, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+		for _, s := range stats {
+			fmt.Fprintf(stdout, "%s{container=%s} %d\n", metric.name, prometheusQuote(s.Container), metric.value(s.NetworkStats))
+		}
+	}
+	return nil
+}
+
+// prometheusQuote quotes a label value of a metric.
+func prometheusQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"embed"
+	"github.com/dotcloud/docker/rcli"
+	"io/fs"
+	"net/http"
+)
+
+// The web UI is embedded in the binary, and served by the HTTP listener at
+// /web/. Its pages run the commands through the HTTP API.
+//
+//go:embed web
+var webAssets embed.FS
+
+// httpHandler returns the handler of the HTTP listener: the web UI at /web/,
+// the WebSockets streaming the containers at /ws/, and the commands
+// everywhere else.
+func (srv *Server) httpHandler() http.Handler {
+	assets, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/web", http.RedirectHandler("/web/", http.StatusMovedPermanently))
+	mux.Handle("/web/", http.StripPrefix("/web/", http.FileServer(http.FS(assets))))
+	mux.Handle("/ws/attach/", srv.serveWebSocket("attach", wsAttachOptions))
+	mux.Handle("/ws/logs/", srv.serveWebSocket("logs", wsLogsOptions))
+	mux.Handle("/", rcli.HTTPHandler(srv))
+	return mux
+}
@@ -0,0 +1,157 @@
+// The web UI of docker, backed by the commands of the HTTP API: each command
+// is called as /COMMAND?q=ARG&q=ARG..., and the lists use their -json output.
+// The logs are streamed by the WebSocket at /ws/logs/CONTAINER.
+
+// How often the lists are refreshed, in milliseconds
+var refreshInterval = 3000;
+
+// call runs `command` with `args` and returns its output. The HTTP API
+// reports errors in the output, after what the command printed.
+function call(command, args) {
+    var query = (args || []).map(function(arg) { return "q=" + encodeURIComponent(arg); }).join("&");
+    return fetch("/" + command + "?" + query, {method: "POST"}).then(function(response) {
+        return response.text();
+    }).then(function(output) {
+        var error = output.match(/(^|\n)Error: (.*)\n?$/);
+        if (error) {
+            throw new Error(error[2]);
+        }
+        return output;
+    });
+}
+
+function callJSON(command, args) {
+    return call(command, args).then(function(output) {
+        return JSON.parse(output) || [];
+    });
+}
+
+function showError(err) {
+    document.getElementById("error").textContent = err ? err.message : "";
+}
+
+function ago(date) {
+    var seconds = Math.max(0, (Date.now() - new Date(date).getTime()) / 1000);
+    var units = [["day", 86400], ["hour", 3600], ["minute", 60], ["second", 1]];
+    for (var i = 0; i < units.length; i++) {
+        var n = Math.floor(seconds / units[i][1]);
+        if (n > 0) {
+            return n + " " + units[i][0] + (n > 1 ? "s" : "") + " ago";
+        }
+    }
+    return "just now";
+}
+
+function cell(row, text, className) {
+    var td = row.insertCell();
+    td.textContent = text;
+    if (className) {
+        td.className = className;
+    }
+    return td;
+}
+
+function button(td, label, action) {
+    var b = document.createElement("button");
+    b.textContent = label;
+    b.onclick = function() {
+        b.disabled = true;
+        action().then(refresh).catch(showError).then(function() { b.disabled = false; });
+    };
+    td.appendChild(b);
+}
+
+// The WebSocket streaming the logs being shown
+var logsSocket = null;
+
+function closeLogs() {
+    if (logsSocket) {
+        logsSocket.close();
+        logsSocket = null;
+    }
+    document.getElementById("logs").hidden = true;
+}
+
+// showLogs shows the logs of the container, and follows its output while it
+// runs. The output comes in binary messages, after the byte of its stream.
+function showLogs(id) {
+    closeLogs();
+    var logs = document.getElementById("logs");
+    var pre = logs.querySelector("pre");
+    var decoder = new TextDecoder();
+    document.getElementById("logs-container").textContent = id;
+    pre.textContent = "";
+    logs.hidden = false;
+    var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+    var socket = new WebSocket(scheme + location.host + "/ws/logs/" + encodeURIComponent(id) + "?follow=1");
+    socket.binaryType = "arraybuffer";
+    socket.onmessage = function(event) {
+        if (typeof event.data === "string") {
+            var control = JSON.parse(event.data);
+            if (control.Type === "exit") {
+                pre.textContent += "\n[exited with status " + control.Status + "]\n";
+            } else if (control.Type === "error") {
+                showError(new Error(control.Message));
+            }
+            return;
+        }
+        pre.textContent += decoder.decode(new Uint8Array(event.data, 1), {stream: true});
+        pre.scrollTop = pre.scrollHeight;
+    };
+    socket.onerror = function() {
+        showError(new Error("Failed to stream the logs of " + id));
+    };
+    logsSocket = socket;
+    return Promise.resolve();
+}
+
+function renderContainers(containers) {
+    var body = document.querySelector("#containers tbody");
+    body.innerHTML = "";
+    containers.forEach(function(c) {
+        var row = body.insertRow();
+        // The short ID, as docker ps displays it
+        cell(row, c.Id.substring(0, 12), "id").title = c.Id;
+        cell(row, c.Image);
+        cell(row, c.Command, "command");
+        cell(row, ago(c.Created));
+        cell(row, c.Status);
+        var actions = row.insertCell();
+        if (c.Running) {
+            button(actions, "Stop", function() { return call("stop", [c.Id]); });
+        } else {
+            button(actions, "Start", function() { return call("start", [c.Id]); });
+        }
+        button(actions, "Logs", function() { return showLogs(c.Id); });
+    });
+}
+
+function renderImages(images) {
+    var body = document.querySelector("#images tbody");
+    body.innerHTML = "";
+    images.forEach(function(img) {
+        var row = body.insertRow();
+        cell(row, img.Name);
+        cell(row, img.Tag);
+        cell(row, img.Id, "id");
+        cell(row, ago(img.Created));
+    });
+}
+
+function refresh() {
+    var psArgs = ["-json"];
+    if (document.getElementById("all").checked) {
+        psArgs.push("-a");
+    }
+    return Promise.all([
+        callJSON("ps", psArgs).then(renderContainers),
+        callJSON("images", ["-json"]).then(renderImages)
+    ]).then(function() { showError(null); }, showError);
+}
+
+document.addEventListener("DOMContentLoaded", function() {
+    document.getElementById("all").onchange = refresh;
+    document.getElementById("logs-close").onclick = closeLogs;
+    refresh();
+    setInterval(refresh, refreshInterval);
+});
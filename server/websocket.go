@@ -0,0 +1,309 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The HTTP listener serves WebSockets streaming the containers, for the web UI
+// and the other clients running in browsers:
+//
+//	/ws/attach/CONTAINER?stdin=1&stdout=1&stderr=1&logs=0
+//	/ws/logs/CONTAINER?follow=0
+//
+// The output of the container is sent in binary messages, whose first byte is
+// the stream it comes from: 1 for stdout and 2 for stderr, like the frames of
+// rcli. Binary messages sent by the client are written to the stdin of the
+// container. Control messages are JSON text messages:
+//
+//	{"Type": "resize", "Height": 24, "Width": 80}  Resizes the tty of the container
+//	{"Type": "close"}                              Closes the stdin of the container
+//	{"Type": "exit", "Status": 0}                  Sent when the container exits
+//	{"Type": "error", "Status": 125, "Message": "..."}
+//
+// Disconnecting leaves the stdin of the container open, so that it can be
+// attached again.
+
+type wsControl struct {
+	Type    string
+	Height  int `json:",omitempty"`
+	Width   int `json:",omitempty"`
+	Status  int
+	Message string `json:",omitempty"`
+}
+
+func writeControl(ws *rcli.WebSocket, control *wsControl) error {
+	data, err := json.Marshal(control)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(rcli.WebSocketText, data)
+}
+
+// wsStream writes the output stream `kind` of a container to a WebSocket.
+type wsStream struct {
+	ws   *rcli.WebSocket
+	kind byte
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	if err := s.ws.WriteMessage(rcli.WebSocketBinary, append([]byte{s.kind}, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// wsOptions are the streams of a container sent to a WebSocket.
+type wsOptions struct {
+	stdin, stdout, stderr bool
+	logs                  bool // Send the logs of the container first
+	follow                bool // Stream the output as the container runs
+}
+
+// queryBool returns the boolean parameter `name` of `query`, or `value`.
+func queryBool(query url.Values, name string, value bool) bool {
+	if b, err := strconv.ParseBool(query.Get(name)); err == nil {
+		return b
+	}
+	return value
+}
+
+// serveWebSocket returns the handler streaming the container named by the
+// last element of the path, with the options which `options` reads from the
+// query. The stream runs as command `name`, attach or logs, with the
+// arguments of its command line: like the other commands, the middlewares
+// may deny it or rewrite its arguments, and it ends when it times out.
+func (srv *Server) serveWebSocket(name string, options func(query url.Values) wsOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opts := options(r.URL.Query())
+		// The command may go on running after it timed out: it may only
+		// use the response until the handler returns
+		var lock sync.Mutex
+		var ws *rcli.WebSocket
+		finished := false
+		stream := func(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+			opts, name, err := opts.parseArgs(name, args)
+			if err != nil {
+				return err
+			}
+			container := srv.containers.Get(name)
+			lock.Lock()
+			if finished {
+				lock.Unlock()
+				return nil
+			}
+			if container == nil {
+				http.Error(w, "No such container: "+name, http.StatusNotFound)
+				finished = true
+			} else if ws, err = rcli.UpgradeWebSocket(w, r); err != nil {
+				log.Printf("WebSocket %v: %v", r.URL.Path, err)
+				finished = true
+			}
+			lock.Unlock()
+			if ws == nil {
+				return nil
+			}
+			// Disconnect the client if the command is cancelled
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				select {
+				case <-rcli.Done(stdout):
+					ws.Close()
+				case <-stop:
+				}
+			}()
+			return streamWebSocket(ws, container, opts)
+		}
+		err := srv.Dispatch(name, stream)(ioutil.NopCloser(strings.NewReader("")), ioutil.Discard, opts.args(name, path.Base(r.URL.Path))...)
+		lock.Lock()
+		defer lock.Unlock()
+		if ws == nil {
+			if err != nil && !finished {
+				http.Error(w, err.Error(), http.StatusForbidden)
+			}
+			finished = true
+			return
+		}
+		if err != nil {
+			writeControl(ws, &wsControl{Type: "error", Status: rcli.StatusError, Message: err.Error()})
+		}
+		ws.Close()
+	})
+}
+
+// args returns the command line of command `name` streaming container `id`
+// with the options, as seen by the middlewares.
+func (options wsOptions) args(name, id string) []string {
+	var args []string
+	if name == "attach" {
+		// The stdin of the container stays open when the client disconnects
+		if options.stdin {
+			args = append(args, "-i", "-keep-stdin")
+		}
+		args = append(args, "-o="+strconv.FormatBool(options.stdout), "-e="+strconv.FormatBool(options.stderr))
+	}
+	return append(args, id)
+}
+
+// parseArgs returns the options and the container of the command line
+// `args` of command `name`, which the middlewares may have rewritten.
+func (options wsOptions) parseArgs(name string, args []string) (wsOptions, string, error) {
+	cmd := flag.NewFlagSet(name, flag.ContinueOnError)
+	cmd.SetOutput(ioutil.Discard)
+	if name == "attach" {
+		cmd.BoolVar(&options.stdin, "i", false, "")
+		cmd.Bool("keep-stdin", false, "")
+		cmd.BoolVar(&options.stdout, "o", true, "")
+		cmd.BoolVar(&options.stderr, "e", true, "")
+	}
+	if err := cmd.Parse(args); err != nil {
+		return options, "", err
+	}
+	if cmd.NArg() != 1 {
+		return options, "", fmt.Errorf("Invalid arguments of '%s': %s", name, strings.Join(args, " "))
+	}
+	return options, cmd.Arg(0), nil
+}
+
+// streamWebSocket streams the container to the WebSocket, until it exits or
+// the client disconnects.
+func streamWebSocket(ws *rcli.WebSocket, container *docker.Container, options wsOptions) error {
+	var c_stdin io.WriteCloser
+	if options.stdin {
+		if !container.Config.OpenStdin {
+			return errors.New("The stdin of " + container.Id + " is closed: run it with -i to attach to it")
+		}
+		var err error
+		if c_stdin, err = container.StdinPipe(); err != nil {
+			return err
+		}
+	}
+	// Read the input and the control messages until the client disconnects
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			kind, message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if kind == rcli.WebSocketBinary {
+				if c_stdin != nil {
+					c_stdin.Write(message)
+				}
+				continue
+			}
+			var control wsControl
+			if err := json.Unmarshal(message, &control); err != nil {
+				writeControl(ws, &wsControl{Type: "error", Status: rcli.StatusError, Message: "Invalid control message: " + err.Error()})
+				continue
+			}
+			switch control.Type {
+			case "resize":
+				err = container.Resize(control.Height, control.Width)
+			case "close":
+				if c_stdin != nil {
+					err = c_stdin.Close()
+				}
+			default:
+				err = errors.New("Unknown control message: " + control.Type)
+			}
+			if err != nil {
+				writeControl(ws, &wsControl{Type: "error", Status: rcli.StatusError, Message: err.Error()})
+			}
+		}
+	}()
+
+	if options.logs {
+		for _, l := range []struct {
+			kind byte
+			log  io.Reader
+		}{{rcli.FrameStdout, container.StdoutLog()}, {rcli.FrameStderr, container.StderrLog()}} {
+			if l.log == nil {
+				continue
+			}
+			if _, err := io.Copy(&wsStream{ws, l.kind}, l.log); err != nil {
+				return err
+			}
+			if closer, ok := l.log.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}
+	if !options.follow || !container.State.Running {
+		if !container.State.Running {
+			return writeControl(ws, &wsControl{Type: "exit", Status: container.State.ExitCode})
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var pipes []io.Closer
+	for _, s := range []struct {
+		attach bool
+		kind   byte
+		pipe   func() (io.ReadCloser, error)
+	}{{options.stdout, rcli.FrameStdout, container.StdoutPipe}, {options.stderr, rcli.FrameStderr, container.StderrPipe}} {
+		if !s.attach {
+			continue
+		}
+		pipe, err := s.pipe()
+		if err != nil {
+			return err
+		}
+		pipes = append(pipes, pipe)
+		wg.Add(1)
+		go func(kind byte, pipe io.Reader) {
+			io.Copy(&wsStream{ws, kind}, pipe)
+			wg.Done()
+		}(s.kind, pipe)
+	}
+	exited := make(chan int, 1)
+	go func() {
+		wg.Wait()
+		exited <- container.Wait()
+	}()
+	select {
+	case status := <-exited:
+		return writeControl(ws, &wsControl{Type: "exit", Status: status})
+	case <-gone:
+		// Stop copying the output of the container
+		for _, pipe := range pipes {
+			pipe.Close()
+		}
+		return nil
+	}
+}
+
+func wsAttachOptions(query url.Values) wsOptions {
+	return wsOptions{
+		stdin:  queryBool(query, "stdin", false),
+		stdout: queryBool(query, "stdout", true),
+		stderr: queryBool(query, "stderr", true),
+		logs:   queryBool(query, "logs", false),
+		follow: true,
+	}
+}
+
+func wsLogsOptions(query url.Values) wsOptions {
+	return wsOptions{
+		stdout: true,
+		stderr: true,
+		logs:   true,
+		follow: queryBool(query, "follow", false),
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWebSocketAuthorized(t *testing.T) {
+	srv := &Server{options: &Options{}}
+	var requests []*Request
+	srv.Use(func(req *Request) error {
+		requests = append(requests, &Request{Command: req.Command, Args: req.Args})
+		return errors.New("Not authorized")
+	})
+	server := httptest.NewServer(srv.httpHandler())
+	defer server.Close()
+	for _, path := range []string{"/ws/attach/abc?stdin=1&stderr=0", "/ws/logs/abc"} {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "Not authorized") {
+			t.Fatalf("%s: expected the middleware to deny the stream, got %s: %s", path, resp.Status, body)
+		}
+	}
+	expected := []*Request{
+		{Command: "attach", Args: []string{"-i", "-keep-stdin", "-o=true", "-e=false", "abc"}},
+		{Command: "logs", Args: []string{"abc"}},
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected the middleware to see %v, got %v", expected, requests)
+	}
+}
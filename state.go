@@ -8,20 +8,24 @@ import (
 )
 
 type State struct {
-	Running   bool
-	Pid       int
-	ExitCode  int
-	StartedAt time.Time
+	Running    bool
+	Pid        int
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	OOMKilled  bool // The container was killed after running out of memory
 
 	stateChangeLock *sync.Mutex
-	stateChangeCond *sync.Cond
+	// Closed when the container stops, and replaced when it starts
+	stopped chan struct{}
 }
 
 func newState() *State {
-	lock := new(sync.Mutex)
+	stopped := make(chan struct{})
+	close(stopped)
 	return &State{
-		stateChangeLock: lock,
-		stateChangeCond: sync.NewCond(lock),
+		stateChangeLock: new(sync.Mutex),
+		stopped:         stopped,
 	}
 }
 
@@ -30,32 +34,87 @@ func (s *State) String() string {
 	if s.Running {
 		return fmt.Sprintf("Up %s", future.HumanDuration(time.Now().Sub(s.StartedAt)))
 	}
-	return fmt.Sprintf("Exit %d", s.ExitCode)
+	// Containers created but never started
+	if s.StartedAt.IsZero() {
+		return "Created"
+	}
+	// Containers stopped before FinishedAt was recorded
+	if s.FinishedAt.IsZero() {
+		return fmt.Sprintf("Exit %d", s.ExitCode)
+	}
+	if s.OOMKilled {
+		return fmt.Sprintf("Exited (%d, out of memory) %s ago", s.ExitCode, future.HumanDuration(time.Now().Sub(s.FinishedAt)))
+	}
+	return fmt.Sprintf("Exited (%d) %s ago", s.ExitCode, future.HumanDuration(time.Now().Sub(s.FinishedAt)))
+}
+
+// Uptime returns how long the container has been running, or how long it ran
+// until it last stopped. It is 0 for containers never started.
+func (s *State) Uptime() time.Duration {
+	if s.StartedAt.IsZero() {
+		return 0
+	}
+	if s.Running {
+		return time.Now().Sub(s.StartedAt)
+	}
+	// Containers stopped before FinishedAt was recorded
+	if s.FinishedAt.Before(s.StartedAt) {
+		return 0
+	}
+	return s.FinishedAt.Sub(s.StartedAt)
 }
 
 func (s *State) setRunning(pid int) {
+	s.stateChangeLock.Lock()
+	defer s.stateChangeLock.Unlock()
 	s.Running = true
 	s.ExitCode = 0
+	s.OOMKilled = false
 	s.Pid = pid
 	s.StartedAt = time.Now()
-	s.broadcast()
+	// FinishedAt is zero while the container runs
+	s.FinishedAt = time.Time{}
+	s.stopped = make(chan struct{})
 }
 
-func (s *State) setStopped(exitCode int) {
+func (s *State) setStopped(exitCode int, oomKilled bool) {
+	s.stateChangeLock.Lock()
+	defer s.stateChangeLock.Unlock()
 	s.Running = false
 	s.Pid = 0
 	s.ExitCode = exitCode
-	s.broadcast()
+	s.OOMKilled = oomKilled
+	s.FinishedAt = time.Now()
+	select {
+	case <-s.stopped:
+	default:
+		close(s.stopped)
+	}
 }
 
-func (s *State) broadcast() {
+// restore carries the outcome of the last run over from `persisted`, the
+// state loaded from disk.
+func (s *State) restore(persisted *State) {
 	s.stateChangeLock.Lock()
-	s.stateChangeCond.Broadcast()
-	s.stateChangeLock.Unlock()
+	defer s.stateChangeLock.Unlock()
+	s.ExitCode = persisted.ExitCode
+	s.StartedAt = persisted.StartedAt
+	s.FinishedAt = persisted.FinishedAt
+	s.OOMKilled = persisted.OOMKilled
+}
+
+// setFinished records how a run which wasn't monitored to its end finished.
+func (s *State) setFinished(exitCode int, finishedAt time.Time) {
+	s.stateChangeLock.Lock()
+	defer s.stateChangeLock.Unlock()
+	s.ExitCode = exitCode
+	s.FinishedAt = finishedAt
 }
 
-func (s *State) wait() {
+// Stopped returns a channel which is closed once the container isn't
+// running, so that its stop can be waited for along with other events.
+func (s *State) Stopped() <-chan struct{} {
 	s.stateChangeLock.Lock()
-	s.stateChangeCond.Wait()
-	s.stateChangeLock.Unlock()
+	defer s.stateChangeLock.Unlock()
+	return s.stopped
 }
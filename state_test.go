@@ -0,0 +1,82 @@
+package docker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateStopped(t *testing.T) {
+	s := newState()
+	select {
+	case <-s.Stopped():
+	default:
+		t.Fatalf("A new container should be stopped")
+	}
+	s.setRunning(42)
+	stopped := s.Stopped()
+	select {
+	case <-stopped:
+		t.Fatalf("A running container shouldn't be stopped")
+	default:
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.setStopped(3, false)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("The stop of the container wasn't notified")
+	}
+	if s.Running || s.ExitCode != 3 {
+		t.Fatalf("Unexpected state: %v", s)
+	}
+	// Stopping twice doesn't panic
+	s.setStopped(3, false)
+	s.setRunning(43)
+	if s.Stopped() == stopped {
+		t.Fatalf("A restarted container should have a new channel")
+	}
+}
+
+func TestStateUptime(t *testing.T) {
+	s := newState()
+	if s.Uptime() != 0 {
+		t.Fatalf("A container never started has no uptime")
+	}
+	s.setRunning(42)
+	s.StartedAt = s.StartedAt.Add(-time.Hour)
+	if uptime := s.Uptime(); uptime < time.Hour || uptime > time.Hour+time.Minute {
+		t.Fatalf("Unexpected uptime of a running container: %v", uptime)
+	}
+	if !s.FinishedAt.IsZero() {
+		t.Fatalf("A running container shouldn't have finished")
+	}
+	s.setStopped(0, false)
+	s.FinishedAt = s.StartedAt.Add(90 * time.Second)
+	if uptime := s.Uptime(); uptime != 90*time.Second {
+		t.Fatalf("Expected the uptime of a stopped container to be how long it ran, got %v", uptime)
+	}
+	// The uptime of the last run doesn't count the previous ones
+	s.setRunning(43)
+	if uptime := s.Uptime(); uptime > time.Second {
+		t.Fatalf("Unexpected uptime of a restarted container: %v", uptime)
+	}
+}
+
+func TestStateOOMKilled(t *testing.T) {
+	s := newState()
+	s.setRunning(42)
+	s.setStopped(137, true)
+	if !s.OOMKilled || s.ExitCode != 137 {
+		t.Fatalf("Unexpected state: %v", s)
+	}
+	s.setRunning(43)
+	if s.OOMKilled {
+		t.Fatalf("A restarted container shouldn't be out of memory anymore")
+	}
+	s.setStopped(0, false)
+	if s.OOMKilled {
+		t.Fatalf("Unexpected state: %v", s)
+	}
+}
@@ -6,8 +6,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"os/user"
-	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -22,41 +21,62 @@ func setupNetworking(gw string) {
 	}
 }
 
-// Takes care of dropping privileges to the desired user
-func changeUser(u string) {
-	if u == "" {
+// Set the domain name of the container, in its UTS namespace
+func setupDomainname(domainname string) {
+	if domainname == "" {
 		return
 	}
-	userent, err := user.LookupId(u)
-	if err != nil {
-		userent, err = user.Lookup(u)
-	}
-	if err != nil {
-		log.Fatalf("Unable to find user %v: %v", u, err)
+	if err := setDomainname(domainname); err != nil {
+		log.Fatalf("Unable to set the domain name: %v", err)
 	}
+}
 
-	uid, err := strconv.Atoi(userent.Uid)
-	if err != nil {
-		log.Fatalf("Invalid uid: %v", userent.Uid)
+// Takes care of dropping privileges to the desired user and groups, as
+// USER[:GROUP], resolved against the /etc/passwd and /etc/group of the image
+func changeUser(u string, groupAdd []string) {
+	if u == "" && len(groupAdd) == 0 {
+		return
 	}
-	gid, err := strconv.Atoi(userent.Gid)
+	user, err := ResolveUser(u, groupAdd, "/etc/passwd", "/etc/group")
 	if err != nil {
-		log.Fatalf("Invalid gid: %v", userent.Gid)
+		log.Fatalf("Unable to set the user: %v", err)
 	}
-
-	if err := syscall.Setgid(gid); err != nil {
+	if err := syscall.Setgroups(user.Groups); err != nil {
+		log.Fatalf("setgroups failed: %v", err)
+	}
+	if err := syscall.Setgid(user.Gid); err != nil {
 		log.Fatalf("setgid failed: %v", err)
 	}
-	if err := syscall.Setuid(uid); err != nil {
+	if err := syscall.Setuid(user.Uid); err != nil {
 		log.Fatalf("setuid failed: %v", err)
 	}
 }
 
-// Set the environment to a known, repeatable state
-func setupEnv() {
+// Set the environment to a known, repeatable state, plus the variables of
+// the container
+func setupEnv(env []string) {
 	os.Clearenv()
 	os.Setenv("HOME", "/")
 	os.Setenv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		os.Setenv(parts[0], parts[1])
+	}
+}
+
+// envFlag collects the variables of the environment given with -e.
+type envFlag []string
+
+func (e *envFlag) String() string {
+	return strings.Join(*e, " ")
+}
+
+func (e *envFlag) Set(value string) error {
+	if err := ValidateEnv(value); err != nil {
+		return err
+	}
+	*e = append(*e, value)
+	return nil
 }
 
 func executeProgram(name string, args []string) {
@@ -79,13 +99,22 @@ func SysInit() {
 		fmt.Println("You should not invoke docker-init manually")
 		os.Exit(1)
 	}
-	var u = flag.String("u", "", "username or uid")
+	var u = flag.String("u", "", "username or uid, and optionally a group name or gid, as USER[:GROUP]")
+	var groups = flag.String("G", "", "comma-separated supplementary groups")
 	var gw = flag.String("g", "", "gateway address")
+	var domainname = flag.String("domainname", "", "domain name")
+	var env envFlag
+	flag.Var(&env, "e", "variable of the environment, as KEY=VALUE")
 
 	flag.Parse()
 
 	setupNetworking(*gw)
-	changeUser(*u)
-	setupEnv()
+	setupDomainname(*domainname)
+	var groupAdd []string
+	if *groups != "" {
+		groupAdd = strings.Split(*groups, ",")
+	}
+	changeUser(*u, groupAdd)
+	setupEnv(env)
 	executeProgram(flag.Arg(0), flag.Args())
 }
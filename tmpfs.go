@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The mount options of tmpfs mounts given without options
+const defaultTmpfsOptions = "nosuid,nodev,noexec"
+
+// The size of /dev/shm, unless the container sets ShmSize
+const defaultShmSize = 64 << 20
+
+// A TmpfsMount is a memory-backed filesystem mounted in a container.
+type TmpfsMount struct {
+	Path    string
+	Options string
+}
+
+// ParseTmpfs parses a tmpfs mount given as PATH[:OPTIONS], where OPTIONS are
+// comma-separated mount options such as size=64m,mode=1777.
+func ParseTmpfs(spec string) (*TmpfsMount, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	mount := &TmpfsMount{Path: path.Clean(parts[0]), Options: defaultTmpfsOptions}
+	if !path.IsAbs(parts[0]) || mount.Path == "/" {
+		return nil, fmt.Errorf("Invalid tmpfs mount: %s (the path must be absolute, and not /)", spec)
+	}
+	if len(parts) == 2 {
+		if parts[1] == "" || strings.ContainsAny(parts[1], " \t") {
+			return nil, fmt.Errorf("Invalid tmpfs mount: %s (invalid options)", spec)
+		}
+		mount.Options = parts[1]
+	}
+	return mount, nil
+}
+
+// TmpfsMounts returns the tmpfs mounts of the container, sorted by path:
+// those of Tmpfs, and /tmp and /run if the root filesystem is read-only.
+func (config *Config) TmpfsMounts() []*TmpfsMount {
+	mounts := make(map[string]*TmpfsMount)
+	if config.ReadOnly {
+		mounts["/tmp"] = &TmpfsMount{"/tmp", "nosuid,nodev,mode=1777"}
+		mounts["/run"] = &TmpfsMount{"/run", "nosuid,nodev,mode=755"}
+	}
+	for _, mount := range config.Tmpfs {
+		mounts[mount.Path] = mount
+	}
+	var paths []string
+	for p := range mounts {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var sorted []*TmpfsMount
+	for _, p := range paths {
+		sorted = append(sorted, mounts[p])
+	}
+	return sorted
+}
+
+// ShmOptions returns the mount options of /dev/shm in the container.
+func (config *Config) ShmOptions() string {
+	size := config.ShmSize
+	if size == 0 {
+		size = defaultShmSize
+	}
+	return fmt.Sprintf("size=%dk,nosuid,nodev,noexec", (size+1023)/1024)
+}
@@ -0,0 +1,39 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestParseTmpfs(t *testing.T) {
+	for spec, expected := range map[string]TmpfsMount{
+		"/cache":                 {"/cache", defaultTmpfsOptions},
+		"/var/cache/:size=64m":   {"/var/cache", "size=64m"},
+		"/tmp:mode=1777,size=1g": {"/tmp", "mode=1777,size=1g"},
+	} {
+		mount, err := ParseTmpfs(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+		} else if *mount != expected {
+			t.Errorf("%s: expected %+v, got %+v", spec, expected, *mount)
+		}
+	}
+	for _, spec := range []string{"cache", "/", "/cache:", "/cache:size=1m mode=1777"} {
+		if _, err := ParseTmpfs(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestTmpfsMounts(t *testing.T) {
+	config := &Config{ReadOnly: true, Tmpfs: []*TmpfsMount{{"/tmp", "size=1m"}, {"/cache", defaultTmpfsOptions}}}
+	mounts := config.TmpfsMounts()
+	if len(mounts) != 3 || mounts[0].Path != "/cache" || mounts[1].Path != "/run" || *mounts[2] != (TmpfsMount{"/tmp", "size=1m"}) {
+		t.Fatalf("Unexpected tmpfs mounts %v", mounts)
+	}
+	if options := (&Config{}).ShmOptions(); options != "size=65536k,nosuid,nodev,noexec" {
+		t.Fatalf("Unexpected /dev/shm options '%s'", options)
+	}
+	if options := (&Config{ShmSize: 1 << 30}).ShmOptions(); options != "size=1048576k,nosuid,nodev,noexec" {
+		t.Fatalf("Unexpected /dev/shm options '%s'", options)
+	}
+}
@@ -0,0 +1,74 @@
+package docker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The resource limits which can be set on containers, named as in setrlimit(2)
+var ulimitNames = []string{
+	"as", "core", "cpu", "data", "fsize", "locks", "memlock", "msgqueue", "nice",
+	"nofile", "nproc", "rss", "rtprio", "rttime", "sigpending", "stack",
+}
+
+// An Ulimit is a resource limit of the processes of a container. A negative
+// limit means unlimited.
+type Ulimit struct {
+	Name string
+	Soft int64
+	Hard int64
+}
+
+// ParseUlimit parses a resource limit given as NAME=SOFT[:HARD], where the
+// limits are numbers or "unlimited". The hard limit is the soft one by
+// default.
+func ParseUlimit(spec string) (*Ulimit, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid ulimit: %s (expected NAME=SOFT[:HARD])", spec)
+	}
+	valid := false
+	for _, name := range ulimitNames {
+		valid = valid || name == parts[0]
+	}
+	if !valid {
+		return nil, fmt.Errorf("Invalid ulimit: %s (valid limits: %s)", spec, strings.Join(ulimitNames, ", "))
+	}
+	limits := strings.SplitN(parts[1], ":", 2)
+	if len(limits) == 1 {
+		limits = append(limits, limits[0])
+	}
+	ulimit := &Ulimit{Name: parts[0]}
+	for i, limit := range []*int64{&ulimit.Soft, &ulimit.Hard} {
+		if limits[i] == "unlimited" {
+			*limit = -1
+			continue
+		}
+		value, err := strconv.ParseInt(limits[i], 10, 64)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("Invalid ulimit: %s (invalid limit '%s')", spec, limits[i])
+		}
+		*limit = value
+	}
+	if ulimit.Hard >= 0 && (ulimit.Soft < 0 || ulimit.Soft > ulimit.Hard) {
+		return nil, fmt.Errorf("Invalid ulimit: %s (the soft limit exceeds the hard limit)", spec)
+	}
+	return ulimit, nil
+}
+
+func (ulimit *Ulimit) String() string {
+	return ulimit.Name + "=" + ulimit.Limits()
+}
+
+// Limits returns the soft and hard limits as SOFT:HARD, the format of
+// lxc.prlimit.
+func (ulimit *Ulimit) Limits() string {
+	format := func(limit int64) string {
+		if limit < 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(limit, 10)
+	}
+	return format(ulimit.Soft) + ":" + format(ulimit.Hard)
+}
@@ -0,0 +1,29 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestParseUlimit(t *testing.T) {
+	for spec, expected := range map[string]Ulimit{
+		"nofile=1024":      {"nofile", 1024, 1024},
+		"nofile=1024:4096": {"nofile", 1024, 4096},
+		"core=0:unlimited": {"core", 0, -1},
+		"nproc=unlimited":  {"nproc", -1, -1},
+	} {
+		ulimit, err := ParseUlimit(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+		} else if *ulimit != expected {
+			t.Errorf("%s: expected %+v, got %+v", spec, expected, *ulimit)
+		}
+	}
+	for _, spec := range []string{"nofile", "files=10", "nofile=-1", "nofile=ten", "nofile=10:5", "nofile=unlimited:10"} {
+		if _, err := ParseUlimit(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+	if limits := (&Ulimit{"core", 0, -1}).Limits(); limits != "0:unlimited" {
+		t.Errorf("Expected '0:unlimited', got '%s'", limits)
+	}
+}
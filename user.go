@@ -0,0 +1,128 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// An ExecUser is the identity the process of a container runs as.
+type ExecUser struct {
+	Uid    int
+	Gid    int
+	Groups []int // Supplementary groups
+}
+
+// parseIdFile calls `entry` with the fields of each entry of `file`, a file in
+// the format of /etc/passwd or /etc/group. A missing file has no entries.
+func parseIdFile(file string, entry func(fields []string)) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) >= 3 {
+			entry(fields)
+		}
+	}
+	return scanner.Err()
+}
+
+// lookupGroup returns the ID of group `name`, a name or a numeric ID.
+func lookupGroup(name, groupFile string) (int, error) {
+	gid := -1
+	err := parseIdFile(groupFile, func(fields []string) {
+		if gid < 0 && fields[0] == name {
+			gid, _ = strconv.Atoi(fields[2])
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if gid >= 0 {
+		return gid, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	return 0, fmt.Errorf("Unable to find group %v", name)
+}
+
+// ResolveUser resolves `spec`, USER[:GROUP] where USER and GROUP are names or
+// numeric IDs, against `passwdFile` and `groupFile`. The process gets the
+// primary group of the user unless GROUP is given, and is a member of the
+// groups listing the user, and of the groups `groupAdd`. Numeric IDs don't
+// need to be in the files: a UID without a user has the group 0.
+func ResolveUser(spec string, groupAdd []string, passwdFile, groupFile string) (*ExecUser, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if parts[0] == "" {
+		parts[0] = "0"
+	}
+	user := &ExecUser{Uid: -1}
+	name := ""
+	// Look up names, then IDs
+	for _, field := range []int{0, 2} {
+		err := parseIdFile(passwdFile, func(fields []string) {
+			if user.Uid >= 0 || len(fields) < 4 || fields[field] != parts[0] {
+				return
+			}
+			uid, err1 := strconv.Atoi(fields[2])
+			gid, err2 := strconv.Atoi(fields[3])
+			if err1 == nil && err2 == nil {
+				name, user.Uid, user.Gid = fields[0], uid, gid
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if user.Uid < 0 {
+		uid, err := strconv.Atoi(parts[0])
+		if err != nil || uid < 0 {
+			return nil, fmt.Errorf("Unable to find user %v", parts[0])
+		}
+		user.Uid, user.Gid = uid, 0
+	}
+	if len(parts) == 2 {
+		if user.Gid, err = lookupGroup(parts[1], groupFile); err != nil {
+			return nil, err
+		}
+	}
+	if name != "" {
+		err := parseIdFile(groupFile, func(fields []string) {
+			if len(fields) < 4 {
+				return
+			}
+			for _, member := range strings.Split(fields[3], ",") {
+				if member == name {
+					if gid, err := strconv.Atoi(fields[2]); err == nil {
+						user.Groups = append(user.Groups, gid)
+					}
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, group := range groupAdd {
+		gid, err := lookupGroup(group, groupFile)
+		if err != nil {
+			return nil, err
+		}
+		user.Groups = append(user.Groups, gid)
+	}
+	return user, nil
+}
@@ -0,0 +1,56 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestResolveUser(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	passwd, group := path.Join(tmp, "passwd"), path.Join(tmp, "group")
+	ioutil.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/bash\n# comment\nwww:x:33:33::/var/www:/bin/false\n1000:x:1001:1001::/:/bin/sh\n"), 0644)
+	ioutil.WriteFile(group, []byte("root:x:0:\nwww:x:33:\nstaff:x:50:www,root\nvideo:x:44:\n"), 0644)
+	for _, test := range []struct {
+		spec     string
+		groupAdd []string
+		expected string
+	}{
+		{"", nil, "0:0 [50]"},
+		{"root", nil, "0:0 [50]"},
+		{"www", nil, "33:33 [50]"},
+		{"33", nil, "33:33 [50]"},
+		{"www:video", nil, "33:44 [50]"},
+		{"www:12", []string{"video", "7"}, "33:12 [50 44 7]"},
+		{"4242", nil, "4242:0 []"},
+		{"4242:staff", nil, "4242:50 []"},
+		{"1000", nil, "1001:1001 []"},
+	} {
+		user, err := ResolveUser(test.spec, test.groupAdd, passwd, group)
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err)
+			continue
+		}
+		if got := fmt.Sprintf("%d:%d %v", user.Uid, user.Gid, user.Groups); got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.spec, test.expected, got)
+		}
+	}
+	for _, spec := range []string{"nobody", "www:nogroup", "-1"} {
+		if _, err := ResolveUser(spec, nil, passwd, group); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+	if _, err := ResolveUser("www", []string{"nogroup"}, passwd, group); err == nil {
+		t.Errorf("Unknown added groups should fail")
+	}
+	// Images without a passwd file only know numeric IDs
+	if user, err := ResolveUser("10:20", nil, path.Join(tmp, "missing"), path.Join(tmp, "missing")); err != nil || user.Uid != 10 || user.Gid != 20 {
+		t.Errorf("Expected 10:20, got %+v (%v)", user, err)
+	}
+}
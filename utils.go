@@ -17,6 +17,15 @@ func Trunc(s string, maxlen int) string {
 	return s[:maxlen]
 }
 
+// The length of the container IDs as displayed
+const shortIdLength = 12
+
+// TruncateId returns container ID `id` as displayed, eg. by 'docker ps'.
+// The full ID and its unique prefixes name the container as well.
+func TruncateId(id string) string {
+	return Trunc(id, shortIdLength)
+}
+
 // Figure out the absolute path of our own binary
 func SelfPath() string {
 	path, err := exec.LookPath(os.Args[0])
@@ -0,0 +1,9 @@
+package docker
+
+// VERSION is the version of docker, shared by the client and the daemon.
+const VERSION = "0.0.1"
+
+// GITCOMMIT is the git commit docker was built from. It is set at build time:
+//
+//	go build -ldflags "-X github.com/dotcloud/docker.GITCOMMIT=$(git rev-parse --short HEAD)"
+var GITCOMMIT string
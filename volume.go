@@ -0,0 +1,62 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// A Volume is a host directory or file bind-mounted in a container.
+type Volume struct {
+	PathOnHost      string
+	PathInContainer string
+	ReadOnly        bool
+}
+
+// ParseVolume parses a volume given as HOST:CONTAINER[:ro|rw]. Volumes are
+// writable by default.
+func ParseVolume(spec string) (*Volume, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("Invalid volume: %s (expected HOST:CONTAINER[:ro|rw])", spec)
+	}
+	volume := &Volume{PathOnHost: path.Clean(parts[0]), PathInContainer: path.Clean(parts[1])}
+	if !path.IsAbs(parts[0]) || !path.IsAbs(parts[1]) || volume.PathInContainer == "/" {
+		return nil, fmt.Errorf("Invalid volume: %s (the paths must be absolute, and not /)", spec)
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			volume.ReadOnly = true
+		case "rw":
+		default:
+			return nil, fmt.Errorf("Invalid volume: %s (the mode is ro or rw)", spec)
+		}
+	}
+	return volume, nil
+}
+
+// MountOptions returns the mount options of the volume in the lxc
+// configuration.
+func (volume *Volume) MountOptions() string {
+	if volume.ReadOnly {
+		return "bind,ro"
+	}
+	return "bind"
+}
+
+// isDir returns true if the volume mounts a directory rather than a file.
+func (volume *Volume) isDir() bool {
+	info, err := os.Stat(volume.PathOnHost)
+	return err != nil || info.IsDir()
+}
+
+// ValidateEnv checks a variable of the environment given as KEY=VALUE.
+func ValidateEnv(spec string) error {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " \t") {
+		return fmt.Errorf("Invalid environment variable: %s (expected KEY=VALUE)", spec)
+	}
+	return nil
+}
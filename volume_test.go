@@ -0,0 +1,38 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestParseVolume(t *testing.T) {
+	for spec, expected := range map[string]Volume{
+		"/srv/data:/data":       {"/srv/data", "/data", false},
+		"/srv/data/:/data/:rw":  {"/srv/data", "/data", false},
+		"/etc/app.conf:/app:ro": {"/etc/app.conf", "/app", true},
+	} {
+		volume, err := ParseVolume(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+		} else if *volume != expected {
+			t.Errorf("%s: expected %+v, got %+v", spec, expected, *volume)
+		}
+	}
+	for _, spec := range []string{"/data", "data:/data", "/data:data", "/data:/", "/data:/data:rx", "/a:/b:ro:rw"} {
+		if _, err := ParseVolume(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	for _, spec := range []string{"MODE=production", "EMPTY=", "URL=http://host/?a=b"} {
+		if err := ValidateEnv(spec); err != nil {
+			t.Errorf("%s: %s", spec, err)
+		}
+	}
+	for _, spec := range []string{"MODE", "=production", "THE MODE=production"} {
+		if err := ValidateEnv(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}